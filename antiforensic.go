@@ -14,32 +14,38 @@ func xorSlices(src1, src2 []byte, dest []byte) {
 	}
 }
 
-func hashBuffer(src []byte, h hash.Hash, iv int, result []byte) []byte {
-	ivSlice := make([]byte, 4)
-	binary.BigEndian.PutUint32(ivSlice, uint32(iv))
-
-	h.Reset()
-	h.Write(ivSlice)
-	h.Write(src)
-	return h.Sum(result)
+// diffuser implements the AF diffusion function. It reuses its scratch buffer so diffusing a stripe does not allocate.
+type diffuser struct {
+	h       hash.Hash
+	scratch []byte // the 4-byte block index followed by room for the digest
 }
 
-func diffuse(src []byte, h hash.Hash) []byte {
-	// src and dest are of the same size
-	sliceSize := len(src)
-	result := make([]byte, 0, sliceSize)
-	digestSize := h.Size()
-
-	for i := 0; i < sliceSize/digestSize; i++ {
-		result = hashBuffer(src[i*digestSize:(i+1)*digestSize], h, i, result)
-	}
+func newDiffuser(h hash.Hash) *diffuser {
+	return &diffuser{h: h, scratch: make([]byte, 4, 4+h.Size())}
+}
 
-	if padding := sliceSize % digestSize; padding != 0 {
-		result = hashBuffer(src[sliceSize-padding:], h, sliceSize/digestSize, result)
-		result = result[:sliceSize]
+// diffuse hashes src block by block into dst, dst and src are of the same size and may be the same slice
+func (d *diffuser) diffuse(dst, src []byte) {
+	digestSize := d.h.Size()
+	for i := 0; i*digestSize < len(src); i++ {
+		end := (i + 1) * digestSize
+		if end > len(src) {
+			end = len(src) // the last block is shorter, the digest is truncated
+		}
+		iv := d.scratch[:4]
+		binary.BigEndian.PutUint32(iv, uint32(i))
+
+		d.h.Reset()
+		d.h.Write(iv)
+		d.h.Write(src[i*digestSize : end])
+		sum := d.h.Sum(iv)
+		copy(dst[i*digestSize:end], sum[4:])
 	}
+}
 
-	return result
+// clear wipes the last digest
+func (d *diffuser) clear() {
+	clearSlice(d.scratch[:cap(d.scratch)])
 }
 
 func afSplit(src []byte, blockNum int, h hash.Hash) ([]byte, error) {
@@ -58,14 +64,17 @@ func afSplit(src []byte, blockNum int, h hash.Hash) ([]byte, error) {
 		return nil, fmt.Errorf("Expected to generate %v bytes of random data, got %v", randomDataSize, n)
 	}
 
+	d := newDiffuser(h)
+	defer d.clear()
 	for i := 0; i < blockNum-1; i++ {
 		b := dest[blockSize*i : blockSize*(i+1)]
 
 		xorSlices(b, buffer, buffer)
-		buffer = diffuse(buffer, h)
+		d.diffuse(buffer, buffer)
 	}
 
 	xorSlices(src, buffer, dest[randomDataSize:randomDataSize+blockSize])
+	clearSlice(buffer)
 
 	return dest, nil
 }
@@ -77,14 +86,74 @@ func afMerge(src []byte, blockSize, blockNum int, h hash.Hash) ([]byte, error) {
 		return nil, fmt.Errorf("af merge input buffer size mismatch %v * %v != %v", blockSize, blockNum, len(src))
 	}
 
+	d := newDiffuser(h)
+	defer d.clear()
 	for i := 0; i < blockNum-1; i++ {
 		b := src[blockSize*i : blockSize*(i+1)]
 
 		xorSlices(b, buffer, buffer)
-		buffer = diffuse(buffer, h)
+		d.diffuse(buffer, buffer)
 	}
 
 	xorSlices(src[blockSize*(blockNum-1):blockSize*blockNum], buffer, buffer)
 
 	return buffer, nil
 }
+
+// afMerger is the incremental form of afMerge, stripes are fed with write() as the key material is decrypted
+type afMerger struct {
+	d         *diffuser
+	blockSize int
+	blockNum  int
+	merged    int    // number of stripes processed
+	buffer    []byte // diffused xor of the processed stripes
+	stripe    []byte // the stripe being collected
+}
+
+func newAfMerger(blockSize, blockNum int, h hash.Hash) *afMerger {
+	return &afMerger{
+		d:         newDiffuser(h),
+		blockSize: blockSize,
+		blockNum:  blockNum,
+		buffer:    make([]byte, blockSize),
+		stripe:    make([]byte, 0, blockSize),
+	}
+}
+
+// write processes the next part of the key material, data beyond the last stripe is ignored
+func (m *afMerger) write(data []byte) {
+	for len(data) > 0 && m.merged < m.blockNum {
+		n := m.blockSize - len(m.stripe)
+		if n > len(data) {
+			n = len(data)
+		}
+		m.stripe = append(m.stripe, data[:n]...)
+		data = data[n:]
+		if len(m.stripe) < m.blockSize {
+			return
+		}
+
+		xorSlices(m.stripe, m.buffer, m.buffer)
+		m.merged++
+		if m.merged < m.blockNum {
+			m.d.diffuse(m.buffer, m.buffer)
+		}
+		clearSlice(m.stripe)
+		m.stripe = m.stripe[:0]
+	}
+}
+
+// result returns the merged key once all the stripes are written
+func (m *afMerger) result() ([]byte, error) {
+	if m.merged != m.blockNum {
+		return nil, fmt.Errorf("af merge input buffer size mismatch %v * %v != %v", m.blockSize, m.blockNum, m.merged*m.blockSize+len(m.stripe))
+	}
+	return secureCopy(m.buffer), nil
+}
+
+// clear wipes the intermediate state
+func (m *afMerger) clear() {
+	m.d.clear()
+	clearSlice(m.buffer)
+	clearSlice(m.stripe[:cap(m.stripe)])
+}
@@ -1,6 +1,8 @@
 package luks
 
 import (
+	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
 	"hash"
 	"testing"
@@ -38,3 +40,77 @@ func TestAntiforensicSha256(t *testing.T) {
 func TestAntiforensicRipemd160(t *testing.T) {
 	runAntiforensicTest(t, ripemd160.New())
 }
+
+func TestAfMergerChunks(t *testing.T) {
+	// 48-byte stripes cross the chunk boundaries
+	keySize := 48
+	secret := make([]byte, keySize)
+	_, err := rand.Read(secret)
+	require.NoError(t, err)
+	material, err := afSplit(secret, stripesNum, sha256.New())
+	require.NoError(t, err)
+
+	for _, chunk := range []int{1, 47, 512, 4096, len(material)} {
+		m := newAfMerger(keySize, stripesNum, sha256.New())
+		for data := material; len(data) > 0; {
+			n := chunk
+			if n > len(data) {
+				n = len(data)
+			}
+			m.write(data[:n])
+			data = data[n:]
+		}
+		merged, err := m.result()
+		require.NoError(t, err)
+		require.Equal(t, secret, merged, "chunk %d", chunk)
+	}
+
+	m := newAfMerger(keySize, stripesNum, sha256.New())
+	m.write(material[:len(material)-1])
+	_, err = m.result()
+	require.Error(t, err)
+}
+
+func TestMergeKeyslotArea(t *testing.T) {
+	key := make([]byte, 64)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	ciph, err := newSectorCipher("aes", "xts", "plain64", key)
+	require.NoError(t, err)
+
+	// the material spans several chunks, the last one is partial
+	volumeKey := make([]byte, 48)
+	_, err = rand.Read(volumeKey)
+	require.NoError(t, err)
+	material, err := afSplit(volumeKey, stripesNum, sha256.New())
+	require.NoError(t, err)
+	require.Greater(t, len(material), 2*keyslotChunkSize)
+	encryptKeyslotArea(ciph, material)
+
+	const offset = 4096
+	disk := make([]byte, offset+len(material))
+	copy(disk[offset:], material)
+	merged, err := mergeKeyslotArea(bytes.NewReader(disk), offset, ciph, len(volumeKey), stripesNum, sha256.New())
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, merged)
+
+	// the pooled chunk buffer is wiped
+	buf := keyslotChunkPool.Get().(*[keyslotChunkSize]byte)
+	require.Equal(t, make([]byte, keyslotChunkSize), buf[:])
+	keyslotChunkPool.Put(buf)
+
+	_, err = mergeKeyslotArea(bytes.NewReader(disk[:len(disk)-1]), offset, ciph, len(volumeKey), stripesNum, sha256.New())
+	require.Error(t, err)
+}
+
+func BenchmarkMergeKeyslotArea(b *testing.B) {
+	ciph, err := newSectorCipher("aes", "xts", "plain64", make([]byte, 64))
+	require.NoError(b, err)
+	disk := bytes.NewReader(make([]byte, 64*stripesNum))
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, err := mergeKeyslotArea(disk, 0, ciph, 64, stripesNum, sha256.New())
+		require.NoError(b, err)
+	}
+}
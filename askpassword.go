@@ -0,0 +1,210 @@
+package luks
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrPassphraseCancelled is returned when the user dismisses the password query at an ask-password agent
+var ErrPassphraseCancelled = fmt.Errorf("Password query cancelled")
+
+// AskPassword is a PassphraseProvider that asks the password with the systemd ask-password agent protocol
+// (https://systemd.io/PASSWORD_AGENTS/). The query is shown by plymouth, systemd-tty-ask-password-agent and other
+// agents the same way as the systemd-cryptsetup queries.
+type AskPassword struct {
+	// Dir is the directory watched by the agents, /run/systemd/ask-password is used by default
+	Dir string
+	// ID identifies the query for the agents, e.g. "cryptsetup:/dev/sda2"
+	ID string
+	// Icon name, "drive-harddisk" is used by default
+	Icon string
+	// Timeout of a single query, 0 means no timeout
+	Timeout time.Duration
+	// AcceptCached allows agents to reply with a password cached from an earlier query
+	AcceptCached bool
+}
+
+// Passphrase publishes the query and waits for a reply of an agent
+func (a AskPassword) Passphrase(ctx context.Context, req PassphraseRequest) ([]byte, error) {
+	dir := a.Dir
+	if dir == "" {
+		dir = "/run/systemd/ask-password"
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(suffix)
+
+	socketPath := filepath.Join(dir, "sck."+id)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(socketPath)
+	defer conn.Close()
+	if err := setPassCred(conn); err != nil {
+		return nil, err
+	}
+
+	if a.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.Timeout)
+		defer cancel()
+	}
+	askPath := filepath.Join(dir, "ask."+id)
+	if err := a.writeAskFile(ctx, askPath, socketPath, req); err != nil {
+		return nil, err
+	}
+	defer os.Remove(askPath)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close() // unblocks the pending read
+		case <-done:
+		}
+	}()
+
+	for {
+		passphrase, err := readAgentReply(conn)
+		if ctx.Err() != nil {
+			clearSlice(passphrase)
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, errUntrustedSender) {
+			continue
+		}
+		return passphrase, err
+	}
+}
+
+func (a AskPassword) writeAskFile(ctx context.Context, path, socketPath string, req PassphraseRequest) error {
+	message := req.Prompt
+	if message == "" {
+		message = "Please enter passphrase"
+		if req.UUID != "" {
+			message += " for disk " + req.UUID
+		}
+		message += ":"
+	}
+	icon := a.Icon
+	if icon == "" {
+		icon = "drive-harddisk"
+	}
+	var notAfter uint64
+	if deadline, ok := ctx.Deadline(); ok {
+		var now unix.Timespec
+		if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &now); err != nil {
+			return err
+		}
+		notAfter = uint64(time.Duration(now.Nano())/time.Microsecond) + uint64(time.Until(deadline)/time.Microsecond)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "[Ask]\nPID=%d\nSocket=%s\nAcceptCached=%d\nEcho=0\nNotAfter=%d\nMessage=%s\nIcon=%s\n",
+		os.Getpid(), socketPath, boolToInt(a.AcceptCached), notAfter, oneLine(message), icon)
+	if a.ID != "" {
+		fmt.Fprintf(&b, "Id=%s\n", oneLine(a.ID))
+	}
+
+	// agents watch for new ask.* files so the query is written to a temporary file and renamed atomically
+	tmp, err := os.CreateTemp(filepath.Dir(path), "tmp.")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+var errUntrustedSender = fmt.Errorf("Ask-password reply from an untrusted sender")
+
+// readAgentReply reads a datagram "+<password>" or "-" (cancelled). Replies are accepted from root and the current
+// user only.
+func readAgentReply(conn *net.UnixConn) ([]byte, error) {
+	buf := make([]byte, 64*1024)
+	oob := make([]byte, unix.CmsgSpace(unix.SizeofUcred))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+	defer clearSlice(buf)
+
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		return nil, errUntrustedSender
+	}
+	cred, err := unix.ParseUnixCredentials(&msgs[0])
+	if err != nil || (cred.Uid != 0 && int(cred.Uid) != os.Getuid()) {
+		return nil, errUntrustedSender
+	}
+
+	reply := buf[:n]
+	switch {
+	case len(reply) > 0 && reply[0] == '+':
+		// an agent might send several NUL separated passwords, the first one is used
+		password := reply[1:]
+		if i := bytes.IndexByte(password, 0); i != -1 {
+			password = password[:i]
+		}
+		return secureCopy(password), nil
+	case len(reply) > 0 && reply[0] == '-':
+		return nil, ErrPassphraseCancelled
+	default:
+		return nil, fmt.Errorf("invalid ask-password reply")
+	}
+}
+
+func setPassCred(conn *net.UnixConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_PASSCRED, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// oneLine makes the value safe for the ini-style ask file
+func oneLine(s string) string {
+	return strings.NewReplacer("\n", " ", "\r", " ").Replace(s)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,82 @@
+package luks
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// answerAskPassword waits for an ask file in dir like an agent does and replies with the reply datagram
+func answerAskPassword(dir string, reply string) <-chan string {
+	ask := make(chan string, 1)
+	go func() {
+		for i := 0; i < 500; i++ {
+			matches, _ := filepath.Glob(filepath.Join(dir, "ask.*"))
+			if len(matches) == 0 {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			data, err := os.ReadFile(matches[0])
+			if err != nil {
+				break
+			}
+			ask <- string(data)
+			var socket string
+			for _, line := range strings.Split(string(data), "\n") {
+				if strings.HasPrefix(line, "Socket=") {
+					socket = strings.TrimPrefix(line, "Socket=")
+				}
+			}
+			conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+			if err != nil {
+				break
+			}
+			_, _ = conn.Write([]byte(reply))
+			conn.Close()
+			return
+		}
+		close(ask)
+	}()
+	return ask
+}
+
+func TestAskPassword(t *testing.T) {
+	dir := t.TempDir()
+	provider := AskPassword{Dir: dir, ID: "cryptsetup:/dev/sda2"}
+
+	ask := answerAskPassword(dir, "+secret\x00other")
+	passphrase, err := provider.Passphrase(context.Background(), PassphraseRequest{Prompt: "Passphrase for root:", Attempt: 1})
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret"), passphrase)
+
+	content := <-ask
+	require.Contains(t, content, "[Ask]\n")
+	require.Contains(t, content, "Message=Passphrase for root:\n")
+	require.Contains(t, content, "Id=cryptsetup:/dev/sda2\n")
+	require.Contains(t, content, "Echo=0\n")
+
+	// the query files are removed once answered
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	answerAskPassword(dir, "-")
+	_, err = provider.Passphrase(context.Background(), PassphraseRequest{Attempt: 1})
+	require.ErrorIs(t, err, ErrPassphraseCancelled)
+}
+
+func TestAskPasswordTimeout(t *testing.T) {
+	dir := t.TempDir()
+	_, err := AskPassword{Dir: dir, Timeout: 50 * time.Millisecond}.Passphrase(context.Background(), PassphraseRequest{Attempt: 1})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
@@ -0,0 +1,215 @@
+package luks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// BackupOptions specifies how the header backup is created
+type BackupOptions struct {
+	// MetadataOnly zeroes the keyslots area in the backup. Such backup contains no key material and can be
+	// shared e.g. for debugging, RestoreHeader refuses it as it would wipe all keyslots of the device.
+	MetadataOnly bool
+}
+
+// maximum size of a header backup: two 4MiB LUKS2 headers with JSON areas and 128MiB keyslots area
+const maxHeaderBackupSize = 2*4194304 + 128*1024*1024
+
+// backupHeader copies the metadata region [base, base+size) of the device to w
+func backupHeader(f Storage, base int64, size uint64, keyslots KeyslotLayout, w io.Writer, opts BackupOptions) error {
+	data := make([]byte, size)
+	if _, err := f.ReadAt(data, base); err != nil {
+		return err
+	}
+	if opts.MetadataOnly {
+		end := keyslots.RegionOffset + keyslots.RegionSize
+		if end > size {
+			end = size
+		}
+		clearSlice(data[keyslots.RegionOffset:end])
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func (d *deviceV1) BackupHeader(w io.Writer, opts BackupOptions) error {
+	layout, err := d.KeyslotLayout()
+	if err != nil {
+		return err
+	}
+	return backupHeader(d.f, 0, d.headerAreaSize(), layout, w, opts)
+}
+
+func (d *deviceV2) BackupHeader(w io.Writer, opts BackupOptions) error {
+	size, err := d.headerAreaSize()
+	if err != nil {
+		return err
+	}
+	layout, err := d.KeyslotLayout()
+	if err != nil {
+		return err
+	}
+	return backupHeader(d.f, d.offset, size, layout, w, opts)
+}
+
+// RestoreHeader writes the header backup (see Inspector.BackupHeader) to the device at the given path, similar to
+// `cryptsetup luksHeaderRestore`. If the device contains a valid LUKS header then the backup must belong to the same
+// volume i.e. version, UUID, volume key size and digest must match, otherwise the restore is refused as the backup
+// can't unlock the existing data. A device without a readable header (wiped or corrupted) is restored unconditionally.
+func RestoreHeader(path string, r io.Reader) error {
+	data, err := io.ReadAll(io.LimitReader(r, maxHeaderBackupSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxHeaderBackupSize {
+		return fmt.Errorf("header backup is too large")
+	}
+
+	// parse the backup using the regular device code, it validates the header checksums and the metadata
+	backup, err := openDevice("", bytesStorage(data), OpenOptions{})
+	if err != nil {
+		return fmt.Errorf("invalid header backup: %w", err)
+	}
+
+	size, err := headerAreaSize(backup)
+	if err != nil {
+		return err
+	}
+	if uint64(len(data)) != size {
+		return fmt.Errorf("header backup size %v does not match the header area size %v", len(data), size)
+	}
+	if err := checkKeyslotMaterial(backup, data); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	deviceSize, err := fileSize(f)
+	if err != nil {
+		return err
+	}
+	if deviceSize < size {
+		return fmt.Errorf("device %v is smaller than the header backup", path)
+	}
+
+	// the primary header might be damaged, that is the main reason to restore it, fall back to the secondary one
+	existing, err := initDevice(path, FileStorage{f}, OpenOptions{})
+	if err != nil && !errors.Is(err, ErrNotLuksDevice) {
+		existing, err = initV2DeviceSecondary(path, FileStorage{f}, 0)
+	}
+	if err == nil {
+		if err := checkSameVolume(existing, backup); err != nil {
+			return err
+		}
+	}
+
+	if _, err := f.WriteAt(data, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// checkKeyslotMaterial verifies that the active keyslots of the backup have their key material, a backup created
+// with BackupOptions.MetadataOnly would overwrite the device keyslots with zeroes
+func checkKeyslotMaterial(backup device, data []byte) error {
+	layout, err := backup.KeyslotLayout()
+	if err != nil {
+		return err
+	}
+	for _, a := range layout.Areas {
+		if !a.Active || a.Offset+a.Size > uint64(len(data)) {
+			continue
+		}
+		if isZero(data[a.Offset : a.Offset+a.Size]) {
+			return fmt.Errorf("header backup has no key material for keyslot %d, it is a metadata-only backup", a.Keyslot)
+		}
+	}
+	return nil
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// checkSameVolume verifies that both devices describe the same LUKS volume
+func checkSameVolume(existing, backup device) error {
+	if existing.Version() != backup.Version() {
+		return fmt.Errorf("header backup version %v does not match the device version %v", backup.Version(), existing.Version())
+	}
+	if existing.UUID() != backup.UUID() {
+		return fmt.Errorf("header backup UUID %v does not match the device UUID %v", backup.UUID(), existing.UUID())
+	}
+
+	existingKeySize, err := volumeKeySize(existing)
+	if err != nil {
+		return err
+	}
+	backupKeySize, err := volumeKeySize(backup)
+	if err != nil {
+		return err
+	}
+	if existingKeySize != backupKeySize {
+		return fmt.Errorf("header backup volume key size %v does not match the device volume key size %v", backupKeySize, existingKeySize)
+	}
+
+	existingDigest, err := existing.MasterKeyDigestParams()
+	if err != nil {
+		return err
+	}
+	backupDigest, err := backup.MasterKeyDigestParams()
+	if err != nil {
+		return err
+	}
+	if !digestsEqual(existingDigest.Digest, backupDigest.Digest) {
+		return fmt.Errorf("header backup volume key digest does not match the device one")
+	}
+	return nil
+}
+
+func headerAreaSize(dev device) (uint64, error) {
+	switch d := dev.(type) {
+	case *deviceV1:
+		return d.headerAreaSize(), nil
+	case *deviceV2:
+		return d.headerAreaSize()
+	default:
+		return 0, fmt.Errorf("unsupported device type %T", dev)
+	}
+}
+
+// volumeKeySize returns size of the volume key in bytes
+func volumeKeySize(dev device) (int, error) {
+	switch d := dev.(type) {
+	case *deviceV1:
+		return int(d.hdr.KeyBytes), nil
+	case *deviceV2:
+		for _, dig := range d.meta.Digests {
+			if len(dig.Segments) == 0 {
+				continue
+			}
+			for _, k := range dig.Keyslots {
+				id, err := k.Int64()
+				if err != nil {
+					return 0, err
+				}
+				if ks, ok := d.meta.Keyslots[int(id)]; ok {
+					return int(ks.KeySize), nil
+				}
+			}
+		}
+		return 0, fmt.Errorf("no keyslot is bound to a data segment")
+	default:
+		return 0, fmt.Errorf("unsupported device type %T", dev)
+	}
+}
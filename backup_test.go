@@ -0,0 +1,102 @@
+package luks
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupRestoreHeader(t *testing.T) {
+	t.Parallel()
+
+	check := func(disk *os.File, volumeKey []byte, headerSize int) {
+		dev, err := Open(disk.Name())
+		require.NoError(t, err)
+		var backup bytes.Buffer
+		require.NoError(t, dev.(Inspector).BackupHeader(&backup, BackupOptions{}))
+		require.Equal(t, headerSize, backup.Len())
+		require.NoError(t, dev.Close())
+
+		// destroy the header and restore it from the backup
+		_, err = disk.WriteAt(make([]byte, headerSize), 0)
+		require.NoError(t, err)
+		_, err = Open(disk.Name())
+		require.ErrorIs(t, err, ErrNotLuksDevice)
+		require.NoError(t, RestoreHeader(disk.Name(), bytes.NewReader(backup.Bytes())))
+
+		dev, err = Open(disk.Name())
+		require.NoError(t, err)
+		defer dev.Close()
+		v, err := dev.UnsealVolume(0, []byte("foobar"))
+		require.NoError(t, err)
+		require.Equal(t, volumeKey, v.key)
+
+		// restoring over a valid header of the same volume is allowed
+		require.NoError(t, RestoreHeader(disk.Name(), bytes.NewReader(backup.Bytes())))
+
+		// a truncated or damaged backup is refused
+		require.Error(t, RestoreHeader(disk.Name(), bytes.NewReader(backup.Bytes()[:headerSize-4096])))
+		damaged := append([]byte(nil), backup.Bytes()...)
+		damaged[5000]++
+		if dev.Version() == 2 {
+			// the JSON area is covered by the header checksum
+			require.Error(t, RestoreHeader(disk.Name(), bytes.NewReader(damaged)))
+		}
+	}
+
+	disk1, key1 := createLuks1Fixture(t, "foobar")
+	check(disk1, key1, 4096+8*256*storageSectorSize)
+	disk2, key2 := createLuks2Fixture(t, "foobar")
+	check(disk2, key2, 16777216)
+}
+
+func TestBackupHeaderMetadataOnly(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+
+	dev, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer dev.Close()
+
+	var backup bytes.Buffer
+	require.NoError(t, dev.(Inspector).BackupHeader(&backup, BackupOptions{MetadataOnly: true}))
+	data := backup.Bytes()
+	require.Len(t, data, 16777216)
+	require.Equal(t, make([]byte, len(data)-32768), data[32768:])
+
+	// the metadata is intact
+	header := make([]byte, 32768)
+	_, err = disk.ReadAt(header, 0)
+	require.NoError(t, err)
+	require.Equal(t, header, data[:32768])
+
+	// restoring it would wipe the keyslots of the device
+	err = RestoreHeader(disk.Name(), bytes.NewReader(data))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "metadata-only backup")
+	_, err = dev.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+}
+
+func TestRestoreHeaderOtherVolume(t *testing.T) {
+	disk1, _ := createLuks2Fixture(t, "foobar")
+	disk2, _ := createLuks2Fixture(t, "foobar")
+
+	dev, err := Open(disk1.Name())
+	require.NoError(t, err)
+	defer dev.Close()
+	var backup bytes.Buffer
+	require.NoError(t, dev.(Inspector).BackupHeader(&backup, BackupOptions{}))
+
+	// fixtures share the UUID but have different volume keys
+	require.Error(t, RestoreHeader(disk2.Name(), bytes.NewReader(backup.Bytes())))
+
+	disk3, _ := createLuks1Fixture(t, "foobar")
+	require.Error(t, RestoreHeader(disk3.Name(), bytes.NewReader(backup.Bytes())))
+
+	// a damaged primary header is compared against the secondary one
+	_, err = disk2.WriteAt(make([]byte, 4096), 4096)
+	require.NoError(t, err)
+	require.Error(t, RestoreHeader(disk2.Name(), bytes.NewReader(backup.Bytes())))
+}
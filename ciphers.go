@@ -0,0 +1,293 @@
+package luks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dgryski/go-camellia"
+	"golang.org/x/crypto/twofish"
+)
+
+// BlockCipherFunc creates a block cipher with the given key
+type BlockCipherFunc func(key []byte) (cipher.Block, error)
+
+var (
+	blockCiphersMu sync.RWMutex
+	blockCiphers   = map[string]BlockCipherFunc{
+		"aes":      aes.NewCipher,
+		"camellia": camellia.New,
+		"serpent":  newSerpentCipher,
+		"twofish": func(key []byte) (cipher.Block, error) {
+			// twofish.NewCipher returns Cipher type, convert it to cipher.Block
+			return twofish.NewCipher(key)
+		},
+	}
+)
+
+// RegisterBlockCipher registers a block cipher for keyslot area encryption under its cryptsetup name (e.g. "cast5").
+// It allows to unlock volumes with keyslot ciphers that luks.go does not implement. A nil fn unregisters the cipher.
+func RegisterBlockCipher(name string, fn BlockCipherFunc) {
+	blockCiphersMu.Lock()
+	defer blockCiphersMu.Unlock()
+	if fn == nil {
+		delete(blockCiphers, name)
+	} else {
+		blockCiphers[name] = fn
+	}
+}
+
+// SupportedCiphers returns list of block ciphers supported for keyslot decryption
+func SupportedCiphers() []string {
+	blockCiphersMu.RLock()
+	defer blockCiphersMu.RUnlock()
+	names := make([]string, 0, len(blockCiphers))
+	for name := range blockCiphers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func getCipher(name string) (BlockCipherFunc, error) {
+	blockCiphersMu.RLock()
+	defer blockCiphersMu.RUnlock()
+	fn, ok := blockCiphers[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown cipher: %v", name)
+	}
+	return fn, nil
+}
+
+// checkKeySize verifies that the cipher accepts a key of the given size e.g. 32 or 64 bytes for aes-xts.
+// Only modes that use the plain block cipher key are checked, modes with additional key material (e.g. lrw) are not.
+func checkKeySize(cipherName, mode string, keySize int) error {
+	newBlock, err := getCipher(cipherName)
+	if err != nil {
+		return err
+	}
+	blockKeySize := keySize
+	switch mode {
+	case "xts":
+		if keySize%2 != 0 {
+			return fmt.Errorf("invalid key size %v for %v-%v", keySize, cipherName, mode)
+		}
+		blockKeySize = keySize / 2
+	case "cbc", "ecb", "ctr":
+	default:
+		return nil
+	}
+	key := make([]byte, blockKeySize)
+	if _, err := newBlock(key); err != nil {
+		return fmt.Errorf("invalid key size %v for %v-%v: %v", keySize, cipherName, mode, err)
+	}
+	return nil
+}
+
+// sectorCipher encrypts 512-byte sectors of a keyslot area, sectors are numbered from the start of the area.
+// *xts.Cipher implements it too.
+type sectorCipher interface {
+	Encrypt(ciphertext, plaintext []byte, sectorNum uint64)
+	Decrypt(plaintext, ciphertext []byte, sectorNum uint64)
+}
+
+// newSectorCipher creates the keyslot area cipher for the dm-crypt style mode and IV generator
+// e.g. "xts" and "plain64" or "cbc" and "essiv:sha256"
+func newSectorCipher(cipherName, mode, ivMode string, key []byte) (sectorCipher, error) {
+	newBlock, err := getCipher(cipherName)
+	if err != nil {
+		return nil, err
+	}
+
+	switch mode {
+	case "xts":
+		switch ivMode {
+		case "plain64", "plain":
+			return newXTSSectorCipher(newBlock, key, ivMode == "plain")
+		}
+	case "cbc":
+		block, err := newBlock(key)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case ivMode == "plain" || ivMode == "plain64":
+			return cbcSectorCipher{block: block, iv: plainIV(ivMode == "plain")}, nil
+		case strings.HasPrefix(ivMode, "essiv:"):
+			iv, err := essivIV(newBlock, strings.TrimPrefix(ivMode, "essiv:"), key)
+			if err != nil {
+				return nil, err
+			}
+			return cbcSectorCipher{block: block, iv: iv}, nil
+		}
+	default:
+		return nil, fmt.Errorf("Unknown encryption mode: %v", mode)
+	}
+	return nil, fmt.Errorf("Unknown IV mode %v for %v encryption mode", ivMode, mode)
+}
+
+// xtsSectorCipher is XTS (IEEE P1619) for 128-bit block ciphers. It produces the same output as xts.Cipher but
+// works on 64-bit words instead of bytes, the keyslot area decryption spends most of its time here on CPUs with
+// AES instructions. With truncate set the sector number is the legacy 32-bit "plain" IV that wraps around at 2TiB.
+type xtsSectorCipher struct {
+	k1, k2   cipher.Block
+	truncate bool
+}
+
+func newXTSSectorCipher(newBlock BlockCipherFunc, key []byte, truncate bool) (*xtsSectorCipher, error) {
+	if len(key)%2 != 0 {
+		return nil, fmt.Errorf("xts: invalid key size %d", len(key))
+	}
+	k1, err := newBlock(key[:len(key)/2])
+	if err != nil {
+		return nil, err
+	}
+	k2, err := newBlock(key[len(key)/2:])
+	if err != nil {
+		return nil, err
+	}
+	if k1.BlockSize() != xtsBlockSize {
+		return nil, fmt.Errorf("xts: cipher does not have a block size of %d", xtsBlockSize)
+	}
+	return &xtsSectorCipher{k1: k1, k2: k2, truncate: truncate}, nil
+}
+
+const xtsBlockSize = 16
+
+// blockBufPool holds per-sector tweak and IV buffers. They escape to the heap through the cipher.Block interface,
+// pooling avoids an allocation for every sector.
+var blockBufPool = sync.Pool{New: func() interface{} { return new([xtsBlockSize]byte) }}
+
+// getIVBuf returns a zeroed buffer of the block size, it is released with putIVBuf
+func getIVBuf(blockSize int) []byte {
+	if blockSize > xtsBlockSize {
+		return make([]byte, blockSize)
+	}
+	return blockBufPool.Get().(*[xtsBlockSize]byte)[:blockSize]
+}
+
+func putIVBuf(buf []byte) {
+	if cap(buf) != xtsBlockSize {
+		return
+	}
+	b := (*[xtsBlockSize]byte)(buf[:xtsBlockSize])
+	*b = [xtsBlockSize]byte{}
+	blockBufPool.Put(b)
+}
+
+func (c *xtsSectorCipher) Encrypt(ciphertext, plaintext []byte, sectorNum uint64) {
+	c.crypt(ciphertext, plaintext, sectorNum, c.k1.Encrypt)
+}
+
+func (c *xtsSectorCipher) Decrypt(plaintext, ciphertext []byte, sectorNum uint64) {
+	c.crypt(plaintext, ciphertext, sectorNum, c.k1.Decrypt)
+}
+
+func (c *xtsSectorCipher) crypt(dst, src []byte, sectorNum uint64, fn func(dst, src []byte)) {
+	if len(src)%xtsBlockSize != 0 || len(dst) < len(src) {
+		panic("xts: invalid buffer size")
+	}
+	if c.truncate {
+		sectorNum = uint64(uint32(sectorNum))
+	}
+
+	tweak := blockBufPool.Get().(*[xtsBlockSize]byte)
+	binary.LittleEndian.PutUint64(tweak[:8], sectorNum)
+	binary.LittleEndian.PutUint64(tweak[8:], 0)
+	c.k2.Encrypt(tweak[:], tweak[:])
+	t0 := binary.LittleEndian.Uint64(tweak[:8])
+	t1 := binary.LittleEndian.Uint64(tweak[8:])
+	*tweak = [xtsBlockSize]byte{}
+	blockBufPool.Put(tweak)
+
+	for i := 0; i < len(src); i += xtsBlockSize {
+		s, d := src[i:i+xtsBlockSize], dst[i:i+xtsBlockSize]
+		binary.LittleEndian.PutUint64(d[:8], binary.LittleEndian.Uint64(s[:8])^t0)
+		binary.LittleEndian.PutUint64(d[8:], binary.LittleEndian.Uint64(s[8:])^t1)
+		fn(d, d)
+		binary.LittleEndian.PutUint64(d[:8], binary.LittleEndian.Uint64(d[:8])^t0)
+		binary.LittleEndian.PutUint64(d[8:], binary.LittleEndian.Uint64(d[8:])^t1)
+
+		// multiply the tweak by the primitive element x of GF(2^128)
+		carry := t1 >> 63
+		t1 = t1<<1 | t0>>63
+		t0 = t0<<1 ^ carry*0x87
+	}
+}
+
+// cbcSectorCipher is CBC with a per-sector IV. The sector is processed in place block by block so no cipher.BlockMode
+// has to be created for every sector.
+type cbcSectorCipher struct {
+	block cipher.Block
+	iv    func(iv []byte, sectorNum uint64)
+}
+
+func (c cbcSectorCipher) Encrypt(ciphertext, plaintext []byte, sectorNum uint64) {
+	bs := c.block.BlockSize()
+	iv := getIVBuf(bs)
+	defer putIVBuf(iv)
+	c.iv(iv, sectorNum)
+	prev := iv
+	for i := 0; i < len(plaintext); i += bs {
+		d := ciphertext[i : i+bs]
+		for j := range d {
+			d[j] = plaintext[i+j] ^ prev[j]
+		}
+		c.block.Encrypt(d, d)
+		prev = d
+	}
+}
+
+func (c cbcSectorCipher) Decrypt(plaintext, ciphertext []byte, sectorNum uint64) {
+	bs := c.block.BlockSize()
+	iv := getIVBuf(bs)
+	defer putIVBuf(iv)
+	c.iv(iv, sectorNum)
+	// walking backwards keeps the previous ciphertext block intact for in-place decryption
+	for i := len(ciphertext) - bs; i >= 0; i -= bs {
+		d := plaintext[i : i+bs]
+		c.block.Decrypt(d, ciphertext[i:i+bs])
+		prev := iv
+		if i > 0 {
+			prev = ciphertext[i-bs : i]
+		}
+		for j := range d {
+			d[j] ^= prev[j]
+		}
+	}
+}
+
+// plainIV is the little-endian sector number, truncated to 32 bits for "plain"
+func plainIV(truncate bool) func(iv []byte, sectorNum uint64) {
+	return func(iv []byte, sectorNum uint64) {
+		if truncate {
+			sectorNum = uint64(uint32(sectorNum))
+		}
+		binary.LittleEndian.PutUint64(iv, sectorNum)
+	}
+}
+
+// essivIV is the "encrypted salt-sector IV": the sector number encrypted with the hash of the key
+func essivIV(newBlock BlockCipherFunc, hashName string, key []byte) (func(iv []byte, sectorNum uint64), error) {
+	h, _ := getHashAlgo(hashName)
+	if h == nil {
+		return nil, fmt.Errorf("Unknown essiv hash algorithm: %v", hashName)
+	}
+	hash := h()
+	hash.Write(key)
+	salt := hash.Sum(nil)
+	defer clearSlice(salt)
+
+	essiv, err := newBlock(salt)
+	if err != nil {
+		return nil, fmt.Errorf("essiv: %v", err)
+	}
+	return func(iv []byte, sectorNum uint64) {
+		binary.LittleEndian.PutUint64(iv, sectorNum)
+		essiv.Encrypt(iv, iv)
+	}, nil
+}
@@ -0,0 +1,190 @@
+package luks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
+)
+
+func TestSerpentVectors(t *testing.T) {
+	for _, v := range []struct{ key, plaintext, ciphertext string }{
+		// Linux kernel crypto/testmgr.h
+		{"", "000102030405060708090a0b0c0d0e0f", "1207fcce9bd0d6476ae98fbed143a0e2"},
+		// NESSIE Serpent-128 set 1 vector 0
+		{"80000000000000000000000000000000", "00000000000000000000000000000000", "264e5481eff42a4606abda06c0bfda3d"},
+	} {
+		key, _ := hex.DecodeString(v.key)
+		plaintext, _ := hex.DecodeString(v.plaintext)
+		c, err := newSerpentCipher(key)
+		require.NoError(t, err)
+
+		out := make([]byte, serpentBlockSize)
+		c.Encrypt(out, plaintext)
+		require.Equal(t, v.ciphertext, hex.EncodeToString(out))
+		c.Decrypt(out, out)
+		require.Equal(t, plaintext, out)
+	}
+
+	_, err := newSerpentCipher(make([]byte, 33))
+	require.Error(t, err)
+}
+
+func TestEssivSectorCipher(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+
+	c, err := newSectorCipher("aes", "cbc", "essiv:sha256", key)
+	require.NoError(t, err)
+
+	// IV of sector 5 is AES_{sha256(key)}(5)
+	salt := sha256.Sum256(key)
+	essiv, err := aes.NewCipher(salt[:])
+	require.NoError(t, err)
+	iv := make([]byte, aes.BlockSize)
+	binary.LittleEndian.PutUint64(iv, 5)
+	essiv.Encrypt(iv, iv)
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+
+	plaintext := make([]byte, storageSectorSize)
+	_, err = rand.Read(plaintext)
+	require.NoError(t, err)
+	expected := make([]byte, storageSectorSize)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(expected, plaintext)
+
+	ciphertext := make([]byte, storageSectorSize)
+	c.Encrypt(ciphertext, plaintext, 5)
+	require.Equal(t, expected, ciphertext)
+	c.Decrypt(ciphertext, ciphertext, 5)
+	require.Equal(t, plaintext, ciphertext)
+}
+
+func TestXTSSectorCipher(t *testing.T) {
+	key := make([]byte, 64)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	reference, err := xts.NewCipher(aes.NewCipher, key)
+	require.NoError(t, err)
+	c, err := newSectorCipher("aes", "xts", "plain64", key)
+	require.NoError(t, err)
+	plain, err := newSectorCipher("aes", "xts", "plain", key)
+	require.NoError(t, err)
+
+	plaintext := make([]byte, storageSectorSize)
+	_, err = rand.Read(plaintext)
+	require.NoError(t, err)
+	expected := make([]byte, storageSectorSize)
+	ciphertext := make([]byte, storageSectorSize)
+	for _, sector := range []uint64{0, 1, 7, 1<<32 + 3, 1<<64 - 1} {
+		reference.Encrypt(expected, plaintext, sector)
+		c.Encrypt(ciphertext, plaintext, sector)
+		require.Equal(t, expected, ciphertext, "sector %d", sector)
+		c.Decrypt(ciphertext, ciphertext, sector)
+		require.Equal(t, plaintext, ciphertext, "sector %d", sector)
+
+		// "plain" uses the lower 32 bits of the sector number
+		reference.Encrypt(expected, plaintext, uint64(uint32(sector)))
+		plain.Encrypt(ciphertext, plaintext, sector)
+		require.Equal(t, expected, ciphertext, "sector %d", sector)
+	}
+
+	_, err = newSectorCipher("aes", "xts", "plain64", make([]byte, 33))
+	require.Error(t, err)
+}
+
+func TestCBCSectorCipherOutOfPlace(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	c, err := newSectorCipher("aes", "cbc", "plain64", key)
+	require.NoError(t, err)
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+
+	ciphertext := make([]byte, storageSectorSize)
+	_, err = rand.Read(ciphertext)
+	require.NoError(t, err)
+	iv := make([]byte, aes.BlockSize)
+	binary.LittleEndian.PutUint64(iv, 9)
+	expected := make([]byte, storageSectorSize)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(expected, ciphertext)
+
+	original := append([]byte(nil), ciphertext...)
+	plaintext := make([]byte, storageSectorSize)
+	c.Decrypt(plaintext, ciphertext, 9)
+	require.Equal(t, expected, plaintext)
+	require.Equal(t, original, ciphertext)
+}
+
+func TestRegisterBlockCipher(t *testing.T) {
+	RegisterBlockCipher("test-aes", aes.NewCipher)
+	require.Contains(t, SupportedCiphers(), "test-aes")
+	_, err := newSectorCipher("test-aes", "xts", "plain64", make([]byte, 64))
+	require.NoError(t, err)
+
+	RegisterBlockCipher("test-aes", nil)
+	require.NotContains(t, SupportedCiphers(), "test-aes")
+	_, err = newSectorCipher("test-aes", "xts", "plain64", make([]byte, 64))
+	require.Error(t, err)
+}
+
+func TestUnsealKeyslotAreaCiphers(t *testing.T) {
+	for _, tc := range []struct {
+		encryption string
+		keySize    int
+	}{
+		{"serpent-xts-plain64", 64},
+		{"camellia-xts-plain64", 64},
+		{"aes-xts-plain", 64},
+		{"aes-cbc-essiv:sha256", 32},
+		{"serpent-cbc-essiv:sha256", 32},
+		{"camellia-cbc-plain64", 32},
+	} {
+		t.Run(tc.encryption, func(t *testing.T) {
+			disk, volumeKey := createLuks2Fixture(t, "foobar")
+			d, err := initV2Device(disk.Name(), FileStorage{disk})
+			require.NoError(t, err)
+
+			// rewrite keyslot 0 with the key material encrypted as cryptsetup does for `--cipher <encryption>`
+			ks := d.meta.Keyslots[0]
+			salt, err := base64.StdEncoding.DecodeString(ks.Kdf.Salt)
+			require.NoError(t, err)
+			afKey := pbkdf2.Key([]byte("foobar"), salt, fixtureIterations, tc.keySize, sha256.New)
+			material, err := afSplit(volumeKey, stripesNum, sha256.New())
+			require.NoError(t, err)
+			cipherName, mode, ivMode, err := parseCipherSpec(tc.encryption)
+			require.NoError(t, err)
+			ciph, err := newSectorCipher(cipherName, mode, ivMode, afKey)
+			require.NoError(t, err)
+			encryptKeyslotArea(ciph, material)
+			offset, err := ks.Area.Offset.Int64()
+			require.NoError(t, err)
+			_, err = disk.WriteAt(material, offset)
+			require.NoError(t, err)
+
+			ks.Area.Encryption = tc.encryption
+			ks.Area.KeySize = uint(tc.keySize)
+			ks.Area.Size = json.Number(strconv.Itoa(len(material)))
+			d.meta.Keyslots[0] = ks
+			require.NoError(t, d.writeHeader())
+
+			d, err = initV2Device(disk.Name(), FileStorage{disk})
+			require.NoError(t, err)
+			v, err := d.UnsealVolume(0, []byte("foobar"))
+			require.NoError(t, err)
+			require.Equal(t, volumeKey, v.key)
+		})
+	}
+}
@@ -0,0 +1,526 @@
+package luks
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ClevisPin recovers the content encryption key of a clevis JWE encrypted with the "dir" algorithm.
+// config is the pin configuration stored at the JWE protected header e.g. the "tpm2" object for the tpm2 pin.
+type ClevisPin func(ctx context.Context, config json.RawMessage) (key []byte, err error)
+
+var (
+	clevisPinsMu sync.RWMutex
+	clevisPins   = make(map[string]ClevisPin)
+)
+
+// RegisterClevisPin registers an implementation of an external clevis pin (e.g. tpm2) that is used by
+// Unlocker.UnlockWithClevis. The tang and sss pins are built-in. A nil pin unregisters the name.
+func RegisterClevisPin(name string, pin ClevisPin) {
+	clevisPinsMu.Lock()
+	defer clevisPinsMu.Unlock()
+
+	if pin == nil {
+		delete(clevisPins, name)
+	} else {
+		clevisPins[name] = pin
+	}
+}
+
+func getClevisPin(name string) ClevisPin {
+	clevisPinsMu.RLock()
+	defer clevisPinsMu.RUnlock()
+
+	return clevisPins[name]
+}
+
+// clevisJWE is a JWE (RFC 7516) in flattened JSON serialization as stored in LUKS2 clevis tokens
+type clevisJWE struct {
+	Protected    string `json:"protected"`
+	EncryptedKey string `json:"encrypted_key"`
+	IV           string `json:"iv"`
+	Ciphertext   string `json:"ciphertext"`
+	Tag          string `json:"tag"`
+}
+
+// clevisHeader is the JWE protected header created by `clevis encrypt tang`
+type clevisHeader struct {
+	Alg    string `json:"alg"`
+	Enc    string `json:"enc"`
+	Kid    string `json:"kid"`
+	Epk    jwk    `json:"epk"`
+	Apu    string `json:"apu"`
+	Apv    string `json:"apv"`
+	Clevis struct {
+		Pin  string `json:"pin"`
+		Tang struct {
+			URL tangURLs `json:"url"`
+		} `json:"tang"`
+		Sss struct {
+			P   string   `json:"p"`
+			T   int      `json:"t"`
+			JWE []string `json:"jwe"`
+		} `json:"sss"`
+	} `json:"clevis"`
+}
+
+// tangURLs is the list of tang servers of the clevis tang pin. clevis stores a single URL string, a list of URLs
+// lets the binding fail over to another server.
+type tangURLs []string
+
+func (u *tangURLs) UnmarshalJSON(data []byte) error {
+	var url string
+	if err := json.Unmarshal(data, &url); err == nil {
+		*u = tangURLs{url}
+		return nil
+	}
+	var urls []string
+	if err := json.Unmarshal(data, &urls); err != nil {
+		return fmt.Errorf("invalid tang url: %v", err)
+	}
+	*u = urls
+	return nil
+}
+
+// parseClevisJWE extracts the JWE from the clevis token. LUKS2 tokens store it as the "jwe" JSON object,
+// LUKS1 (luksmeta) tokens use the compact serialization.
+func parseClevisJWE(token Token) (*clevisJWE, error) {
+	payload := bytes.TrimRight(token.Payload, "\x00\n")
+	if len(payload) != 0 && payload[0] == '{' {
+		var node struct {
+			JWE *clevisJWE `json:"jwe"`
+		}
+		if err := json.Unmarshal(payload, &node); err != nil {
+			return nil, fmt.Errorf("invalid clevis token: %v", err)
+		}
+		if node.JWE == nil {
+			return nil, fmt.Errorf("clevis token has no jwe")
+		}
+		return node.JWE, nil
+	}
+
+	return parseCompactJWE(string(payload))
+}
+
+func parseCompactJWE(s string) (*clevisJWE, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("invalid clevis token: malformed compact JWE")
+	}
+	return &clevisJWE{Protected: parts[0], EncryptedKey: parts[1], IV: parts[2], Ciphertext: parts[3], Tag: parts[4]}, nil
+}
+
+// clevisPassphrase recovers the keyslot passphrase from the clevis token
+func clevisPassphrase(ctx context.Context, token Token) ([]byte, error) {
+	jwe, err := parseClevisJWE(token)
+	if err != nil {
+		return nil, err
+	}
+	return clevisDecrypt(ctx, jwe)
+}
+
+// clevisDecrypt decrypts the JWE with the clevis pin specified at its protected header
+func clevisDecrypt(ctx context.Context, jwe *clevisJWE) ([]byte, error) {
+	protected, err := base64.RawURLEncoding.DecodeString(jwe.Protected)
+	if err != nil {
+		return nil, fmt.Errorf("invalid clevis JWE header: %v", err)
+	}
+	var hdr clevisHeader
+	if err := json.Unmarshal(protected, &hdr); err != nil {
+		return nil, fmt.Errorf("invalid clevis JWE header: %v", err)
+	}
+
+	switch hdr.Clevis.Pin {
+	case "tang":
+		return clevisTangDecrypt(ctx, jwe, &hdr)
+	case "sss":
+		return clevisSssDecrypt(ctx, jwe, &hdr)
+	}
+
+	pin := getClevisPin(hdr.Clevis.Pin)
+	if pin == nil {
+		return nil, fmt.Errorf("unsupported clevis pin %q", hdr.Clevis.Pin)
+	}
+	if hdr.Alg != "dir" {
+		return nil, fmt.Errorf("unsupported clevis JWE algorithm %q", hdr.Alg)
+	}
+	keySize, err := jweKeySize(hdr.Enc)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Clevis map[string]json.RawMessage `json:"clevis"`
+	}
+	if err := json.Unmarshal(protected, &config); err != nil {
+		return nil, fmt.Errorf("invalid clevis JWE header: %v", err)
+	}
+	key, err := pin(ctx, config.Clevis[hdr.Clevis.Pin])
+	if err != nil {
+		return nil, fmt.Errorf("clevis %s pin: %w", hdr.Clevis.Pin, err)
+	}
+	defer clearSlice(key)
+	if len(key) != keySize {
+		return nil, fmt.Errorf("clevis %s pin key size %d does not match encryption %v", hdr.Clevis.Pin, len(key), hdr.Enc)
+	}
+	return decryptJWE(jwe, key)
+}
+
+// jweKeySize returns the content encryption key size for the JWE "enc" algorithm
+func jweKeySize(enc string) (int, error) {
+	switch enc {
+	case "A128GCM":
+		return 16, nil
+	case "A192GCM":
+		return 24, nil
+	case "A256GCM":
+		return 32, nil
+	default:
+		return 0, fmt.Errorf("unsupported clevis JWE encryption %q", enc)
+	}
+}
+
+// clevisTangDecrypt decrypts the JWE protected with the clevis tang pin. The tang server advertisement must
+// contain the key the token was bound to. The server never learns the content, it only performs
+// the McCallum-Relyea exchange with a blinded ephemeral key.
+func clevisTangDecrypt(ctx context.Context, jwe *clevisJWE, hdr *clevisHeader) ([]byte, error) {
+	if hdr.Alg != "ECDH-ES" {
+		return nil, fmt.Errorf("unsupported clevis JWE algorithm %q", hdr.Alg)
+	}
+	keySize, err := jweKeySize(hdr.Enc)
+	if err != nil {
+		return nil, err
+	}
+
+	// the servers are tried in order, the first one that responds performs the key recovery
+	url, keys, err := fetchTangAdvertisementAny(ctx, hdr.Clevis.Tang.URL, hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+	var serverKey *ecdsa.PublicKey
+	for i := range keys {
+		if keys[i].hasKeyOp("deriveKey") && keys[i].hasThumbprint(hdr.Kid) {
+			if serverKey, err = keys[i].ecdsaPublicKey(); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	if serverKey == nil {
+		return nil, fmt.Errorf("tang server %v has no exchange key %v", url, hdr.Kid)
+	}
+	epk, err := hdr.Epk.ecdsaPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("invalid clevis ephemeral key: %v", err)
+	}
+	if epk.Curve != serverKey.Curve {
+		return nil, fmt.Errorf("clevis ephemeral key curve does not match the tang server key")
+	}
+
+	z, err := tangRecover(ctx, url, hdr.Kid, serverKey, epk)
+	if err != nil {
+		return nil, err
+	}
+	defer clearSlice(z)
+
+	apu, err := base64.RawURLEncoding.DecodeString(hdr.Apu)
+	if err != nil {
+		return nil, fmt.Errorf("invalid clevis JWE apu: %v", err)
+	}
+	apv, err := base64.RawURLEncoding.DecodeString(hdr.Apv)
+	if err != nil {
+		return nil, fmt.Errorf("invalid clevis JWE apv: %v", err)
+	}
+	key := concatKDF(z, hdr.Enc, apu, apv, keySize)
+	defer clearSlice(key)
+
+	return decryptJWE(jwe, key)
+}
+
+// clevisSssDecrypt decrypts the JWE protected with the clevis sss pin. The content encryption key is split with
+// Shamir's secret sharing, each share is encrypted with a nested pin. At least threshold shares need to be
+// recovered to combine the key.
+func clevisSssDecrypt(ctx context.Context, jwe *clevisJWE, hdr *clevisHeader) ([]byte, error) {
+	if hdr.Alg != "dir" {
+		return nil, fmt.Errorf("unsupported clevis JWE algorithm %q", hdr.Alg)
+	}
+	keySize, err := jweKeySize(hdr.Enc)
+	if err != nil {
+		return nil, err
+	}
+	cfg := hdr.Clevis.Sss
+	pBytes, err := base64.RawURLEncoding.DecodeString(cfg.P)
+	if err != nil || len(pBytes) == 0 {
+		return nil, fmt.Errorf("invalid clevis sss prime")
+	}
+	if cfg.T < 1 || cfg.T > len(cfg.JWE) {
+		return nil, fmt.Errorf("invalid clevis sss threshold %d for %d shares", cfg.T, len(cfg.JWE))
+	}
+
+	var (
+		shares   [][]byte
+		firstErr error
+	)
+	defer func() {
+		for _, s := range shares {
+			clearSlice(s)
+		}
+	}()
+	for _, sub := range cfg.JWE {
+		if len(shares) == cfg.T {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		subJWE, err := parseCompactJWE(sub)
+		if err == nil {
+			var share []byte
+			if share, err = clevisDecrypt(ctx, subJWE); err == nil {
+				if len(share) != 2*len(pBytes) {
+					clearSlice(share)
+					err = fmt.Errorf("invalid clevis sss share size %d", len(share))
+				} else {
+					shares = append(shares, share)
+					continue
+				}
+			}
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if len(shares) < cfg.T {
+		return nil, fmt.Errorf("clevis sss: recovered %d of %d required shares: %w", len(shares), cfg.T, firstErr)
+	}
+
+	key, err := sssCombine(new(big.Int).SetBytes(pBytes), len(pBytes), shares)
+	if err != nil {
+		return nil, err
+	}
+	defer clearSlice(key)
+	if len(key) != keySize {
+		return nil, fmt.Errorf("clevis sss key size %d does not match encryption %v", len(key), hdr.Enc)
+	}
+	return decryptJWE(jwe, key)
+}
+
+// sssCombine recovers the secret from the shares (x || y points of size bytes each) with Lagrange interpolation
+// at x = 0 over the prime field p
+func sssCombine(p *big.Int, size int, shares [][]byte) ([]byte, error) {
+	xs := make([]*big.Int, len(shares))
+	ys := make([]*big.Int, len(shares))
+	for i, s := range shares {
+		xs[i] = new(big.Int).SetBytes(s[:size])
+		ys[i] = new(big.Int).SetBytes(s[size:])
+	}
+
+	secret := new(big.Int)
+	for i := range shares {
+		num := big.NewInt(1)
+		den := big.NewInt(1)
+		for j := range shares {
+			if i == j {
+				continue
+			}
+			num.Mul(num, xs[j])
+			num.Mod(num, p)
+			den.Mul(den, new(big.Int).Sub(xs[j], xs[i]))
+			den.Mod(den, p)
+		}
+		if den.ModInverse(den, p) == nil {
+			return nil, fmt.Errorf("clevis sss shares have duplicate points")
+		}
+		term := new(big.Int).Mul(ys[i], num)
+		term.Mul(term, den)
+		secret.Add(secret, term)
+		secret.Mod(secret, p)
+	}
+	defer secret.SetInt64(0)
+	return secret.FillBytes(make([]byte, size)), nil
+}
+
+// tangRecover performs the McCallum-Relyea exchange and returns the ECDH shared secret (x coordinate) of
+// the ephemeral key epk and the server key. The request to the server is blinded with a random key.
+func tangRecover(ctx context.Context, url, kid string, serverKey, epk *ecdsa.PublicKey) ([]byte, error) {
+	curve := epk.Curve
+	blind, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	defer blind.D.SetInt64(0)
+
+	// x = epk + blind
+	xx, xy := curve.Add(epk.X, epk.Y, blind.X, blind.Y)
+	req := ecPointJWK(curve, xx, xy)
+	req.Alg = "ECMR"
+	reqBody, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, TangTimeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(url, "/")+"/rec/"+kid, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/jwk+json")
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTangUnreachable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tang server %v returned status %v", url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, tangMaxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTangUnreachable, err)
+	}
+	var respKey jwk
+	if err := json.Unmarshal(body, &respKey); err != nil {
+		return nil, fmt.Errorf("invalid tang recovery response: %v", err)
+	}
+	y, err := respKey.ecdsaPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("invalid tang recovery response: %v", err)
+	}
+	if y.Curve != curve {
+		return nil, fmt.Errorf("tang recovery response curve does not match")
+	}
+
+	// z = y - serverKey * blind
+	tx, ty := curve.ScalarMult(serverKey.X, serverKey.Y, blind.D.Bytes())
+	ty.Sub(curve.Params().P, ty)
+	zx, zy := curve.Add(y.X, y.Y, tx, ty)
+	if zx.Sign() == 0 && zy.Sign() == 0 {
+		return nil, fmt.Errorf("Tang recovery resulted in the point at infinity")
+	}
+	size := (curve.Params().BitSize + 7) / 8
+	return zx.FillBytes(make([]byte, size)), nil
+}
+
+func ecPointJWK(curve elliptic.Curve, x, y *big.Int) jwk {
+	size := (curve.Params().BitSize + 7) / 8
+	return jwk{
+		Kty: "EC",
+		Crv: curve.Params().Name,
+		X:   base64.RawURLEncoding.EncodeToString(x.FillBytes(make([]byte, size))),
+		Y:   base64.RawURLEncoding.EncodeToString(y.FillBytes(make([]byte, size))),
+	}
+}
+
+// concatKDF derives the content encryption key from the ECDH-ES shared secret as specified at RFC 7518 section 4.6.2
+func concatKDF(z []byte, alg string, apu, apv []byte, keySize int) []byte {
+	var otherInfo bytes.Buffer
+	for _, field := range [][]byte{[]byte(alg), apu, apv} {
+		_ = binary.Write(&otherInfo, binary.BigEndian, uint32(len(field)))
+		otherInfo.Write(field)
+	}
+	_ = binary.Write(&otherInfo, binary.BigEndian, uint32(keySize*8))
+
+	var key []byte
+	for counter := uint32(1); len(key) < keySize; counter++ {
+		h := sha256.New()
+		_ = binary.Write(h, binary.BigEndian, counter)
+		h.Write(z)
+		h.Write(otherInfo.Bytes())
+		key = h.Sum(key)
+	}
+	clearSlice(key[keySize:])
+	return key[:keySize]
+}
+
+// decryptJWE decrypts AES-GCM encrypted JWE content with the given content encryption key
+func decryptJWE(jwe *clevisJWE, key []byte) ([]byte, error) {
+	if jwe.EncryptedKey != "" {
+		return nil, fmt.Errorf("unexpected encrypted key in ECDH-ES JWE")
+	}
+	iv, err := base64.RawURLEncoding.DecodeString(jwe.IV)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWE iv: %v", err)
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(jwe.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWE ciphertext: %v", err)
+	}
+	tag, err := base64.RawURLEncoding.DecodeString(jwe.Tag)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWE tag: %v", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(jwe.Protected))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt clevis JWE: %v", err)
+	}
+	return plaintext, nil
+}
+
+// unsealClevis recovers the volume using the first clevis token that unlocks its keyslot
+func unsealClevis(ctx context.Context, d device) (*Volume, error) {
+	tokens, err := d.Tokens()
+	if err != nil {
+		return nil, err
+	}
+
+	active := make(map[int]bool)
+	for _, s := range d.Slots() {
+		active[s] = true
+	}
+
+	var firstErr error
+	for _, t := range tokens {
+		if t.Type != ClevisTokenType {
+			continue
+		}
+		passphrase, err := clevisPassphrase(ctx, t)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("clevis token %d: %w", t.ID, err)
+			}
+			continue
+		}
+		for _, s := range t.Slots {
+			if !active[s] {
+				continue
+			}
+			volume, err := d.UnsealVolumeContext(ctx, s, passphrase)
+			if err == nil {
+				clearSlice(passphrase)
+				return volume, nil
+			}
+			if firstErr == nil {
+				firstErr = fmt.Errorf("clevis token %d: %w", t.ID, err)
+			}
+		}
+		clearSlice(passphrase)
+	}
+
+	if firstErr == nil {
+		firstErr = fmt.Errorf("device has no clevis tokens bound to active keyslots")
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,261 @@
+package luks
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// clevisEncrypt encrypts the data the same way as `clevis encrypt tang` does. If urls are specified the binding
+// lists them instead of the server URL.
+func clevisEncrypt(t *testing.T, srv *testTangServer, data []byte, urls ...string) *clevisJWE {
+	exchange := ecJWK(srv.exchangeKey, "ECMR", "deriveKey")
+	kid, err := exchange.thumbprint(crypto.SHA256)
+	require.NoError(t, err)
+
+	ephemeral, err := ecdsa.GenerateKey(srv.exchangeKey.Curve, rand.Reader)
+	require.NoError(t, err)
+	epk := ecJWK(ephemeral, "ECDH-ES")
+	epkJSON, err := json.Marshal(epk)
+	require.NoError(t, err)
+
+	url, err := json.Marshal(srv.URL)
+	require.NoError(t, err)
+	if len(urls) > 0 {
+		url, err = json.Marshal(urls)
+		require.NoError(t, err)
+	}
+	hdr := fmt.Sprintf(`{"alg":"ECDH-ES","enc":"A256GCM","kid":"%s","epk":%s,"clevis":{"pin":"tang","tang":{"url":%s}}}`, kid, epkJSON, url)
+	protected := base64.RawURLEncoding.EncodeToString([]byte(hdr))
+
+	zx, _ := ephemeral.Curve.ScalarMult(srv.exchangeKey.X, srv.exchangeKey.Y, ephemeral.D.Bytes())
+	z := zx.FillBytes(make([]byte, (ephemeral.Curve.Params().BitSize+7)/8))
+	block, err := aes.NewCipher(concatKDF(z, "A256GCM", nil, nil, 32))
+	require.NoError(t, err)
+	gcm, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	iv := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(iv)
+	require.NoError(t, err)
+	sealed := gcm.Seal(nil, iv, data, []byte(protected))
+	ciphertext, tag := sealed[:len(data)], sealed[len(data):]
+
+	return &clevisJWE{
+		Protected:  protected,
+		IV:         base64.RawURLEncoding.EncodeToString(iv),
+		Ciphertext: base64.RawURLEncoding.EncodeToString(ciphertext),
+		Tag:        base64.RawURLEncoding.EncodeToString(tag),
+	}
+}
+
+func TestConcatKDF(t *testing.T) {
+	// RFC 7518 appendix C
+	z := []byte{158, 86, 217, 29, 129, 113, 53, 211, 114, 131, 66, 131, 191, 132, 38, 156, 251, 49, 110, 163, 218, 128, 106, 72, 246, 218, 167, 121, 140, 254, 144, 196}
+	key := concatKDF(z, "A128GCM", []byte("Alice"), []byte("Bob"), 16)
+	require.Equal(t, "VqqN6vgjbSBcIijNcacQGg", base64.RawURLEncoding.EncodeToString(key))
+}
+
+func TestClevisTangPassphrase(t *testing.T) {
+	srv := newTestTangServer(t)
+	jwe := clevisEncrypt(t, srv, []byte("secret passphrase"))
+
+	payload, err := json.Marshal(map[string]interface{}{"type": "clevis", "keyslots": []string{"1"}, "jwe": jwe})
+	require.NoError(t, err)
+	passphrase, err := clevisPassphrase(context.Background(), Token{Type: ClevisTokenType, Payload: payload})
+	require.NoError(t, err)
+	require.Equal(t, "secret passphrase", string(passphrase))
+
+	// LUKS1 luksmeta stores the compact serialization
+	compact := jwe.Protected + ".." + jwe.IV + "." + jwe.Ciphertext + "." + jwe.Tag
+	passphrase, err = clevisPassphrase(context.Background(), Token{Type: ClevisTokenType, Payload: []byte(compact)})
+	require.NoError(t, err)
+	require.Equal(t, "secret passphrase", string(passphrase))
+
+	// the token is bound to a different server key
+	other := newTestTangServer(t)
+	jwe = clevisEncrypt(t, other, []byte("secret passphrase"))
+	other.Close()
+	compact = jwe.Protected + ".." + jwe.IV + "." + jwe.Ciphertext + "." + jwe.Tag
+	_, err = clevisPassphrase(context.Background(), Token{Type: ClevisTokenType, Payload: []byte(compact)})
+	require.ErrorIs(t, err, ErrTangUnreachable)
+}
+
+func TestClevisTangFailover(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	downURL := down.URL
+	down.Close() // nothing listens at this address anymore
+
+	srv := newTestTangServer(t)
+	jwe := clevisEncrypt(t, srv, []byte("secret passphrase"), downURL, srv.URL)
+
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	addLuks2FixtureKeyslot(t, d, 1, "secret passphrase", volumeKey)
+	payload, err := json.Marshal(map[string]interface{}{"type": "clevis", "keyslots": []string{"1"}, "jwe": jwe})
+	require.NoError(t, err)
+	d.meta.Tokens[0] = payload
+	require.NoError(t, d.writeHeader())
+
+	dev, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer dev.Close()
+	volume, err := unsealClevis(context.Background(), dev.(device))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, volume.key)
+
+	// none of the servers is reachable
+	srv.Close()
+	_, err = clevisPassphrase(context.Background(), Token{Type: ClevisTokenType, Payload: payload})
+	require.ErrorIs(t, err, ErrTangUnreachable)
+}
+
+func TestUnsealClevis(t *testing.T) {
+	srv := newTestTangServer(t)
+
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	addLuks2FixtureKeyslot(t, d, 1, "clevis passphrase", volumeKey)
+	payload, err := json.Marshal(map[string]interface{}{"type": "clevis", "keyslots": []string{"1"}, "jwe": clevisEncrypt(t, srv, []byte("clevis passphrase"))})
+	require.NoError(t, err)
+	d.meta.Tokens[0] = payload
+	require.NoError(t, d.writeHeader())
+
+	dev, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer dev.Close()
+	volume, err := unsealClevis(context.Background(), dev.(device))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, volume.key)
+
+	noTokens, _ := createLuks2Fixture(t, "foobar")
+	dev2, err := Open(noTokens.Name())
+	require.NoError(t, err)
+	defer dev2.Close()
+	_, err = unsealClevis(context.Background(), dev2.(device))
+	require.Error(t, err)
+}
+
+// clevisSssEncrypt encrypts the data the same way as `clevis encrypt sss` does with the given nested tang servers
+func clevisSssEncrypt(t *testing.T, servers []*testTangServer, threshold int, data []byte) *clevisJWE {
+	p, err := rand.Prime(rand.Reader, 256)
+	require.NoError(t, err)
+	coefficients := make([]*big.Int, threshold)
+	for i := range coefficients {
+		coefficients[i], err = rand.Int(rand.Reader, p)
+		require.NoError(t, err)
+	}
+	secret := coefficients[0].FillBytes(make([]byte, 32))
+
+	var shares []string
+	for i, srv := range servers {
+		x := big.NewInt(int64(i + 1))
+		y := new(big.Int)
+		for j := len(coefficients) - 1; j >= 0; j-- {
+			y.Mul(y, x)
+			y.Add(y, coefficients[j])
+			y.Mod(y, p)
+		}
+		point := append(x.FillBytes(make([]byte, 32)), y.FillBytes(make([]byte, 32))...)
+		sub := clevisEncrypt(t, srv, point)
+		shares = append(shares, sub.Protected+".."+sub.IV+"."+sub.Ciphertext+"."+sub.Tag)
+	}
+
+	sharesJSON, err := json.Marshal(shares)
+	require.NoError(t, err)
+	hdr := fmt.Sprintf(`{"alg":"dir","enc":"A256GCM","clevis":{"pin":"sss","sss":{"p":"%s","t":%d,"jwe":%s}}}`,
+		base64.RawURLEncoding.EncodeToString(p.FillBytes(make([]byte, 32))), threshold, sharesJSON)
+	protected := base64.RawURLEncoding.EncodeToString([]byte(hdr))
+
+	block, err := aes.NewCipher(secret)
+	require.NoError(t, err)
+	gcm, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	iv := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(iv)
+	require.NoError(t, err)
+	sealed := gcm.Seal(nil, iv, data, []byte(protected))
+
+	return &clevisJWE{
+		Protected:  protected,
+		IV:         base64.RawURLEncoding.EncodeToString(iv),
+		Ciphertext: base64.RawURLEncoding.EncodeToString(sealed[:len(data)]),
+		Tag:        base64.RawURLEncoding.EncodeToString(sealed[len(data):]),
+	}
+}
+
+func TestClevisSss(t *testing.T) {
+	first := newTestTangServer(t)
+	second := newTestTangServer(t)
+	down := newTestTangServer(t)
+	servers := []*testTangServer{first, down, second}
+
+	for _, threshold := range []int{1, 2} {
+		jwe := clevisSssEncrypt(t, servers, threshold, []byte("sss passphrase"))
+		payload, err := json.Marshal(map[string]interface{}{"type": "clevis", "keyslots": []string{"1"}, "jwe": jwe})
+		require.NoError(t, err)
+		if threshold == 2 {
+			down.Close()
+		}
+		passphrase, err := clevisPassphrase(context.Background(), Token{Type: ClevisTokenType, Payload: payload})
+		require.NoError(t, err)
+		require.Equal(t, "sss passphrase", string(passphrase))
+	}
+
+	// not enough shares can be recovered
+	second.Close()
+	jwe := clevisSssEncrypt(t, servers, 2, []byte("sss passphrase"))
+	payload, err := json.Marshal(map[string]interface{}{"type": "clevis", "keyslots": []string{"1"}, "jwe": jwe})
+	require.NoError(t, err)
+	_, err = clevisPassphrase(context.Background(), Token{Type: ClevisTokenType, Payload: payload})
+	require.ErrorIs(t, err, ErrTangUnreachable)
+}
+
+func TestRegisterClevisPin(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+
+	hdr := fmt.Sprintf(`{"alg":"dir","enc":"A256GCM","clevis":{"pin":"test","test":{"key":"%s"}}}`, base64.RawURLEncoding.EncodeToString(key))
+	protected := base64.RawURLEncoding.EncodeToString([]byte(hdr))
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	gcm, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	iv := make([]byte, gcm.NonceSize())
+	sealed := gcm.Seal(nil, iv, []byte("pin passphrase"), []byte(protected))
+	compact := protected + ".." + base64.RawURLEncoding.EncodeToString(iv) + "." +
+		base64.RawURLEncoding.EncodeToString(sealed[:len(sealed)-16]) + "." + base64.RawURLEncoding.EncodeToString(sealed[len(sealed)-16:])
+	token := Token{Type: ClevisTokenType, Payload: []byte(compact)}
+
+	_, err = clevisPassphrase(context.Background(), token)
+	require.Error(t, err)
+
+	RegisterClevisPin("test", func(ctx context.Context, config json.RawMessage) ([]byte, error) {
+		var cfg struct {
+			Key string `json:"key"`
+		}
+		if err := json.Unmarshal(config, &cfg); err != nil {
+			return nil, err
+		}
+		return base64.RawURLEncoding.DecodeString(cfg.Key)
+	})
+	defer RegisterClevisPin("test", nil)
+
+	passphrase, err := clevisPassphrase(context.Background(), token)
+	require.NoError(t, err)
+	require.Equal(t, "pin passphrase", string(passphrase))
+}
@@ -0,0 +1,220 @@
+// Package clevistpm2 implements the clevis tpm2 pin. Importing the package registers the pin with
+// luks.RegisterClevisPin so Unlocker.UnlockWithClevis can unlock volumes bound to the TPM (directly or as a share
+// of the sss pin).
+//
+// The pin lives in a separate package to keep the TPM dependencies out of the core library.
+package clevistpm2
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/anatol/luks.go"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Device is the path of the TPM device. The in-kernel resource manager is used by default so the pin can be
+// used concurrently with other TPM clients.
+var Device = "/dev/tpmrm0"
+
+// config is the "tpm2" pin configuration stored by `clevis encrypt tpm2`
+type config struct {
+	Hash    string          `json:"hash"`
+	Key     string          `json:"key"`
+	JwkPub  string          `json:"jwk_pub"`
+	JwkPriv string          `json:"jwk_priv"`
+	PcrBank string          `json:"pcr_bank"`
+	PcrIds  json.RawMessage `json:"pcr_ids"`
+}
+
+func init() {
+	luks.RegisterClevisPin("tpm2", decrypt)
+}
+
+// decrypt unseals the JWK stored at the TPM object and returns its key
+func decrypt(ctx context.Context, raw json.RawMessage) ([]byte, error) {
+	var cfg config
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid tpm2 pin configuration: %v", err)
+	}
+	hashAlg, err := algorithm(cfg.Hash)
+	if err != nil {
+		return nil, err
+	}
+	pcrBank, err := algorithm(cfg.PcrBank)
+	if err != nil {
+		return nil, err
+	}
+	pcrs, err := parsePCRs(cfg.PcrIds)
+	if err != nil {
+		return nil, err
+	}
+	template, err := primaryTemplate(cfg.Key, hashAlg)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := decodeBlob(cfg.JwkPub)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tpm2 pin jwk_pub: %v", err)
+	}
+	priv, err := decodeBlob(cfg.JwkPriv)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tpm2 pin jwk_priv: %v", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	rw, err := tpm2.OpenTPM(Device)
+	if err != nil {
+		return nil, err
+	}
+	defer rw.Close()
+
+	parent, _, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", template)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create primary key: %v", err)
+	}
+	defer tpm2.FlushContext(rw, parent)
+
+	object, _, err := tpm2.Load(rw, parent, "", pub, priv)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load sealed object: %v", err)
+	}
+	defer tpm2.FlushContext(rw, object)
+
+	var data []byte
+	if len(pcrs) == 0 {
+		data, err = tpm2.Unseal(rw, object, "")
+	} else {
+		data, err = unsealWithPCRPolicy(rw, object, hashAlg, tpm2.PCRSelection{Hash: pcrBank, PCRs: pcrs})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to unseal: %v", err)
+	}
+	defer clearSlice(data)
+
+	var key struct {
+		Kty string `json:"kty"`
+		K   string `json:"k"`
+	}
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, fmt.Errorf("invalid unsealed JWK: %v", err)
+	}
+	if key.Kty != "oct" {
+		return nil, fmt.Errorf("unsupported unsealed JWK type %q", key.Kty)
+	}
+	return base64.RawURLEncoding.DecodeString(key.K)
+}
+
+// unsealWithPCRPolicy unseals the object in a policy session that satisfies the PCR policy
+func unsealWithPCRPolicy(rw io.ReadWriter, object tpmutil.Handle, hashAlg tpm2.Algorithm, sel tpm2.PCRSelection) ([]byte, error) {
+	session, _, err := tpm2.StartAuthSession(rw, tpm2.HandleNull, tpm2.HandleNull, make([]byte, 16), nil, tpm2.SessionPolicy, tpm2.AlgNull, hashAlg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start policy session: %v", err)
+	}
+	defer tpm2.FlushContext(rw, session)
+
+	if err := tpm2.PolicyPCR(rw, session, nil, sel); err != nil {
+		return nil, fmt.Errorf("unable to apply PCR policy: %v", err)
+	}
+	return tpm2.UnsealWithSession(rw, session, object, "")
+}
+
+func algorithm(name string) (tpm2.Algorithm, error) {
+	switch name {
+	case "sha1":
+		return tpm2.AlgSHA1, nil
+	case "", "sha256":
+		return tpm2.AlgSHA256, nil
+	case "sha384":
+		return tpm2.AlgSHA384, nil
+	case "sha512":
+		return tpm2.AlgSHA512, nil
+	default:
+		return 0, fmt.Errorf("unsupported tpm2 pin hash algorithm %q", name)
+	}
+}
+
+// primaryTemplate returns the primary key template matching tpm2-tools defaults that clevis uses
+func primaryTemplate(key string, nameAlg tpm2.Algorithm) (tpm2.Public, error) {
+	attrs := tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth |
+		tpm2.FlagRestricted | tpm2.FlagDecrypt
+	symmetric := &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB}
+
+	switch key {
+	case "", "ecc":
+		return tpm2.Public{
+			Type:          tpm2.AlgECC,
+			NameAlg:       nameAlg,
+			Attributes:    attrs,
+			ECCParameters: &tpm2.ECCParams{Symmetric: symmetric, CurveID: tpm2.CurveNISTP256},
+		}, nil
+	case "rsa":
+		return tpm2.Public{
+			Type:          tpm2.AlgRSA,
+			NameAlg:       nameAlg,
+			Attributes:    attrs,
+			RSAParameters: &tpm2.RSAParams{Symmetric: symmetric, KeyBits: 2048},
+		}, nil
+	default:
+		return tpm2.Public{}, fmt.Errorf("unsupported tpm2 pin key type %q", key)
+	}
+}
+
+// parsePCRs parses the PCR list, clevis stores it as a comma separated string e.g. "0,7"
+func parsePCRs(raw json.RawMessage) ([]int, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var list []int
+	if err := json.Unmarshal(raw, &list); err == nil {
+		return list, nil
+	}
+	var single int
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return []int{single}, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, fmt.Errorf("invalid tpm2 pin pcr_ids: %s", raw)
+	}
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		pcr, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tpm2 pin pcr_ids: %v", s)
+		}
+		list = append(list, pcr)
+	}
+	return list, nil
+}
+
+// decodeBlob decodes TPM2B_PUBLIC/TPM2B_PRIVATE as written by tpm2_create and strips its size prefix,
+// go-tpm adds it back when the object is loaded
+func decodeBlob(s string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 2 || int(binary.BigEndian.Uint16(b)) != len(b)-2 {
+		return nil, fmt.Errorf("invalid TPM2B size")
+	}
+	return b[2:], nil
+}
+
+func clearSlice(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
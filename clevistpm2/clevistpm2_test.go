@@ -0,0 +1,40 @@
+package clevistpm2
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePCRs(t *testing.T) {
+	for raw, expected := range map[string][]int{
+		`"0,7"`:   {0, 7},
+		`"7"`:     {7},
+		`7`:       {7},
+		`[1,2,3]`: {1, 2, 3},
+		`""`:      nil,
+	} {
+		pcrs, err := parsePCRs(json.RawMessage(raw))
+		require.NoError(t, err, raw)
+		require.Equal(t, expected, pcrs, raw)
+	}
+	pcrs, err := parsePCRs(nil)
+	require.NoError(t, err)
+	require.Nil(t, pcrs)
+
+	_, err = parsePCRs(json.RawMessage(`"0,x"`))
+	require.Error(t, err)
+}
+
+func TestDecodeBlob(t *testing.T) {
+	b, err := decodeBlob(base64.RawURLEncoding.EncodeToString([]byte{0, 3, 1, 2, 3}))
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, b)
+
+	_, err = decodeBlob(base64.RawURLEncoding.EncodeToString([]byte{0, 4, 1, 2, 3}))
+	require.Error(t, err)
+	_, err = decodeBlob("!")
+	require.Error(t, err)
+}
@@ -0,0 +1,163 @@
+package crypttab
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/anatol/luks.go"
+)
+
+// ActivateOptions controls Activate
+type ActivateOptions struct {
+	// Concurrency is the number of entries activated in parallel, 0 means 1. Note that passphrase providers that
+	// interact with the user (e.g. a terminal prompt) should not be used concurrently.
+	Concurrency int
+	// Passphrase provides passphrases for entries without a keyfile. Such entries fail if it is nil.
+	Passphrase luks.PassphraseProvider
+	// IncludeNoAuto activates entries with the `noauto` option too, they are skipped by default
+	IncludeNoAuto bool
+}
+
+// Result is the outcome of an entry activation
+type Result struct {
+	Entry Entry
+	// Skipped is set for `noauto` entries that were not activated
+	Skipped bool
+	Err     error
+}
+
+// Activate activates the entries and returns results in the order of entries. The error is non-nil if activation
+// of an entry without the `nofail` option failed.
+func Activate(ctx context.Context, entries []Entry, opts ActivateOptions) ([]Result, error) {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	results := make([]Result, len(entries))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, e := range entries {
+		results[i].Entry = e
+		if e.Options.NoAuto && !opts.IncludeNoAuto {
+			results[i].Skipped = true
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, e Entry) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i].Err = activateEntry(ctx, e, opts.Passphrase)
+		}(i, e)
+	}
+	wg.Wait()
+
+	var failed []string
+	for _, r := range results {
+		if r.Err != nil && !r.Entry.Options.NoFail {
+			failed = append(failed, r.Entry.Name)
+		}
+	}
+	if len(failed) != 0 {
+		return results, fmt.Errorf("unable to activate %s", strings.Join(failed, ", "))
+	}
+	return results, nil
+}
+
+// activateEntry unlocks a single entry, it is a variable to be replaced in tests
+var activateEntry = func(ctx context.Context, e Entry, provider luks.PassphraseProvider) error {
+	if e.Options.Type != "luks" {
+		return fmt.Errorf("%s: %s volumes are not supported", e.Name, e.Options.Type)
+	}
+	source, err := ResolveSource(e.Source)
+	if err != nil {
+		return fmt.Errorf("%s: %w", e.Name, err)
+	}
+
+	var dev luks.Device
+	if e.Options.Header != "" {
+		dev, err = luks.OpenWithHeader(e.Options.Header, source)
+	} else {
+		dev, err = luks.Open(source)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", e.Name, err)
+	}
+	defer dev.Close()
+
+	if flags := e.Options.flags(); len(flags) != 0 {
+		if err := dev.FlagsAdd(flags...); err != nil {
+			return fmt.Errorf("%s: %w", e.Name, err)
+		}
+	}
+
+	if e.KeyFile != "" {
+		f, err := os.Open(e.KeyFile)
+		if err != nil {
+			return fmt.Errorf("%s: %w", e.Name, err)
+		}
+		defer f.Close()
+		u, ok := dev.(luks.Unlocker)
+		if !ok {
+			return fmt.Errorf("%s: device does not support keyfile unlocking", e.Name)
+		}
+		err = u.UnlockWithKeyfile(e.Options.KeySlot, f, e.Options.KeyfileOffset, e.Options.KeyfileSize, e.Name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", e.Name, err)
+		}
+		return nil
+	}
+
+	if provider == nil {
+		return fmt.Errorf("%s: no keyfile and no passphrase provider", e.Name)
+	}
+	if e.Options.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.Options.Timeout)
+		defer cancel()
+	}
+	tries := e.Options.Tries
+	if tries == 0 {
+		tries = math.MaxInt32
+	}
+	opts := luks.ProviderUnlockOptions{
+		Tries:  tries,
+		Prompt: fmt.Sprintf("Please enter passphrase for disk %s (%s):", e.Name, e.Source),
+	}
+	if e.Options.KeySlot >= 0 {
+		keyslot := e.Options.KeySlot
+		opts.Keyslot = &keyslot
+	}
+	err = luks.UnlockWithProvider(ctx, dev, provider, e.Name, opts)
+	if err != nil {
+		return fmt.Errorf("%s: %w", e.Name, err)
+	}
+	return nil
+}
+
+// flags returns dm-crypt flags for the options
+func (o Options) flags() []string {
+	var flags []string
+	for _, f := range []struct {
+		set  bool
+		flag string
+	}{
+		{o.Discard, luks.FlagAllowDiscards},
+		{o.ReadOnly, luks.FlagReadOnly},
+		{o.SameCPUCrypt, luks.FlagSameCPUCrypt},
+		{o.SubmitFromCryptCPUs, luks.FlagSubmitFromCryptCPUs},
+		{o.NoReadWorkqueue, luks.FlagNoReadWorkqueue},
+		{o.NoWriteWorkqueue, luks.FlagNoWriteWorkqueue},
+	} {
+		if f.set {
+			flags = append(flags, f.flag)
+		}
+	}
+	return flags
+}
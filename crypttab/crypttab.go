@@ -0,0 +1,210 @@
+// Package crypttab parses /etc/crypttab (see crypttab(5)) and activates its LUKS entries with luks.go. Together with
+// a passphrase provider it allows to set up encrypted volumes at boot without systemd-cryptsetup.
+package crypttab
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry is a single crypttab line
+type Entry struct {
+	// Name of the device mapper volume
+	Name string
+	// Source device as written in crypttab e.g. /dev/sda2 or UUID=..., see ResolveSource
+	Source string
+	// KeyFile is the path of the keyfile, empty if the passphrase needs to be asked ("none" or "-" in crypttab)
+	KeyFile string
+	Options Options
+}
+
+// Options are the parsed crypttab options
+type Options struct {
+	// Type is the volume type: "luks" (also the default when no type is given), "plain", "tcrypt" or "bitlk".
+	// Only LUKS volumes can be activated.
+	Type string
+	// Header is the path of a detached LUKS header
+	Header string
+	// KeyfileOffset and KeyfileSize follow cryptsetup --keyfile-offset/--keyfile-size, 0 size reads till EOF
+	KeyfileOffset int64
+	KeyfileSize   int64
+	// KeySlot restricts unlocking to the keyslot, -1 tries all keyslots
+	KeySlot int
+	// Tries is the number of passphrase attempts, 0 means unlimited
+	Tries int
+	// Timeout of the passphrase query, 0 means no timeout
+	Timeout time.Duration
+
+	Discard             bool
+	ReadOnly            bool
+	SameCPUCrypt        bool
+	SubmitFromCryptCPUs bool
+	NoReadWorkqueue     bool
+	NoWriteWorkqueue    bool
+	// NoFail marks entries whose activation failure is not fatal
+	NoFail bool
+	// NoAuto marks entries that are not activated automatically at boot
+	NoAuto bool
+
+	// Other contains the options unknown to this package (e.g. tpm2-device=auto), valueless options map to ""
+	Other map[string]string
+}
+
+// DefaultTries is the number of passphrase attempts if the `tries=` option is not set, the same as systemd uses
+const DefaultTries = 3
+
+// ParseFile parses the crypttab file at path
+func ParseFile(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Parse parses crypttab content. Empty lines and lines starting with '#' are ignored.
+func Parse(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		e, err := parseEntry(text)
+		if err != nil {
+			return nil, fmt.Errorf("crypttab line %d: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func parseEntry(text string) (Entry, error) {
+	fields := strings.Fields(text)
+	if len(fields) < 2 || len(fields) > 4 {
+		return Entry{}, fmt.Errorf("expected 2 to 4 fields, got %d", len(fields))
+	}
+	e := Entry{Name: fields[0], Source: fields[1]}
+	if len(fields) > 2 && fields[2] != "none" && fields[2] != "-" {
+		e.KeyFile = fields[2]
+	}
+	var options string
+	if len(fields) > 3 {
+		options = fields[3]
+	}
+	var err error
+	e.Options, err = parseOptions(options)
+	return e, err
+}
+
+func parseOptions(s string) (Options, error) {
+	opts := Options{Type: "luks", KeySlot: -1, Tries: DefaultTries}
+	if s == "" || s == "-" {
+		return opts, nil
+	}
+
+	for _, opt := range strings.Split(s, ",") {
+		if opt == "" {
+			continue
+		}
+		key, value := opt, ""
+		if i := strings.IndexByte(opt, '='); i != -1 {
+			key, value = opt[:i], opt[i+1:]
+		}
+
+		var err error
+		switch key {
+		case "luks", "plain", "tcrypt", "bitlk":
+			opts.Type = key
+		case "header":
+			opts.Header = value
+		case "keyfile-offset":
+			opts.KeyfileOffset, err = strconv.ParseInt(value, 10, 64)
+		case "keyfile-size":
+			opts.KeyfileSize, err = strconv.ParseInt(value, 10, 64)
+		case "key-slot", "keyslot":
+			opts.KeySlot, err = strconv.Atoi(value)
+		case "tries":
+			opts.Tries, err = strconv.Atoi(value)
+		case "timeout":
+			opts.Timeout, err = parseTimespan(value)
+		case "discard":
+			opts.Discard = true
+		case "readonly", "read-only":
+			opts.ReadOnly = true
+		case "same-cpu-crypt":
+			opts.SameCPUCrypt = true
+		case "submit-from-crypt-cpus":
+			opts.SubmitFromCryptCPUs = true
+		case "no-read-workqueue":
+			opts.NoReadWorkqueue = true
+		case "no-write-workqueue":
+			opts.NoWriteWorkqueue = true
+		case "nofail":
+			opts.NoFail = true
+		case "noauto":
+			opts.NoAuto = true
+		default:
+			if opts.Other == nil {
+				opts.Other = make(map[string]string)
+			}
+			opts.Other[key] = value
+		}
+		if err != nil {
+			return Options{}, fmt.Errorf("invalid option %q: %v", opt, err)
+		}
+		if opts.KeyfileOffset < 0 || opts.KeyfileSize < 0 || opts.Tries < 0 {
+			return Options{}, fmt.Errorf("invalid option %q", opt)
+		}
+	}
+	return opts, nil
+}
+
+// parseTimespan parses a systemd time span, a plain number is seconds
+func parseTimespan(s string) (time.Duration, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return time.Duration(n) * time.Second, nil
+	}
+	return time.ParseDuration(strings.NewReplacer("min", "m", "sec", "s").Replace(s))
+}
+
+// DiskDir is the udev directory with the persistent device symlinks used by ResolveSource
+var DiskDir = "/dev/disk"
+
+// ResolveSource returns the device path of a crypttab source. UUID=, PARTUUID=, LABEL= and PARTLABEL= sources are
+// resolved with the udev symlinks at DiskDir, other sources are paths already.
+func ResolveSource(source string) (string, error) {
+	prefixes := []struct{ tag, dir string }{
+		{"UUID=", "by-uuid"},
+		{"PARTUUID=", "by-partuuid"},
+		{"LABEL=", "by-label"},
+		{"PARTLABEL=", "by-partlabel"},
+	}
+	for _, p := range prefixes {
+		if !strings.HasPrefix(source, p.tag) {
+			continue
+		}
+		value := strings.TrimPrefix(source, p.tag)
+		if p.tag == "UUID=" || p.tag == "PARTUUID=" {
+			value = strings.ToLower(value)
+		}
+		link := filepath.Join(DiskDir, p.dir, value)
+		path, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			return "", fmt.Errorf("unable to resolve %s: %v", source, err)
+		}
+		return path, nil
+	}
+	return source, nil
+}
@@ -0,0 +1,141 @@
+package crypttab
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anatol/luks.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	content := `
+# comment
+root  UUID=0d6f4a9b-1c5e-4f1a-9d5e-6b0a1f0c2d3e  none  luks,discard,tries=0,timeout=30
+data  /dev/sdb1  /etc/keys/data.key  header=/boot/data.hdr,keyfile-offset=1024,keyfile-size=512,key-slot=2,nofail,tpm2-device=auto
+swap  PARTUUID=ABCD  -  plain,noauto,timeout=2min
+home  LABEL=home
+`
+	entries, err := Parse(strings.NewReader(content))
+	require.NoError(t, err)
+	require.Equal(t, []Entry{
+		{
+			Name:    "root",
+			Source:  "UUID=0d6f4a9b-1c5e-4f1a-9d5e-6b0a1f0c2d3e",
+			Options: Options{Type: "luks", KeySlot: -1, Tries: 0, Timeout: 30 * time.Second, Discard: true},
+		},
+		{
+			Name:    "data",
+			Source:  "/dev/sdb1",
+			KeyFile: "/etc/keys/data.key",
+			Options: Options{
+				Type: "luks", Header: "/boot/data.hdr", KeyfileOffset: 1024, KeyfileSize: 512, KeySlot: 2,
+				Tries: DefaultTries, NoFail: true, Other: map[string]string{"tpm2-device": "auto"},
+			},
+		},
+		{
+			Name:    "swap",
+			Source:  "PARTUUID=ABCD",
+			Options: Options{Type: "plain", KeySlot: -1, Tries: DefaultTries, Timeout: 2 * time.Minute, NoAuto: true},
+		},
+		{
+			Name:    "home",
+			Source:  "LABEL=home",
+			Options: Options{Type: "luks", KeySlot: -1, Tries: DefaultTries},
+		},
+	}, entries)
+
+	for _, invalid := range []string{
+		"root",
+		"root /dev/sda a b c",
+		"root /dev/sda none keyfile-offset=abc",
+		"root /dev/sda none keyfile-size=-1",
+		"root /dev/sda none timeout=forever",
+	} {
+		_, err := Parse(strings.NewReader(invalid))
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestResolveSource(t *testing.T) {
+	dir := t.TempDir()
+	defer func(orig string) { DiskDir = orig }(DiskDir)
+	DiskDir = dir
+
+	dev := filepath.Join(dir, "sda2")
+	require.NoError(t, os.WriteFile(dev, nil, 0o644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "by-uuid"), 0o755))
+	require.NoError(t, os.Symlink("../sda2", filepath.Join(dir, "by-uuid", "0d6f4a9b-1c5e")))
+
+	path, err := ResolveSource("UUID=0D6F4A9B-1C5E")
+	require.NoError(t, err)
+	require.Equal(t, dev, path)
+
+	path, err = ResolveSource("/dev/sdc")
+	require.NoError(t, err)
+	require.Equal(t, "/dev/sdc", path)
+
+	_, err = ResolveSource("PARTUUID=missing")
+	require.Error(t, err)
+}
+
+func TestActivate(t *testing.T) {
+	defer func(orig func(context.Context, Entry, luks.PassphraseProvider) error) { activateEntry = orig }(activateEntry)
+
+	var (
+		mu               sync.Mutex
+		running, maxSeen int
+		activated        []string
+	)
+	activateEntry = func(_ context.Context, e Entry, _ luks.PassphraseProvider) error {
+		mu.Lock()
+		running++
+		if running > maxSeen {
+			maxSeen = running
+		}
+		activated = append(activated, e.Name)
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if strings.HasPrefix(e.Name, "bad") {
+			return errors.New("failed")
+		}
+		return nil
+	}
+
+	entries := []Entry{
+		{Name: "a"},
+		{Name: "b"},
+		{Name: "bad-optional", Options: Options{NoFail: true}},
+		{Name: "manual", Options: Options{NoAuto: true}},
+		{Name: "c"},
+	}
+	results, err := Activate(context.Background(), entries, ActivateOptions{Concurrency: 2})
+	require.NoError(t, err)
+	require.Len(t, results, len(entries))
+	require.Equal(t, 2, maxSeen)
+	require.ElementsMatch(t, []string{"a", "b", "bad-optional", "c"}, activated)
+	require.Error(t, results[2].Err)
+	require.True(t, results[3].Skipped)
+
+	_, err = Activate(context.Background(), []Entry{{Name: "a"}, {Name: "bad"}}, ActivateOptions{})
+	require.Error(t, err)
+	require.Equal(t, "unable to activate bad", err.Error())
+}
+
+func TestActivateEntryErrors(t *testing.T) {
+	err := activateEntry(context.Background(), Entry{Name: "swap", Source: "/dev/sdb", Options: Options{Type: "plain"}}, nil)
+	require.Error(t, err)
+	err = activateEntry(context.Background(), Entry{Name: "root", Source: filepath.Join(t.TempDir(), "missing"), Options: Options{Type: "luks"}}, nil)
+	require.Error(t, err)
+}
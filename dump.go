@@ -0,0 +1,211 @@
+package luks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// dumpDevice renders the device metadata in the `cryptsetup luksDump` LUKS2 format. LUKS v1 devices are rendered
+// in the same format so tools can parse reports of both versions alike.
+func dumpDevice(w io.Writer, d device) error {
+	segments, err := d.Segments()
+	if err != nil {
+		return err
+	}
+	digests, err := d.Digests()
+	if err != nil {
+		return err
+	}
+	tokens, err := d.Tokens()
+	if err != nil {
+		return err
+	}
+	layout, err := d.KeyslotLayout()
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	b.WriteString("LUKS header information\n")
+	fmt.Fprintf(&b, "Version:       \t%d\n", d.Version())
+	if v2, ok := d.(*deviceV2); ok {
+		fmt.Fprintf(&b, "Epoch:         \t%d\n", v2.hdr.SequenceID)
+		fmt.Fprintf(&b, "Metadata area: \t%d [bytes]\n", v2.hdr.HeaderSize)
+	}
+	fmt.Fprintf(&b, "Keyslots area: \t%d [bytes]\n", layout.RegionSize)
+	fmt.Fprintf(&b, "UUID:          \t%s\n", d.UUID())
+	if d.Version() == 2 {
+		fmt.Fprintf(&b, "Label:         \t%s\n", orNone(d.Label(), "(no label)"))
+		fmt.Fprintf(&b, "Subsystem:     \t%s\n", orNone(d.Subsystem(), "(no subsystem)"))
+	}
+	fmt.Fprintf(&b, "Flags:       \t%s\n", orNone(strings.Join(d.Flags(), " "), "(no flags)"))
+
+	b.WriteString("\nData segments:\n")
+	for _, s := range segments {
+		fmt.Fprintf(&b, "  %d: %s\n", s.ID, s.Type)
+		fmt.Fprintf(&b, "\toffset: %d [bytes]\n", s.Offset)
+		if s.Dynamic {
+			b.WriteString("\tlength: (whole device)\n")
+		} else {
+			fmt.Fprintf(&b, "\tlength: %d [bytes]\n", s.Size)
+		}
+		fmt.Fprintf(&b, "\tcipher: %s\n", s.Encryption)
+		fmt.Fprintf(&b, "\tsector: %d [bytes]\n", s.SectorSize)
+		if s.Integrity != "" {
+			fmt.Fprintf(&b, "\tintegrity: %s\n", s.Integrity)
+		}
+	}
+
+	keyslots, err := usedKeyslots(d)
+	if err != nil {
+		return err
+	}
+
+	b.WriteString("\nKeyslots:\n")
+	for _, ks := range keyslots {
+		fmt.Fprintf(&b, "  %d: luks%d\n", ks.ID, d.Version())
+		if ks.State == KeyslotStateUnbound {
+			b.WriteString("\t(unbound)\n")
+		}
+		fmt.Fprintf(&b, "\tKey:        %d bits\n", ks.KeySize*8)
+		fmt.Fprintf(&b, "\tPriority:   %s\n", ks.Priority)
+		fmt.Fprintf(&b, "\tCipher:     %s\n", ks.AreaEncryption)
+		fmt.Fprintf(&b, "\tCipher key: %d bits\n", ks.AreaKeySize*8)
+		fmt.Fprintf(&b, "\tPBKDF:      %s\n", ks.Kdf.Type)
+		if ks.Kdf.Type == "pbkdf2" {
+			fmt.Fprintf(&b, "\tHash:       %s\n", ks.Kdf.Hash)
+			fmt.Fprintf(&b, "\tIterations: %d\n", ks.Kdf.Iterations)
+		} else {
+			fmt.Fprintf(&b, "\tTime cost:  %d\n", ks.Kdf.Time)
+			fmt.Fprintf(&b, "\tMemory:     %d\n", ks.Kdf.Memory)
+			fmt.Fprintf(&b, "\tThreads:    %d\n", ks.Kdf.Threads)
+		}
+		fmt.Fprintf(&b, "\tSalt:       %s\n", dumpHex(ks.KdfSalt))
+		fmt.Fprintf(&b, "\tAF stripes: %d\n", ks.AfStripes)
+		fmt.Fprintf(&b, "\tAF hash:    %s\n", ks.AfHash)
+		fmt.Fprintf(&b, "\tArea offset:%d [bytes]\n", ks.Area.Offset)
+		fmt.Fprintf(&b, "\tArea length:%d [bytes]\n", ks.Area.Size)
+		for _, dig := range digests {
+			if containsInt(dig.Keyslots, ks.ID) {
+				fmt.Fprintf(&b, "\tDigest ID:  %d\n", dig.ID)
+			}
+		}
+	}
+
+	b.WriteString("Tokens:\n")
+	for _, t := range tokens {
+		fmt.Fprintf(&b, "  %d: %s\n", t.ID, t.Type)
+		for _, s := range t.Slots {
+			fmt.Fprintf(&b, "\tKeyslot:    %d\n", s)
+		}
+	}
+
+	b.WriteString("Digests:\n")
+	for _, dig := range digests {
+		fmt.Fprintf(&b, "  %d: %s\n", dig.ID, dig.Type)
+		fmt.Fprintf(&b, "\tHash:       %s\n", dig.Hash)
+		fmt.Fprintf(&b, "\tIterations: %d\n", dig.Iterations)
+		fmt.Fprintf(&b, "\tSalt:       %s\n", dumpHex(dig.Salt))
+		fmt.Fprintf(&b, "\tDigest:     %s\n", dumpHex(dig.Digest))
+	}
+
+	_, err = w.Write(b.Bytes())
+	return err
+}
+
+// usedKeyslots returns information about active and unbound keyslots sorted by id
+func usedKeyslots(d device) ([]KeyslotInfo, error) {
+	layout, err := d.KeyslotLayout()
+	if err != nil {
+		return nil, err
+	}
+
+	var keyslots []KeyslotInfo
+	for _, a := range layout.Areas {
+		ks, err := d.Keyslot(a.Keyslot)
+		if err != nil {
+			return nil, err
+		}
+		if ks.State != KeyslotStateInactive {
+			keyslots = append(keyslots, ks)
+		}
+	}
+	return keyslots, nil
+}
+
+// deviceView is the normalized JSON view of the device metadata
+type deviceView struct {
+	Version   int
+	UUID      string
+	Label     string `json:",omitempty"`
+	Subsystem string `json:",omitempty"`
+	Flags     []string
+	Keyslots  []KeyslotInfo
+	Tokens    []tokenView
+	Segments  []SegmentInfo
+	Digests   []DigestInfo
+}
+
+// tokenView is a Token with the payload encoded as a JSON object rather than base64 string
+type tokenView struct {
+	ID      int
+	Slots   []int
+	Type    string
+	Payload json.RawMessage
+}
+
+func marshalDevice(d device) ([]byte, error) {
+	view := deviceView{
+		Version:   d.Version(),
+		UUID:      d.UUID(),
+		Label:     d.Label(),
+		Subsystem: d.Subsystem(),
+		Flags:     d.Flags(),
+	}
+
+	var err error
+	if view.Keyslots, err = usedKeyslots(d); err != nil {
+		return nil, err
+	}
+	if view.Segments, err = d.Segments(); err != nil {
+		return nil, err
+	}
+	if view.Digests, err = d.Digests(); err != nil {
+		return nil, err
+	}
+	tokens, err := d.Tokens()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		view.Tokens = append(view.Tokens, tokenView{ID: t.ID, Slots: t.Slots, Type: t.Type, Payload: t.Payload})
+	}
+
+	return json.Marshal(view)
+}
+
+// dumpHex formats binary data as space separated hex bytes, 16 bytes per line
+func dumpHex(data []byte) string {
+	var b strings.Builder
+	for i, c := range data {
+		if i != 0 {
+			if i%16 == 0 {
+				b.WriteString("\n\t            ")
+			} else {
+				b.WriteByte(' ')
+			}
+		}
+		fmt.Fprintf(&b, "%02x", c)
+	}
+	return b.String()
+}
+
+func orNone(s, none string) string {
+	if s == "" {
+		return none
+	}
+	return s
+}
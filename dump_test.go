@@ -0,0 +1,76 @@
+package luks
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDump(t *testing.T) {
+	disk1, _ := createLuks1Fixture(t, "foobar")
+	disk2, _ := createLuks2Fixture(t, "foobar")
+
+	for _, disk := range []*os.File{disk1, disk2} {
+		dev, err := Open(disk.Name())
+		require.NoError(t, err)
+		defer dev.Close()
+
+		var report bytes.Buffer
+		require.NoError(t, dev.(Inspector).DumpTo(&report))
+		out := report.String()
+		require.Contains(t, out, "UUID:          \t"+dev.UUID()+"\n")
+		require.Contains(t, out, "\tcipher: aes-xts-plain64\n")
+		require.Contains(t, out, "\tlength: (whole device)\n")
+		require.Contains(t, out, "  0: luks")
+		require.Contains(t, out, "\tPBKDF:      pbkdf2\n")
+		require.Contains(t, out, "\tDigest ID:  0\n")
+		require.NotContains(t, out, "  1: luks")
+
+		params, err := dev.(Inspector).MasterKeyDigestParams()
+		require.NoError(t, err)
+		require.Contains(t, out, "\tDigest:     "+dumpHex(params.Digest)+"\n")
+	}
+}
+
+func TestDumpHex(t *testing.T) {
+	require.Equal(t, "", dumpHex(nil))
+	require.Equal(t, "00 01 ff", dumpHex([]byte{0, 1, 0xff}))
+	data := make([]byte, 17)
+	require.Equal(t, "00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00\n\t            00", dumpHex(data))
+}
+
+func TestMarshalJSON(t *testing.T) {
+	disk1, _ := createLuks1Fixture(t, "foobar")
+	disk2, _ := createLuks2Fixture(t, "foobar")
+
+	for _, disk := range []*os.File{disk1, disk2} {
+		dev, err := Open(disk.Name())
+		require.NoError(t, err)
+		defer dev.Close()
+
+		data, err := json.Marshal(dev)
+		require.NoError(t, err)
+
+		var view struct {
+			Version  int
+			UUID     string
+			Keyslots []KeyslotInfo
+			Segments []SegmentInfo
+			Digests  []DigestInfo
+		}
+		require.NoError(t, json.Unmarshal(data, &view))
+		require.Equal(t, dev.Version(), view.Version)
+		require.Equal(t, dev.UUID(), view.UUID)
+		require.Len(t, view.Keyslots, 1)
+		require.Equal(t, KeyslotStateActive, view.Keyslots[0].State)
+		segments, err := dev.(Inspector).Segments()
+		require.NoError(t, err)
+		require.Equal(t, segments, view.Segments)
+		digests, err := dev.(Inspector).Digests()
+		require.NoError(t, err)
+		require.Equal(t, digests, view.Digests)
+	}
+}
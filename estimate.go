@@ -0,0 +1,174 @@
+package luks
+
+import (
+	"fmt"
+	"hash"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// minimal duration of a KDF micro-benchmark, shorter runs are dominated by timer and scheduling noise
+const kdfBenchmarkDuration = 10 * time.Millisecond
+
+// estimatePbkdf2 estimates time needed to derive a key of keyLength bytes with the given number of pbkdf2 iterations.
+// It runs pbkdf2 on the current CPU and scales the result linearly.
+func estimatePbkdf2(h func() hash.Hash, iterations int, keyLength int) time.Duration {
+	if iterations <= 0 {
+		return 0
+	}
+	// every output block of the hash size needs its own run of iterations
+	hashSize := h().Size()
+	blocks := (keyLength + hashSize - 1) / hashSize
+
+	password := []byte("benchmark")
+	salt := make([]byte, 32)
+	for n := 1000; ; n *= 2 {
+		start := time.Now()
+		pbkdf2.Key(password, salt, n, hashSize, h)
+		elapsed := time.Since(start)
+		if elapsed >= kdfBenchmarkDuration || n >= iterations {
+			return time.Duration(float64(elapsed) / float64(n) * float64(iterations) * float64(blocks))
+		}
+	}
+}
+
+// estimateArgon2 estimates time needed to run argon2 with the given parameters (memory is in KiB).
+// The benchmark uses a single pass over a limited amount of memory and the result is scaled linearly
+// with time and memory costs.
+func estimateArgon2(kdfType string, timeCost, memory, threads uint32) time.Duration {
+	if timeCost == 0 || memory == 0 {
+		return 0
+	}
+	if threads == 0 {
+		threads = 1
+	}
+	if threads > 255 {
+		threads = 255
+	}
+
+	benchMemory := memory
+	if benchMemory > 16*1024 {
+		benchMemory = 16 * 1024
+	}
+	// argon2 requires at least 8 KiB of memory per thread
+	if benchMemory < 8*threads {
+		benchMemory = 8 * threads
+	}
+
+	password := []byte("benchmark")
+	salt := make([]byte, 32)
+	start := time.Now()
+	if kdfType == "argon2i" {
+		argon2.Key(password, salt, 1, benchMemory, uint8(threads), 32)
+	} else {
+		argon2.IDKey(password, salt, 1, benchMemory, uint8(threads), 32)
+	}
+	elapsed := time.Since(start)
+
+	return time.Duration(float64(elapsed) * float64(timeCost) * float64(memory) / float64(benchMemory))
+}
+
+// pbkdf2IterationsFor returns the number of pbkdf2 iterations that takes approximately the given time on the current
+// CPU, similar to cryptsetup --iter-time. The result is never lower than minIterations.
+func pbkdf2IterationsFor(h func() hash.Hash, keyLength int, target time.Duration, minIterations int) int {
+	const probe = 1000000
+	elapsed := estimatePbkdf2(h, probe, keyLength)
+	if elapsed <= 0 {
+		return minIterations
+	}
+	iterations := int(float64(probe) * float64(target) / float64(elapsed))
+	if iterations < minIterations {
+		return minIterations
+	}
+	return iterations
+}
+
+// KdfBenchmark is the result of BenchmarkKdf
+type KdfBenchmark struct {
+	// Params are the benchmarked parameters with the cost adjusted to take approximately the target time
+	Params KdfParams
+	// IterationsPerSecond is the measured pbkdf2 speed for a key of the hash size, it is 0 for argon2
+	IterationsPerSecond int
+	// Duration is the estimated time of a key derivation with Params
+	Duration time.Duration
+}
+
+// Limits of the argon2 parameters picked by BenchmarkKdf, the same as cryptsetup uses
+const (
+	benchmarkArgon2MinTime   = 4
+	benchmarkArgon2MaxMemory = 1048576 // 1GiB in KiB
+	benchmarkArgon2MinMemory = 32
+	benchmarkArgon2Threads   = 4
+)
+
+// BenchmarkKdf measures the KDF on the current machine and finds the cost parameters that take approximately
+// targetTime, similar to `cryptsetup benchmark` and `cryptsetup --iter-time`.
+//
+// For pbkdf2 spec.Hash (sha256 by default) is benchmarked and the number of iterations is set. For argon2 spec.Memory
+// and spec.Threads are the upper limits of the memory cost (1GiB and 4 by default). Like cryptsetup, the time cost
+// grows with targetTime while the memory cost is reduced only if the minimal time cost of 4 is still too slow.
+func BenchmarkKdf(spec KdfParams, targetTime time.Duration) (KdfBenchmark, error) {
+	if targetTime <= 0 {
+		return KdfBenchmark{}, fmt.Errorf("invalid benchmark target time %v", targetTime)
+	}
+
+	switch spec.Type {
+	case "pbkdf2":
+		hashName := spec.Hash
+		if hashName == "" {
+			hashName = "sha256"
+		}
+		h, size := getHashAlgo(hashName)
+		if h == nil {
+			return KdfBenchmark{}, fmt.Errorf("Unknown pbkdf2 hash algorithm: %v", hashName)
+		}
+		perSecond := pbkdf2IterationsFor(h, size, time.Second, 1)
+		iterations := int(float64(perSecond) * targetTime.Seconds())
+		if iterations < luksV1MinIterations {
+			iterations = luksV1MinIterations
+		}
+		return KdfBenchmark{
+			Params:              KdfParams{Type: spec.Type, Hash: hashName, Iterations: iterations},
+			IterationsPerSecond: perSecond,
+			Duration:            time.Duration(float64(iterations) / float64(perSecond) * float64(time.Second)),
+		}, nil
+	case "argon2i", "argon2id":
+		memory := spec.Memory
+		if memory <= 0 {
+			memory = benchmarkArgon2MaxMemory
+		}
+		threads := spec.Threads
+		if threads <= 0 {
+			threads = benchmarkArgon2Threads
+		}
+		if threads > 255 {
+			return KdfBenchmark{}, fmt.Errorf("invalid %v threads number: %v", spec.Type, threads)
+		}
+
+		// a single pass over the memory, the cost scales linearly with both time and memory
+		pass := estimateArgon2(spec.Type, 1, uint32(memory), uint32(threads))
+		if pass <= 0 {
+			pass = 1
+		}
+		timeCost := int(targetTime / pass)
+		if timeCost < benchmarkArgon2MinTime {
+			timeCost = benchmarkArgon2MinTime
+			memory = int(float64(memory) * float64(targetTime) / float64(benchmarkArgon2MinTime*pass))
+			minMemory := benchmarkArgon2MinMemory
+			if minMemory < 8*threads {
+				minMemory = 8 * threads // argon2 requires at least 8 KiB of memory per thread
+			}
+			if memory < minMemory {
+				memory = minMemory
+			}
+		}
+		return KdfBenchmark{
+			Params:   KdfParams{Type: spec.Type, Time: timeCost, Memory: memory, Threads: threads},
+			Duration: estimateArgon2(spec.Type, uint32(timeCost), uint32(memory), uint32(threads)),
+		}, nil
+	default:
+		return KdfBenchmark{}, fmt.Errorf("Unknown kdf type: %v", spec.Type)
+	}
+}
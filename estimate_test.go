@@ -0,0 +1,76 @@
+package luks
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimatedUnlockTime(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+
+	fast, err := d.EstimatedUnlockTime(0)
+	require.NoError(t, err)
+	require.NotZero(t, fast)
+
+	ks := d.meta.Keyslots[0]
+	ks.Kdf.Iterations = 100 * fixtureIterations
+	d.meta.Keyslots[0] = ks
+	slow, err := d.EstimatedUnlockTime(0)
+	require.NoError(t, err)
+	// the estimate scales with the number of iterations
+	require.Greater(t, slow, 10*fast)
+
+	_, err = d.EstimatedUnlockTime(3)
+	require.Error(t, err)
+
+	disk1, _ := createLuks1Fixture(t, "foobar")
+	d1, err := initV1Device(disk1.Name(), FileStorage{disk1})
+	require.NoError(t, err)
+	estimate, err := d1.EstimatedUnlockTime(0)
+	require.NoError(t, err)
+	require.NotZero(t, estimate)
+	_, err = d1.EstimatedUnlockTime(1)
+	require.Equal(t, ErrKeyslotDisabled, err)
+}
+
+func TestPbkdf2IterationsFor(t *testing.T) {
+	short := pbkdf2IterationsFor(sha256.New, 32, 20*time.Millisecond, 1000)
+	long := pbkdf2IterationsFor(sha256.New, 32, 200*time.Millisecond, 1000)
+	require.GreaterOrEqual(t, short, 1000)
+	require.Greater(t, long, 2*short)
+
+	require.Equal(t, 1000, pbkdf2IterationsFor(sha256.New, 32, time.Nanosecond, 1000))
+}
+
+func TestBenchmarkKdf(t *testing.T) {
+	short, err := BenchmarkKdf(KdfParams{Type: "pbkdf2"}, 20*time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, "sha256", short.Params.Hash)
+	require.Greater(t, short.IterationsPerSecond, 0)
+	require.GreaterOrEqual(t, short.Params.Iterations, luksV1MinIterations)
+	long, err := BenchmarkKdf(KdfParams{Type: "pbkdf2", Hash: "sha512"}, 200*time.Millisecond)
+	require.NoError(t, err)
+	require.Greater(t, long.Params.Iterations, short.Params.Iterations)
+
+	// a tiny target reduces the argon2 memory cost but never the time cost
+	argon, err := BenchmarkKdf(KdfParams{Type: "argon2id", Memory: 64 * 1024, Threads: 2}, time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, 4, argon.Params.Time)
+	require.Equal(t, 2, argon.Params.Threads)
+	require.LessOrEqual(t, argon.Params.Memory, 64*1024)
+	require.GreaterOrEqual(t, argon.Params.Memory, 32)
+	require.NotZero(t, argon.Duration)
+
+	_, err = BenchmarkKdf(KdfParams{Type: "pbkdf2", Hash: "md5"}, time.Second)
+	require.Error(t, err)
+	_, err = BenchmarkKdf(KdfParams{Type: "scrypt"}, time.Second)
+	require.Error(t, err)
+	_, err = BenchmarkKdf(KdfParams{Type: "pbkdf2"}, 0)
+	require.Error(t, err)
+}
@@ -17,8 +17,18 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// skipIfMissing skips the test if the given binary (e.g. cryptsetup) is not available at the host
+func skipIfMissing(t *testing.T, binary string) {
+	t.Helper()
+	if _, err := exec.LookPath(binary); err != nil {
+		t.Skipf("%s binary is not found, skipping the test", binary)
+	}
+}
+
 // generate several LUKS disks, mount them as loop device and test end-to-end mount process
 func runLuksTest(t *testing.T, name string, testPersistentFlags bool, formatArgs ...string) {
+	skipIfMissing(t, "cryptsetup")
+	skipIfMissing(t, "mkfs.ext4")
 	t.Parallel()
 
 	tmpImage, err := os.CreateTemp("", "luks.go.img."+name)
@@ -166,6 +176,18 @@ func runLuksTest(t *testing.T, name string, testPersistentFlags bool, formatArgs
 	require.NoError(t, err)
 	out = bytes.TrimRight(out, "\n")
 	require.Equal(t, expectedUUID, string(out))
+
+	// luksSuspend/luksResume cycle
+	unlocker := dev.(luks.Unlocker)
+	require.NoError(t, unlocker.Suspend(name))
+	out, err = exec.Command("dmsetup", "info", "-c", "--noheadings", "-o", "suspended", name).CombinedOutput()
+	require.NoError(t, err)
+	require.Equal(t, "Suspended", strings.TrimSpace(string(out)))
+	require.Equal(t, luks.ErrPassphraseDoesNotMatch, unlocker.Resume(name, []byte("wrongpassword")))
+	require.NoError(t, unlocker.Resume(name, []byte(password)))
+	data, err = os.ReadFile(filepath.Join(tmpMountpoint2, "empty.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "Hello, world!", string(data))
 }
 
 func TestLUKS1(t *testing.T) {
@@ -175,3 +197,11 @@ func TestLUKS1(t *testing.T) {
 func TestLUKS2(t *testing.T) {
 	runLuksTest(t, "luks2", true, "--type", "luks2", "--iter-time", "5")
 }
+
+func TestLUKS1CustomOffset(t *testing.T) {
+	runLuksTest(t, "luks1offset", false, "--type", "luks1", "--iter-time", "5", "--offset", "8192")
+}
+
+func TestLUKS2CustomOffset(t *testing.T) {
+	runLuksTest(t, "luks2offset", false, "--type", "luks2", "--iter-time", "5", "--offset", "36864")
+}
@@ -0,0 +1,90 @@
+package luks
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// default relying party id used by systemd-cryptenroll
+const systemdFido2DefaultRP = "io.systemd.cryptsetup"
+
+// SystemdFido2Token is a parsed `systemd-fido2` token as created by systemd-cryptenroll
+type SystemdFido2Token struct {
+	Keyslots []int
+	// Credential is the FIDO2 credential id
+	Credential []byte
+	// Salt is sent to the authenticator with the hmac-secret extension, the result is the keyslot passphrase
+	Salt []byte
+	// RP is the relying party id
+	RP string
+	// PINRequired reports whether the client PIN has to be provided
+	PINRequired bool
+	// UPRequired reports whether user presence (touching the device) is required
+	UPRequired bool
+	// UVRequired reports whether user verification (e.g. fingerprint) is required
+	UVRequired bool
+}
+
+// fido2TokenJSON is the JSON schema of the token, see systemd-cryptenroll-fido2.c at systemd
+type fido2TokenJSON struct {
+	Keyslots    numberList `json:"keyslots"`
+	Credential  string     `json:"fido2-credential"`
+	Salt        string     `json:"fido2-salt"`
+	RP          *string    `json:"fido2-rp"`
+	PINRequired *bool      `json:"fido2-clientPin-required"`
+	UPRequired  *bool      `json:"fido2-up-required"`
+	UVRequired  *bool      `json:"fido2-uv-required"`
+}
+
+// ParseSystemdFido2Token parses LUKS2 `systemd-fido2` token payload. Fields missing in tokens created by older
+// systemd versions are set to the defaults systemd uses: PIN and user presence are required, the relying party
+// is "io.systemd.cryptsetup".
+func ParseSystemdFido2Token(payload []byte) (*SystemdFido2Token, error) {
+	var node fido2TokenJSON
+	if err := json.Unmarshal(payload, &node); err != nil {
+		return nil, fmt.Errorf("invalid systemd-fido2 token: %v", err)
+	}
+
+	var (
+		t   SystemdFido2Token
+		err error
+	)
+	if t.Keyslots, err = node.Keyslots.ints(); err != nil {
+		return nil, fmt.Errorf("invalid systemd-fido2 token keyslots: %v", err)
+	}
+	if t.Credential, err = base64.StdEncoding.DecodeString(node.Credential); err != nil {
+		return nil, fmt.Errorf("invalid systemd-fido2 token fido2-credential: %v", err)
+	}
+	if len(t.Credential) == 0 {
+		return nil, fmt.Errorf("systemd-fido2 token has no fido2-credential")
+	}
+	if t.Salt, err = base64.StdEncoding.DecodeString(node.Salt); err != nil {
+		return nil, fmt.Errorf("invalid systemd-fido2 token fido2-salt: %v", err)
+	}
+	if len(t.Salt) == 0 {
+		return nil, fmt.Errorf("systemd-fido2 token has no fido2-salt")
+	}
+
+	t.RP = systemdFido2DefaultRP
+	if node.RP != nil {
+		t.RP = *node.RP
+	}
+	t.PINRequired = boolOrDefault(node.PINRequired, true)
+	t.UPRequired = boolOrDefault(node.UPRequired, true)
+	t.UVRequired = boolOrDefault(node.UVRequired, false)
+	return &t, nil
+}
+
+func boolOrDefault(b *bool, def bool) bool {
+	if b == nil {
+		return def
+	}
+	return *b
+}
+
+func init() {
+	RegisterTokenType(SystemdFido2TokenType, func(payload []byte) (interface{}, error) {
+		return ParseSystemdFido2Token(payload)
+	})
+}
@@ -0,0 +1,38 @@
+package luks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSystemdFido2Token(t *testing.T) {
+	tok, err := ParseSystemdFido2Token([]byte(`{"type":"systemd-fido2","keyslots":["2"],"fido2-credential":"Y3JlZA==",
+		"fido2-salt":"c2FsdA==","fido2-rp":"example.org","fido2-clientPin-required":false,"fido2-up-required":false,
+		"fido2-uv-required":true}`))
+	require.NoError(t, err)
+	require.Equal(t, &SystemdFido2Token{
+		Keyslots:    []int{2},
+		Credential:  []byte("cred"),
+		Salt:        []byte("salt"),
+		RP:          "example.org",
+		PINRequired: false,
+		UPRequired:  false,
+		UVRequired:  true,
+	}, tok)
+
+	// tokens created by older systemd versions
+	tok, err = ParseSystemdFido2Token([]byte(`{"type":"systemd-fido2","keyslots":["0"],"fido2-credential":"Y3JlZA==","fido2-salt":"c2FsdA=="}`))
+	require.NoError(t, err)
+	require.Equal(t, "io.systemd.cryptsetup", tok.RP)
+	require.True(t, tok.PINRequired)
+	require.True(t, tok.UPRequired)
+	require.False(t, tok.UVRequired)
+
+	_, err = ParseSystemdFido2Token([]byte(`{"type":"systemd-fido2","fido2-salt":"c2FsdA=="}`))
+	require.Error(t, err)
+	_, err = ParseSystemdFido2Token([]byte(`{"type":"systemd-fido2","fido2-credential":"Y3JlZA=="}`))
+	require.Error(t, err)
+	_, err = ParseSystemdFido2Token([]byte(`{"type":"systemd-fido2","fido2-credential":"!!","fido2-salt":"c2FsdA=="}`))
+	require.Error(t, err)
+}
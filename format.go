@@ -0,0 +1,223 @@
+package luks
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// FormatOptions specifies parameters of a new LUKS2 volume
+type FormatOptions struct {
+	// Passphrase protects the initial keyslot #0
+	Passphrase []byte
+	// Cipher of the data segment, default is "aes-xts-plain64"
+	Cipher string
+	// KeySize is the volume key size in bytes, default is 64 (AES-256 in XTS mode)
+	KeySize int
+	// Kdf of the initial keyslot, default is argon2id with cryptsetup default cost parameters
+	Kdf KdfParams
+	// SectorSize is the data segment encryption sector size, default is 512
+	SectorSize int
+	// UUID of the volume, a random one is generated if empty
+	UUID      string
+	Label     string
+	Subsystem string
+}
+
+// LUKS2 metadata layout used by Format(), it matches cryptsetup defaults: 16KiB header copies followed by
+// keyslots area, data starts at 16MiB
+const (
+	formatHeaderSize    = 16384
+	formatDataOffset    = 16777216
+	formatKeyslotsSize  = formatDataOffset - 2*formatHeaderSize
+	formatDigestHash    = "sha256"
+	formatDigestIters   = 100000
+	formatDefaultCipher = "aes-xts-plain64"
+)
+
+var formatDefaultKdf = KdfParams{Type: "argon2id", Time: 4, Memory: 1048576, Threads: 4}
+
+// Format creates a new LUKS2 volume at the given path. All previous LUKS metadata at the device is destroyed.
+// The volume gets a random volume key that is stored into keyslot #0 protected with opts.Passphrase.
+// It returns the device opened for writing.
+func Format(path string, opts FormatOptions) (Device, error) {
+	if len(opts.Passphrase) == 0 {
+		return nil, fmt.Errorf("passphrase is not specified")
+	}
+	if opts.Cipher == "" {
+		opts.Cipher = formatDefaultCipher
+	}
+	if opts.KeySize == 0 {
+		opts.KeySize = 64
+	}
+	if opts.Kdf.Type == "" {
+		opts.Kdf = formatDefaultKdf
+	}
+	if opts.SectorSize == 0 {
+		opts.SectorSize = storageSectorSize
+	}
+
+	cipherName, cipherMode, _, err := parseCipherSpec(opts.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	if opts.KeySize <= 0 || opts.KeySize%8 != 0 {
+		return nil, fmt.Errorf("invalid volume key size %v", opts.KeySize)
+	}
+	if err := checkKeySize(cipherName, cipherMode, opts.KeySize); err != nil {
+		return nil, err
+	}
+	if opts.SectorSize < storageSectorSize || opts.SectorSize > 4096 || !isPowerOfTwo(uint(opts.SectorSize)) {
+		return nil, fmt.Errorf("invalid sector size %v", opts.SectorSize)
+	}
+	if opts.UUID, err = uuidOrRandom(opts.UUID); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	d, err := formatV2Device(path, FileStorage{f}, opts)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func formatV2Device(path string, f Storage, opts FormatOptions) (*deviceV2, error) {
+	size, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+	if size <= formatDataOffset {
+		return nil, fmt.Errorf("device %v is too small, LUKS2 metadata requires %v bytes", path, formatDataOffset)
+	}
+
+	hdr := headerV2{Version: 2, HeaderSize: formatHeaderSize}
+	copy(hdr.Magic[:], luks2PrimaryMagic)
+	copy(hdr.ChecksumAlgorithm[:], "sha256")
+	if _, err := rand.Read(hdr.Salt[:]); err != nil {
+		return nil, err
+	}
+	if err := putFixedString(hdr.UUID[:], opts.UUID); err != nil {
+		return nil, err
+	}
+	if err := putFixedString(hdr.Label[:], opts.Label); err != nil {
+		return nil, err
+	}
+	if err := putFixedString(hdr.SubsystemLabel[:], opts.Subsystem); err != nil {
+		return nil, err
+	}
+
+	volumeKey := make([]byte, opts.KeySize)
+	if _, err := rand.Read(volumeKey); err != nil {
+		return nil, err
+	}
+	defer clearSlice(volumeKey)
+
+	digestSalt := make([]byte, 32)
+	if _, err := rand.Read(digestSalt); err != nil {
+		return nil, err
+	}
+	digestValue, err := deriveKdfKey(volumeKey, digestSalt, KdfParams{Type: "pbkdf2", Hash: "sha256", Iterations: formatDigestIters}, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := metadata{
+		Keyslots: map[int]keyslot{},
+		Tokens:   map[int]json.RawMessage{},
+		Segments: map[int]segment{
+			0: {
+				Type:       "crypt",
+				Offset:     json.Number(strconv.Itoa(formatDataOffset)),
+				IvTweak:    "0",
+				Size:       "dynamic",
+				Encryption: opts.Cipher,
+				SectorSize: uint(opts.SectorSize),
+			},
+		},
+		Digests: map[int]digest{
+			0: {
+				Type:       "pbkdf2",
+				Keyslots:   numberList{},
+				Segments:   numberList{"0"},
+				Hash:       formatDigestHash,
+				Iterations: formatDigestIters,
+				Salt:       base64.StdEncoding.EncodeToString(digestSalt),
+				Digest:     base64.StdEncoding.EncodeToString(digestValue),
+			},
+		},
+		Config: config{
+			JSONSize:     json.Number(strconv.Itoa(formatHeaderSize - 4096)),
+			KeyslotsSize: json.Number(strconv.Itoa(formatKeyslotsSize)),
+		},
+	}
+
+	// clear both header copies so no leftovers of a previous header (e.g. a stale secondary header) remain,
+	// the keyslots area is overwritten with random data like cryptsetup does so old key material is destroyed
+	if _, err := f.WriteAt(make([]byte, 2*formatHeaderSize), 0); err != nil {
+		return nil, err
+	}
+	if err := wipeArea(f, 2*formatHeaderSize, formatKeyslotsSize); err != nil {
+		return nil, err
+	}
+
+	d := &deviceV2{path: path, f: f, hdr: &hdr, meta: &meta}
+	if _, err := d.addKeyslot(volumeKey, opts.Passphrase, opts.Kdf); err != nil {
+		return nil, err
+	}
+	if err := d.writeHeader(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// uuidOrRandom validates the UUID, a random UUID is generated if it is empty
+func uuidOrRandom(uuid string) (string, error) {
+	if uuid == "" {
+		return randomUUID()
+	}
+	if !isValidUUID(uuid) {
+		return "", fmt.Errorf("invalid UUID %q", uuid)
+	}
+	return uuid, nil
+}
+
+// isValidUUID checks that the string is a UUID in the canonical 8-4-4-4-12 hex form
+func isValidUUID(uuid string) bool {
+	if len(uuid) != 36 {
+		return false
+	}
+	for i, c := range uuid {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// randomUUID generates a random (version 4) UUID
+func randomUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
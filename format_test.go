@@ -0,0 +1,152 @@
+package luks
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func createFormatDisk(t *testing.T, size int64) string {
+	disk, err := os.CreateTemp("", "luks.go.format")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(disk.Name()) })
+	require.NoError(t, disk.Truncate(size))
+	require.NoError(t, disk.Close())
+	return disk.Name()
+}
+
+var formatFixtureKdf = KdfParams{Type: "pbkdf2", Hash: "sha256", Iterations: fixtureIterations}
+
+func TestFormat(t *testing.T) {
+	t.Parallel()
+
+	path := createFormatDisk(t, formatDataOffset+2*1024*1024)
+	d, err := Format(path, FormatOptions{
+		Passphrase: []byte("foobar"),
+		Kdf:        formatFixtureKdf,
+		SectorSize: 4096,
+		Label:      "data",
+		UUID:       "3f0c7a4e-2b1d-4c6e-9a8f-1e2d3c4b5a69",
+	})
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+
+	d, err = Open(path)
+	require.NoError(t, err)
+	defer d.Close()
+
+	require.Equal(t, 2, d.Version())
+	require.Equal(t, "3f0c7a4e-2b1d-4c6e-9a8f-1e2d3c4b5a69", d.UUID())
+	require.Equal(t, "data", d.(*deviceV2).Label())
+	require.Equal(t, []int{0}, d.Slots())
+
+	v, err := d.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	require.Len(t, v.key, 64)
+	require.Equal(t, "aes-xts-plain64", v.StorageEncryption)
+	require.Equal(t, uint64(4096), v.StorageSectorSize)
+	require.Equal(t, uint64(formatDataOffset), v.StorageOffset)
+	require.Equal(t, uint64(2*1024*1024), v.StorageSize)
+
+	_, err = d.UnsealVolume(0, []byte("wrong"))
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+
+	// the secondary header is valid too
+	d2, err := OpenWithOptions(path, OpenOptions{UseSecondaryHeader: true})
+	require.NoError(t, err)
+	defer d2.Close()
+	_, err = d2.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+}
+
+func TestFormatReplacesExistingHeader(t *testing.T) {
+	t.Parallel()
+
+	disk, _ := createLuks2Fixture(t, "foobar")
+	oldMaterial := make([]byte, 258048)
+	_, err := disk.ReadAt(oldMaterial, 32768)
+	require.NoError(t, err)
+
+	d, err := Format(disk.Name(), FormatOptions{Passphrase: []byte("newpass"), Kdf: formatFixtureKdf, KeySize: 32})
+	require.NoError(t, err)
+	defer d.Close()
+	require.NotEqual(t, "7d2c1e9a-3b4f-4e5d-8a6b-9c0d1e2f3a4b", d.UUID())
+
+	_, err = d.UnsealVolume(0, []byte("foobar"))
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+	v, err := d.UnsealVolume(0, []byte("newpass"))
+	require.NoError(t, err)
+	require.Len(t, v.key, 32)
+
+	// the old keyslot material beyond the new (smaller) keyslot is wiped too
+	material := make([]byte, len(oldMaterial))
+	_, err = disk.ReadAt(material, 32768)
+	require.NoError(t, err)
+	require.NotEqual(t, oldMaterial[131072:], material[131072:])
+}
+
+func TestFormatUnalignedKeyMaterial(t *testing.T) {
+	t.Parallel()
+
+	// 24*4000 bytes of key material is not a multiple of the sector size, it is padded like cryptsetup does
+	path := createFormatDisk(t, formatDataOffset+1024*1024)
+	d, err := Format(path, FormatOptions{Passphrase: []byte("foobar"), Kdf: formatFixtureKdf, Cipher: "aes-cbc-essiv:sha256", KeySize: 24})
+	require.NoError(t, err)
+	defer d.Close()
+	v, err := d.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	require.Len(t, v.key, 24)
+
+	keyslot, err := d.(Writer).AddKeyslot([]byte("foobar"), []byte("second"), formatFixtureKdf)
+	require.NoError(t, err)
+	v, err = d.UnsealVolume(keyslot, []byte("second"))
+	require.NoError(t, err)
+	require.Len(t, v.key, 24)
+}
+
+func TestFormatInvalidOptions(t *testing.T) {
+	t.Parallel()
+
+	path := createFormatDisk(t, formatDataOffset+1024*1024)
+	for _, opts := range []FormatOptions{
+		{},
+		{Passphrase: []byte("foobar"), Kdf: formatFixtureKdf, Cipher: "aes-xts"},
+		{Passphrase: []byte("foobar"), Kdf: formatFixtureKdf, Cipher: "nosuchcipher-xts-plain64"},
+		{Passphrase: []byte("foobar"), Kdf: formatFixtureKdf, KeySize: 33},
+		{Passphrase: []byte("foobar"), Kdf: formatFixtureKdf, KeySize: 24},
+		{Passphrase: []byte("foobar"), Kdf: formatFixtureKdf, KeySize: 40},
+		{Passphrase: []byte("foobar"), Kdf: formatFixtureKdf, Cipher: "aes-cbc-essiv:sha256", KeySize: 40},
+		{Passphrase: []byte("foobar"), Kdf: formatFixtureKdf, SectorSize: 1000},
+		{Passphrase: []byte("foobar"), Kdf: formatFixtureKdf, SectorSize: 8192},
+		{Passphrase: []byte("foobar"), Kdf: KdfParams{Type: "scrypt"}},
+		{Passphrase: []byte("foobar"), Kdf: formatFixtureKdf, Label: strings.Repeat("x", 48)},
+	} {
+		_, err := Format(path, opts)
+		require.Error(t, err, "%+v", opts)
+	}
+
+	small := createFormatDisk(t, formatDataOffset)
+	_, err := Format(small, FormatOptions{Passphrase: []byte("foobar"), Kdf: formatFixtureKdf})
+	require.Error(t, err)
+}
+
+func TestFormatCryptsetupCompatible(t *testing.T) {
+	t.Parallel()
+	skipIfMissing(t, "cryptsetup")
+
+	path := createFormatDisk(t, formatDataOffset+1024*1024)
+	d, err := Format(path, FormatOptions{
+		Passphrase: []byte("foobar"),
+		Kdf:        KdfParams{Type: "argon2id", Time: 4, Memory: 32 * 1024, Threads: 1},
+	})
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+
+	cmd := exec.Command("cryptsetup", "open", "--test-passphrase", path)
+	cmd.Stdin = strings.NewReader("foobar")
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+}
@@ -0,0 +1,227 @@
+package luks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"unsafe"
+
+	"github.com/anatol/devmapper.go"
+	"golang.org/x/sys/unix"
+)
+
+// dm-integrity superblock magic, see struct superblock in drivers/md/dm-integrity.c
+var integritySuperblockMagic = []byte("integrt\x00")
+
+// superblock flag that tells the device is formatted with the fixed (kernel 5.4+) metadata padding
+const integrityFlagFixedPadding = 0x8
+
+// integritySuperblock contains dm-integrity superblock fields needed to map the device
+type integritySuperblock struct {
+	version             uint8
+	tagSize             uint16
+	providedDataSectors uint64 // size of the data area in 512-byte sectors
+	flags               uint32
+}
+
+// readIntegritySuperblock reads dm-integrity superblock located at offset (in bytes) of the backing device
+func readIntegritySuperblock(path string, offset uint64) (*integritySuperblock, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, storageSectorSize)
+	if _, err := f.ReadAt(buf, int64(offset)); err != nil {
+		return nil, fmt.Errorf("unable to read dm-integrity superblock: %v", err)
+	}
+	return parseIntegritySuperblock(buf)
+}
+
+func parseIntegritySuperblock(buf []byte) (*integritySuperblock, error) {
+	if len(buf) < 32 || !bytes.Equal(buf[:8], integritySuperblockMagic) {
+		return nil, fmt.Errorf("no dm-integrity superblock found, the volume integrity area is not formatted")
+	}
+	sb := &integritySuperblock{
+		version:             buf[8],
+		tagSize:             binary.LittleEndian.Uint16(buf[10:]),
+		providedDataSectors: binary.LittleEndian.Uint64(buf[16:]),
+		flags:               binary.LittleEndian.Uint32(buf[24:]),
+	}
+	if sb.tagSize == 0 {
+		return nil, fmt.Errorf("invalid dm-integrity tag size: %v", sb.tagSize)
+	}
+	if sb.providedDataSectors == 0 {
+		return nil, fmt.Errorf("invalid dm-integrity data size: %v", sb.providedDataSectors)
+	}
+	return sb, nil
+}
+
+// integrityTableSpec builds dm-integrity target parameters for a device whose tags are managed by dm-crypt.
+// In recovery mode ('R') tags are not verified and writes do not go through the journal, it is needed
+// to read volumes that were formatted without wiping the integrity tags (cryptsetup --integrity-no-wipe).
+func integrityTableSpec(backend string, offset uint64, sb *integritySuperblock, sectorSize uint64, recovery bool) string {
+	mode := "J"
+	if recovery {
+		mode = "R"
+	}
+
+	var opts []string
+	if sectorSize > storageSectorSize {
+		opts = append(opts, fmt.Sprintf("block_size:%d", sectorSize))
+	}
+	if sb.flags&integrityFlagFixedPadding != 0 {
+		opts = append(opts, "fix_padding")
+	}
+
+	spec := fmt.Sprintf("%s %d %d %s %d", backend, offset/storageSectorSize, sb.tagSize, mode, len(opts))
+	if len(opts) > 0 {
+		spec += " " + strings.Join(opts, " ")
+	}
+	return spec
+}
+
+// integrityCipherSpec converts LUKS2 cipher and integrity names to the kernel crypto API form dm-crypt expects for
+// authenticated encryption, e.g. "aes-xts-random" with "hmac(sha256)" becomes "capi:authenc(hmac(sha256),xts(aes))-random"
+func integrityCipherSpec(encryption, integrity string) (string, error) {
+	if strings.HasPrefix(encryption, capiPrefix) {
+		return encryption, nil
+	}
+
+	parts := strings.Split(encryption, "-")
+	var cipher, iv string
+	switch len(parts) {
+	case 2:
+		cipher, iv = parts[0], parts[1]
+	case 3:
+		cipher, iv = fmt.Sprintf("%s(%s)", parts[1], parts[0]), parts[2]
+	default:
+		return "", fmt.Errorf("invalid cipher specification: %v", encryption)
+	}
+
+	switch integrity {
+	case "aead":
+		return fmt.Sprintf("capi:%s-%s", cipher, iv), nil
+	case "poly1305":
+		return fmt.Sprintf("capi:rfc7539(%s,poly1305)-%s", cipher, iv), nil
+	default:
+		return fmt.Sprintf("capi:authenc(%s,%s)-%s", integrity, cipher, iv), nil
+	}
+}
+
+// integrityMapperName returns name of the dm-integrity device placed under the dm-crypt mapping, it follows
+// cryptsetup naming
+func integrityMapperName(name string) string {
+	return name + "_dif"
+}
+
+// setupIntegrityMapper creates dm-integrity device under dm-crypt mapping with the given name
+func (v *Volume) setupIntegrityMapper(name string) error {
+	if v.StorageOffset%storageSectorSize != 0 {
+		return fmt.Errorf("offset must be multiple of sector size")
+	}
+	sb, err := readIntegritySuperblock(v.BackingDevice, v.StorageOffset)
+	if err != nil {
+		return err
+	}
+	cipher, err := integrityCipherSpec(v.StorageEncryption, v.StorageIntegrity)
+	if err != nil {
+		return err
+	}
+
+	difName := integrityMapperName(name)
+	difUUID := mapperUUID("SUBDEV", v.UUID, difName)
+	spec := integrityTableSpec(v.BackingDevice, v.StorageOffset, sb, v.StorageSectorSize, v.IntegrityRecovery)
+	if err := devmapper.Create(difName, difUUID); err != nil {
+		return err
+	}
+	if err := loadTable(difName, v.mapperFlags(), "integrity", sb.providedDataSectors, spec); err != nil {
+		_ = devmapper.Remove(difName)
+		return err
+	}
+	if err := devmapper.Resume(difName); err != nil {
+		_ = devmapper.Remove(difName)
+		return err
+	}
+
+	crypt := *v
+	crypt.BackingDevice = "/dev/mapper/" + difName
+	crypt.StorageOffset = 0
+	crypt.StorageSize = sb.providedDataSectors * storageSectorSize
+	crypt.StorageEncryption = cipher
+	table, err := crypt.cryptTable()
+	if err != nil {
+		_ = devmapper.Remove(difName)
+		return err
+	}
+	table.Flags = append(table.Flags, fmt.Sprintf("integrity:%d:aead", sb.tagSize))
+
+	err = v.withKeyringKey(func(keyID string) error {
+		table.KeyID = keyID
+		return devmapper.CreateAndLoad(name, v.mapperUUID(name), v.mapperFlags(), table)
+	})
+	if err != nil {
+		_ = devmapper.Remove(difName)
+	}
+	return err
+}
+
+// removeIntegrityMapper removes dm-integrity device left under the removed dm-crypt mapping, if any
+func removeIntegrityMapper(name string, deferred bool) error {
+	difName := integrityMapperName(name)
+	info, err := devmapper.InfoByName(difName)
+	if err != nil || !strings.HasPrefix(info.UUID, "CRYPT-SUBDEV-") {
+		return nil // the mapping has no integrity device
+	}
+	if deferred {
+		return deferredRemove(difName)
+	}
+	return devmapper.Remove(difName)
+}
+
+// loadTable loads a single-target table into an inactive slot of the device-mapper device (DM_TABLE_LOAD).
+// devmapper.go supports only its own target types thus the ioctl is issued directly, see also deferredRemove().
+// length is the target size in 512-byte sectors.
+func loadTable(name string, flags uint32, targetType string, length uint64, spec string) error {
+	var req unix.DmIoctl
+	if len(name) >= len(req.Name) {
+		return fmt.Errorf("device-mapper name %q is too long", name)
+	}
+	var target unix.DmTargetSpec
+	if len(targetType) >= len(target.Target_type) {
+		return fmt.Errorf("device-mapper target type %q is too long", targetType)
+	}
+
+	specSize := roundUp(len(spec)+1, 8) // NUL-terminated and 8-byte aligned
+	target.Sector_start = 0
+	target.Length = length
+	target.Next = uint32(unix.SizeofDmTargetSpec + specSize)
+	copy(target.Target_type[:], targetType)
+
+	req.Version = [3]uint32{unix.DM_VERSION_MAJOR, 0, 0}
+	req.Data_size = uint32(unix.SizeofDmIoctl + unix.SizeofDmTargetSpec + specSize)
+	req.Data_start = unix.SizeofDmIoctl
+	req.Target_count = 1
+	req.Flags = flags
+	copy(req.Name[:], name)
+
+	data := make([]byte, req.Data_size)
+	copy(data, (*[unix.SizeofDmIoctl]byte)(unsafe.Pointer(&req))[:])
+	copy(data[unix.SizeofDmIoctl:], (*[unix.SizeofDmTargetSpec]byte)(unsafe.Pointer(&target))[:])
+	copy(data[unix.SizeofDmIoctl+unix.SizeofDmTargetSpec:], spec)
+
+	control, err := os.Open("/dev/mapper/control")
+	if err != nil {
+		return err
+	}
+	defer control.Close()
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, control.Fd(), unix.DM_TABLE_LOAD, uintptr(unsafe.Pointer(&data[0])))
+	if errno != 0 {
+		return os.NewSyscallError("dm table load", errno)
+	}
+	return nil
+}
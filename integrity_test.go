@@ -0,0 +1,60 @@
+package luks
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIntegritySuperblock(t *testing.T) {
+	buf := make([]byte, storageSectorSize)
+	_, err := parseIntegritySuperblock(buf)
+	require.Error(t, err)
+
+	copy(buf, integritySuperblockMagic)
+	buf[8] = 5
+	binary.LittleEndian.PutUint16(buf[10:], 36)
+	binary.LittleEndian.PutUint64(buf[16:], 2048)
+	binary.LittleEndian.PutUint32(buf[24:], integrityFlagFixedPadding)
+
+	sb, err := parseIntegritySuperblock(buf)
+	require.NoError(t, err)
+	require.Equal(t, uint8(5), sb.version)
+	require.Equal(t, uint16(36), sb.tagSize)
+	require.Equal(t, uint64(2048), sb.providedDataSectors)
+	require.Equal(t, uint32(integrityFlagFixedPadding), sb.flags)
+
+	binary.LittleEndian.PutUint64(buf[16:], 0)
+	_, err = parseIntegritySuperblock(buf)
+	require.Error(t, err)
+}
+
+func TestIntegrityTableSpec(t *testing.T) {
+	sb := &integritySuperblock{tagSize: 48, providedDataSectors: 2048}
+	require.Equal(t, "/dev/sda 32768 48 J 0", integrityTableSpec("/dev/sda", 16*1024*1024, sb, 512, false))
+
+	// --integrity-no-wipe volumes are mapped in recovery mode
+	sb.flags = integrityFlagFixedPadding
+	require.Equal(t, "/dev/sda 32768 48 R 2 block_size:4096 fix_padding", integrityTableSpec("/dev/sda", 16*1024*1024, sb, 4096, true))
+}
+
+func TestIntegrityCipherSpec(t *testing.T) {
+	tests := []struct {
+		encryption, integrity, expected string
+	}{
+		{"aes-xts-random", "hmac(sha256)", "capi:authenc(hmac(sha256),xts(aes))-random"},
+		{"aes-gcm-random", "aead", "capi:gcm(aes)-random"},
+		{"chacha20-random", "poly1305", "capi:rfc7539(chacha20,poly1305)-random"},
+		{"aegis128-random", "aead", "capi:aegis128-random"},
+		{"capi:gcm(aes)-random", "aead", "capi:gcm(aes)-random"},
+	}
+	for _, test := range tests {
+		spec, err := integrityCipherSpec(test.encryption, test.integrity)
+		require.NoError(t, err)
+		require.Equal(t, test.expected, spec)
+	}
+
+	_, err := integrityCipherSpec("aes", "aead")
+	require.Error(t, err)
+}
@@ -1,6 +1,53 @@
 package luks
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// numberList is a list of numbers that LUKS2 stores as JSON strings e.g. `"keyslots": ["0", "1"]`
+type numberList []json.Number
+
+// parseUint64 parses LUKS2 unsigned 64-bit value (offsets, sizes). These values are stored as decimal strings and
+// must not be truncated to int on 32-bit platforms.
+func parseUint64(n json.Number) (uint64, error) {
+	return strconv.ParseUint(n.String(), 10, 64)
+}
+
+func (l numberList) MarshalJSON() ([]byte, error) {
+	strs := make([]string, len(l))
+	for i, n := range l {
+		strs[i] = n.String()
+	}
+	return json.Marshal(strs)
+}
+
+// ints converts the list to integers
+func (l numberList) ints() ([]int, error) {
+	result := make([]int, len(l))
+	for i, v := range l {
+		n, err := v.Int64()
+		if err != nil {
+			return nil, err
+		}
+		result[i] = int(n)
+	}
+	return result, nil
+}
+
+// removeNumber returns the list without the entries equal to n
+func removeNumber(l numberList, n int) numberList {
+	result := make(numberList, 0, len(l))
+	for _, v := range l {
+		if i, err := v.Int64(); err == nil && int(i) == n {
+			continue
+		}
+		result = append(result, v)
+	}
+	return result
+}
 
 type keyslot struct {
 	Type     string       `json:"type"`
@@ -8,21 +55,27 @@ type keyslot struct {
 	Af       antiForensic `json:"af"`
 	Area     area         `json:"area"`
 	Kdf      kdf          `json:"kdf"`
-	Priority *int         `json:"priority"` // need to distinguish 0 (ignore) from absence of the field (normal priority)
+	Priority *int         `json:"priority,omitempty"` // need to distinguish 0 (ignore) from absence of the field (normal priority)
+
+	extra extraFields
 }
 
 type antiForensic struct {
 	Type    string `json:"type"`
 	Stripes uint   `json:"stripes"`
 	Hash    string `json:"hash"`
+
+	extra extraFields
 }
 
 type area struct {
 	Type       string      `json:"type"`
 	Encryption string      `json:"encryption"`
 	KeySize    uint        `json:"key_size"`
-	Offset     json.Number `json:"offset"`
-	Size       json.Number `json:"size"`
+	Offset     json.Number `json:"offset,string"`
+	Size       json.Number `json:"size,string"`
+
+	extra extraFields
 }
 
 type kdf struct {
@@ -30,39 +83,56 @@ type kdf struct {
 	Salt string `json:"salt"`
 
 	// pbkdf2 specific fields
-	Hash       string `json:"hash"`
-	Iterations uint   `json:"iterations"`
+	Hash       string `json:"hash,omitempty"`
+	Iterations uint   `json:"iterations,omitempty"`
 
 	// argon2i fields
-	Time   uint `json:"time"`
-	Memory uint `json:"memory"`
-	Cpus   uint `json:"cpus"`
+	Time   uint `json:"time,omitempty"`
+	Memory uint `json:"memory,omitempty"`
+	Cpus   uint `json:"cpus,omitempty"`
+
+	extra extraFields
 }
 
 type segment struct {
 	Type       string      `json:"type"`
-	Offset     json.Number `json:"offset"`
-	IvTweak    json.Number `json:"iv_tweak"`
+	Offset     json.Number `json:"offset,string"`
+	IvTweak    json.Number `json:"iv_tweak,string"`
 	Size       string      `json:"size"` // either 'dynamic' or uint
 	Encryption string      `json:"encryption"`
 	SectorSize uint        `json:"sector_size"`
+	Integrity  *integrity  `json:"integrity,omitempty"`
+
+	extra extraFields
+}
+
+type integrity struct {
+	Type              string `json:"type"`
+	JournalEncryption string `json:"journal_encryption"`
+	JournalIntegrity  string `json:"journal_integrity"`
+
+	extra extraFields
 }
 
 type digest struct {
-	Type       string        `json:"type"`
-	Keyslots   []json.Number `json:"keyslots"`
-	Segments   []json.Number `json:"segments"`
-	Hash       string        `json:"hash"`
-	Iterations uint          `json:"iterations"`
-	Salt       string        `json:"salt"`
-	Digest     string        `json:"digest"`
+	Type       string     `json:"type"`
+	Keyslots   numberList `json:"keyslots"`
+	Segments   numberList `json:"segments"`
+	Hash       string     `json:"hash"`
+	Iterations uint       `json:"iterations"`
+	Salt       string     `json:"salt"`
+	Digest     string     `json:"digest"`
+
+	extra extraFields
 }
 
 type config struct {
-	JSONSize     json.Number `json:"json_size"`
-	KeyslotsSize json.Number `json:"keyslots_size"`
-	Flags        []string    `json:"flags"`
-	Requirements []string    `json:"requirements"`
+	JSONSize     json.Number `json:"json_size,string"`
+	KeyslotsSize json.Number `json:"keyslots_size,string"`
+	Flags        []string    `json:"flags,omitempty"`
+	Requirements []string    `json:"requirements,omitempty"`
+
+	extra extraFields
 }
 
 type metadata struct {
@@ -71,4 +141,265 @@ type metadata struct {
 	Segments map[int]segment         `json:"segments"`
 	Digests  map[int]digest          `json:"digests"`
 	Config   config                  `json:"config"`
+
+	extra extraFields
+}
+
+// clone returns a copy of the metadata that can be modified without affecting the original
+func (m *metadata) clone() *metadata {
+	c := *m
+	c.Keyslots = make(map[int]keyslot, len(m.Keyslots))
+	for k, v := range m.Keyslots {
+		c.Keyslots[k] = v
+	}
+	c.Tokens = make(map[int]json.RawMessage, len(m.Tokens))
+	for k, v := range m.Tokens {
+		c.Tokens[k] = v
+	}
+	c.Segments = make(map[int]segment, len(m.Segments))
+	for k, v := range m.Segments {
+		c.Segments[k] = v
+	}
+	c.Digests = make(map[int]digest, len(m.Digests))
+	for k, v := range m.Digests {
+		v.Keyslots = append(numberList{}, v.Keyslots...)
+		v.Segments = append(numberList{}, v.Segments...)
+		c.Digests[k] = v
+	}
+	c.Config.Flags = append([]string(nil), m.Config.Flags...)
+	c.Config.Requirements = append([]string(nil), m.Config.Requirements...)
+	return &c
+}
+
+// withoutKeyslot returns a copy of the metadata with the keyslot and all references to it removed
+func (m *metadata) withoutKeyslot(keyslotIdx int) (*metadata, error) {
+	c := m.clone()
+	delete(c.Keyslots, keyslotIdx)
+	for i, dig := range c.Digests {
+		dig.Keyslots = removeNumber(dig.Keyslots, keyslotIdx)
+		if len(dig.Keyslots) == 0 && len(dig.Segments) == 0 {
+			// the digest of an unbound key is not referenced anymore
+			delete(c.Digests, i)
+			continue
+		}
+		c.Digests[i] = dig
+	}
+	for i, t := range c.Tokens {
+		// tokens are kept as raw JSON to preserve type-specific fields, update only the keyslots list
+		var node map[string]json.RawMessage
+		if err := json.Unmarshal(t, &node); err != nil {
+			return nil, err
+		}
+		var keyslots numberList
+		if raw, ok := node["keyslots"]; ok {
+			if err := json.Unmarshal(raw, &keyslots); err != nil {
+				return nil, err
+			}
+		}
+		updated := removeNumber(keyslots, keyslotIdx)
+		if len(updated) == len(keyslots) {
+			continue
+		}
+		raw, err := json.Marshal(updated)
+		if err != nil {
+			return nil, err
+		}
+		node["keyslots"] = raw
+		if c.Tokens[i], err = json.Marshal(node); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// extraFields keeps JSON object members that are unknown to this library (e.g. added by a newer cryptsetup version)
+// so they survive a metadata rewrite
+type extraFields map[string]json.RawMessage
+
+// decodeExtra returns members of the JSON object that do not correspond to any field of the given struct
+func decodeExtra(data []byte, known interface{}) (extraFields, error) {
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+
+	t := reflect.TypeOf(known)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		// encoding/json matches object keys case-insensitively
+		for k := range all {
+			if strings.EqualFold(k, name) {
+				delete(all, k)
+			}
+		}
+	}
+
+	if len(all) == 0 {
+		return nil, nil
+	}
+	return all, nil
+}
+
+// encodeWithExtra encodes the value and adds the extra members to the resulting JSON object
+func encodeWithExtra(v interface{}, extra extraFields) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return data, err
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	for k, v := range extra {
+		if _, ok := all[k]; !ok {
+			all[k] = v
+		}
+	}
+	return json.Marshal(all)
+}
+
+func (x *keyslot) UnmarshalJSON(data []byte) error {
+	type plain keyslot
+	if err := json.Unmarshal(data, (*plain)(x)); err != nil {
+		return err
+	}
+	extra, err := decodeExtra(data, plain{})
+	x.extra = extra
+	return err
+}
+
+func (x keyslot) MarshalJSON() ([]byte, error) {
+	type plain keyslot
+	return encodeWithExtra(plain(x), x.extra)
+}
+
+func (x *antiForensic) UnmarshalJSON(data []byte) error {
+	type plain antiForensic
+	if err := json.Unmarshal(data, (*plain)(x)); err != nil {
+		return err
+	}
+	extra, err := decodeExtra(data, plain{})
+	x.extra = extra
+	return err
+}
+
+func (x antiForensic) MarshalJSON() ([]byte, error) {
+	type plain antiForensic
+	return encodeWithExtra(plain(x), x.extra)
+}
+
+func (x *area) UnmarshalJSON(data []byte) error {
+	type plain area
+	if err := json.Unmarshal(data, (*plain)(x)); err != nil {
+		return err
+	}
+	extra, err := decodeExtra(data, plain{})
+	x.extra = extra
+	return err
+}
+
+func (x area) MarshalJSON() ([]byte, error) {
+	type plain area
+	return encodeWithExtra(plain(x), x.extra)
+}
+
+func (x *kdf) UnmarshalJSON(data []byte) error {
+	type plain kdf
+	if err := json.Unmarshal(data, (*plain)(x)); err != nil {
+		return err
+	}
+	extra, err := decodeExtra(data, plain{})
+	x.extra = extra
+	return err
+}
+
+func (x kdf) MarshalJSON() ([]byte, error) {
+	type plain kdf
+	return encodeWithExtra(plain(x), x.extra)
+}
+
+func (x *segment) UnmarshalJSON(data []byte) error {
+	type plain segment
+	if err := json.Unmarshal(data, (*plain)(x)); err != nil {
+		return err
+	}
+	extra, err := decodeExtra(data, plain{})
+	x.extra = extra
+	return err
+}
+
+func (x segment) MarshalJSON() ([]byte, error) {
+	type plain segment
+	return encodeWithExtra(plain(x), x.extra)
+}
+
+func (x *integrity) UnmarshalJSON(data []byte) error {
+	type plain integrity
+	if err := json.Unmarshal(data, (*plain)(x)); err != nil {
+		return err
+	}
+	extra, err := decodeExtra(data, plain{})
+	x.extra = extra
+	return err
+}
+
+func (x integrity) MarshalJSON() ([]byte, error) {
+	type plain integrity
+	return encodeWithExtra(plain(x), x.extra)
+}
+
+func (x *digest) UnmarshalJSON(data []byte) error {
+	type plain digest
+	if err := json.Unmarshal(data, (*plain)(x)); err != nil {
+		return err
+	}
+	extra, err := decodeExtra(data, plain{})
+	x.extra = extra
+	return err
+}
+
+func (x digest) MarshalJSON() ([]byte, error) {
+	type plain digest
+	return encodeWithExtra(plain(x), x.extra)
+}
+
+func (x *config) UnmarshalJSON(data []byte) error {
+	type plain config
+	if err := json.Unmarshal(data, (*plain)(x)); err != nil {
+		return err
+	}
+	extra, err := decodeExtra(data, plain{})
+	x.extra = extra
+	return err
+}
+
+func (x config) MarshalJSON() ([]byte, error) {
+	type plain config
+	return encodeWithExtra(plain(x), x.extra)
+}
+
+func (x *metadata) UnmarshalJSON(data []byte) error {
+	type plain metadata
+	if err := json.Unmarshal(data, (*plain)(x)); err != nil {
+		return err
+	}
+	extra, err := decodeExtra(data, plain{})
+	x.extra = extra
+	return err
+}
+
+func (x metadata) MarshalJSON() ([]byte, error) {
+	type plain metadata
+	return encodeWithExtra(plain(x), x.extra)
 }
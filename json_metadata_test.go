@@ -21,3 +21,87 @@ func TestParseMetadata(t *testing.T) {
 	parseMetadata(t, "testdata/metadata/1.json")
 	parseMetadata(t, "testdata/metadata/2.json")
 }
+
+func TestMetadataRoundTrip(t *testing.T) {
+	data, err := os.ReadFile("testdata/metadata/1.json")
+	require.NoError(t, err)
+
+	var meta metadata
+	require.NoError(t, json.Unmarshal(data, &meta))
+
+	encoded, err := json.Marshal(&meta)
+	require.NoError(t, err)
+
+	// LUKS2 stores 64-bit numbers and keyslot references as strings
+	require.Contains(t, string(encoded), `"offset":"4194304"`)
+	require.Contains(t, string(encoded), `"keyslots":["0","1"]`)
+	require.Contains(t, string(encoded), `"json_size":"12288"`)
+	require.NotContains(t, string(encoded), `"priority"`)
+
+	// encoding must be stable across parse/serialize cycles
+	var meta2 metadata
+	require.NoError(t, json.Unmarshal(encoded, &meta2))
+	encoded2, err := json.Marshal(&meta2)
+	require.NoError(t, err)
+	require.Equal(t, encoded, encoded2)
+}
+
+func TestParseUint64(t *testing.T) {
+	v, err := parseUint64("5368709120")
+	require.NoError(t, err)
+	require.Equal(t, uint64(5*1024*1024*1024), v)
+
+	v, err = parseUint64("18446744073709551615")
+	require.NoError(t, err)
+	require.Equal(t, uint64(18446744073709551615), v)
+
+	_, err = parseUint64("-1")
+	require.Error(t, err)
+	_, err = parseUint64("dynamic")
+	require.Error(t, err)
+}
+
+func TestMetadataUnknownFields(t *testing.T) {
+	data, err := os.ReadFile("testdata/metadata/1.json")
+	require.NoError(t, err)
+
+	var raw map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &raw))
+	raw["future"] = map[string]interface{}{"a": "b"}
+	raw["config"].(map[string]interface{})["future_flag"] = []interface{}{"x", "y"}
+	slot := raw["keyslots"].(map[string]interface{})["0"].(map[string]interface{})
+	slot["future_slot"] = float64(5)
+	slot["kdf"].(map[string]interface{})["future_kdf"] = "z"
+	raw["segments"].(map[string]interface{})["0"].(map[string]interface{})["future_segment"] = true
+	data, err = json.Marshal(raw)
+	require.NoError(t, err)
+
+	var meta metadata
+	require.NoError(t, json.Unmarshal(data, &meta))
+	encoded, err := json.Marshal(&meta)
+	require.NoError(t, err)
+
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(encoded, &decoded))
+	require.Equal(t, raw, decoded)
+}
+
+func TestUnknownConfigFieldSurvivesHeaderRewrite(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	d.meta.Config.extra = extraFields{"future_key": json.RawMessage(`{"nested":["1","2"]}`)}
+	require.NoError(t, d.writeHeader())
+
+	d, err = initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"nested":["1","2"]}`, string(d.meta.Config.extra["future_key"]))
+	require.NoError(t, d.writeHeader())
+
+	d, err = initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"nested":["1","2"]}`, string(d.meta.Config.extra["future_key"]))
+	_, err = d.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+}
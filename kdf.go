@@ -0,0 +1,101 @@
+package luks
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Kdf derives a key from a passphrase. It allows to plug an alternative implementation of a KDF type e.g. an
+// OpenSSL-backed pbkdf2 in FIPS environments or a hardware-backed argon2, see RegisterKdf.
+type Kdf interface {
+	// DeriveKey derives a key of keyLength bytes. Only the params fields of the KDF type are set: Hash and Iterations
+	// for pbkdf2, Time, Memory (in KiB) and Threads for argon2.
+	DeriveKey(passphrase, salt []byte, params KdfParams, keyLength int) ([]byte, error)
+}
+
+// KdfFunc is an adapter to use ordinary functions as Kdf
+type KdfFunc func(passphrase, salt []byte, params KdfParams, keyLength int) ([]byte, error)
+
+// DeriveKey calls f(passphrase, salt, params, keyLength)
+func (f KdfFunc) DeriveKey(passphrase, salt []byte, params KdfParams, keyLength int) ([]byte, error) {
+	return f(passphrase, salt, params, keyLength)
+}
+
+// builtinKdfs are the pure Go implementations used by default
+var builtinKdfs = map[string]Kdf{
+	"pbkdf2": KdfFunc(func(passphrase, salt []byte, params KdfParams, keyLength int) ([]byte, error) {
+		h, _ := getHashAlgo(params.Hash)
+		if h == nil {
+			return nil, fmt.Errorf("Unknown pbkdf2 hash algorithm: %v", params.Hash)
+		}
+		return pbkdf2.Key(passphrase, salt, params.Iterations, keyLength, h), nil
+	}),
+	"argon2i": KdfFunc(func(passphrase, salt []byte, params KdfParams, keyLength int) ([]byte, error) {
+		return argon2.Key(passphrase, salt, uint32(params.Time), uint32(params.Memory), uint8(params.Threads), uint32(keyLength)), nil
+	}),
+	"argon2id": KdfFunc(func(passphrase, salt []byte, params KdfParams, keyLength int) ([]byte, error) {
+		return argon2.IDKey(passphrase, salt, uint32(params.Time), uint32(params.Memory), uint8(params.Threads), uint32(keyLength)), nil
+	}),
+}
+
+var (
+	kdfsMu sync.RWMutex
+	kdfs   = map[string]Kdf{}
+)
+
+func init() {
+	for kdfType, k := range builtinKdfs {
+		kdfs[kdfType] = k
+	}
+}
+
+// RegisterKdf registers the implementation of the KDF type (e.g. "argon2id") used for keyslots and digests.
+// It replaces the built-in implementation or adds a type luks.go does not implement. A nil kdf restores
+// the built-in implementation of the type or unregisters a type without one.
+func RegisterKdf(kdfType string, kdf Kdf) {
+	kdfsMu.Lock()
+	defer kdfsMu.Unlock()
+	if kdf == nil {
+		kdf = builtinKdfs[kdfType]
+	}
+	if kdf == nil {
+		delete(kdfs, kdfType)
+	} else {
+		kdfs[kdfType] = kdf
+	}
+}
+
+// SupportedKdfs returns list of key derivation functions supported for keyslots and digests
+func SupportedKdfs() []string {
+	kdfsMu.RLock()
+	defer kdfsMu.RUnlock()
+	names := make([]string, 0, len(kdfs))
+	for name := range kdfs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// deriveKdfKey derives a key with the implementation registered for params.Type
+func deriveKdfKey(passphrase, salt []byte, params KdfParams, keyLength int) ([]byte, error) {
+	kdfsMu.RLock()
+	k, ok := kdfs[params.Type]
+	kdfsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown kdf type: %v", params.Type)
+	}
+	key, err := k.DeriveKey(passphrase, salt, params, keyLength)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != keyLength {
+		clearSlice(key)
+		return nil, fmt.Errorf("%v returned a key of %d bytes, expected %d", params.Type, len(key), keyLength)
+	}
+	return secureMove(key), nil
+}
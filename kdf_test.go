@@ -0,0 +1,62 @@
+package luks
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterKdf(t *testing.T) {
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+
+	builtin := builtinKdfs["pbkdf2"]
+	var calls []KdfParams
+	RegisterKdf("pbkdf2", KdfFunc(func(passphrase, salt []byte, params KdfParams, keyLength int) ([]byte, error) {
+		calls = append(calls, params)
+		return builtin.DeriveKey(passphrase, salt, params, keyLength)
+	}))
+	defer RegisterKdf("pbkdf2", nil)
+
+	v, err := d.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, v.key)
+	// the keyslot and the digest
+	require.Len(t, calls, 2)
+	require.Equal(t, KdfParams{Type: "pbkdf2", Hash: "sha256", Iterations: fixtureIterations}, calls[0])
+
+	RegisterKdf("pbkdf2", KdfFunc(func(passphrase, salt []byte, params KdfParams, keyLength int) ([]byte, error) {
+		return nil, fmt.Errorf("pbkdf2 is disabled")
+	}))
+	_, err = d.UnsealVolume(0, []byte("foobar"))
+	require.Error(t, err)
+	require.Equal(t, "pbkdf2 is disabled", err.Error())
+
+	// a nil kdf restores the built-in implementation
+	RegisterKdf("pbkdf2", nil)
+	_, err = d.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	require.Contains(t, SupportedKdfs(), "pbkdf2")
+}
+
+func TestRegisterKdfNewType(t *testing.T) {
+	require.NotContains(t, SupportedKdfs(), "test")
+	_, err := deriveKdfKey([]byte("foobar"), nil, KdfParams{Type: "test"}, 32)
+	require.Error(t, err)
+
+	RegisterKdf("test", KdfFunc(func(passphrase, salt []byte, params KdfParams, keyLength int) ([]byte, error) {
+		return make([]byte, 16), nil
+	}))
+	require.Contains(t, SupportedKdfs(), "test")
+	// the key length returned by the implementation is verified
+	_, err = deriveKdfKey([]byte("foobar"), nil, KdfParams{Type: "test"}, 32)
+	require.Error(t, err)
+	key, err := deriveKdfKey([]byte("foobar"), nil, KdfParams{Type: "test"}, 16)
+	require.NoError(t, err)
+	require.Len(t, key, 16)
+
+	RegisterKdf("test", nil)
+	require.NotContains(t, SupportedKdfs(), "test")
+}
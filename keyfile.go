@@ -0,0 +1,69 @@
+package luks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DefaultKeyfileSizeMax is the maximum keyfile size read when no size is given, the same as cryptsetup uses
+const DefaultKeyfileSizeMax = 8 * 1024 * 1024
+
+// ReadKeyfile reads a passphrase from the keyfile the same way `cryptsetup --key-file --keyfile-offset
+// --keyfile-size` does. offset bytes are skipped. If maxSize is positive exactly maxSize bytes are read,
+// otherwise everything till EOF is read (at most DefaultKeyfileSizeMax bytes).
+// The content is used verbatim: a keyfile is binary data, it is not terminated at a NUL byte and a trailing newline
+// is part of the passphrase.
+func ReadKeyfile(r io.Reader, offset, maxSize int64) ([]byte, error) {
+	if offset < 0 || maxSize < 0 {
+		return nil, fmt.Errorf("invalid keyfile offset %d or size %d", offset, maxSize)
+	}
+	if offset > 0 {
+		if err := skipKeyfileOffset(r, offset); err != nil {
+			return nil, err
+		}
+	}
+
+	if maxSize > 0 {
+		key := make([]byte, maxSize)
+		if n, err := io.ReadFull(r, key); err != nil {
+			clearSlice(key)
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, fmt.Errorf("cannot read requested amount of keyfile data: got %d of %d bytes", n, maxSize)
+			}
+			return nil, err
+		}
+		return key, nil
+	}
+
+	key, err := io.ReadAll(io.LimitReader(r, DefaultKeyfileSizeMax+1))
+	if err != nil {
+		clearSlice(key)
+		return nil, err
+	}
+	if len(key) > DefaultKeyfileSizeMax {
+		clearSlice(key)
+		return nil, fmt.Errorf("keyfile exceeds maximum size %d", DefaultKeyfileSizeMax)
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("keyfile is empty")
+	}
+	return key, nil
+}
+
+// skipKeyfileOffset skips offset bytes of the keyfile. Readers that cannot seek (e.g. an *os.File that is a pipe
+// or stdin fails with ESPIPE) are read through instead.
+func skipKeyfileOffset(r io.Reader, offset int64) error {
+	if s, ok := r.(io.Seeker); ok {
+		if _, err := s.Seek(offset, io.SeekCurrent); err == nil {
+			return nil
+		}
+	}
+	if n, err := io.CopyN(io.Discard, r, offset); err != nil {
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("keyfile is shorter than offset %d (%d bytes)", offset, n)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package luks
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadKeyfile(t *testing.T) {
+	data := []byte("head\x00secret\n\x00tail")
+
+	// no size given: everything till EOF including NUL bytes and newlines
+	key, err := ReadKeyfile(bytes.NewReader(data), 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, key)
+
+	key, err = ReadKeyfile(bytes.NewReader(data), 5, 8)
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret\n\x00"), key)
+
+	// the offset is skipped by reading for non-seekable streams (e.g. stdin)
+	key, err = ReadKeyfile(io.MultiReader(strings.NewReader("head\x00"), strings.NewReader("secret\n")), 5, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret\n"), key)
+
+	// *os.File is a Seeker but seeking a pipe fails with ESPIPE
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	go func() {
+		_, _ = w.Write(data)
+		w.Close()
+	}()
+	key, err = ReadKeyfile(r, 5, 8)
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret\n\x00"), key)
+
+	_, err = ReadKeyfile(bytes.NewReader(data), 5, 100)
+	require.Error(t, err)
+	_, err = ReadKeyfile(io.MultiReader(bytes.NewReader(data)), 100, 0)
+	require.Error(t, err)
+	_, err = ReadKeyfile(bytes.NewReader(data), int64(len(data)), 0)
+	require.Error(t, err)
+	_, err = ReadKeyfile(bytes.NewReader(data), -1, 0)
+	require.Error(t, err)
+	_, err = ReadKeyfile(bytes.NewReader(make([]byte, DefaultKeyfileSizeMax+1)), 0, 0)
+	require.Error(t, err)
+}
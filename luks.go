@@ -2,17 +2,70 @@ package luks
 
 import (
 	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/anatol/devmapper.go"
+	"golang.org/x/sys/unix"
 )
 
-// ErrPassphraseDoesNotMatch is an error that indicates provided passphrase does not match
-var ErrPassphraseDoesNotMatch = fmt.Errorf("Passphrase does not match")
+// ErrPassphraseIncorrect is an error that indicates provided passphrase does not match the keyslot. Callers
+// might ask for the passphrase again.
+var ErrPassphraseIncorrect = fmt.Errorf("Passphrase does not match")
 
-// Device represents LUKS partition data
+// ErrPassphraseDoesNotMatch is the former name of ErrPassphraseIncorrect.
+//
+// Deprecated: use ErrPassphraseIncorrect.
+var ErrPassphraseDoesNotMatch = ErrPassphraseIncorrect
+
+// ErrVolumeKeyIncorrect is returned when a volume key provided by the caller does not match the volume key digest
+var ErrVolumeKeyIncorrect = fmt.Errorf("Volume key does not match")
+
+// ErrVolumeKeyExportDisabled is returned by Unlocker.VolumeKey if the device is opened without
+// OpenOptions.AllowVolumeKeyExport
+var ErrVolumeKeyExportDisabled = fmt.Errorf("Volume key export is disabled")
+
+// ErrMetadataOnly is an error that indicates the keyslot can't be unsealed as the device is opened with
+// OpenOptions.MetadataOnly
+var ErrMetadataOnly = fmt.Errorf("Device is opened in metadata-only mode")
+
+// ErrKeyslotInactive is an error that indicates the keyslot is not in use (LUKS v1 keyslot marked as
+// LUKS_KEY_DISABLED or a missing LUKS v2 keyslot)
+var ErrKeyslotInactive = fmt.Errorf("Keyslot is inactive")
+
+// ErrKeyslotDisabled is the former name of ErrKeyslotInactive.
+//
+// Deprecated: use ErrKeyslotInactive.
+var ErrKeyslotDisabled = ErrKeyslotInactive
+
+// ErrKeyslotUnbound is an error that indicates the LUKS2 keyslot is not bound to a data segment thus it does
+// not store the volume key, see Inspector.UnboundSlots
+var ErrKeyslotUnbound = fmt.Errorf("Keyslot is not bound to a data segment")
+
+// ErrKdfMemoryLimit is an error that indicates the keyslot KDF requires more memory than allowed by
+// OpenOptions.MaxKdfMemory
+var ErrKdfMemoryLimit = fmt.Errorf("Keyslot KDF memory cost exceeds the limit")
+
+// ErrNotLuksDevice is an error that indicates the device does not contain a LUKS header
+var ErrNotLuksDevice = fmt.Errorf("Device is not a LUKS device")
+
+// ErrUnsupportedVersion is an error that indicates the device has a LUKS header of a version other than 1 or 2
+var ErrUnsupportedVersion = fmt.Errorf("Unsupported LUKS version")
+
+// ErrHeaderCorrupted is an error that indicates the LUKS header is damaged e.g. its checksum or metadata is invalid.
+// The returned errors wrap it with the details, use errors.Is() to check for it.
+var ErrHeaderCorrupted = fmt.Errorf("LUKS header is corrupted")
+
+// Device represents LUKS partition data. Both LUKS v1 and v2 devices implement it so callers can write
+// version-agnostic code, Version() and Capabilities() allow to check for format-specific features.
+// Devices returned by Open also implement the optional Inspector, Unlocker, Writer and TokenManager interfaces,
+// use a type assertion to access them e.g. `w, ok := dev.(luks.Writer)`.
 type Device interface {
 	io.Closer
 	// Version returns version of LUKS disk
@@ -21,11 +74,17 @@ type Device interface {
 	Path() string
 	// UUID returns UUID of the LUKS partition
 	UUID() string
-	// Slots returns list of all active slots for this device sorted by priority
+	// Slots returns list of all active slots for this device sorted by priority. LUKS v2 keyslots with "ignore"
+	// priority are not listed thus never tried by UnlockAny, they can still be unsealed explicitly by id.
+	// Unbound keyslots are not listed either, see UnboundSlots.
 	Slots() []int
 	// Tokens returns list of available tokens (metadata) for slots
 	Tokens() ([]Token, error)
-	// FlagsGet get the list of LUKS flags (options) used during unlocking
+	// Capabilities reports features supported by this device. It allows to write version-agnostic code
+	// instead of type-asserting/checking Version().
+	Capabilities() Capabilities
+	// FlagsGet get the list of LUKS flags (options) used during unlocking. It is initialized with the persistent
+	// flags that are applicable to dm-crypt, other flags (e.g. dm-integrity "no-journal") are ignored.
 	FlagsGet() []string
 	// FlagsAdd adds LUKS flags used for the upcoming unlocking
 	// Note that this method does not update LUKS v2 persistent flags
@@ -44,10 +103,187 @@ type Device interface {
 	//   volume.SetupMapper(dmName)
 	// ```
 	Unlock(keyslot int, passphrase []byte, dmName string) error
-	// UnlockAny iterates over all available slots and tries to unlock them until succeeds
+	// UnlockAny iterates over all available slots and tries to unlock them until succeeds.
+	// Use UnsealAny to try the slots concurrently.
 	UnlockAny(passphrase []byte, dmName string) error
 }
 
+// Inspector is implemented by devices that expose the on-disk metadata in detail e.g. for auditing, repair and
+// backup tools
+type Inspector interface {
+	// Label returns the LUKS2 header label (used e.g. by udev for /dev/disk/by-label), LUKS v1 has no label
+	Label() string
+	// Subsystem returns the LUKS2 header subsystem label, LUKS v1 has no subsystem
+	Subsystem() string
+	// UnboundSlots returns LUKS v2 keyslots sorted by id that are not bound to a data segment (`cryptsetup luksAddKey
+	// --unbound`, systemd stores wrapped keys this way). Such a keyslot stores an arbitrary key instead of the volume
+	// key, it can be read with UnsealUnboundKey. LUKS v1 has no unbound keyslots.
+	UnboundSlots() []int
+	// Flags returns the persistent flags stored in the LUKS2 header config (`cryptsetup --persistent`).
+	// LUKS v1 has no persistent flags.
+	Flags() []string
+	// AutoUnlockable reports whether the device can be unlocked without user interaction i.e. a token bound to
+	// an active keyslot can be handled by a registered TokenHandler (see RegisterTokenHandler)
+	AutoUnlockable() bool
+	// KeyslotFeasible reports whether the keyslot can be unlocked on this machine e.g. argon2 memory cost of
+	// the keyslot fits into available system memory. If it is not feasible then reason describes why.
+	// It allows a low-memory (e.g. recovery) environment to warn the user before attempting to unlock.
+	KeyslotFeasible(keyslot int) (feasible bool, reason string)
+	// EstimatedUnlockTime estimates how long it takes to unlock the keyslot on this machine. It is based on
+	// the keyslot KDF parameters and a short benchmark of the KDF, the passphrase is not needed.
+	// It allows a boot UI to show a realistic progress instead of an indefinite spinner.
+	EstimatedUnlockTime(keyslot int) (time.Duration, error)
+	// RequiredAlgorithms returns lists of ciphers, cipher modes, hashes and key derivation functions needed to
+	// unlock the device keyslots and to map its data segments. Modes are block modes without the IV generator
+	// e.g. "xts". It allows to check the device against SupportedCiphers(), SupportedModes(), SupportedHashes(),
+	// SupportedKdfs() before unlocking. Note that data segments are decrypted by the kernel
+	// (dm-crypt), their cipher has to be supported by the kernel crypto API as well.
+	RequiredAlgorithms() (ciphers, modes, hashes, kdfs []string)
+	// MasterKeyDigestParams returns parameters of the master (volume) key digest. It allows external tools to verify
+	// a volume key offline or to bind new keyslots to the same volume key.
+	MasterKeyDigestParams() (DigestParams, error)
+	// KeyslotLayout returns on-disk layout of the keyslots area. It is intended for repair tooling that needs to verify
+	// or reconstruct a damaged keyslot layout.
+	KeyslotLayout() (KeyslotLayout, error)
+	// Keyslot returns parameters of the keyslot e.g. for auditing against a security policy. For an inactive keyslot
+	// only ID, State and (LUKS v1) Area are set.
+	Keyslot(keyslot int) (KeyslotInfo, error)
+	// Segments returns data segments of the device sorted by id. LUKS v1 devices have a single crypt segment.
+	Segments() ([]SegmentInfo, error)
+	// Digests returns volume key digests sorted by id together with keyslots and segments they bind. A keyslot that
+	// is not listed by any digest can't be verified. LUKS v1 devices have a single digest bound to all active keyslots.
+	Digests() ([]DigestInfo, error)
+	// DumpTo writes a human-readable report of the device metadata similar to `cryptsetup luksDump`
+	// (e.g. for bug reports). The report contains no secret material.
+	DumpTo(w io.Writer) error
+	// MetadataJSON returns the LUKS2 JSON metadata exactly as it is stored in the JSON area (without the zero
+	// padding). LUKS v1 has no JSON metadata, an error is returned.
+	MetadataJSON() ([]byte, error)
+	// MarshalJSON encodes a normalized view of the device metadata (version, UUID, flags, keyslots, tokens,
+	// segments and digests) that is the same for both LUKS versions. It contains no secret material.
+	MarshalJSON() ([]byte, error)
+	// Snapshot returns a deterministic summary of the device metadata that can be stored and compared later
+	// to detect changes e.g. unauthorized enrollment. See DeviceSnapshot.
+	Snapshot() (DeviceSnapshot, error)
+	// BackupHeader writes the whole LUKS metadata region (binary headers, JSON metadata and keyslots area) to w,
+	// similar to `cryptsetup luksHeaderBackup`. The backup can be restored with RestoreHeader().
+	BackupHeader(w io.Writer, opts BackupOptions) error
+}
+
+// Unlocker is implemented by devices that support unlocking methods other than a keyslot passphrase, cancellable
+// unlocking and suspending of the active mapping
+type Unlocker interface {
+	// UnsealVolumeContext is similar to UnsealVolume but aborts once ctx is cancelled, e.g. a slow argon2 keyslot
+	// does not block a shutdown. It returns ctx.Err() and wipes the derived key material in this case.
+	UnsealVolumeContext(ctx context.Context, keyslot int, passphrase []byte) (*Volume, error)
+	// UnlockContext is the cancellable version of Unlock, see UnsealVolumeContext
+	UnlockContext(ctx context.Context, keyslot int, passphrase []byte, dmName string) error
+	// UnlockAnyContext is the cancellable version of UnlockAny, see UnsealVolumeContext
+	UnlockAnyContext(ctx context.Context, passphrase []byte, dmName string) error
+	// UnlockWithKeyfile reads the passphrase from r with ReadKeyfile (cryptsetup `--key-file`, `--keyfile-offset` and
+	// `--keyfile-size` semantics) and unlocks the keyslot. A negative keyslot tries all keyslots like UnlockAny.
+	UnlockWithKeyfile(keyslot int, r io.Reader, offset, maxSize int64, dmName string) error
+	// UnlockWithClevis recovers the passphrase of a keyslot from its clevis token and maps the volume with dmName.
+	// The tang and sss pins are built-in, no clevis or jose binaries are needed. Other pins can be added with
+	// RegisterClevisPin, e.g. the tpm2 pin is implemented at the clevistpm2 package.
+	// Tokens are tried in order until one of them unlocks its keyslot.
+	UnlockWithClevis(ctx context.Context, dmName string) error
+	// UnlockWithVolumeKey verifies the volume key against the header digest and maps the volume with dmName without
+	// using any keyslot, it is equivalent of `cryptsetup open --master-key-file`. It is useful for recovery when
+	// all keyslots are lost but the volume key was backed up. ErrVolumeKeyIncorrect is returned if the key does
+	// not match. The key is copied, the caller keeps its ownership.
+	UnlockWithVolumeKey(key []byte, dmName string) error
+	// VolumeKey recovers the volume key using the keyslot passphrase and returns it, it is equivalent of
+	// `cryptsetup luksDump --dump-master-key`. It is meant for key escrow and backup systems, use UnsealVolume
+	// to activate the volume. The device needs to be opened with OpenOptions.AllowVolumeKeyExport otherwise
+	// ErrVolumeKeyExportDisabled is returned. The caller should Wipe the key once it is stored.
+	VolumeKey(keyslot int, passphrase []byte) (*VolumeKey, error)
+	// UnsealUnboundKey recovers the key stored in an unbound keyslot, UnsealVolume returns ErrKeyslotUnbound for
+	// such keyslots. The caller should wipe the key once it is not needed anymore.
+	UnsealUnboundKey(keyslot int, passphrase []byte) ([]byte, error)
+	// Suspend suspends I/O of the device mapping and wipes the volume key from the kernel memory, it is equivalent
+	// of `cryptsetup luksSuspend`. The mapping stays frozen until Resume() is called.
+	Suspend(dmName string) error
+	// Resume recovers the volume key using any keyslot that matches the passphrase, passes it to the suspended mapping
+	// and resumes I/O. It is equivalent of `cryptsetup luksResume`.
+	Resume(dmName string, passphrase []byte) error
+}
+
+// Writer is implemented by devices that can modify the LUKS header: keyslots, UUID, labels and persistent flags.
+// Note that the methods fail unless the device is opened with OpenOptions.ReadWrite, see Capabilities().Writable.
+type Writer interface {
+	// SetUUID changes UUID of the volume (e.g. of a cloned disk image), it is equivalent of
+	// `cryptsetup luksUUID --uuid`. An empty uuid generates a random one. Active mappings keep the old UUID in
+	// their device-mapper UUID until they are reopened. The device needs to be opened with OpenOptions.ReadWrite.
+	SetUUID(uuid string) error
+	// SetLabel updates the label in both LUKS2 header copies, it is equivalent of `cryptsetup config --label`.
+	// The device needs to be opened with OpenOptions.ReadWrite.
+	SetLabel(label string) error
+	// SetSubsystem updates the subsystem label in both LUKS2 header copies (`cryptsetup config --subsystem`).
+	// The device needs to be opened with OpenOptions.ReadWrite.
+	SetSubsystem(subsystem string) error
+	// SetFlags replaces the persistent flags and rewrites both LUKS2 header copies, it is equivalent of
+	// `cryptsetup refresh --persistent`. Flags used by the current device object for unlocking (FlagsGet) are not
+	// changed. The device needs to be opened with OpenOptions.ReadWrite.
+	SetFlags(flags []string) error
+	// AddKeyslot adds a new keyslot protected with newPassphrase and returns its id. The volume key is recovered
+	// using existingPassphrase. The device needs to be opened with OpenOptions.ReadWrite.
+	AddKeyslot(existingPassphrase, newPassphrase []byte, kdf KdfParams) (keyslot int, err error)
+	// AddKeyslotWithVolumeKey adds a new keyslot protected with newPassphrase using the volume key instead of
+	// an existing passphrase, it is equivalent of `cryptsetup luksAddKey --master-key-file`. The key is verified
+	// against the header digest, ErrVolumeKeyIncorrect is returned if it does not match.
+	// The device needs to be opened with OpenOptions.ReadWrite.
+	AddKeyslotWithVolumeKey(volumeKey *VolumeKey, newPassphrase []byte, kdf KdfParams) (keyslot int, err error)
+	// AddUnboundKeyslot stores the key into a new LUKS v2 keyslot that is not bound to a data segment and returns
+	// its id, it is equivalent of `cryptsetup luksAddKey --unbound --volume-key-file`. The keyslot gets its own
+	// digest of the key. The device needs to be opened with OpenOptions.ReadWrite.
+	AddUnboundKeyslot(key, passphrase []byte, kdf KdfParams) (keyslot int, err error)
+	// ChangePassphrase replaces the passphrase of the keyslot, the keyslot id and KDF cost parameters are preserved.
+	// The new key material is written before the old one is wiped so an interrupted change (e.g. power loss) leaves
+	// the keyslot usable with either the old or the new passphrase.
+	// The device needs to be opened with OpenOptions.ReadWrite.
+	ChangePassphrase(keyslot int, oldPassphrase, newPassphrase []byte) error
+	// RemoveKeyslot securely wipes the keyslot material and removes the keyslot from the header. LUKS v2 digests and
+	// tokens do not reference the keyslot anymore. It refuses to remove the last keyslot of the device.
+	// The device needs to be opened with OpenOptions.ReadWrite.
+	RemoveKeyslot(keyslot int) error
+	// UnlockAndKillSlot recovers the volume key using the given keyslot and then wipes the keyslot so the passphrase
+	// (e.g. a one-time recovery passphrase) can't be used anymore. It refuses to kill the last keyslot of the device.
+	// The device needs to be opened with OpenOptions.ReadWrite.
+	UnlockAndKillSlot(keyslot int, passphrase []byte) ([]byte, error)
+}
+
+// TokenManager is implemented by devices that can modify tokens stored in the LUKS header.
+// The device needs to be opened with OpenOptions.ReadWrite.
+type TokenManager interface {
+	// EnrollToken adds a new keyslot protected with newPassphrase and a token bound to it. Both keyslot and token
+	// are written with a single header update so a crash can't leave an orphan keyslot or token.
+	// The volume key is recovered using existingPassphrase. Token.Type and Token.Payload (JSON object) are used,
+	// the token's keyslots list is set to the new keyslot.
+	EnrollToken(existingPassphrase, newPassphrase []byte, token Token, kdf KdfParams) (keyslot int, tokenID int, err error)
+	// ImportToken adds the token to the LUKS2 metadata with the first free token id and returns the id, it is
+	// equivalent of `cryptsetup token import`. Token.Payload must be a JSON object, non-empty Token.Type overrides
+	// its "type" field. The token is bound to Token.Slots, the keyslots must exist. Token.ID is ignored.
+	// The device needs to be opened with OpenOptions.ReadWrite.
+	ImportToken(token Token) (tokenID int, err error)
+	// RemoveToken removes the token from the LUKS2 metadata, the keyslots bound to it are kept.
+	// The device needs to be opened with OpenOptions.ReadWrite.
+	RemoveToken(tokenID int) error
+	// ReplaceToken replaces the token payload in place keeping its id, e.g. to re-bind a TPM policy. The new token
+	// is validated the same way as with ImportToken and written with a single header update.
+	// The device needs to be opened with OpenOptions.ReadWrite.
+	ReplaceToken(tokenID int, token Token) error
+}
+
+// device is implemented by both LUKS versions, it combines Device with all the optional interfaces
+type device interface {
+	Device
+	Inspector
+	Unlocker
+	Writer
+	TokenManager
+}
+
 // List of options handled by luks.go API.
 // These names correspond to LUKSv2 persistent flags names (see persistent_flags[] array).
 const (
@@ -56,48 +292,622 @@ const (
 	FlagSubmitFromCryptCPUs string = "submit-from-crypt-cpus"
 	FlagNoReadWorkqueue     string = "no-read-workqueue"  // supported at Linux 5.9 or newer
 	FlagNoWriteWorkqueue    string = "no-write-workqueue" // supported at Linux 5.9 or newer
+	// FlagReadOnly activates the mapping read-only (`cryptsetup open --readonly`). It is an activation option only,
+	// LUKS2 has no such persistent flag.
+	FlagReadOnly string = "read-only"
+)
+
+// Well-known token types
+const (
+	ClevisTokenType          = "clevis"
+	LUKS2KeyringTokenType    = "luks2-keyring"
+	SystemdFido2TokenType    = "systemd-fido2"
+	SystemdTPM2TokenType     = "systemd-tpm2"
+	SystemdPKCS11TokenType   = "systemd-pkcs11"
+	SystemdRecoveryTokenType = "systemd-recovery"
 )
 
+var knownTokenTypes = []string{
+	ClevisTokenType,
+	LUKS2KeyringTokenType,
+	SystemdFido2TokenType,
+	SystemdTPM2TokenType,
+	SystemdPKCS11TokenType,
+	SystemdRecoveryTokenType,
+}
+
+// normalizeTokenType trims the token type and maps it case-insensitively to one of the well-known types.
+// Some token producers are lenient about whitespaces and casing.
+func normalizeTokenType(tokenType string) string {
+	tokenType = strings.TrimSpace(tokenType)
+	for _, t := range knownTokenTypes {
+		if strings.EqualFold(tokenType, t) {
+			return t
+		}
+	}
+	return tokenType
+}
+
 // Token represents LUKS token metadata information
 type Token struct {
 	ID    int
 	Slots []int
-	// Type of the token e.g. "clevis", "systemd-fido2"
+	// Type of the token e.g. "clevis", "systemd-fido2". Well-known types are normalized (trimmed, case-insensitive match)
 	Type    string
 	Payload []byte
+	// Value is the decoded payload, it is set only if a decoder is registered for the type (see RegisterTokenType)
+	Value interface{}
+}
+
+// KeyslotArea describes location of a keyslot binary material on the disk
+type KeyslotArea struct {
+	Keyslot int
+	Active  bool
+	Offset  uint64 // in bytes from the beginning of the LUKS device
+	Size    uint64 // in bytes
+}
+
+// KeyslotState describes whether a keyslot is in use
+type KeyslotState string
+
+const (
+	KeyslotStateInactive KeyslotState = "inactive"
+	KeyslotStateActive   KeyslotState = "active"
+	// KeyslotStateUnbound is a LUKS2 keyslot that is not assigned to the data segment (`cryptsetup luksAddKey
+	// --unbound`), the stored key is not the volume key.
+	KeyslotStateUnbound KeyslotState = "unbound"
+)
+
+// KeyslotInfo describes keyslot parameters
+type KeyslotInfo struct {
+	ID    int
+	State KeyslotState
+	// Priority is one of "ignore", "normal", "prefer". LUKS v1 keyslots are always "normal".
+	Priority string
+	KeySize  int // size of the stored key in bytes
+	Kdf      KdfParams
+	KdfSalt  []byte
+	// AreaEncryption is the cipher of the keyslot area e.g. "aes-xts-plain64"
+	AreaEncryption string
+	AreaKeySize    int // in bytes
+	AfStripes      int
+	AfHash         string
+	Area           KeyslotArea
+}
+
+// DigestInfo describes a digest object, it binds keyslots to data segments
+type DigestInfo struct {
+	ID int
+	DigestParams
+	Keyslots []int
+	Segments []int
+}
+
+// SegmentInfo describes a data segment, it contains the parameters needed to build a dm-crypt table
+type SegmentInfo struct {
+	ID   int
+	Type string // "crypt" or "linear"
+	// Offset is in bytes from the beginning of the LUKS device, or of the data device if the header is detached
+	Offset uint64
+	// Size of the segment in bytes, it is zero for a dynamic segment that spans up to the end of the device
+	Size       uint64
+	Dynamic    bool
+	Encryption string // e.g. "aes-xts-plain64"
+	IvTweak    uint64 // in sectors
+	SectorSize int
+	// Integrity is the dm-integrity algorithm of authenticated encryption, empty if the segment is not protected
+	Integrity string
+}
+
+// KeyslotLayout describes the keyslots region and areas of the individual keyslots
+type KeyslotLayout struct {
+	RegionOffset uint64 // in bytes from the beginning of the LUKS device
+	RegionSize   uint64
+	// Alignment is the largest power of two (up to 1MiB) all keyslot area offsets are aligned to.
+	// cryptsetup aligns keyslot areas to 4096 bytes.
+	Alignment uint64
+	Areas     []KeyslotArea // sorted by keyslot id
 }
 
+// observedAlignment returns the largest power of two (up to 1MiB) that all the offsets are multiple of
+func observedAlignment(areas []KeyslotArea) uint64 {
+	alignment := uint64(1024 * 1024)
+	for _, a := range areas {
+		for a.Offset%alignment != 0 {
+			alignment /= 2
+		}
+	}
+	return alignment
+}
+
+// KdfParams specifies key derivation function parameters for a new keyslot
+type KdfParams struct {
+	// Type of the KDF, one of "pbkdf2", "argon2i", "argon2id"
+	Type string
+	// pbkdf2 parameters
+	Hash       string
+	Iterations int
+	// argon2 parameters
+	Time    int
+	Memory  int // memory cost in KiB
+	Threads int
+}
+
+// Thresholds used by CheckKdfStrength
+const (
+	minPbkdf2Iterations = 600000  // OWASP recommendation for pbkdf2-sha256
+	minArgon2Memory     = 1048576 // 1GiB in KiB, cryptsetup default maximum
+	minArgon2Time       = 4
+)
+
+// CheckKdfStrength checks KDF parameters of a keyslot against a policy and returns a list of warnings
+// (e.g. too few pbkdf2 iterations, too little argon2 memory). An empty list means the parameters are fine.
+func CheckKdfStrength(kdf KdfParams) []string {
+	var warnings []string
+
+	switch kdf.Type {
+	case "pbkdf2":
+		warnings = append(warnings, "pbkdf2 is not memory-hard, consider using argon2id")
+		if kdf.Iterations < minPbkdf2Iterations {
+			warnings = append(warnings, fmt.Sprintf("pbkdf2 iterations %d is below recommended minimum %d", kdf.Iterations, minPbkdf2Iterations))
+		}
+		switch strings.ToLower(kdf.Hash) {
+		case "sha1", "ripemd160":
+			warnings = append(warnings, fmt.Sprintf("pbkdf2 hash %v is weak, consider using sha256 or stronger", kdf.Hash))
+		}
+	case "argon2i", "argon2id":
+		if kdf.Memory < minArgon2Memory {
+			warnings = append(warnings, fmt.Sprintf("%v memory %d KiB is below recommended minimum %d KiB", kdf.Type, kdf.Memory, minArgon2Memory))
+		}
+		if kdf.Time < minArgon2Time {
+			warnings = append(warnings, fmt.Sprintf("%v time cost %d is below recommended minimum %d", kdf.Type, kdf.Time, minArgon2Time))
+		}
+	default:
+		warnings = append(warnings, fmt.Sprintf("unknown kdf type %q", kdf.Type))
+	}
+
+	return warnings
+}
+
+// Capabilities describes features supported by a LUKS device
+type Capabilities struct {
+	// Tokens is set if the format natively stores tokens metadata (LUKS2).
+	// Note that for LUKS1 devices Tokens() still reports luksmeta slots.
+	Tokens bool
+	// Integrity is set if a data segment is protected with dm-integrity (LUKS2 authenticated encryption)
+	Integrity bool
+	// Reencryption is set if the device is in the middle of an online reencryption (LUKS2 reencrypt keyslot
+	// or requirements)
+	Reencryption bool
+	// Writable is set if the device is opened for writing and metadata modifying operations
+	// (e.g. UnlockAndKillSlot) can be used. See OpenOptions.ReadWrite.
+	Writable bool
+}
+
+// DigestParams describes how the master (volume) key digest is computed
+type DigestParams struct {
+	// Type of the digest KDF e.g. "pbkdf2"
+	Type       string
+	Hash       string
+	Iterations int
+	Salt       []byte
+	// Digest is the expected digest value. Note that LUKS v1 stores only the first 20 bytes of the digest.
+	Digest []byte
+}
+
+// OpenOptions specifies how the LUKS device is opened
+type OpenOptions struct {
+	// UseSecondaryHeader forces parsing of the secondary LUKS2 header copy even if the primary one is valid.
+	// Together with the default (primary) open it allows to compare both copies e.g. to detect tampering.
+	// LUKS1 has no secondary header.
+	UseSecondaryHeader bool
+	// Offset of the LUKS device within the file e.g. a LUKS partition inside a whole-disk image.
+	// All header and data offsets are relative to it. Only LUKS2 devices are supported.
+	Offset int64
+	// Size of the LUKS device within the file (in bytes starting at Offset). The file might continue past the LUKS
+	// device (e.g. other partitions follow), thus a "dynamic" data segment of a device at a non-zero Offset can be
+	// mapped only if Size is set. Zero means the device extends to the end of the file.
+	Size int64
+	// MetadataOnly parses only the binary header and metadata, keyslot areas are never read. Metadata inspection
+	// methods (Slots(), Tokens(), ...) work as usual but unsealing a keyslot returns ErrMetadataOnly.
+	// It minimizes I/O for bulk scanning workflows that never unlock.
+	MetadataOnly bool
+	// ReadWrite opens the device for writing. It is required for operations that modify LUKS metadata.
+	ReadWrite bool
+	// MaxKdfMemory is the maximum argon2 memory cost (in KiB) of a keyslot that is unsealed, keyslots that request
+	// more fail with ErrKdfMemoryLimit before any memory is allocated. It protects e.g. a small initramfs from
+	// a crafted header. 0 means DefaultMaxKdfMemory, a negative value disables the limit.
+	// LUKS1 keyslots use pbkdf2 only and are not affected.
+	MaxKdfMemory int
+	// AllowVolumeKeyExport enables Unlocker.VolumeKey. Exporting the volume key is disabled by default as anyone who
+	// holds it can decrypt the volume regardless of the keyslots.
+	AllowVolumeKeyExport bool
+}
+
+// DefaultMaxKdfMemory is the default OpenOptions.MaxKdfMemory, 4GiB in KiB. It matches the maximum memory cost
+// cryptsetup uses for new keyslots.
+const DefaultMaxKdfMemory = 4 * 1024 * 1024
+
 // Open reads LUKS headers from the given partition and returns LUKS device object.
-// This function internally handles LUKS v1 and v2 partitions metadata.
+// This function internally handles LUKS v1 and v2 partitions metadata. If the partition does not contain
+// a LUKS header then ErrNotLuksDevice is returned.
 func Open(path string) (Device, error) {
-	f, err := os.Open(path)
+	return OpenWithOptions(path, OpenOptions{})
+}
+
+// OpenWithOptions is similar to Open but allows to specify additional options
+func OpenWithOptions(path string, opts OpenOptions) (Device, error) {
+	return openPath(path, opts)
+}
+
+func openPath(path string, opts OpenOptions) (device, error) {
+	mode := os.O_RDONLY
+	if opts.ReadWrite {
+		mode = os.O_RDWR
+	}
+	f, err := os.OpenFile(path, mode, 0)
 	if err != nil {
 		return nil, err
 	}
 
+	dev, err := openDevice(path, FileStorage{f}, opts)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return dev, nil
+}
+
+// OpenFile reads LUKS headers from an already opened file and returns LUKS device object.
+// The LUKS version is detected from the header. The device takes ownership of the file and closes it in Close().
+func OpenFile(f *os.File) (Device, error) {
+	return openDevice(f.Name(), FileStorage{f}, OpenOptions{})
+}
+
+// OpenStorage reads LUKS headers from the given storage (e.g. a memory buffer or a network block device) and
+// returns LUKS device object. The path is used only for device-mapper activation, it might be empty if the volume
+// is not going to be activated. OpenOptions.ReadWrite is ignored, writes go to the storage as is.
+func OpenStorage(s Storage, path string, opts OpenOptions) (Device, error) {
+	return openDevice(path, s, opts)
+}
+
+// ParseHeader parses LUKS headers from a memory buffer (e.g. a dump of the first megabytes of a disk) and returns
+// a read-only LUKS device object for metadata inspection (version, UUID, keyslots, tokens, segments). The buffer
+// does not need to include the encrypted payload. The buffer must not be modified while the device is in use.
+func ParseHeader(data []byte) (Device, error) {
+	return openDevice("", bytesStorage(data), OpenOptions{})
+}
+
+// ReadHeaderFrom is similar to ParseHeader but reads the headers from the given reader. At most the maximum LUKS
+// header area size (two 4MiB LUKS2 headers and 128MiB of keyslots) is read, the rest of the stream is not consumed.
+func ReadHeaderFrom(r io.Reader) (Device, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxHeaderBackupSize))
+	if err != nil {
+		return nil, err
+	}
+	return ParseHeader(data)
+}
+
+// OpenWithHeader opens a LUKS device with a detached header (see `cryptsetup --header`). The metadata is read from
+// headerPath while the encrypted payload is located at dataPath. Segment offsets are relative to the data device.
+func OpenWithHeader(headerPath, dataPath string) (Device, error) {
+	data, err := os.Open(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(headerPath)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	dev, err := openDevice(headerPath, FileStorage{f}, OpenOptions{})
+	if err != nil {
+		f.Close()
+		data.Close()
+		return nil, err
+	}
+
+	if err := checkHeaderDeviceSize(dev); err != nil {
+		dev.Close()
+		data.Close()
+		return nil, err
+	}
+
+	dd := &dataDevice{path: dataPath, f: FileStorage{data}}
+	switch d := dev.(type) {
+	case *deviceV1:
+		d.data = dd
+	case *deviceV2:
+		d.data = dd
+	}
+	return dev, nil
+}
+
+// checkHeaderDeviceSize verifies that the detached header device holds the whole metadata region declared by
+// the header. The device might be larger (e.g. a raw partition), the rest of it is ignored.
+func checkHeaderDeviceSize(dev device) error {
+	var f Storage
+	switch d := dev.(type) {
+	case *deviceV1:
+		f = d.f
+	case *deviceV2:
+		f = d.f
+	}
+	areaSize, err := headerAreaSize(dev)
+	if err != nil {
+		return err
+	}
+	size, err := f.Size()
+	if err != nil {
+		return err
+	}
+	if size < areaSize {
+		return fmt.Errorf("header device %v is truncated: the metadata region is %d bytes, the device has %d bytes", dev.Path(), areaSize, size)
+	}
+	return nil
+}
+
+// dataDevice is the device with the encrypted payload when it is separated from the LUKS header
+type dataDevice struct {
+	path string
+	f    Storage
+}
+
+func openDevice(path string, f Storage, opts OpenOptions) (device, error) {
+	dev, err := initDevice(path, f, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	switch d := dev.(type) {
+	case *deviceV1:
+		d.metadataOnly = opts.MetadataOnly
+		d.allowKeyExport = opts.AllowVolumeKeyExport
+	case *deviceV2:
+		d.metadataOnly = opts.MetadataOnly
+		d.maxKdfMemory = opts.MaxKdfMemory
+		d.size = opts.Size
+		d.allowKeyExport = opts.AllowVolumeKeyExport
+	}
+	return dev, nil
+}
+
+func initDevice(path string, f Storage, opts OpenOptions) (device, error) {
+	if opts.Offset < 0 || opts.Size < 0 {
+		return nil, fmt.Errorf("invalid LUKS device offset %d or size %d", opts.Offset, opts.Size)
+	}
 	// LUKS Magic and version are stored in the first 8 bytes of the LUKS header
 	header := make([]byte, 8)
-	if _, err := f.ReadAt(header[:], 0); err != nil {
+	if _, err := f.ReadAt(header[:], opts.Offset); err == io.EOF {
+		return nil, ErrNotLuksDevice // the file is too small to contain a LUKS header
+	} else if err != nil {
 		return nil, err
 	}
 
+	if opts.UseSecondaryHeader {
+		// primary header might be corrupted, do not rely on its magic
+		if bytes.Equal(header, []byte("LUKS\xba\xbe\x00\x01")) {
+			return nil, fmt.Errorf("LUKS v1 does not have a secondary header")
+		}
+		return initV2DeviceSecondary(path, f, opts.Offset)
+	}
+
 	// verify header magic
 	if !bytes.Equal(header[0:6], []byte("LUKS\xba\xbe")) {
-		return nil, fmt.Errorf("invalid LUKS header")
+		return nil, ErrNotLuksDevice
 	}
 
 	version := int(header[6])<<8 + int(header[7])
 	switch version {
 	case 1:
+		if opts.Offset != 0 {
+			return nil, fmt.Errorf("LUKS v1 device at non-zero offset is not supported")
+		}
 		return initV1Device(path, f)
 	case 2:
-		return initV2Device(path, f)
+		return initV2DeviceAt(path, f, opts.Offset)
 	default:
-		return nil, fmt.Errorf("invalid LUKS version %v", version)
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedVersion, version)
 	}
 }
 
 // Lock closes device mapper partition with the given name
 func Lock(name string) error {
-	return devmapper.Remove(name)
+	if err := devmapper.Remove(name); err != nil {
+		return err
+	}
+	return removeIntegrityMapper(name, false)
+}
+
+// suspendMapping suspends the mapping of the device and wipes its volume key
+func suspendMapping(d device, name string) error {
+	if err := checkMapperUUID(name, mapperUUID(fmt.Sprintf("LUKS%d", d.Version()), d.UUID(), name)); err != nil {
+		return err
+	}
+	if err := devmapper.Suspend(name); err != nil {
+		return err
+	}
+	if err := devmapper.Message(name, 0, "key wipe"); err != nil {
+		// do not leave the mapping frozen with the key still in memory
+		_ = devmapper.Resume(name)
+		return err
+	}
+	return nil
+}
+
+// resumeMapping recovers the volume key and resumes the suspended mapping of the device
+func resumeMapping(d device, name string, passphrase []byte) error {
+	volume, err := unsealAny(d, passphrase)
+	if err != nil {
+		return err
+	}
+	defer clearSlice(volume.key)
+	return volume.ResumeMapper(name)
+}
+
+// CloseOptions specifies how the mapping is closed
+type CloseOptions struct {
+	// Deferred schedules removal of a mapping that is still in use (e.g. mounted), the kernel removes it once
+	// the last user closes it. It is equivalent of `cryptsetup close --deferred`.
+	Deferred bool
+}
+
+// Close removes device mapper mapping with the given name, it is equivalent of `cryptsetup close`.
+// dm-crypt wipes the volume key from the kernel memory when the mapping is destroyed.
+func Close(name string, opts CloseOptions) error {
+	err := devmapper.Remove(name)
+	if opts.Deferred && errors.Is(err, unix.EBUSY) {
+		if err := deferredRemove(name); err != nil {
+			return err
+		}
+		return removeIntegrityMapper(name, true)
+	}
+	if err != nil {
+		return err
+	}
+	return removeIntegrityMapper(name, false)
+}
+
+// UnsealAnyOptions specifies how UnsealAny tries the keyslots
+type UnsealAnyOptions struct {
+	// Workers is the maximum number of keyslots tried concurrently. Zero or one tries the keyslots one by one.
+	Workers int
+	// MemoryBudget limits memory (in bytes) used by argon2 keyslots that are tried at the same time. Zero means
+	// the memory currently available at the system. A keyslot that needs more than the budget is tried alone.
+	MemoryBudget uint64
+	// RecoveryKey normalizes the passphrase with NormalizeRecoveryKey before trying the keyslots if it is
+	// a well-formed systemd recovery key. Other passphrases are used as is.
+	RecoveryKey bool
+}
+
+// UnsealAny tries all active keyslots of the device and returns the first keyslot that matches the passphrase
+// together with its volume, see Device.UnsealVolume. With opts.Workers > 1 the keyslots are tried concurrently,
+// other attempts are cancelled once a keyslot matches. If no keyslot matches then the error of the first failed
+// keyslot other than ErrPassphraseIncorrect is returned, or ErrPassphraseIncorrect if there is no such keyslot.
+func UnsealAny(ctx context.Context, d Device, passphrase []byte, opts UnsealAnyOptions) (keyslot int, volume *Volume, err error) {
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	budget := opts.MemoryBudget
+	if budget == 0 && workers > 1 {
+		if budget, err = availableMemory(); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if opts.RecoveryKey {
+		if key, err := NormalizeRecoveryKey(passphrase); err == nil {
+			defer clearSlice(key)
+			passphrase = key
+		}
+	}
+
+	type result struct {
+		keyslot int
+		volume  *Volume
+		err     error
+		memory  uint64
+	}
+
+	attemptCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	slots := d.Slots()
+	results := make(chan result, len(slots))
+	errs := make(map[int]error)
+	var found *result
+	var running int
+	var memoryInUse uint64
+	for next := 0; found == nil && (next < len(slots) || running > 0); {
+		if next < len(slots) && running < workers && ctx.Err() == nil {
+			memory := keyslotMemory(d, slots[next])
+			if running == 0 || memoryInUse+memory <= budget {
+				running++
+				memoryInUse += memory
+				go func(keyslot int, memory uint64) {
+					var v *Volume
+					var err error
+					if u, ok := d.(Unlocker); ok {
+						v, err = u.UnsealVolumeContext(attemptCtx, keyslot, passphrase)
+					} else {
+						v, err = d.UnsealVolume(keyslot, passphrase) // the attempt can't be cancelled
+					}
+					results <- result{keyslot, v, err, memory}
+				}(slots[next], memory)
+				next++
+				continue
+			}
+		}
+		if running == 0 {
+			break // the context is cancelled
+		}
+
+		r := <-results
+		running--
+		memoryInUse -= r.memory
+		if r.err == nil {
+			found = &r
+			cancel()
+		} else {
+			errs[r.keyslot] = r.err
+		}
+	}
+
+	// wait for the cancelled attempts, a keyslot might have matched concurrently with the found one
+	for ; running > 0; running-- {
+		if r := <-results; r.err == nil {
+			clearSlice(r.volume.key)
+		}
+	}
+
+	if found != nil {
+		return found.keyslot, found.volume, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+	for _, s := range slots {
+		if err := errs[s]; err != nil && !errors.Is(err, ErrPassphraseIncorrect) {
+			return 0, nil, err
+		}
+	}
+	return 0, nil, ErrPassphraseIncorrect
+}
+
+// keyslotMemory returns amount of memory (in bytes) needed to derive the keyslot key
+func keyslotMemory(dev Device, keyslot int) uint64 {
+	d, ok := dev.(*deviceV2)
+	if !ok {
+		return 0 // LUKS v1 uses pbkdf2 only
+	}
+	ks, ok := d.meta.Keyslots[keyslot]
+	if !ok || (ks.Kdf.Type != "argon2i" && ks.Kdf.Type != "argon2id") {
+		return 0
+	}
+	return uint64(ks.Kdf.Memory) * 1024 // memory cost is specified in KiB
+}
+
+// unsealAny tries all active slots of the device and returns the volume for the first slot that matches the passphrase
+func unsealAny(d Device, passphrase []byte) (*Volume, error) {
+	_, volume, err := UnsealAny(context.Background(), d, passphrase, UnsealAnyOptions{})
+	return volume, err
+}
+
+// SameMasterKey unlocks both devices and checks whether they share the same master (volume) key, e.g. one device
+// is a clone of the other. The keys are compared in constant time and wiped before the function returns.
+func SameMasterKey(a, b Device, passA, passB []byte) (bool, error) {
+	volumeA, err := unsealAny(a, passA)
+	if err != nil {
+		return false, err
+	}
+	defer clearSlice(volumeA.key)
+
+	volumeB, err := unsealAny(b, passB)
+	if err != nil {
+		return false, err
+	}
+	defer clearSlice(volumeB.key)
+
+	return subtle.ConstantTimeCompare(volumeA.key, volumeB.key) == 1, nil
 }
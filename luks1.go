@@ -2,16 +2,18 @@ package luks
 
 import (
 	"bytes"
-	"crypto/cipher"
+	"context"
+	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash"
 	"hash/crc32"
-	"os"
+	"io"
+	"strconv"
+	"strings"
+	"time"
 	"unsafe"
-
-	"golang.org/x/crypto/pbkdf2"
-	"golang.org/x/crypto/xts"
 )
 
 // LUKS v1 format is specified here
@@ -39,30 +41,63 @@ type keySlot struct {
 	Stripes           uint32
 }
 
-const luksV1SlotEnabled = 0xAC71F3
+// keyslot 'active' field values, LUKS_KEY_ENABLED and LUKS_KEY_DISABLED at cryptsetup.
+// Any other value means a corrupted keyslot.
+const (
+	luksV1SlotEnabled  = 0x00AC71F3
+	luksV1SlotDisabled = 0x0000DEAD
+)
+
+// pbkdf2 iterations of new keyslots: LUKS_SLOT_ITERATIONS_MIN and default --iter-time of cryptsetup
+const (
+	luksV1MinIterations   = 1000
+	luksV1DefaultIterTime = 2 * time.Second
+)
 
 type deviceV1 struct {
 	path  string
-	f     *os.File
+	f     Storage
 	hdr   *headerV1
 	flags []string
+	// keyslot areas must not be read, see OpenOptions.MetadataOnly
+	metadataOnly bool
+	// allowKeyExport is OpenOptions.AllowVolumeKeyExport
+	allowKeyExport bool
+	// data is the payload device if the header is detached, nil otherwise
+	data *dataDevice
 }
 
-func initV1Device(path string, f *os.File) (*deviceV1, error) {
+var _ device = (*deviceV1)(nil)
+
+func initV1Device(path string, f Storage) (*deviceV1, error) {
 	var hdr headerV1
 
-	if _, err := f.Seek(0, 0); err != nil {
-		return nil, err
-	}
-	if err := binary.Read(f, binary.BigEndian, &hdr); err != nil {
+	if err := binary.Read(io.NewSectionReader(f, 0, int64(binary.Size(hdr))), binary.BigEndian, &hdr); err != nil {
 		return nil, err
 	}
 
 	return &deviceV1{path: path, f: f, hdr: &hdr}, nil
 }
 
+// headerAreaSize returns size of the on-disk metadata region (binary header and keyslots material) as it is
+// declared by the header. Note that a header device might be larger than this region.
+func (d *deviceV1) headerAreaSize() uint64 {
+	var end uint64
+	length := uint64(keyslotMaterialSize(int(d.hdr.KeyBytes), stripesNum))
+	for _, s := range d.hdr.KeySlots {
+		offset := uint64(s.KeyMaterialOffset) * storageSectorSize
+		if end < offset+length {
+			end = offset + length
+		}
+	}
+	return uint64(roundUp(int(end), 4096))
+}
+
 func (d *deviceV1) Close() error {
-	return d.f.Close()
+	if d.data != nil {
+		closeStorage(d.data.f)
+	}
+	return closeStorage(d.f)
 }
 
 func (d *deviceV1) Path() string {
@@ -83,10 +118,250 @@ func (d *deviceV1) Slots() []int {
 	return slots
 }
 
+func (d *deviceV1) UnboundSlots() []int {
+	return nil
+}
+
+func (d *deviceV1) Capabilities() Capabilities {
+	return Capabilities{Writable: isWritable(d.f)}
+}
+
+func (d *deviceV1) AutoUnlockable() bool {
+	return autoUnlockable(d)
+}
+
+func (d *deviceV1) UnlockWithClevis(ctx context.Context, dmName string) error {
+	volume, err := unsealClevis(ctx, d)
+	if err != nil {
+		return err
+	}
+	return volume.SetupMapper(dmName)
+}
+
 func (d *deviceV1) UUID() string {
 	return fixedArrayToString(d.hdr.UUID[:])
 }
 
+func (d *deviceV1) KeyslotFeasible(keyslotIdx int) (bool, string) {
+	if keyslotIdx < 0 || keyslotIdx >= len(d.hdr.KeySlots) {
+		return false, fmt.Sprintf("keyslot %d is out of range of available slots", keyslotIdx)
+	}
+	if d.hdr.KeySlots[keyslotIdx].Active != luksV1SlotEnabled {
+		return false, fmt.Sprintf("keyslot %d is not active", keyslotIdx)
+	}
+	// LUKS v1 uses pbkdf2 only, it does not need a significant amount of memory
+	return true, ""
+}
+
+func (d *deviceV1) EstimatedUnlockTime(keyslotIdx int) (time.Duration, error) {
+	if keyslotIdx < 0 || keyslotIdx >= len(d.hdr.KeySlots) {
+		return 0, fmt.Errorf("keyslot %d is out of range of available slots", keyslotIdx)
+	}
+	slot := d.hdr.KeySlots[keyslotIdx]
+	if slot.Active != luksV1SlotEnabled {
+		return 0, ErrKeyslotInactive
+	}
+
+	algo := fixedArrayToString(d.hdr.HashSpec[:])
+	h, _ := getHashAlgo(algo)
+	if h == nil {
+		return 0, fmt.Errorf("Unknown hash spec algorithm: %v", algo)
+	}
+
+	// keyslot key derivation plus the volume key digest computation
+	keySize := int(d.hdr.KeyBytes)
+	return estimatePbkdf2(h, int(slot.Iterations), keySize) + estimatePbkdf2(h, int(d.hdr.MkDigestIter), keySize), nil
+}
+
+func (d *deviceV1) RequiredAlgorithms() (ciphers, modes, hashes, kdfs []string) {
+	// LUKS v1 uses the same cipher and hash for all keyslots, the master key digest and the payload
+	mode := strings.SplitN(fixedArrayToString(d.hdr.CipherMode[:]), "-", 2)[0]
+	hashSpec := fixedArrayToString(d.hdr.HashSpec[:])
+
+	return []string{fixedArrayToString(d.hdr.CipherName[:])}, []string{mode}, []string{hashSpec}, []string{"pbkdf2"}
+}
+
+func (d *deviceV1) MasterKeyDigestParams() (DigestParams, error) {
+	return DigestParams{
+		Type:       "pbkdf2",
+		Hash:       fixedArrayToString(d.hdr.HashSpec[:]),
+		Iterations: int(d.hdr.MkDigestIter),
+		Salt:       append([]byte(nil), d.hdr.MkDigestSalt[:]...),
+		Digest:     append([]byte(nil), d.hdr.MkDigest[:]...),
+	}, nil
+}
+
+func (d *deviceV1) Digests() ([]DigestInfo, error) {
+	params, err := d.MasterKeyDigestParams()
+	if err != nil {
+		return nil, err
+	}
+	return []DigestInfo{{ID: 0, DigestParams: params, Keyslots: d.Slots(), Segments: []int{0}}}, nil
+}
+
+func (d *deviceV1) DumpTo(w io.Writer) error {
+	return dumpDevice(w, d)
+}
+
+func (d *deviceV1) MetadataJSON() ([]byte, error) {
+	return nil, fmt.Errorf("LUKS v1 does not have JSON metadata")
+}
+
+func (d *deviceV1) MarshalJSON() ([]byte, error) {
+	return marshalDevice(d)
+}
+
+func (d *deviceV1) KeyslotLayout() (KeyslotLayout, error) {
+	size := uint64(keyslotMaterialSize(int(d.hdr.KeyBytes), stripesNum))
+	areas := make([]KeyslotArea, len(d.hdr.KeySlots))
+	regionOffset := d.headerAreaSize()
+	for i, s := range d.hdr.KeySlots {
+		offset := uint64(s.KeyMaterialOffset) * storageSectorSize
+		areas[i] = KeyslotArea{
+			Keyslot: i,
+			Active:  s.Active == luksV1SlotEnabled,
+			Offset:  offset,
+			Size:    size,
+		}
+		if offset < regionOffset {
+			regionOffset = offset
+		}
+	}
+
+	// LUKS v1 keyslots region spans from the first keyslot material to the end of the last one
+	return KeyslotLayout{
+		RegionOffset: regionOffset,
+		RegionSize:   d.headerAreaSize() - regionOffset,
+		Alignment:    observedAlignment(areas),
+		Areas:        areas,
+	}, nil
+}
+
+func (d *deviceV1) Keyslot(keyslotIdx int) (KeyslotInfo, error) {
+	if keyslotIdx < 0 || keyslotIdx >= len(d.hdr.KeySlots) {
+		return KeyslotInfo{}, fmt.Errorf("keyslot %d is out of range of available slots", keyslotIdx)
+	}
+	slot := d.hdr.KeySlots[keyslotIdx]
+	info := KeyslotInfo{
+		ID:    keyslotIdx,
+		State: KeyslotStateInactive,
+		Area: KeyslotArea{
+			Keyslot: keyslotIdx,
+			Active:  slot.Active == luksV1SlotEnabled,
+			Offset:  uint64(slot.KeyMaterialOffset) * storageSectorSize,
+			Size:    uint64(keyslotMaterialSize(int(d.hdr.KeyBytes), stripesNum)),
+		},
+	}
+	if slot.Active != luksV1SlotEnabled {
+		return info, nil
+	}
+
+	hash := fixedArrayToString(d.hdr.HashSpec[:])
+	info.State = KeyslotStateActive
+	info.Priority = "normal"
+	info.KeySize = int(d.hdr.KeyBytes)
+	info.Kdf = KdfParams{Type: "pbkdf2", Hash: hash, Iterations: int(slot.Iterations)}
+	info.KdfSalt = append([]byte(nil), slot.Salt[:]...)
+	info.AreaEncryption = fixedArrayToString(d.hdr.CipherName[:]) + "-" + fixedArrayToString(d.hdr.CipherMode[:])
+	info.AreaKeySize = int(d.hdr.KeyBytes)
+	info.AfStripes = int(slot.Stripes)
+	info.AfHash = hash
+	return info, nil
+}
+
+func (d *deviceV1) Segments() ([]SegmentInfo, error) {
+	return []SegmentInfo{{
+		ID:         0,
+		Type:       "crypt",
+		Offset:     uint64(d.hdr.PayloadOffset) * storageSectorSize,
+		Dynamic:    true,
+		Encryption: fixedArrayToString(d.hdr.CipherName[:]) + "-" + fixedArrayToString(d.hdr.CipherMode[:]),
+		SectorSize: storageSectorSize,
+	}}, nil
+}
+
+func (d *deviceV1) Snapshot() (DeviceSnapshot, error) {
+	snap := DeviceSnapshot{
+		Version:  1,
+		UUID:     d.UUID(),
+		Keyslots: make([]SnapshotEntry, 0, len(d.hdr.KeySlots)),
+	}
+
+	for i, s := range d.hdr.KeySlots {
+		if s.Active != luksV1SlotEnabled {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := binary.Write(&buf, binary.BigEndian, s); err != nil {
+			return DeviceSnapshot{}, err
+		}
+		snap.Keyslots = append(snap.Keyslots, SnapshotEntry{ID: i, Fingerprint: fingerprint(buf.Bytes())})
+	}
+
+	tokens, err := d.Tokens()
+	if err != nil {
+		return DeviceSnapshot{}, err
+	}
+	snap.Tokens = make([]SnapshotEntry, 0, len(tokens))
+	for _, t := range tokens {
+		snap.Tokens = append(snap.Tokens, SnapshotEntry{ID: t.ID, Fingerprint: fingerprint(t.Payload)})
+	}
+
+	snap.Segments = []SnapshotSegment{{
+		ID:         0,
+		Offset:     strconv.FormatUint(uint64(d.hdr.PayloadOffset)*storageSectorSize, 10),
+		Size:       "dynamic",
+		Encryption: fixedArrayToString(d.hdr.CipherName[:]) + "-" + fixedArrayToString(d.hdr.CipherMode[:]),
+		SectorSize: storageSectorSize,
+	}}
+
+	return snap, nil
+}
+
+func (d *deviceV1) SetUUID(uuid string) error {
+	if !isWritable(d.f) {
+		return fmt.Errorf("device %v is opened read-only", d.path)
+	}
+	uuid, err := uuidOrRandom(uuid)
+	if err != nil {
+		return err
+	}
+
+	orig := d.hdr.UUID
+	if err := putFixedString(d.hdr.UUID[:], uuid); err != nil {
+		return err
+	}
+	if err := d.writeHeader(); err != nil {
+		d.hdr.UUID = orig
+		return err
+	}
+	return nil
+}
+
+func (d *deviceV1) Label() string {
+	return ""
+}
+
+func (d *deviceV1) Subsystem() string {
+	return ""
+}
+
+func (d *deviceV1) SetLabel(label string) error {
+	return fmt.Errorf("LUKS v1 does not support labels")
+}
+
+func (d *deviceV1) SetSubsystem(subsystem string) error {
+	return fmt.Errorf("LUKS v1 does not support subsystem labels")
+}
+
+func (d *deviceV1) Flags() []string {
+	return nil
+}
+
+func (d *deviceV1) SetFlags(flags []string) error {
+	return fmt.Errorf("LUKS v1 does not support persistent flags")
+}
+
 func (d *deviceV1) FlagsGet() []string {
 	return d.flags
 }
@@ -105,7 +380,11 @@ func (d *deviceV1) Version() int {
 }
 
 func (d *deviceV1) Unlock(keyslot int, passphrase []byte, dmName string) error {
-	volume, err := d.UnsealVolume(keyslot, passphrase)
+	return d.UnlockContext(context.Background(), keyslot, passphrase, dmName)
+}
+
+func (d *deviceV1) UnlockContext(ctx context.Context, keyslot int, passphrase []byte, dmName string) error {
+	volume, err := d.UnsealVolumeContext(ctx, keyslot, passphrase)
 	if err != nil {
 		return err
 	}
@@ -114,14 +393,31 @@ func (d *deviceV1) Unlock(keyslot int, passphrase []byte, dmName string) error {
 	return volume.SetupMapper(dmName)
 }
 
+func (d *deviceV1) UnlockWithKeyfile(keyslot int, r io.Reader, offset, maxSize int64, dmName string) error {
+	passphrase, err := ReadKeyfile(r, offset, maxSize)
+	if err != nil {
+		return err
+	}
+	defer clearSlice(passphrase)
+
+	if keyslot < 0 {
+		return d.UnlockAny(passphrase, dmName)
+	}
+	return d.Unlock(keyslot, passphrase, dmName)
+}
+
 func (d *deviceV1) UnlockAny(passphrase []byte, dmName string) error {
+	return d.UnlockAnyContext(context.Background(), passphrase, dmName)
+}
+
+func (d *deviceV1) UnlockAnyContext(ctx context.Context, passphrase []byte, dmName string) error {
 	for k, s := range d.hdr.KeySlots {
 		if s.Active != luksV1SlotEnabled {
 			continue
 		}
 
-		volume, err := d.UnsealVolume(k, passphrase)
-		if err == ErrPassphraseDoesNotMatch {
+		volume, err := d.UnsealVolumeContext(ctx, k, passphrase)
+		if errors.Is(err, ErrPassphraseIncorrect) {
 			continue
 		} else if err != nil {
 			return err
@@ -129,15 +425,38 @@ func (d *deviceV1) UnlockAny(passphrase []byte, dmName string) error {
 
 		return volume.SetupMapper(dmName)
 	}
-	return ErrPassphraseDoesNotMatch
+	return ErrPassphraseIncorrect
+}
+
+func (d *deviceV1) Suspend(dmName string) error {
+	return suspendMapping(d, dmName)
+}
+
+func (d *deviceV1) Resume(dmName string, passphrase []byte) error {
+	return resumeMapping(d, dmName, passphrase)
 }
 
 func (d *deviceV1) UnsealVolume(keyslotIdx int, passphrase []byte) (*Volume, error) {
+	return d.UnsealVolumeContext(context.Background(), keyslotIdx, passphrase)
+}
+
+func (d *deviceV1) UnsealVolumeContext(ctx context.Context, keyslotIdx int, passphrase []byte) (*Volume, error) {
+	if d.metadataOnly {
+		return nil, ErrMetadataOnly
+	}
+
 	keyslots := d.hdr.KeySlots
 	if keyslotIdx < 0 || keyslotIdx >= len(keyslots) {
 		return nil, fmt.Errorf("keyslot %d is out of range of available slots", keyslotIdx)
 	}
 	slot := keyslots[keyslotIdx]
+	switch slot.Active {
+	case luksV1SlotEnabled:
+	case luksV1SlotDisabled:
+		return nil, ErrKeyslotInactive
+	default:
+		return nil, fmt.Errorf("keyslot %d has invalid state 0x%08x", keyslotIdx, slot.Active)
+	}
 
 	algo := fixedArrayToString(d.hdr.HashSpec[:])
 	h, _ := getHashAlgo(algo)
@@ -145,7 +464,12 @@ func (d *deviceV1) UnsealVolume(keyslotIdx int, passphrase []byte) (*Volume, err
 		return nil, fmt.Errorf("Unknown hash spec algorithm: %v", algo)
 	}
 
-	afKey := deriveLuks1AfKey(passphrase, slot, int(d.hdr.KeyBytes), h)
+	afKey, err := deriveKey(ctx, passphrase, func(passphrase []byte) ([]byte, error) {
+		return deriveLuks1AfKey(passphrase, slot, int(d.hdr.KeyBytes), algo)
+	})
+	if err != nil {
+		return nil, err
+	}
 	defer clearSlice(afKey)
 
 	finalKey, err := d.decryptLuks1VolumeKey(keyslotIdx, slot, afKey, h)
@@ -154,27 +478,55 @@ func (d *deviceV1) UnsealVolume(keyslotIdx int, passphrase []byte) (*Volume, err
 	}
 
 	// verify with digest
-	generatedDigest := pbkdf2.Key(finalKey, d.hdr.MkDigestSalt[:], int(d.hdr.MkDigestIter), int(d.hdr.KeyBytes), h)
-	defer clearSlice(generatedDigest)
-	if !bytes.Equal(generatedDigest[:20], d.hdr.MkDigest[:]) {
-		return nil, ErrPassphraseDoesNotMatch
+	if ok, err := d.verifyVolumeKey(ctx, finalKey); err != nil || !ok {
+		clearSlice(finalKey)
+		if err == nil {
+			err = ErrPassphraseIncorrect
+		}
+		return nil, err
 	}
+	return d.volumeForKey(finalKey)
+}
 
+// verifyVolumeKey checks the key against the master key digest
+func (d *deviceV1) verifyVolumeKey(ctx context.Context, key []byte) (bool, error) {
+	if len(key) != int(d.hdr.KeyBytes) {
+		return false, nil
+	}
+	generatedDigest, err := deriveKey(ctx, key, func(key []byte) ([]byte, error) {
+		params := KdfParams{Type: "pbkdf2", Hash: fixedArrayToString(d.hdr.HashSpec[:]), Iterations: int(d.hdr.MkDigestIter)}
+		return deriveKdfKey(key, d.hdr.MkDigestSalt[:], params, len(d.hdr.MkDigest))
+	})
+	if err != nil {
+		return false, err
+	}
+	defer clearSlice(generatedDigest)
+	return digestsEqual(generatedDigest, d.hdr.MkDigest[:]), nil
+}
+
+// volumeForKey describes the payload mapping with the verified volume key, the volume takes ownership of the key
+func (d *deviceV1) volumeForKey(finalKey []byte) (*Volume, error) {
 	encryption := fixedArrayToString(d.hdr.CipherName[:]) + "-" + fixedArrayToString(d.hdr.CipherMode[:])
 
 	storageOffset := uint64(d.hdr.PayloadOffset) * storageSectorSize
 
-	storageSize, err := fileSize(d.f)
+	backingPath, backingFile := d.path, d.f
+	if d.data != nil {
+		backingPath, backingFile = d.data.path, d.data.f
+	}
+	storageSize, err := backingFile.Size()
 	if err != nil {
+		clearSlice(finalKey)
 		return nil, err
 	}
 	if storageSize < storageOffset {
+		clearSlice(finalKey)
 		return nil, fmt.Errorf("backing file size %d is smaller than LUKS segment offset %d", storageSize, storageOffset)
 	}
 	storageSize -= storageOffset
 
 	v := Volume{
-		BackingDevice:     d.path,
+		BackingDevice:     backingPath,
 		Flags:             d.flags,
 		UUID:              d.UUID(),
 		key:               finalKey,
@@ -189,52 +541,332 @@ func (d *deviceV1) UnsealVolume(keyslotIdx int, passphrase []byte) (*Volume, err
 	return &v, nil
 }
 
-func (d *deviceV1) decryptLuks1VolumeKey(keyslotIdx int, slot keySlot, afKey []byte, h func() hash.Hash) ([]byte, error) {
-	// decrypt keyslotIdx area using the derived key
-	keyslotSize := d.hdr.KeyBytes * stripesNum
-	if keyslotSize%storageSectorSize != 0 {
-		return nil, fmt.Errorf("keyslot[%v] size %v is not multiple of the sector size %v", keyslotIdx, keyslotSize, storageSectorSize)
+func (d *deviceV1) UnlockWithVolumeKey(key []byte, dmName string) error {
+	if d.metadataOnly {
+		return ErrMetadataOnly
+	}
+	ok, err := d.verifyVolumeKey(context.Background(), key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrVolumeKeyIncorrect
 	}
-	keyData := make([]byte, keyslotSize)
-	defer clearSlice(keyData)
+	volume, err := d.volumeForKey(secureCopy(key))
+	if err != nil {
+		return err
+	}
+	defer clearSlice(volume.key)
+	return volume.SetupMapper(dmName)
+}
 
-	if _, err := d.f.ReadAt(keyData, int64(slot.KeyMaterialOffset)*storageSectorSize); err != nil {
+func (d *deviceV1) VolumeKey(keyslot int, passphrase []byte) (*VolumeKey, error) {
+	if !d.allowKeyExport {
+		return nil, ErrVolumeKeyExportDisabled
+	}
+	volume, err := d.UnsealVolume(keyslot, passphrase)
+	if err != nil {
 		return nil, err
 	}
+	defer volume.Wipe()
+	return volume.Key(), nil
+}
 
-	ciph, err := d.buildLuks1AfCipher(afKey)
+func (d *deviceV1) AddUnboundKeyslot(key, passphrase []byte, kdf KdfParams) (int, error) {
+	return 0, fmt.Errorf("LUKS v1 does not support unbound keyslots")
+}
+
+func (d *deviceV1) UnsealUnboundKey(keyslot int, passphrase []byte) ([]byte, error) {
+	return nil, fmt.Errorf("LUKS v1 does not support unbound keyslots")
+}
+
+func (d *deviceV1) UnlockAndKillSlot(keyslotIdx int, passphrase []byte) ([]byte, error) {
+	if !isWritable(d.f) {
+		// check it before unlocking, read-only devices (e.g. snapshots) must never be modified
+		return nil, fmt.Errorf("device %v is opened read-only", d.path)
+	}
+	slots := d.Slots()
+	if len(slots) == 1 && slots[0] == keyslotIdx {
+		return nil, fmt.Errorf("keyslot %d is the last keyslot of the device, refusing to kill it", keyslotIdx)
+	}
+
+	volume, err := d.UnsealVolume(keyslotIdx, passphrase)
 	if err != nil {
 		return nil, err
 	}
+	if err := d.killSlot(keyslotIdx); err != nil {
+		clearSlice(volume.key)
+		return nil, err
+	}
+	return volume.key, nil
+}
 
-	for i := 0; i < int(keyslotSize/storageSectorSize); i++ {
-		block := keyData[i*storageSectorSize : (i+1)*storageSectorSize]
-		ciph.Decrypt(block, block, uint64(i))
+// ChangePassphrase replaces the passphrase of the keyslot. LUKS v1 keyslot material has a fixed location thus
+// a free keyslot is used as a temporary copy: the new material is stored into the free keyslot first, then the keyslot
+// is rewritten in place and the temporary copy is removed. At any point at least one keyslot opens the device.
+func (d *deviceV1) ChangePassphrase(keyslotIdx int, oldPassphrase, newPassphrase []byte) error {
+	if !isWritable(d.f) {
+		return fmt.Errorf("device %v is opened read-only", d.path)
 	}
 
-	// anti-forensic merge
-	if slot.Stripes != stripesNum {
-		return nil, fmt.Errorf("LUKS currently supports only af with 4000 stripes")
+	volume, err := d.UnsealVolume(keyslotIdx, oldPassphrase)
+	if err != nil {
+		return err
+	}
+	defer clearSlice(volume.key)
+
+	tmpIdx := d.freeKeyslot()
+	if tmpIdx == -1 {
+		return fmt.Errorf("changing passphrase of a LUKS v1 device requires a free keyslot")
 	}
-	return afMerge(keyData, int(d.hdr.KeyBytes), int(slot.Stripes), h())
+	iterations := int(d.hdr.KeySlots[keyslotIdx].Iterations)
+
+	// 1. the temporary copy of the keyslot protected with the new passphrase
+	if err := d.writeKeyslot(tmpIdx, volume.key, newPassphrase, iterations); err != nil {
+		return err
+	}
+	d.hdr.KeySlots[tmpIdx].Active = luksV1SlotEnabled
+	if err := d.writeHeader(); err != nil {
+		return err
+	}
+
+	// 2. rewrite the original keyslot, until the header is updated only the temporary copy is usable
+	if err := d.writeKeyslot(keyslotIdx, volume.key, newPassphrase, iterations); err != nil {
+		return err
+	}
+	if err := d.writeHeader(); err != nil {
+		return err
+	}
+
+	// 3. drop the temporary copy
+	return d.killSlot(tmpIdx)
 }
 
-func (d *deviceV1) buildLuks1AfCipher(afKey []byte) (*xts.Cipher, error) {
-	var cipherFunc func(key []byte) (cipher.Block, error)
+func (d *deviceV1) RemoveKeyslot(keyslotIdx int) error {
+	if !isWritable(d.f) {
+		return fmt.Errorf("device %v is opened read-only", d.path)
+	}
+	if keyslotIdx < 0 || keyslotIdx >= len(d.hdr.KeySlots) {
+		return fmt.Errorf("keyslot %d is out of range of available slots", keyslotIdx)
+	}
+	if d.hdr.KeySlots[keyslotIdx].Active != luksV1SlotEnabled {
+		return fmt.Errorf("%w: keyslot %d", ErrKeyslotInactive, keyslotIdx)
+	}
+	if len(d.Slots()) == 1 {
+		return fmt.Errorf("keyslot %d is the last keyslot of the device, refusing to remove it", keyslotIdx)
+	}
+	return d.killSlot(keyslotIdx)
+}
 
-	cipherName := fixedArrayToString(d.hdr.CipherName[:])
-	cipherFunc, err := getCipher(cipherName)
+// AddKeyslot adds a new keyslot. LUKS v1 supports only pbkdf2 with the hash algorithm specified by the header.
+// If kdf.Iterations is zero then the number of iterations is calculated by benchmarking pbkdf2 on this machine.
+func (d *deviceV1) AddKeyslot(existingPassphrase, newPassphrase []byte, kdf KdfParams) (int, error) {
+	if !isWritable(d.f) {
+		return 0, fmt.Errorf("device %v is opened read-only", d.path)
+	}
+	iterations, err := d.keyslotIterations(kdf)
+	if err != nil {
+		return 0, err
+	}
+
+	volume, err := unsealAny(d, existingPassphrase)
+	if err != nil {
+		return 0, err
+	}
+	defer clearSlice(volume.key)
+
+	return d.addKeyslot(volume.key, newPassphrase, iterations)
+}
+
+// AddKeyslotWithVolumeKey is similar to AddKeyslot but the volume key is provided by the caller instead of being
+// recovered from an existing keyslot.
+func (d *deviceV1) AddKeyslotWithVolumeKey(volumeKey *VolumeKey, newPassphrase []byte, kdf KdfParams) (int, error) {
+	if !isWritable(d.f) {
+		return 0, fmt.Errorf("device %v is opened read-only", d.path)
+	}
+	if volumeKey == nil || len(volumeKey.Bytes()) == 0 {
+		return 0, fmt.Errorf("volume key is wiped")
+	}
+	iterations, err := d.keyslotIterations(kdf)
+	if err != nil {
+		return 0, err
+	}
+
+	ok, err := d.verifyVolumeKey(context.Background(), volumeKey.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, ErrVolumeKeyIncorrect
+	}
+	return d.addKeyslot(volumeKey.Bytes(), newPassphrase, iterations)
+}
+
+// keyslotIterations validates the KDF parameters of a new keyslot and returns its pbkdf2 iterations number
+func (d *deviceV1) keyslotIterations(kdf KdfParams) (int, error) {
+	hashSpec := fixedArrayToString(d.hdr.HashSpec[:])
+	if kdf.Type != "" && kdf.Type != "pbkdf2" {
+		return 0, fmt.Errorf("LUKS v1 supports only pbkdf2 kdf, got %v", kdf.Type)
+	}
+	if kdf.Hash != "" && kdf.Hash != hashSpec {
+		return 0, fmt.Errorf("LUKS v1 keyslots must use the header hash algorithm %v, got %v", hashSpec, kdf.Hash)
+	}
+	iterations := kdf.Iterations
+	if iterations == 0 {
+		h, _ := getHashAlgo(hashSpec)
+		if h == nil {
+			return 0, fmt.Errorf("Unknown hash spec algorithm: %v", hashSpec)
+		}
+		iterations = pbkdf2IterationsFor(h, int(d.hdr.KeyBytes), luksV1DefaultIterTime, luksV1MinIterations)
+	}
+	if iterations < luksV1MinIterations {
+		return 0, fmt.Errorf("invalid pbkdf2 iterations number %v, minimum is %v", iterations, luksV1MinIterations)
+	}
+	return iterations, nil
+}
+
+// addKeyslot stores the volume key into the first free keyslot and writes the header
+func (d *deviceV1) addKeyslot(volumeKey, passphrase []byte, iterations int) (int, error) {
+	keyslotIdx := d.freeKeyslot()
+	if keyslotIdx == -1 {
+		return 0, fmt.Errorf("no free keyslots, maximum number of keyslots is %d", len(d.hdr.KeySlots))
+	}
+
+	orig := *d.hdr
+	if err := d.writeKeyslot(keyslotIdx, volumeKey, passphrase, iterations); err != nil {
+		*d.hdr = orig
+		return 0, err
+	}
+	d.hdr.KeySlots[keyslotIdx].Active = luksV1SlotEnabled
+	if err := d.writeHeader(); err != nil {
+		*d.hdr = orig
+		return 0, err
+	}
+	return keyslotIdx, nil
+}
+
+// freeKeyslot returns index of the first disabled keyslot or -1 if all keyslots are in use
+func (d *deviceV1) freeKeyslot() int {
+	for i, s := range d.hdr.KeySlots {
+		if s.Active == luksV1SlotDisabled {
+			return i
+		}
+	}
+	return -1
+}
+
+// writeKeyslot encrypts the volume key with the passphrase and writes the key material to the keyslot area.
+// The in-memory keyslot parameters (salt, iterations) are updated but neither the keyslot state nor the header
+// is written, it is the caller's responsibility.
+func (d *deviceV1) writeKeyslot(keyslotIdx int, volumeKey, passphrase []byte, iterations int) error {
+	hashSpec := fixedArrayToString(d.hdr.HashSpec[:])
+	h, _ := getHashAlgo(hashSpec)
+	if h == nil {
+		return fmt.Errorf("Unknown hash spec algorithm: %v", hashSpec)
+	}
+
+	slot := &d.hdr.KeySlots[keyslotIdx]
+	if _, err := rand.Read(slot.Salt[:]); err != nil {
+		return err
+	}
+	slot.Iterations = uint32(iterations)
+	slot.Stripes = stripesNum
+
+	afKey, err := deriveLuks1AfKey(passphrase, *slot, int(d.hdr.KeyBytes), hashSpec)
+	if err != nil {
+		return err
+	}
+	defer clearSlice(afKey)
+	ciph, err := d.buildLuks1AfCipher(afKey)
+	if err != nil {
+		return err
+	}
+
+	material, err := splitKeyslotMaterial(volumeKey, h())
+	if err != nil {
+		return err
+	}
+	defer clearSlice(material)
+	encryptKeyslotArea(ciph, material)
+
+	if _, err := d.f.WriteAt(material, int64(slot.KeyMaterialOffset)*storageSectorSize); err != nil {
+		return err
+	}
+	return syncStorage(d.f)
+}
+
+func (d *deviceV1) EnrollToken(existingPassphrase, newPassphrase []byte, token Token, kdf KdfParams) (int, int, error) {
+	return 0, 0, fmt.Errorf("LUKS v1 does not support tokens")
+}
+
+func (d *deviceV1) ImportToken(token Token) (int, error) {
+	return 0, fmt.Errorf("LUKS v1 does not support tokens")
+}
+
+func (d *deviceV1) RemoveToken(tokenID int) error {
+	return fmt.Errorf("LUKS v1 does not support tokens")
+}
+
+func (d *deviceV1) ReplaceToken(tokenID int, token Token) error {
+	return fmt.Errorf("LUKS v1 does not support tokens")
+}
+
+// killSlot marks the keyslot as disabled, wipes the keyslot material and writes the updated header.
+// Once wiping starts the keyslot material might be destroyed, so the keyslot stays disabled in the in-memory
+// header even if wiping or writing the header fails.
+func (d *deviceV1) killSlot(keyslotIdx int) error {
+	if keyslotIdx < 0 || keyslotIdx >= len(d.hdr.KeySlots) {
+		return fmt.Errorf("keyslot %d is out of range of available slots", keyslotIdx)
+	}
+	slot := &d.hdr.KeySlots[keyslotIdx]
+
+	offset := int64(slot.KeyMaterialOffset) * storageSectorSize
+	size := int64(keyslotMaterialSize(int(d.hdr.KeyBytes), stripesNum))
+
+	slot.Active = luksV1SlotDisabled
+	slot.Iterations = 0
+	clearSlice(slot.Salt[:])
+
+	if err := wipeArea(d.f, offset, size); err != nil {
+		return err
+	}
+	return d.writeHeader()
+}
+
+// writeHeader writes the in-memory binary header to the disk
+func (d *deviceV1) writeHeader() error {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, d.hdr); err != nil {
+		return err
+	}
+	if _, err := d.f.WriteAt(buf.Bytes(), 0); err != nil {
+		return err
+	}
+	return syncStorage(d.f)
+}
+
+func (d *deviceV1) decryptLuks1VolumeKey(keyslotIdx int, slot keySlot, afKey []byte, h func() hash.Hash) ([]byte, error) {
+	// decrypt keyslotIdx area using the derived key
+	ciph, err := d.buildLuks1AfCipher(afKey)
 	if err != nil {
 		return nil, err
 	}
 
-	cipherMode := fixedArrayToString(d.hdr.CipherMode[:])
-	switch cipherMode {
-	case "xts-plain64":
-		return xts.NewCipher(cipherFunc, afKey)
-	default:
-		return nil, fmt.Errorf("Unknown encryption mode: %v", cipherMode)
+	// anti-forensic merge
+	if slot.Stripes != stripesNum {
+		return nil, fmt.Errorf("LUKS currently supports only af with 4000 stripes")
 	}
+	return mergeKeyslotArea(d.f, int64(slot.KeyMaterialOffset)*storageSectorSize, ciph, int(d.hdr.KeyBytes), int(slot.Stripes), h())
+}
+
+func (d *deviceV1) buildLuks1AfCipher(afKey []byte) (sectorCipher, error) {
+	cipherName := fixedArrayToString(d.hdr.CipherName[:])
+	// e.g. "xts-plain64" or "cbc-essiv:sha256"
+	modeParts := strings.SplitN(fixedArrayToString(d.hdr.CipherMode[:]), "-", 2)
+	if len(modeParts) != 2 {
+		return nil, fmt.Errorf("Unknown encryption mode: %v", fixedArrayToString(d.hdr.CipherMode[:]))
+	}
+	return newSectorCipher(cipherName, modeParts[0], modeParts[1], afKey)
 }
 
 var (
@@ -263,15 +895,7 @@ func (d *deviceV1) Tokens() ([]Token, error) {
 	var hdr luksMetaHeader
 	data := make([]byte, unsafe.Sizeof(hdr))
 
-	var holeOffset int
-	length := int(d.hdr.KeyBytes * stripesNum)
-	for _, s := range d.hdr.KeySlots {
-		offset := int(s.KeyMaterialOffset * storageSectorSize)
-		if holeOffset < offset+length {
-			holeOffset = offset + length
-		}
-	}
-	holeOffset = roundUp(holeOffset, 4096)
+	holeOffset := int(d.headerAreaSize())
 
 	if _, err := d.f.ReadAt(data, int64(holeOffset)); err != nil {
 		return nil, err
@@ -315,6 +939,9 @@ func (d *deviceV1) Tokens() ([]Token, error) {
 				Type:    luksMetaTokenType(s.UUID[:]),
 				Payload: payload,
 			}
+			if err := decodeToken(&t); err != nil {
+				return nil, err
+			}
 			tokens = append(tokens, t)
 		}
 	}
@@ -326,12 +953,12 @@ var clevisUUID = []byte{0xcb, 0x6e, 0x89, 0x04, 0x81, 0xff, 0x40, 0xda, 0xa8, 0x
 
 func luksMetaTokenType(uuid []byte) string {
 	if bytes.Equal(uuid, clevisUUID) {
-		return "clevis"
+		return ClevisTokenType
 	}
 
 	return ""
 }
 
-func deriveLuks1AfKey(passphrase []byte, slot keySlot, keySize int, h func() hash.Hash) []byte {
-	return pbkdf2.Key(passphrase, slot.Salt[:], int(slot.Iterations), keySize, h)
+func deriveLuks1AfKey(passphrase []byte, slot keySlot, keySize int, hashSpec string) ([]byte, error) {
+	return deriveKdfKey(passphrase, slot.Salt[:], KdfParams{Type: "pbkdf2", Hash: hashSpec, Iterations: int(slot.Iterations)}, keySize)
 }
@@ -1,15 +1,109 @@
 package luks
 
 import (
+	"context"
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/binary"
 	"os"
 	"os/exec"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
 )
 
+// createLuks1Fixture generates a LUKS1 disk image without using cryptsetup.
+// The image has keyslot #0 protected with the given password, all the other keyslots are disabled.
+// It returns the disk file and the volume key.
+func createLuks1Fixture(t *testing.T, password string) (*os.File, []byte) {
+	return createLuks1FixtureWithHash(t, password, "sha256")
+}
+
+// createLuks1FixtureWithHash is similar to createLuks1Fixture but uses the given hash (`cryptsetup --hash`) for
+// pbkdf2, the anti-forensic split and the master key digest
+func createLuks1FixtureWithHash(t *testing.T, password string, hash string) (*os.File, []byte) {
+	h, _ := getHashAlgo(hash)
+	require.NotNil(t, h, hash)
+
+	disk, err := os.CreateTemp("", "luksv1.go.fixture")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		disk.Close()
+		os.Remove(disk.Name())
+	})
+
+	const (
+		keySize        = 32
+		slotSectors    = 256  // keyslot material (keySize*stripesNum) rounded up to 4096 bytes
+		payloadSectors = 4096 // 2MiB
+	)
+	require.NoError(t, disk.Truncate(payloadSectors*storageSectorSize+1024*1024))
+
+	hdr := headerV1{
+		Version:       1,
+		PayloadOffset: payloadSectors,
+		KeyBytes:      keySize,
+		MkDigestIter:  fixtureIterations,
+	}
+	copy(hdr.Magic[:], "LUKS\xba\xbe")
+	copy(hdr.CipherName[:], "aes")
+	copy(hdr.CipherMode[:], "xts-plain64")
+	copy(hdr.HashSpec[:], hash)
+	copy(hdr.UUID[:], "0b5e4f1c-6a3d-4c2b-9e8f-7a6b5c4d3e2f")
+	for i := range hdr.KeySlots {
+		hdr.KeySlots[i] = keySlot{
+			Active:            luksV1SlotDisabled,
+			KeyMaterialOffset: uint32(8 + i*slotSectors),
+			Stripes:           stripesNum,
+		}
+	}
+
+	volumeKey := make([]byte, keySize)
+	_, err = rand.Read(volumeKey)
+	require.NoError(t, err)
+	_, err = rand.Read(hdr.MkDigestSalt[:])
+	require.NoError(t, err)
+	digestValue := pbkdf2.Key(volumeKey, hdr.MkDigestSalt[:], fixtureIterations, len(hdr.MkDigest), h)
+	copy(hdr.MkDigest[:], digestValue)
+
+	addLuks1FixtureKeyslot(t, disk, &hdr, 0, password, volumeKey)
+
+	_, err = disk.Seek(0, 0)
+	require.NoError(t, err)
+	require.NoError(t, binary.Write(disk, binary.BigEndian, &hdr))
+
+	return disk, volumeKey
+}
+
+// addLuks1FixtureKeyslot enables keyslot with the given index in the fixture header and writes its key material.
+// The caller is responsible for writing the header.
+func addLuks1FixtureKeyslot(t *testing.T, disk *os.File, hdr *headerV1, idx int, password string, volumeKey []byte) {
+	slot := &hdr.KeySlots[idx]
+	slot.Active = luksV1SlotEnabled
+	slot.Iterations = fixtureIterations
+	_, err := rand.Read(slot.Salt[:])
+	require.NoError(t, err)
+
+	h, _ := getHashAlgo(fixedArrayToString(hdr.HashSpec[:]))
+	keyMaterial, err := afSplit(volumeKey, stripesNum, h())
+	require.NoError(t, err)
+	afKey := pbkdf2.Key([]byte(password), slot.Salt[:], fixtureIterations, len(volumeKey), h)
+	ciph, err := xts.NewCipher(aes.NewCipher, afKey)
+	require.NoError(t, err)
+	for i := 0; i < len(keyMaterial)/storageSectorSize; i++ {
+		block := keyMaterial[i*storageSectorSize : (i+1)*storageSectorSize]
+		ciph.Encrypt(block, block, uint64(i))
+	}
+	_, err = disk.WriteAt(keyMaterial, int64(slot.KeyMaterialOffset)*storageSectorSize)
+	require.NoError(t, err)
+}
+
 func prepareLuks1Disk(t *testing.T, password string, cryptsetupArgs ...string) (*os.File, error) {
+	skipIfMissing(t, "cryptsetup")
+
 	disk, err := os.CreateTemp("", "luksv1.go.disk")
 	require.NoError(t, err)
 	require.NoError(t, disk.Truncate(2*1024*1024))
@@ -36,7 +130,7 @@ func runLuks1Test(t *testing.T, cryptsetupArgs ...string) {
 	defer disk.Close()
 	defer os.Remove(disk.Name())
 
-	d, err := initV1Device(disk.Name(), disk)
+	d, err := initV1Device(disk.Name(), FileStorage{disk})
 	require.NoError(t, err)
 
 	tokens, err := d.Tokens()
@@ -63,6 +157,65 @@ func TestLuks1Sha512(t *testing.T) {
 	runLuks1Test(t, "--hash", "sha512")
 }
 
+func TestLuks1Whirlpool(t *testing.T) {
+	runLuks1Test(t, "--hash", "whirlpool")
+}
+
+// runLuks1HashFixtureTest unseals a fixture that uses the hash for all of pbkdf2, AF merge and the digest
+func runLuks1HashFixtureTest(t *testing.T, hash string) {
+	disk, volumeKey := createLuks1FixtureWithHash(t, "foobar", hash)
+
+	d, err := initV1Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	v, err := d.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, v.key)
+
+	_, err = d.UnsealVolume(0, []byte("wrong"))
+	require.ErrorIs(t, err, ErrPassphraseIncorrect)
+
+	_, _, hashes, _ := d.RequiredAlgorithms()
+	require.Equal(t, []string{hash}, hashes)
+	require.Contains(t, SupportedHashes(), hash)
+}
+
+func TestLuks1WhirlpoolFixture(t *testing.T) {
+	runLuks1HashFixtureTest(t, "whirlpool")
+}
+
+func TestLuks1Ripemd160(t *testing.T) {
+	runLuks1Test(t, "--hash", "ripemd160")
+}
+
+func TestLuks1Ripemd160Fixture(t *testing.T) {
+	// ripemd160 was the default hash of old Debian installers, its 20-byte output is shorter than the 32-byte key
+	runLuks1HashFixtureTest(t, "ripemd160")
+}
+
+func TestLuks1Blake2Fixture(t *testing.T) {
+	for _, hash := range []string{"blake2b-512", "blake2s-256"} {
+		t.Run(hash, func(t *testing.T) {
+			runLuks1HashFixtureTest(t, hash)
+		})
+	}
+}
+
+func TestLuks1UnlockCustomOffset(t *testing.T) {
+	t.Parallel()
+
+	disk, err := prepareLuks1Disk(t, "foobar", "--offset", "3072") // 1.5MiB
+	require.NoError(t, err)
+	defer disk.Close()
+	defer os.Remove(disk.Name())
+
+	d, err := initV1Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	v, err := d.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3072*storageSectorSize), v.StorageOffset)
+	require.Equal(t, uint64(512*1024), v.StorageSize)
+}
+
 func TestLuks1UnlockMultipleKeySlots(t *testing.T) {
 	t.Parallel()
 
@@ -82,7 +235,7 @@ func TestLuks1UnlockMultipleKeySlots(t *testing.T) {
 	}
 	require.NoError(t, addKeyCmd.Run())
 
-	d, err := initV1Device(disk.Name(), disk)
+	d, err := initV1Device(disk.Name(), FileStorage{disk})
 	require.NoError(t, err)
 
 	tokens, err := d.Tokens()
@@ -98,6 +251,7 @@ func TestLuks1UnlockMultipleKeySlots(t *testing.T) {
 
 func TestReadLuksMetaInitialized(t *testing.T) {
 	t.Parallel()
+	skipIfMissing(t, "luksmeta")
 
 	password := "barfoo"
 	disk, err := prepareLuks1Disk(t, password)
@@ -131,7 +285,7 @@ func TestReadLuksMetaInitialized(t *testing.T) {
 	}
 	require.NoError(t, saveMeta2.Run())
 
-	d, err := initV1Device(disk.Name(), disk)
+	d, err := initV1Device(disk.Name(), FileStorage{disk})
 	require.NoError(t, err)
 
 	tokens, err := d.Tokens()
@@ -152,3 +306,287 @@ func TestReadLuksMetaInitialized(t *testing.T) {
 	_, err = d.UnsealVolume(0, []byte(password))
 	require.NoError(t, err)
 }
+
+func TestLuks1UnlockFixture(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk, volumeKey := createLuks1Fixture(t, password)
+
+	dev, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer dev.Close()
+	require.Equal(t, 1, dev.Version())
+	require.Equal(t, "0b5e4f1c-6a3d-4c2b-9e8f-7a6b5c4d3e2f", dev.UUID())
+	require.Equal(t, []int{0}, dev.Slots())
+
+	tokens, err := dev.Tokens()
+	require.NoError(t, err)
+	require.Empty(t, tokens)
+
+	_, err = dev.UnsealVolume(0, []byte("wrongpassword"))
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+
+	v, err := dev.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, v.key)
+	require.Equal(t, uint64(4096*storageSectorSize), v.StorageOffset)
+	require.Equal(t, uint64(1024*1024), v.StorageSize)
+	require.Equal(t, "aes-xts-plain64", v.StorageEncryption)
+}
+
+func TestLuks1UnlockWithVolumeKey(t *testing.T) {
+	disk, volumeKey := createLuks1Fixture(t, "foobar")
+	d, err := initV1Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+
+	wrongKey := append([]byte(nil), volumeKey...)
+	wrongKey[0] ^= 0xff
+	require.Equal(t, ErrVolumeKeyIncorrect, d.UnlockWithVolumeKey(wrongKey, "luks-go-test-volume-key"))
+	require.Equal(t, ErrVolumeKeyIncorrect, d.UnlockWithVolumeKey(volumeKey[:len(volumeKey)-1], "luks-go-test-volume-key"))
+
+	ok, err := d.verifyVolumeKey(context.Background(), volumeKey)
+	require.NoError(t, err)
+	require.True(t, ok)
+	expected, err := d.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	v, err := d.volumeForKey(append([]byte(nil), volumeKey...))
+	require.NoError(t, err)
+	require.Equal(t, expected, v)
+
+	d.metadataOnly = true
+	require.Equal(t, ErrMetadataOnly, d.UnlockWithVolumeKey(volumeKey, "luks-go-test-volume-key"))
+}
+
+func TestLuks1RequiredAlgorithms(t *testing.T) {
+	disk, _ := createLuks1Fixture(t, "foobar")
+
+	d, err := initV1Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+
+	ciphers, modes, hashes, kdfs := d.RequiredAlgorithms()
+	require.Equal(t, []string{"aes"}, ciphers)
+	// the payload cipher mode is reported without its IV generator so it can be checked against SupportedModes()
+	require.Equal(t, []string{"xts"}, modes)
+	require.Subset(t, SupportedModes(), modes)
+	require.Equal(t, []string{"sha256"}, hashes)
+	require.Equal(t, []string{"pbkdf2"}, kdfs)
+}
+
+func TestLuks1HeaderAreaSize(t *testing.T) {
+	disk, _ := createLuks1Fixture(t, "foobar")
+
+	d, err := initV1Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	// 8 keyslots of 256 sectors each after the 4096 bytes binary header
+	require.Equal(t, uint64((8+8*256)*storageSectorSize), d.headerAreaSize())
+}
+
+func TestLuks1KeyslotLayout(t *testing.T) {
+	disk, _ := createLuks1Fixture(t, "foobar")
+
+	d, err := initV1Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+
+	layout, err := d.KeyslotLayout()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4096), layout.RegionOffset)
+	require.Equal(t, uint64(8*128*1024), layout.RegionSize)
+	require.Equal(t, uint64(4096), layout.Alignment)
+	require.Len(t, layout.Areas, 8)
+	require.Equal(t, KeyslotArea{Keyslot: 0, Active: true, Offset: 4096, Size: 128000}, layout.Areas[0])
+	require.Equal(t, KeyslotArea{Keyslot: 7, Active: false, Offset: 4096 + 7*128*1024, Size: 128000}, layout.Areas[7])
+}
+
+func TestLuks1DisabledKeyslot(t *testing.T) {
+	disk, volumeKey := createLuks1Fixture(t, "foobar")
+
+	d, err := initV1Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	// keyslot #1 has valid material but it is disabled, keyslot #2 has neither enabled nor disabled magic
+	addLuks1FixtureKeyslot(t, disk, d.hdr, 1, "barfoo", volumeKey)
+	d.hdr.KeySlots[1].Active = luksV1SlotDisabled
+	addLuks1FixtureKeyslot(t, disk, d.hdr, 2, "barfoo", volumeKey)
+	d.hdr.KeySlots[2].Active = 1
+	require.NoError(t, d.writeHeader())
+
+	d, err = initV1Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	require.Equal(t, []int{0}, d.Slots())
+
+	_, err = d.UnsealVolume(1, []byte("barfoo"))
+	require.Equal(t, ErrKeyslotDisabled, err)
+	_, err = d.UnsealVolume(2, []byte("barfoo"))
+	require.Error(t, err)
+	require.NotEqual(t, ErrKeyslotDisabled, err)
+
+	v, err := d.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, v.key)
+}
+
+func TestLuks1AddKeyslot(t *testing.T) {
+	disk, volumeKey := createLuks1Fixture(t, "foobar")
+
+	dev, err := OpenWithOptions(disk.Name(), OpenOptions{ReadWrite: true})
+	require.NoError(t, err)
+	defer dev.Close()
+	w := dev.(Writer)
+
+	kdf := KdfParams{Type: "pbkdf2", Iterations: fixtureIterations}
+	_, err = w.AddKeyslot([]byte("wrong"), []byte("second"), kdf)
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+	_, err = w.AddKeyslot([]byte("foobar"), []byte("second"), KdfParams{Type: "argon2id", Time: 4, Memory: 32, Threads: 1})
+	require.Error(t, err)
+	_, err = w.AddKeyslot([]byte("foobar"), []byte("second"), KdfParams{Type: "pbkdf2", Hash: "sha512", Iterations: fixtureIterations})
+	require.Error(t, err)
+	_, err = w.AddKeyslot([]byte("foobar"), []byte("second"), KdfParams{Type: "pbkdf2", Iterations: 10})
+	require.Error(t, err)
+
+	slot, err := w.AddKeyslot([]byte("foobar"), []byte("second"), kdf)
+	require.NoError(t, err)
+	require.Equal(t, 1, slot)
+
+	reopened, err := initV1Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1}, reopened.Slots())
+	require.Equal(t, uint32(fixtureIterations), reopened.hdr.KeySlots[1].Iterations)
+	v, err := reopened.UnsealVolume(1, []byte("second"))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, v.key)
+
+	// fill all remaining keyslots
+	for i := 2; i < 8; i++ {
+		slot, err := w.AddKeyslot([]byte("second"), []byte("pass"), kdf)
+		require.NoError(t, err)
+		require.Equal(t, i, slot)
+	}
+	_, err = w.AddKeyslot([]byte("foobar"), []byte("pass"), kdf)
+	require.Error(t, err)
+}
+
+func TestLuks1AddKeyslotWithVolumeKey(t *testing.T) {
+	disk, volumeKey := createLuks1Fixture(t, "foobar")
+
+	dev, err := OpenWithOptions(disk.Name(), OpenOptions{ReadWrite: true})
+	require.NoError(t, err)
+	defer dev.Close()
+
+	kdf := KdfParams{Type: "pbkdf2", Iterations: fixtureIterations}
+	wrongKey := append([]byte(nil), volumeKey...)
+	wrongKey[0] ^= 0xff
+	_, err = dev.(Writer).AddKeyslotWithVolumeKey(NewVolumeKey(wrongKey), []byte("recovery"), kdf)
+	require.Equal(t, ErrVolumeKeyIncorrect, err)
+	wiped := NewVolumeKey(volumeKey)
+	wiped.Wipe()
+	_, err = dev.(Writer).AddKeyslotWithVolumeKey(wiped, []byte("recovery"), kdf)
+	require.Error(t, err)
+	require.Equal(t, []int{0}, dev.Slots())
+
+	keyslot, err := dev.(Writer).AddKeyslotWithVolumeKey(NewVolumeKey(volumeKey), []byte("recovery"), kdf)
+	require.NoError(t, err)
+	require.Equal(t, 1, keyslot)
+
+	reopened, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer reopened.Close()
+	require.Equal(t, []int{0, 1}, reopened.Slots())
+	v, err := reopened.UnsealVolume(1, []byte("recovery"))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, v.key)
+}
+
+func TestLuks1UnlockAndKillSlotHeaderWriteFailure(t *testing.T) {
+	disk, _ := createLuks1Fixture(t, "foobar")
+	d, err := initV1Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	_, err = d.AddKeyslot([]byte("foobar"), []byte("recovery"), KdfParams{Type: "pbkdf2", Iterations: fixtureIterations})
+	require.NoError(t, err)
+
+	// the keyslot material is wiped but writing the header fails
+	storage := &failingStorage{Storage: FileStorage{disk}, fail: func(off int64) bool { return off == 0 }}
+	d, err = initV1Device(disk.Name(), storage)
+	require.NoError(t, err)
+	_, err = d.UnlockAndKillSlot(1, []byte("recovery"))
+	require.Error(t, err)
+
+	// the key material is gone thus the keyslot must not be advertised anymore
+	require.Equal(t, []int{0}, d.Slots())
+
+	onDisk, err := initV1Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1}, onDisk.Slots())
+	_, err = onDisk.UnsealVolume(1, []byte("recovery"))
+	require.Error(t, err)
+}
+
+func TestLuks1ChangePassphrase(t *testing.T) {
+	disk, volumeKey := createLuks1Fixture(t, "foobar")
+
+	dev, err := OpenWithOptions(disk.Name(), OpenOptions{ReadWrite: true})
+	require.NoError(t, err)
+	defer dev.Close()
+
+	require.Equal(t, ErrPassphraseDoesNotMatch, dev.(Writer).ChangePassphrase(0, []byte("wrong"), []byte("newpass")))
+	require.NoError(t, dev.(Writer).ChangePassphrase(0, []byte("foobar"), []byte("newpass")))
+	require.Equal(t, []int{0}, dev.Slots())
+
+	reopened, err := initV1Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	require.Equal(t, []int{0}, reopened.Slots())
+	require.Equal(t, uint32(fixtureIterations), reopened.hdr.KeySlots[0].Iterations)
+	_, err = reopened.UnsealVolume(0, []byte("foobar"))
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+	v, err := reopened.UnsealVolume(0, []byte("newpass"))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, v.key)
+
+	// the temporary copy is wiped
+	require.Equal(t, uint32(luksV1SlotDisabled), reopened.hdr.KeySlots[1].Active)
+	require.Equal(t, make([]byte, 32), reopened.hdr.KeySlots[1].Salt[:])
+}
+
+func TestLuks1Keyslot(t *testing.T) {
+	disk, _ := createLuks1Fixture(t, "foobar")
+	d, err := initV1Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+
+	info, err := d.Keyslot(0)
+	require.NoError(t, err)
+	require.Equal(t, KeyslotInfo{
+		ID:             0,
+		State:          KeyslotStateActive,
+		Priority:       "normal",
+		KeySize:        32,
+		Kdf:            KdfParams{Type: "pbkdf2", Hash: "sha256", Iterations: fixtureIterations},
+		KdfSalt:        d.hdr.KeySlots[0].Salt[:],
+		AreaEncryption: "aes-xts-plain64",
+		AreaKeySize:    32,
+		AfStripes:      stripesNum,
+		AfHash:         "sha256",
+		Area:           KeyslotArea{Keyslot: 0, Active: true, Offset: 4096, Size: 32 * stripesNum},
+	}, info)
+
+	info, err = d.Keyslot(1)
+	require.NoError(t, err)
+	require.Equal(t, KeyslotInfo{
+		ID:    1,
+		State: KeyslotStateInactive,
+		Area:  KeyslotArea{Keyslot: 1, Offset: (8 + 256) * storageSectorSize, Size: 32 * stripesNum},
+	}, info)
+
+	_, err = d.Keyslot(8)
+	require.Error(t, err)
+}
+
+func TestLuks1Segments(t *testing.T) {
+	disk, _ := createLuks1Fixture(t, "foobar")
+	d, err := initV1Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+
+	segments, err := d.Segments()
+	require.NoError(t, err)
+	require.Equal(t, []SegmentInfo{
+		{ID: 0, Type: "crypt", Offset: 4096 * storageSectorSize, Dynamic: true, Encryption: "aes-xts-plain64", SectorSize: 512},
+	}, segments)
+}
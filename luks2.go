@@ -2,21 +2,21 @@ package luks
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/sha256"
-	"crypto/sha512"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash"
-	"os"
+	"io"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 	"unsafe"
-
-	"golang.org/x/crypto/argon2"
-	"golang.org/x/crypto/pbkdf2"
-	"golang.org/x/crypto/xts"
 )
 
 // LUKS v2 format is specified here
@@ -38,40 +38,135 @@ type headerV2 struct {
 }
 
 type deviceV2 struct {
-	path  string
-	f     *os.File
-	hdr   *headerV2
-	meta  *metadata
-	flags []string
+	path   string
+	f      Storage
+	offset int64 // offset of the LUKS device within f, all header and data offsets are relative to it
+	size   int64 // size of the LUKS device within f, zero means up to the end of f, see OpenOptions.Size
+	hdr    *headerV2
+	meta   *metadata
+	flags  []string
+	// keyslot areas must not be read, see OpenOptions.MetadataOnly
+	metadataOnly bool
+	// maxKdfMemory is OpenOptions.MaxKdfMemory
+	maxKdfMemory int
+	// allowKeyExport is OpenOptions.AllowVolumeKeyExport
+	allowKeyExport bool
+	// data is the payload device if the header is detached, nil otherwise
+	data *dataDevice
+}
+
+var (
+	luks2PrimaryMagic   = []byte("LUKS\xba\xbe")
+	luks2SecondaryMagic = []byte("SKUL\xba\xbe")
+)
+
+// maximum number of keyslots and tokens, see LUKS2_KEYSLOTS_MAX and LUKS2_TOKENS_MAX at cryptsetup
+const (
+	luks2KeyslotsMax = 32
+	luks2TokensMax   = 32
+)
+
+// list of offsets where the secondary header can be found, see hdr2_offsets[] at cryptsetup
+var luks2SecondaryOffsets = []int64{0x4000, 0x8000, 0x10000, 0x20000, 0x40000, 0x80000, 0x100000, 0x200000, 0x400000}
+
+var _ device = (*deviceV2)(nil)
+
+func initV2Device(path string, f Storage) (*deviceV2, error) {
+	return initV2DeviceAt(path, f, 0)
+}
+
+// initV2DeviceAt initializes the device that is located at baseOffset within f (e.g. a LUKS partition inside
+// a whole-disk image)
+func initV2DeviceAt(path string, f Storage, baseOffset int64) (*deviceV2, error) {
+	return initV2DeviceAtHeader(path, f, baseOffset, 0)
+}
+
+// initV2DeviceSecondary initializes the device using the secondary header copy
+func initV2DeviceSecondary(path string, f Storage, baseOffset int64) (*deviceV2, error) {
+	magic := make([]byte, len(luks2SecondaryMagic))
+	for _, offset := range luks2SecondaryOffsets {
+		if _, err := f.ReadAt(magic, baseOffset+offset); err != nil {
+			return nil, err
+		}
+		if bytes.Equal(magic, luks2SecondaryMagic) {
+			return initV2DeviceAtHeader(path, f, baseOffset, offset)
+		}
+	}
+	return nil, fmt.Errorf("%w: secondary LUKS header is not found", ErrHeaderCorrupted)
 }
 
-func initV2Device(path string, f *os.File) (*deviceV2, error) {
+// initV2DeviceAtHeader initializes the device using the header copy located at hdrOffset (relative to baseOffset)
+func initV2DeviceAtHeader(path string, f Storage, baseOffset int64, hdrOffset int64) (*deviceV2, error) {
 	var hdr headerV2
 
-	if _, err := f.Seek(0, 0); err != nil {
+	if err := binary.Read(io.NewSectionReader(f, baseOffset+hdrOffset, 4096), binary.BigEndian, &hdr); err != nil {
 		return nil, err
 	}
-	if err := binary.Read(f, binary.BigEndian, &hdr); err != nil {
-		return nil, err
+	if hdr.HeaderOffset != uint64(hdrOffset) {
+		return nil, fmt.Errorf("%w: header offset mismatch: expected %v, got %v", ErrHeaderCorrupted, hdrOffset, hdr.HeaderOffset)
 	}
 
 	hdrSize := hdr.HeaderSize // size of header + JSON metadata
 	if !isPowerOfTwo(uint(hdrSize)) || hdrSize < 16384 || hdrSize > 4194304 {
-		return nil, fmt.Errorf("Invalid size of LUKS header: %v", hdrSize)
+		return nil, fmt.Errorf("%w: invalid header size %v", ErrHeaderCorrupted, hdrSize)
 	}
 
 	// read the whole header
 	data := make([]byte, hdrSize)
-	if _, err := f.ReadAt(data, 0); err != nil {
+	if _, err := f.ReadAt(data, baseOffset+hdrOffset); err != nil {
+		return nil, err
+	}
+
+	checksum, err := computeHeaderChecksum(&hdr, data)
+	if err != nil {
 		return nil, err
 	}
+	expectedChecksum := hdr.Checksum[:len(checksum)]
+	if !bytes.Equal(checksum, expectedChecksum) {
+		return nil, fmt.Errorf("%w: invalid header checksum", ErrHeaderCorrupted)
+	}
+
+	var meta metadata
+	jsonData := data[4096:]
+	if idx := bytes.IndexByte(jsonData, 0); idx != -1 {
+		jsonData = jsonData[:idx]
+	}
+
+	// decode only the first JSON object, the JSON area might contain leftovers of a partial write after it
+	if err := json.NewDecoder(bytes.NewReader(jsonData)).Decode(&meta); err != nil {
+		return nil, fmt.Errorf("%w: invalid JSON metadata: %v", ErrHeaderCorrupted, err)
+	}
+
+	return &deviceV2{
+		path:   path,
+		f:      f,
+		offset: baseOffset,
+		hdr:    &hdr,
+		meta:   &meta,
+		flags:  activationFlags(meta.Config.Flags),
+	}, nil
+}
+
+// activationFlags returns the persistent flags that are applied to the dm-crypt mapping. Similar to cryptsetup
+// unknown flags are ignored.
+func activationFlags(persistent []string) []string {
+	var flags []string
+	for _, f := range persistent {
+		if _, ok := flagsKernelNames[f]; ok {
+			flags = append(flags, f)
+		}
+	}
+	return flags
+}
 
+// computeHeaderChecksum calculates the checksum of the whole header area (binary header + JSON metadata).
+// Note that the checksum field in data is cleared by this function.
+func computeHeaderChecksum(hdr *headerV2, data []byte) ([]byte, error) {
 	for i := 0; i < 64; i++ {
 		// clear the checksum
 		data[int(unsafe.Offsetof(hdr.Checksum))+i] = 0
 	}
 
-	// calculate the checksum of the whole header
 	var h hash.Hash
 	algo := fixedArrayToString(hdr.ChecksumAlgorithm[:])
 	switch algo {
@@ -82,51 +177,168 @@ func initV2Device(path string, f *os.File) (*deviceV2, error) {
 	}
 
 	h.Write(data)
+	return h.Sum(make([]byte, 0)), nil
+}
 
-	checksum := h.Sum(make([]byte, 0))
-	expectedChecksum := hdr.Checksum[:h.Size()]
-	if !bytes.Equal(checksum, expectedChecksum) {
-		return nil, fmt.Errorf("Invalid header checksum")
+// encodeHeader serializes the binary header and the JSON metadata into a header area of size hdr.HeaderSize.
+// The JSON is zero-padded up to config.json_size so no stale bytes from a previous (longer) JSON survive the rewrite.
+func encodeHeader(hdr *headerV2, meta *metadata) ([]byte, error) {
+	jsonSize, err := meta.Config.JSONSize.Int64()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config.json_size value: %v", err)
+	}
+	if jsonSize != int64(hdr.HeaderSize)-4096 {
+		return nil, fmt.Errorf("config.json_size %v does not match header size %v", jsonSize, hdr.HeaderSize)
 	}
 
-	var meta metadata
-	jsonData := data[4096:]
-	jsonData = jsonData[:bytes.IndexByte(jsonData, 0)]
+	jsonData, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	// JSON area must contain at least one terminating zero byte
+	if int64(len(jsonData)) >= jsonSize {
+		return nil, fmt.Errorf("JSON metadata size %v exceeds config.json_size %v", len(jsonData), jsonSize)
+	}
 
-	if err := json.Unmarshal(jsonData, &meta); err != nil {
+	buff := bytes.NewBuffer(make([]byte, 0, hdr.HeaderSize))
+	if err := binary.Write(buff, binary.BigEndian, hdr); err != nil {
 		return nil, err
 	}
+	data := buff.Bytes()[:hdr.HeaderSize]
+	copy(data[4096:], jsonData)
 
-	return &deviceV2{
-		path:  path,
-		f:     f,
-		hdr:   &hdr,
-		meta:  &meta,
-		flags: meta.Config.Flags,
-	}, nil
+	checksum, err := computeHeaderChecksum(hdr, data)
+	if err != nil {
+		return nil, err
+	}
+	copy(data[unsafe.Offsetof(hdr.Checksum):], checksum)
+
+	return data, nil
+}
+
+// writeHeader writes the current in-memory metadata to both primary and secondary header copies.
+// The header sequence id is incremented so cryptsetup picks up the updated header.
+func (d *deviceV2) writeHeader() error {
+	d.hdr.SequenceID++
+
+	// the secondary header directly follows the primary one
+	offsets := []uint64{0, d.hdr.HeaderSize}
+	// encode both copies first so an invalid metadata (e.g. too large JSON) does not leave a partially written header
+	copies := make([][]byte, len(offsets))
+	for i, offset := range offsets {
+		hdr := *d.hdr
+		hdr.HeaderOffset = offset
+		if offset == 0 {
+			copy(hdr.Magic[:], luks2PrimaryMagic)
+		} else {
+			copy(hdr.Magic[:], luks2SecondaryMagic)
+		}
+
+		data, err := encodeHeader(&hdr, d.meta)
+		if err != nil {
+			d.hdr.SequenceID--
+			return err
+		}
+		copies[i] = data
+	}
+
+	for i, offset := range offsets {
+		if _, err := d.f.WriteAt(copies[i], d.offset+int64(offset)); err != nil {
+			return err
+		}
+	}
+
+	return syncStorage(d.f)
+}
+
+// headerAreaSize returns size of the on-disk metadata region (both binary headers with JSON areas and keyslots area)
+// as it is declared by the header. Note that a header device (e.g. a raw partition with a detached header) might be
+// larger than this region, the rest of the device does not belong to LUKS metadata.
+func (d *deviceV2) headerAreaSize() (uint64, error) {
+	keyslotsSize, err := d.meta.Config.KeyslotsSize.Int64()
+	if err != nil {
+		return 0, fmt.Errorf("invalid config.keyslots_size value: %v", err)
+	}
+	return 2*d.hdr.HeaderSize + uint64(keyslotsSize), nil
 }
 
 func (d *deviceV2) Close() error {
-	return d.f.Close()
+	if d.data != nil {
+		closeStorage(d.data.f)
+	}
+	return closeStorage(d.f)
 }
 
 func (d *deviceV2) Path() string {
 	return d.path
 }
 
+// keyslot priorities, see crypt_keyslot_priority at cryptsetup
+const (
+	luks2PriorityIgnore = 0
+	luks2PriorityNormal = 1
+	luks2PriorityPrefer = 2
+)
+
+func (ks *keyslot) priority() int {
+	if ks.Priority == nil {
+		return luks2PriorityNormal
+	}
+	return *ks.Priority
+}
+
+// Slots returns the keyslots in the order cryptsetup tries them: "prefer" keyslots first, then "normal" ones,
+// by id within the same priority
 func (d *deviceV2) Slots() []int {
 	var normPrio, highPrio []int
 	for i, k := range d.meta.Keyslots {
-		if k.Priority != nil && *k.Priority == 2 {
+		if d.isUnbound(i) {
+			continue
+		}
+		switch k.priority() {
+		case luks2PriorityPrefer:
 			highPrio = append(highPrio, i)
-		} else if k.Priority == nil || *k.Priority == 1 {
+		case luks2PriorityNormal:
 			normPrio = append(normPrio, i)
 		}
 	}
-	// first we append high priority slots, then normal priority
+	sort.Ints(highPrio)
+	sort.Ints(normPrio)
 	return append(highPrio, normPrio...)
 }
 
+func (d *deviceV2) UnboundSlots() []int {
+	var slots []int
+	for i := range d.meta.Keyslots {
+		if d.isUnbound(i) {
+			slots = append(slots, i)
+		}
+	}
+	sort.Ints(slots)
+	return slots
+}
+
+// isUnbound reports whether the keyslot is not bound to a data segment i.e. it has no digest or its digest
+// is not assigned to any segment
+func (d *deviceV2) isUnbound(keyslotIdx int) bool {
+	dig := d.findDigestForKeyslot(keyslotIdx)
+	return dig == nil || len(dig.Segments) == 0
+}
+
+// isLastBoundKeyslot reports whether the keyslot is the only one that can unlock the data segment,
+// unbound keyslots do not count
+func (d *deviceV2) isLastBoundKeyslot(keyslotIdx int) bool {
+	if d.isUnbound(keyslotIdx) {
+		return false
+	}
+	for i := range d.meta.Keyslots {
+		if i != keyslotIdx && !d.isUnbound(i) {
+			return false
+		}
+	}
+	return true
+}
+
 func (d *deviceV2) Tokens() ([]Token, error) {
 	var tokens []Token
 
@@ -153,9 +365,12 @@ func (d *deviceV2) Tokens() ([]Token, error) {
 		token := Token{
 			ID:      i,
 			Slots:   keyslots,
-			Type:    node.Type,
+			Type:    normalizeTokenType(node.Type),
 			Payload: t,
 		}
+		if err := decodeToken(&token); err != nil {
+			return nil, err
+		}
 
 		tokens = append(tokens, token)
 	}
@@ -163,186 +378,1416 @@ func (d *deviceV2) Tokens() ([]Token, error) {
 	return tokens, nil
 }
 
-func (d *deviceV2) UUID() string {
-	return fixedArrayToString(d.hdr.UUID[:])
-}
-
-func (d *deviceV2) FlagsGet() []string {
-	return d.flags
+func (d *deviceV2) Capabilities() Capabilities {
+	return Capabilities{
+		Tokens:       true,
+		Integrity:    d.hasIntegrity(),
+		Reencryption: d.inReencryption(),
+		Writable:     isWritable(d.f),
+	}
 }
 
-func (d *deviceV2) FlagsAdd(flags ...string) error {
-	d.flags = append(d.flags, flags...)
-	return nil
+// hasIntegrity reports whether any data segment is protected with dm-integrity
+func (d *deviceV2) hasIntegrity() bool {
+	for _, seg := range d.meta.Segments {
+		if seg.Integrity != nil {
+			return true
+		}
+	}
+	return false
 }
 
-func (d *deviceV2) FlagsClear() {
-	d.flags = nil
+// inReencryption reports whether the metadata describes an (interrupted) online reencryption
+func (d *deviceV2) inReencryption() bool {
+	for _, ks := range d.meta.Keyslots {
+		if ks.Type == "reencrypt" {
+			return true
+		}
+	}
+	for _, req := range d.meta.Config.Requirements {
+		if strings.HasPrefix(req, "online-reencrypt") {
+			return true
+		}
+	}
+	return false
 }
 
-func (d *deviceV2) Version() int {
-	return 2
+func (d *deviceV2) AutoUnlockable() bool {
+	return autoUnlockable(d)
 }
 
-func (d *deviceV2) Unlock(keyslot int, passphrase []byte, dmName string) error {
-	volume, err := d.UnsealVolume(keyslot, passphrase)
+func (d *deviceV2) UnlockWithClevis(ctx context.Context, dmName string) error {
+	volume, err := unsealClevis(ctx, d)
 	if err != nil {
 		return err
 	}
-	defer clearSlice(volume.key)
-
 	return volume.SetupMapper(dmName)
 }
 
-func (d *deviceV2) UnlockAny(passphrase []byte, dmName string) error {
-	for _, s := range d.Slots() {
-		volume, err := d.UnsealVolume(s, passphrase)
-		if err == ErrPassphraseDoesNotMatch {
-			continue
-		} else if err != nil {
-			return err
-		}
+func (d *deviceV2) UUID() string {
+	return fixedArrayToString(d.hdr.UUID[:])
+}
 
-		return volume.SetupMapper(dmName)
+func (d *deviceV2) KeyslotFeasible(keyslotIdx int) (bool, string) {
+	ks, ok := d.meta.Keyslots[keyslotIdx]
+	if !ok {
+		return false, fmt.Sprintf("keyslot %d does not exist", keyslotIdx)
+	}
+
+	if err := d.checkKdfMemory(keyslotIdx, ks.Kdf); err != nil {
+		return false, err.Error()
+	}
+
+	switch ks.Kdf.Type {
+	case "argon2i", "argon2id":
+		required := uint64(ks.Kdf.Memory) * 1024 // memory cost is specified in KiB
+		available, err := availableMemory()
+		if err != nil {
+			return false, fmt.Sprintf("unable to get available memory: %v", err)
+		}
+		if required > available {
+			return false, fmt.Sprintf("keyslot %d %v requires %d MiB of memory but only %d MiB is available", keyslotIdx, ks.Kdf.Type, required>>20, available>>20)
+		}
 	}
-	return ErrPassphraseDoesNotMatch
+	return true, ""
 }
 
-func (d *deviceV2) UnsealVolume(keyslotIdx int, passphrase []byte) (*Volume, error) {
-	keyslots := d.meta.Keyslots
+// checkKdfMemory verifies the argon2 memory cost against the OpenOptions.MaxKdfMemory limit
+func (d *deviceV2) checkKdfMemory(keyslotIdx int, k kdf) error {
+	if k.Type != "argon2i" && k.Type != "argon2id" {
+		return nil
+	}
+	limit := d.maxKdfMemory
+	if limit == 0 {
+		limit = DefaultMaxKdfMemory
+	}
+	if limit > 0 && uint64(k.Memory) > uint64(limit) {
+		return fmt.Errorf("%w: keyslot %d %v requires %d MiB of memory, the limit is %d MiB", ErrKdfMemoryLimit, keyslotIdx, k.Type, k.Memory>>10, limit>>10)
+	}
+	return nil
+}
 
-	keyslot, ok := keyslots[keyslotIdx]
+func (d *deviceV2) EstimatedUnlockTime(keyslotIdx int) (time.Duration, error) {
+	ks, ok := d.meta.Keyslots[keyslotIdx]
 	if !ok {
-		return nil, fmt.Errorf("Unable to get a keyslot with id: %d", keyslotIdx)
+		return 0, fmt.Errorf("%w: keyslot %d", ErrKeyslotInactive, keyslotIdx)
 	}
 
-	afKey, err := deriveLuks2AfKey(keyslot.Kdf, keyslotIdx, passphrase, keyslot.Area.KeySize)
-	if err != nil {
-		return nil, err
+	var estimate time.Duration
+	switch ks.Kdf.Type {
+	case "pbkdf2":
+		h, _ := getHashAlgo(ks.Kdf.Hash)
+		if h == nil {
+			return 0, fmt.Errorf("Unknown keyslotIdx[%v].kdf.hash algorithm: %v", keyslotIdx, ks.Kdf.Hash)
+		}
+		estimate = estimatePbkdf2(h, int(ks.Kdf.Iterations), int(ks.Area.KeySize))
+	case "argon2i", "argon2id":
+		estimate = estimateArgon2(ks.Kdf.Type, uint32(ks.Kdf.Time), uint32(ks.Kdf.Memory), uint32(ks.Kdf.Cpus))
+	default:
+		return 0, fmt.Errorf("Unknown kdf type: %v", ks.Kdf.Type)
 	}
-	defer clearSlice(afKey)
 
-	finalKey, err := d.decryptLuks2VolumeKey(keyslotIdx, keyslot, afKey)
-	if err != nil {
-		return nil, err
+	// the recovered key is verified with the digest
+	if dig := d.findDigestForKeyslot(keyslotIdx); dig != nil && dig.Type == "pbkdf2" {
+		h, size := getHashAlgo(dig.Hash)
+		if h == nil {
+			return 0, fmt.Errorf("Unknown digest hash algorithm: %v", dig.Hash)
+		}
+		estimate += estimatePbkdf2(h, int(dig.Iterations), size)
 	}
 
-	// verify with digest
-	digest := d.findDigestForKeyslot(keyslotIdx)
-	if digest == nil {
-		return nil, fmt.Errorf("No digest is found for keyslot %v", keyslotIdx)
-	}
+	return estimate, nil
+}
 
-	generatedDigest, err := computeDigestForKey(digest, keyslotIdx, finalKey)
-	if err != nil {
-		return nil, err
+func (d *deviceV2) RequiredAlgorithms() (ciphers, modes, hashes, kdfs []string) {
+	cipherSet := make(map[string]bool)
+	modeSet := make(map[string]bool)
+	hashSet := make(map[string]bool)
+	kdfSet := make(map[string]bool)
+
+	addCipher := func(encryption string) {
+		cipherName, cipherMode, _, err := parseCipherSpec(encryption)
+		if err != nil {
+			// report the unparseable spec as is so the caller sees it as unsupported
+			cipherSet[encryption] = true
+			return
+		}
+		cipherSet[cipherName] = true
+		modeSet[cipherMode] = true
 	}
-	defer clearSlice(generatedDigest)
 
-	expectedDigest, err := base64.StdEncoding.DecodeString(digest.Digest)
-	if err != nil {
-		return nil, fmt.Errorf("keyslotIdx[%v].digest.Digest base64 parsing failed: %v", keyslotIdx, err)
+	for _, k := range d.meta.Keyslots {
+		addCipher(k.Area.Encryption)
+		hashSet[k.Af.Hash] = true
+		hashSet[k.Kdf.Hash] = true
+		kdfSet[k.Kdf.Type] = true
+	}
+	for _, dig := range d.meta.Digests {
+		hashSet[dig.Hash] = true
+		kdfSet[dig.Type] = true
 	}
-	if !bytes.Equal(generatedDigest[0:len(expectedDigest)], expectedDigest) {
-		return nil, ErrPassphraseDoesNotMatch
+	for _, seg := range d.meta.Segments {
+		if seg.Encryption == "" || isNullCipher(seg.Encryption) {
+			continue
+		}
+		addCipher(seg.Encryption)
 	}
-	clearSlice(generatedDigest)
 
-	if len(digest.Segments) != 1 {
-		return nil, fmt.Errorf("LUKS partition expects exactly 1 storage segment, got %+v", len(digest.Segments))
+	return sortedSet(cipherSet), sortedSet(modeSet), sortedSet(hashSet), sortedSet(kdfSet)
+}
+
+func (d *deviceV2) MasterKeyDigestParams() (DigestParams, error) {
+	// the volume key digest is the one that is bound to the data segments
+	for i, dig := range d.meta.Digests {
+		if len(dig.Segments) == 0 {
+			continue
+		}
+		return digestParams(i, dig)
 	}
-	seg, err := digest.Segments[0].Int64()
+	return DigestParams{}, fmt.Errorf("no digest is bound to a data segment")
+}
+
+func digestParams(id int, dig digest) (DigestParams, error) {
+	salt, err := base64.StdEncoding.DecodeString(dig.Salt)
 	if err != nil {
-		return nil, err
+		return DigestParams{}, fmt.Errorf("digest[%v].salt base64 parsing failed: %v", id, err)
 	}
-
-	storageSegment := d.meta.Segments[int(seg)]
-	offset, err := storageSegment.Offset.Int64()
+	value, err := base64.StdEncoding.DecodeString(dig.Digest)
 	if err != nil {
+		return DigestParams{}, fmt.Errorf("digest[%v].digest base64 parsing failed: %v", id, err)
+	}
+
+	return DigestParams{
+		Type:       dig.Type,
+		Hash:       dig.Hash,
+		Iterations: int(dig.Iterations),
+		Salt:       salt,
+		Digest:     value,
+	}, nil
+}
+
+func (d *deviceV2) DumpTo(w io.Writer) error {
+	return dumpDevice(w, d)
+}
+
+func (d *deviceV2) MetadataJSON() ([]byte, error) {
+	data := make([]byte, d.hdr.HeaderSize-4096)
+	if _, err := d.f.ReadAt(data, d.offset+int64(d.hdr.HeaderOffset)+4096); err != nil {
 		return nil, err
 	}
+	if idx := bytes.IndexByte(data, 0); idx != -1 {
+		data = data[:idx]
+	}
+	return data, nil
+}
 
-	var storageSize uint64
-	if storageSegment.Size == "dynamic" {
-		storageSize, err = fileSize(d.f)
+func (d *deviceV2) MarshalJSON() ([]byte, error) {
+	return marshalDevice(d)
+}
+
+func (d *deviceV2) Digests() ([]DigestInfo, error) {
+	digests := make([]DigestInfo, 0, len(d.meta.Digests))
+	for i, dig := range d.meta.Digests {
+		params, err := digestParams(i, dig)
 		if err != nil {
 			return nil, err
 		}
-		if storageSize < uint64(offset) {
-			return nil, fmt.Errorf("backing file size %d is smaller than LUKS segment offset %d", storageSize, offset)
-		}
-
-		storageSize -= uint64(offset)
-	} else {
-		size, err := strconv.Atoi(storageSegment.Size)
+		keyslots, err := dig.Keyslots.ints()
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("invalid digest[%v] keyslots: %v", i, err)
 		}
-		if size == 0 {
-			return nil, fmt.Errorf("invalid segment size: %v", size)
+		segments, err := dig.Segments.ints()
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest[%v] segments: %v", i, err)
 		}
-
-		storageSize = uint64(size)
+		digests = append(digests, DigestInfo{ID: i, DigestParams: params, Keyslots: keyslots, Segments: segments})
 	}
+	sort.Slice(digests, func(i, j int) bool { return digests[i].ID < digests[j].ID })
+	return digests, nil
+}
+
+func (d *deviceV2) Label() string {
+	return fixedArrayToString(d.hdr.Label[:])
+}
+
+func (d *deviceV2) Subsystem() string {
+	return fixedArrayToString(d.hdr.SubsystemLabel[:])
+}
 
-	ivTweak, err := storageSegment.IvTweak.Int64()
+func (d *deviceV2) SetUUID(uuid string) error {
+	uuid, err := uuidOrRandom(uuid)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return d.updateHeader(func(hdr *headerV2) error {
+		return putFixedString(hdr.UUID[:], uuid)
+	})
+}
 
-	v := &Volume{
-		BackingDevice:     d.path,
-		Flags:             d.flags,
-		UUID:              d.UUID(),
-		key:               finalKey,
-		LuksType:          "LUKS2",
-		StorageSize:       storageSize,
-		StorageOffset:     uint64(offset),
-		StorageEncryption: storageSegment.Encryption,
-		StorageIvTweak:    uint64(ivTweak),
-		StorageSectorSize: uint64(storageSegment.SectorSize),
+func (d *deviceV2) SetLabel(label string) error {
+	return d.updateHeader(func(hdr *headerV2) error {
+		return putFixedString(hdr.Label[:], label)
+	})
+}
+
+func (d *deviceV2) SetSubsystem(subsystem string) error {
+	return d.updateHeader(func(hdr *headerV2) error {
+		return putFixedString(hdr.SubsystemLabel[:], subsystem)
+	})
+}
+
+// updateHeader modifies the binary header and writes both header copies. The header is left intact on error.
+func (d *deviceV2) updateHeader(update func(hdr *headerV2) error) error {
+	if !isWritable(d.f) {
+		return fmt.Errorf("device %v is opened read-only", d.path)
 	}
-	return v, nil
+
+	orig := *d.hdr
+	if err := update(d.hdr); err != nil {
+		*d.hdr = orig
+		return err
+	}
+	if err := d.writeHeader(); err != nil {
+		*d.hdr = orig
+		return err
+	}
+	return nil
 }
 
-func computeDigestForKey(dig *digest, keyslotIdx int, finalKey []byte) ([]byte, error) {
-	digSalt, err := base64.StdEncoding.DecodeString(dig.Salt)
+func (d *deviceV2) KeyslotLayout() (KeyslotLayout, error) {
+	keyslotsSize, err := parseUint64(d.meta.Config.KeyslotsSize)
 	if err != nil {
-		return nil, fmt.Errorf("keyslotIdx[%v].digest.salt base64 parsing failed: %v", keyslotIdx, err)
+		return KeyslotLayout{}, fmt.Errorf("invalid config.keyslots_size value: %v", err)
 	}
 
-	switch dig.Type {
-	case "pbkdf2":
-		h, size := getHashAlgo(dig.Hash)
-		if h == nil {
-			return nil, fmt.Errorf("Unknown digest hash algorithm: %v", dig.Hash)
+	areas := make([]KeyslotArea, 0, len(d.meta.Keyslots))
+	for i, ks := range d.meta.Keyslots {
+		offset, err := parseUint64(ks.Area.Offset)
+		if err != nil {
+			return KeyslotLayout{}, fmt.Errorf("invalid keyslot[%v] offset: %v", i, err)
 		}
-		return pbkdf2.Key(finalKey, digSalt, int(dig.Iterations), size, h), nil
-	default:
-		return nil, fmt.Errorf("Unknown digest kdf type: %v", dig.Type)
+		size, err := parseUint64(ks.Area.Size)
+		if err != nil {
+			return KeyslotLayout{}, fmt.Errorf("invalid keyslot[%v] size: %v", i, err)
+		}
+		areas = append(areas, KeyslotArea{Keyslot: i, Active: true, Offset: offset, Size: size})
 	}
+	sort.Slice(areas, func(i, j int) bool { return areas[i].Keyslot < areas[j].Keyslot })
+
+	// the keyslots region directly follows both binary headers with JSON areas
+	return KeyslotLayout{
+		RegionOffset: 2 * d.hdr.HeaderSize,
+		RegionSize:   keyslotsSize,
+		Alignment:    observedAlignment(areas),
+		Areas:        areas,
+	}, nil
 }
 
-func (d *deviceV2) decryptLuks2VolumeKey(keyslotIdx int, keyslot keyslot, afKey []byte) ([]byte, error) {
-	// this method follows logic at luks2_keyslot_get_key()
-	area := keyslot.Area
+// names of keyslot priorities as they are shown by `cryptsetup luksDump`
+var luks2PriorityNames = map[int]string{
+	luks2PriorityIgnore: "ignore",
+	luks2PriorityNormal: "normal",
+	luks2PriorityPrefer: "prefer",
+}
 
-	// decrypt keyslotIdx area using the derived key
-	keyslotSize := keyslot.KeySize * stripesNum
+func (d *deviceV2) Keyslot(keyslotIdx int) (KeyslotInfo, error) {
+	if keyslotIdx < 0 || keyslotIdx >= luks2KeyslotsMax {
+		return KeyslotInfo{}, fmt.Errorf("keyslot %d is out of range of available slots", keyslotIdx)
+	}
+	ks, ok := d.meta.Keyslots[keyslotIdx]
+	if !ok {
+		return KeyslotInfo{ID: keyslotIdx, State: KeyslotStateInactive}, nil
+	}
 
-	areaSize, err := area.Size.Int64()
+	offset, err := parseUint64(ks.Area.Offset)
 	if err != nil {
-		return nil, fmt.Errorf("Invalid keyslotIdx[%v] size value: %v. %v", keyslotIdx, area.Size, err)
+		return KeyslotInfo{}, fmt.Errorf("invalid keyslot[%v] offset: %v", keyslotIdx, err)
 	}
-	if int64(keyslotSize) > areaSize {
-		return nil, fmt.Errorf("keyslot[%v] area size too small, given %v expected at least %v", keyslotIdx, areaSize, keyslotSize)
+	size, err := parseUint64(ks.Area.Size)
+	if err != nil {
+		return KeyslotInfo{}, fmt.Errorf("invalid keyslot[%v] size: %v", keyslotIdx, err)
 	}
-	if keyslotSize%storageSectorSize != 0 {
-		return nil, fmt.Errorf("keyslot[%v] size %v is not multiple of the sector size %v", keyslotIdx, keyslotSize, storageSectorSize)
+	salt, err := base64.StdEncoding.DecodeString(ks.Kdf.Salt)
+	if err != nil {
+		return KeyslotInfo{}, fmt.Errorf("keyslotIdx[%v].kdf.salt base64 parsing failed: %v", keyslotIdx, err)
+	}
+
+	state := KeyslotStateActive
+	if d.isUnbound(keyslotIdx) {
+		state = KeyslotStateUnbound
+	}
+	priority, ok := luks2PriorityNames[ks.priority()]
+	if !ok {
+		priority = strconv.Itoa(ks.priority())
+	}
+
+	return KeyslotInfo{
+		ID:       keyslotIdx,
+		State:    state,
+		Priority: priority,
+		KeySize:  int(ks.KeySize),
+		Kdf: KdfParams{
+			Type:       ks.Kdf.Type,
+			Hash:       ks.Kdf.Hash,
+			Iterations: int(ks.Kdf.Iterations),
+			Time:       int(ks.Kdf.Time),
+			Memory:     int(ks.Kdf.Memory),
+			Threads:    int(ks.Kdf.Cpus),
+		},
+		KdfSalt:        salt,
+		AreaEncryption: ks.Area.Encryption,
+		AreaKeySize:    int(ks.Area.KeySize),
+		AfStripes:      int(ks.Af.Stripes),
+		AfHash:         ks.Af.Hash,
+		Area:           KeyslotArea{Keyslot: keyslotIdx, Active: true, Offset: offset, Size: size},
+	}, nil
+}
+
+func (d *deviceV2) Segments() ([]SegmentInfo, error) {
+	segments := make([]SegmentInfo, 0, len(d.meta.Segments))
+	for i, seg := range d.meta.Segments {
+		info := SegmentInfo{
+			ID:         i,
+			Type:       seg.Type,
+			Encryption: seg.Encryption,
+			SectorSize: int(seg.SectorSize),
+		}
+
+		var err error
+		if info.Offset, err = parseUint64(seg.Offset); err != nil {
+			return nil, fmt.Errorf("invalid segment[%v] offset: %v", i, err)
+		}
+		if seg.IvTweak != "" {
+			if info.IvTweak, err = parseUint64(seg.IvTweak); err != nil {
+				return nil, fmt.Errorf("invalid segment[%v] iv_tweak: %v", i, err)
+			}
+		}
+		if seg.Size == "dynamic" {
+			info.Dynamic = true
+		} else if info.Size, err = parseUint64(json.Number(seg.Size)); err != nil {
+			return nil, fmt.Errorf("invalid segment[%v] size: %v", i, err)
+		}
+		if seg.Integrity != nil {
+			info.Integrity = seg.Integrity.Type
+		}
+		segments = append(segments, info)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].ID < segments[j].ID })
+	return segments, nil
+}
+
+func (d *deviceV2) Snapshot() (DeviceSnapshot, error) {
+	snap := DeviceSnapshot{
+		Version:    2,
+		UUID:       d.UUID(),
+		SequenceID: d.hdr.SequenceID,
+		Keyslots:   make([]SnapshotEntry, 0, len(d.meta.Keyslots)),
+		Tokens:     make([]SnapshotEntry, 0, len(d.meta.Tokens)),
+		Segments:   make([]SnapshotSegment, 0, len(d.meta.Segments)),
+	}
+
+	for i, ks := range d.meta.Keyslots {
+		data, err := json.Marshal(ks)
+		if err != nil {
+			return DeviceSnapshot{}, err
+		}
+		snap.Keyslots = append(snap.Keyslots, SnapshotEntry{ID: i, Fingerprint: fingerprint(data)})
+	}
+	sortSnapshotEntries(snap.Keyslots)
+
+	for i, t := range d.meta.Tokens {
+		snap.Tokens = append(snap.Tokens, SnapshotEntry{ID: i, Fingerprint: fingerprint(t)})
+	}
+	sortSnapshotEntries(snap.Tokens)
+
+	for i, seg := range d.meta.Segments {
+		snap.Segments = append(snap.Segments, SnapshotSegment{
+			ID:         i,
+			Offset:     seg.Offset.String(),
+			Size:       seg.Size,
+			Encryption: seg.Encryption,
+			SectorSize: int(seg.SectorSize),
+		})
+	}
+	sort.Slice(snap.Segments, func(i, j int) bool { return snap.Segments[i].ID < snap.Segments[j].ID })
+
+	return snap, nil
+}
+
+func (d *deviceV2) Flags() []string {
+	return append([]string(nil), d.meta.Config.Flags...)
+}
+
+// flags that can be stored in the LUKS2 header, see persistent_flags[] at cryptsetup
+var luks2PersistentFlags = []string{
+	FlagAllowDiscards,
+	FlagSameCPUCrypt,
+	FlagSubmitFromCryptCPUs,
+	"no-journal", // dm-integrity flag
+	FlagNoReadWorkqueue,
+	FlagNoWriteWorkqueue,
+}
+
+func (d *deviceV2) SetFlags(flags []string) error {
+	if !isWritable(d.f) {
+		return fmt.Errorf("device %v is opened read-only", d.path)
+	}
+
+	var persistent []string
+	seen := make(map[string]bool)
+	for _, f := range flags {
+		if !containsString(luks2PersistentFlags, f) {
+			return fmt.Errorf("flag %q can't be stored in LUKS2 header", f)
+		}
+		if !seen[f] {
+			seen[f] = true
+			persistent = append(persistent, f)
+		}
+	}
+
+	orig := d.meta
+	d.meta = orig.clone()
+	d.meta.Config.Flags = persistent
+	if err := d.writeHeader(); err != nil {
+		d.meta = orig
+		return err
+	}
+	return nil
+}
+
+func (d *deviceV2) FlagsGet() []string {
+	return d.flags
+}
+
+func (d *deviceV2) FlagsAdd(flags ...string) error {
+	d.flags = append(d.flags, flags...)
+	return nil
+}
+
+func (d *deviceV2) FlagsClear() {
+	d.flags = nil
+}
+
+func (d *deviceV2) Version() int {
+	return 2
+}
+
+func (d *deviceV2) Unlock(keyslot int, passphrase []byte, dmName string) error {
+	return d.UnlockContext(context.Background(), keyslot, passphrase, dmName)
+}
+
+func (d *deviceV2) UnlockContext(ctx context.Context, keyslot int, passphrase []byte, dmName string) error {
+	volume, err := d.UnsealVolumeContext(ctx, keyslot, passphrase)
+	if err != nil {
+		return err
+	}
+	defer clearSlice(volume.key)
+
+	return volume.SetupMapper(dmName)
+}
+
+func (d *deviceV2) UnlockWithKeyfile(keyslot int, r io.Reader, offset, maxSize int64, dmName string) error {
+	passphrase, err := ReadKeyfile(r, offset, maxSize)
+	if err != nil {
+		return err
+	}
+	defer clearSlice(passphrase)
+
+	if keyslot < 0 {
+		return d.UnlockAny(passphrase, dmName)
+	}
+	return d.Unlock(keyslot, passphrase, dmName)
+}
+
+func (d *deviceV2) UnlockAny(passphrase []byte, dmName string) error {
+	return d.UnlockAnyContext(context.Background(), passphrase, dmName)
+}
+
+func (d *deviceV2) UnlockAnyContext(ctx context.Context, passphrase []byte, dmName string) error {
+	// keyslots over the memory limit are skipped, the limit error is returned only if no keyslot was tried
+	var lastErr error
+	for _, s := range d.Slots() {
+		volume, err := d.UnsealVolumeContext(ctx, s, passphrase)
+		if errors.Is(err, ErrPassphraseIncorrect) {
+			lastErr = ErrPassphraseIncorrect
+			continue
+		} else if errors.Is(err, ErrKdfMemoryLimit) {
+			if lastErr == nil {
+				lastErr = err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		return volume.SetupMapper(dmName)
+	}
+	if lastErr == nil {
+		return ErrPassphraseIncorrect
+	}
+	return lastErr
+}
+
+func (d *deviceV2) Suspend(dmName string) error {
+	return suspendMapping(d, dmName)
+}
+
+func (d *deviceV2) Resume(dmName string, passphrase []byte) error {
+	return resumeMapping(d, dmName, passphrase)
+}
+
+func (d *deviceV2) UnsealVolume(keyslotIdx int, passphrase []byte) (*Volume, error) {
+	return d.UnsealVolumeContext(context.Background(), keyslotIdx, passphrase)
+}
+
+func (d *deviceV2) UnsealVolumeContext(ctx context.Context, keyslotIdx int, passphrase []byte) (*Volume, error) {
+	if d.metadataOnly {
+		return nil, ErrMetadataOnly
+	}
+	if _, ok := d.meta.Keyslots[keyslotIdx]; ok && d.isUnbound(keyslotIdx) {
+		return nil, fmt.Errorf("%w: keyslot %d", ErrKeyslotUnbound, keyslotIdx)
+	}
+
+	finalKey, digest, err := d.unsealKeyslot(ctx, keyslotIdx, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return d.volumeForDigest(digest, finalKey)
+}
+
+func (d *deviceV2) UnsealUnboundKey(keyslotIdx int, passphrase []byte) ([]byte, error) {
+	if d.metadataOnly {
+		return nil, ErrMetadataOnly
+	}
+	if _, ok := d.meta.Keyslots[keyslotIdx]; ok && !d.isUnbound(keyslotIdx) {
+		return nil, fmt.Errorf("keyslot %d is bound to a data segment, use UnsealVolume", keyslotIdx)
+	}
+
+	key, _, err := d.unsealKeyslot(context.Background(), keyslotIdx, passphrase)
+	return key, err
+}
+
+// unsealKeyslot recovers the key stored in the keyslot and verifies it with the keyslot digest
+func (d *deviceV2) unsealKeyslot(ctx context.Context, keyslotIdx int, passphrase []byte) ([]byte, *digest, error) {
+	keyslot, ok := d.meta.Keyslots[keyslotIdx]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: keyslot %d", ErrKeyslotInactive, keyslotIdx)
+	}
+	if err := d.checkKdfMemory(keyslotIdx, keyslot.Kdf); err != nil {
+		return nil, nil, err
+	}
+	digest := d.findDigestForKeyslot(keyslotIdx)
+	if digest == nil {
+		return nil, nil, fmt.Errorf("No digest is found for keyslot %v", keyslotIdx)
+	}
+
+	afKey, err := deriveKey(ctx, passphrase, func(passphrase []byte) ([]byte, error) {
+		return deriveLuks2AfKey(keyslot.Kdf, keyslotIdx, passphrase, keyslot.Area.KeySize)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer clearSlice(afKey)
+
+	finalKey, err := d.decryptLuks2VolumeKey(keyslotIdx, keyslot, afKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// verify with digest
+	if ok, err := verifyDigest(ctx, digest, keyslotIdx, finalKey); err != nil || !ok {
+		clearSlice(finalKey)
+		if err == nil {
+			err = ErrPassphraseIncorrect
+		}
+		return nil, nil, err
+	}
+	return finalKey, digest, nil
+}
+
+// verifyDigest checks whether the key matches the digest
+func verifyDigest(ctx context.Context, digest *digest, keyslotIdx int, key []byte) (bool, error) {
+	generatedDigest, err := deriveKey(ctx, key, func(key []byte) ([]byte, error) {
+		return computeDigestForKey(digest, keyslotIdx, key)
+	})
+	if err != nil {
+		return false, err
+	}
+	defer clearSlice(generatedDigest)
+
+	expectedDigest, err := base64.StdEncoding.DecodeString(digest.Digest)
+	if err != nil {
+		return false, fmt.Errorf("keyslotIdx[%v].digest.Digest base64 parsing failed: %v", keyslotIdx, err)
+	}
+	return digestsEqual(generatedDigest, expectedDigest), nil
+}
+
+// volumeForDigest describes the mapping of the segment the digest is bound to. The volume takes ownership
+// of the verified key, it is wiped if the segment is invalid.
+func (d *deviceV2) volumeForDigest(digest *digest, finalKey []byte) (*Volume, error) {
+	v, err := d.segmentVolume(digest)
+	if err != nil {
+		clearSlice(finalKey)
+		return nil, err
+	}
+	v.key = finalKey
+	return v, nil
+}
+
+func (d *deviceV2) segmentVolume(digest *digest) (*Volume, error) {
+	if len(digest.Segments) != 1 {
+		return nil, fmt.Errorf("LUKS partition expects exactly 1 storage segment, got %+v", len(digest.Segments))
+	}
+	seg, err := digest.Segments[0].Int64()
+	if err != nil {
+		return nil, err
+	}
+
+	storageSegment := d.meta.Segments[int(seg)]
+	if storageSegment.Encryption == "" {
+		return nil, fmt.Errorf("invalid segment encryption: the value is empty")
+	}
+	offset, err := parseUint64(storageSegment.Offset)
+	if err != nil {
+		return nil, fmt.Errorf("invalid segment offset: %v", err)
+	}
+	sectorSize := uint64(storageSegment.SectorSize)
+	if sectorSize == 0 {
+		sectorSize = storageSectorSize
+	}
+	if sectorSize > 4096 || !isPowerOfTwo(uint(sectorSize)) || sectorSize < storageSectorSize {
+		return nil, fmt.Errorf("invalid segment sector size %d", sectorSize)
+	}
+
+	// segment offsets are relative to the payload device, it is the header device unless the header is detached
+	backingPath, backingFile, baseOffset, size := d.path, d.f, uint64(d.offset), d.size
+	if d.data != nil {
+		backingPath, backingFile, baseOffset, size = d.data.path, d.data.f, 0, 0
+	}
+
+	var storageSize uint64
+	if storageSegment.Size == "dynamic" {
+		storageSize, err = payloadSize(backingFile, baseOffset, size)
+		if err != nil {
+			return nil, err
+		}
+		if storageSize < offset {
+			return nil, fmt.Errorf("backing file size %d is smaller than LUKS segment offset %d", storageSize, offset)
+		}
+
+		storageSize -= offset
+	} else {
+		size, err := parseUint64(json.Number(storageSegment.Size))
+		if err != nil {
+			return nil, fmt.Errorf("invalid segment size: %v", err)
+		}
+		if size == 0 {
+			return nil, fmt.Errorf("invalid segment size: %v", size)
+		}
+
+		storageSize = size
+	}
+
+	ivTweak, err := parseUint64(storageSegment.IvTweak)
+	if err != nil {
+		return nil, fmt.Errorf("invalid segment iv_tweak: %v", err)
+	}
+
+	var integrityType string
+	if storageSegment.Integrity != nil {
+		integrityType = storageSegment.Integrity.Type
+	}
+
+	v := &Volume{
+		BackingDevice:     backingPath,
+		Flags:             d.flags,
+		UUID:              d.UUID(),
+		LuksType:          "LUKS2",
+		StorageSize:       storageSize,
+		StorageOffset:     baseOffset + offset,
+		StorageEncryption: storageSegment.Encryption,
+		StorageIvTweak:    ivTweak,
+		StorageSectorSize: sectorSize,
+		StorageIntegrity:  integrityType,
+	}
+	if isNullCipher(storageSegment.Encryption) {
+		v.StorageUnencrypted = true
+	}
+	return v, nil
+}
+
+// payloadSize returns size of the payload device starting at baseOffset, size is the device size given by the caller
+// or zero. A device embedded at an offset of a larger file does not extend to the end of the file, its size has
+// to be given explicitly.
+func payloadSize(backingFile Storage, baseOffset uint64, size int64) (uint64, error) {
+	fileSize, err := backingFile.Size()
+	if err != nil {
+		return 0, err
+	}
+	if fileSize < baseOffset {
+		return 0, fmt.Errorf("backing file size %d is smaller than LUKS device offset %d", fileSize, baseOffset)
+	}
+	if baseOffset == 0 && size == 0 {
+		return fileSize, nil
+	}
+	if size == 0 {
+		return 0, fmt.Errorf("the data segment size is dynamic, the size of the LUKS device at offset %d must be specified", baseOffset)
+	}
+	if uint64(size) > fileSize-baseOffset {
+		return 0, fmt.Errorf("LUKS device size %d exceeds the backing file size %d at offset %d", size, fileSize, baseOffset)
+	}
+	return uint64(size), nil
+}
+
+func (d *deviceV2) UnlockWithVolumeKey(key []byte, dmName string) error {
+	if d.metadataOnly {
+		return ErrMetadataOnly
+	}
+	dig, err := d.findDigestForVolumeKey(key)
+	if err != nil {
+		return err
+	}
+	volume, err := d.volumeForDigest(dig, secureCopy(key))
+	if err != nil {
+		return err
+	}
+	defer clearSlice(volume.key)
+	return volume.SetupMapper(dmName)
+}
+
+// findDigestForVolumeKey returns the segment digest that matches the key or ErrVolumeKeyIncorrect
+func (d *deviceV2) findDigestForVolumeKey(key []byte) (*digest, error) {
+	for i, dig := range d.meta.Digests {
+		if len(dig.Segments) == 0 || !d.digestKeySizeMatches(&dig, len(key)) {
+			continue
+		}
+		dig := dig
+		ok, err := verifyDigest(context.Background(), &dig, -1, key)
+		if err != nil {
+			return nil, fmt.Errorf("digest %v: %v", i, err)
+		}
+		if ok {
+			return &dig, nil
+		}
+	}
+	return nil, ErrVolumeKeyIncorrect
+}
+
+// digestKeySizeMatches checks the key size against keyslots of the digest. The digest alone does not detect
+// a truncated key: PBKDF2 HMAC pads short keys with zeros, thus a key without its trailing zero bytes matches.
+func (d *deviceV2) digestKeySizeMatches(dig *digest, keySize int) bool {
+	for _, id := range dig.Keyslots {
+		slot, err := id.Int64()
+		if err != nil {
+			continue
+		}
+		if ks, ok := d.meta.Keyslots[int(slot)]; ok && int(ks.KeySize) != keySize {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *deviceV2) VolumeKey(keyslot int, passphrase []byte) (*VolumeKey, error) {
+	if !d.allowKeyExport {
+		return nil, ErrVolumeKeyExportDisabled
+	}
+	volume, err := d.UnsealVolume(keyslot, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer volume.Wipe()
+	return volume.Key(), nil
+}
+
+func (d *deviceV2) UnlockAndKillSlot(keyslotIdx int, passphrase []byte) ([]byte, error) {
+	if !isWritable(d.f) {
+		// check it before unlocking, read-only devices (e.g. snapshots) must never be modified
+		return nil, fmt.Errorf("device %v is opened read-only", d.path)
+	}
+	if _, ok := d.meta.Keyslots[keyslotIdx]; ok && d.isLastBoundKeyslot(keyslotIdx) {
+		return nil, fmt.Errorf("keyslot %d is the last keyslot of the device, refusing to kill it", keyslotIdx)
+	}
+
+	volume, err := d.UnsealVolume(keyslotIdx, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.killSlot(keyslotIdx); err != nil {
+		clearSlice(volume.key)
+		return nil, err
+	}
+	return volume.key, nil
+}
+
+// killSlot wipes the keyslot binary area, removes the keyslot and all references to it (digests, tokens)
+// from the metadata and writes the updated headers.
+// Once wiping starts the keyslot material might be destroyed, so the keyslot stays removed from the in-memory
+// metadata even if wiping or writing the headers fails.
+func (d *deviceV2) killSlot(keyslotIdx int) error {
+	ks, ok := d.meta.Keyslots[keyslotIdx]
+	if !ok {
+		return fmt.Errorf("%w: keyslot %d", ErrKeyslotInactive, keyslotIdx)
+	}
+
+	offset, err := ks.Area.Offset.Int64()
+	if err != nil {
+		return fmt.Errorf("Invalid keyslot[%v] offset: %v. %v", keyslotIdx, ks.Area.Offset, err)
+	}
+	size, err := ks.Area.Size.Int64()
+	if err != nil {
+		return fmt.Errorf("Invalid keyslot[%v] size value: %v. %v", keyslotIdx, ks.Area.Size, err)
+	}
+
+	meta, err := d.meta.withoutKeyslot(keyslotIdx)
+	if err != nil {
+		return err
+	}
+	d.meta = meta
+
+	if err := wipeArea(d.f, d.offset+offset, size); err != nil {
+		return err
+	}
+	return d.writeHeader()
+}
+
+func (d *deviceV2) AddKeyslot(existingPassphrase, newPassphrase []byte, params KdfParams) (int, error) {
+	if !isWritable(d.f) {
+		return 0, fmt.Errorf("device %v is opened read-only", d.path)
+	}
+
+	volume, err := unsealAny(d, existingPassphrase)
+	if err != nil {
+		return 0, err
+	}
+	defer clearSlice(volume.key)
+
+	orig := d.meta
+	d.meta = orig.clone()
+
+	keyslotIdx, err := d.addKeyslot(volume.key, newPassphrase, params)
+	if err != nil {
+		d.meta = orig
+		return 0, err
+	}
+	if err := d.writeHeader(); err != nil {
+		d.meta = orig
+		return 0, err
+	}
+	return keyslotIdx, nil
+}
+
+func (d *deviceV2) AddKeyslotWithVolumeKey(volumeKey *VolumeKey, newPassphrase []byte, params KdfParams) (int, error) {
+	if !isWritable(d.f) {
+		return 0, fmt.Errorf("device %v is opened read-only", d.path)
+	}
+	if volumeKey == nil || len(volumeKey.Bytes()) == 0 {
+		return 0, fmt.Errorf("volume key is wiped")
+	}
+	if _, err := d.findDigestForVolumeKey(volumeKey.Bytes()); err != nil {
+		return 0, err
+	}
+
+	orig := d.meta
+	d.meta = orig.clone()
+
+	keyslotIdx, err := d.addKeyslot(volumeKey.Bytes(), newPassphrase, params)
+	if err != nil {
+		d.meta = orig
+		return 0, err
+	}
+	if err := d.writeHeader(); err != nil {
+		d.meta = orig
+		return 0, err
+	}
+	return keyslotIdx, nil
+}
+
+func (d *deviceV2) AddUnboundKeyslot(key, passphrase []byte, params KdfParams) (int, error) {
+	if !isWritable(d.f) {
+		return 0, fmt.Errorf("device %v is opened read-only", d.path)
+	}
+	if len(key) == 0 {
+		return 0, fmt.Errorf("unbound keyslot key is empty")
+	}
+
+	orig := d.meta
+	d.meta = orig.clone()
+
+	keyslotIdx, err := d.addUnboundKeyslot(key, passphrase, params)
+	if err != nil {
+		d.meta = orig
+		return 0, err
+	}
+	if err := d.writeHeader(); err != nil {
+		d.meta = orig
+		return 0, err
+	}
+	return keyslotIdx, nil
+}
+
+func (d *deviceV2) ChangePassphrase(keyslotIdx int, oldPassphrase, newPassphrase []byte) error {
+	if !isWritable(d.f) {
+		return fmt.Errorf("device %v is opened read-only", d.path)
+	}
+
+	volume, err := d.UnsealVolume(keyslotIdx, oldPassphrase)
+	if err != nil {
+		return err
+	}
+	defer clearSlice(volume.key)
+
+	old := d.meta.Keyslots[keyslotIdx]
+	oldOffset, err := old.Area.Offset.Int64()
+	if err != nil {
+		return fmt.Errorf("Invalid keyslot[%v] offset: %v. %v", keyslotIdx, old.Area.Offset, err)
+	}
+	oldSize, err := old.Area.Size.Int64()
+	if err != nil {
+		return fmt.Errorf("Invalid keyslot[%v] size value: %v. %v", keyslotIdx, old.Area.Size, err)
+	}
+
+	// the new material goes to a free area, the old area stays intact until both headers point to the new one
+	params := KdfParams{
+		Type:       old.Kdf.Type,
+		Hash:       old.Kdf.Hash,
+		Iterations: int(old.Kdf.Iterations),
+		Time:       int(old.Kdf.Time),
+		Memory:     int(old.Kdf.Memory),
+		Threads:    int(old.Kdf.Cpus),
+	}
+	ks, err := d.writeKeyslotMaterial(keyslotIdx, volume.key, newPassphrase, params)
+	if err != nil {
+		return err
+	}
+	ks.Priority = old.Priority
+	ks.extra = old.extra
+
+	orig := d.meta
+	d.meta = orig.clone()
+	d.meta.Keyslots[keyslotIdx] = ks
+	if err := d.writeHeader(); err != nil {
+		d.meta = orig
+		return err
+	}
+
+	return wipeArea(d.f, d.offset+oldOffset, oldSize)
+}
+
+func (d *deviceV2) RemoveKeyslot(keyslotIdx int) error {
+	if !isWritable(d.f) {
+		return fmt.Errorf("device %v is opened read-only", d.path)
+	}
+	if _, ok := d.meta.Keyslots[keyslotIdx]; !ok {
+		return fmt.Errorf("%w: keyslot %d", ErrKeyslotInactive, keyslotIdx)
+	}
+	if d.isLastBoundKeyslot(keyslotIdx) {
+		return fmt.Errorf("keyslot %d is the last keyslot of the device, refusing to remove it", keyslotIdx)
+	}
+
+	return d.killSlot(keyslotIdx)
+}
+
+func (d *deviceV2) EnrollToken(existingPassphrase, newPassphrase []byte, token Token, params KdfParams) (int, int, error) {
+	if !isWritable(d.f) {
+		return 0, 0, fmt.Errorf("device %v is opened read-only", d.path)
+	}
+
+	volume, err := unsealAny(d, existingPassphrase)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer clearSlice(volume.key)
+
+	// modify a copy of the metadata, the device state is updated only if the header is written successfully
+	orig := d.meta
+	d.meta = orig.clone()
+
+	keyslotIdx, err := d.addKeyslot(volume.key, newPassphrase, params)
+	if err != nil {
+		d.meta = orig
+		return 0, 0, err
+	}
+	tokenID, err := d.addToken(token, []int{keyslotIdx})
+	if err != nil {
+		d.meta = orig
+		return 0, 0, err
+	}
+	if err := d.writeHeader(); err != nil {
+		d.meta = orig
+		return 0, 0, err
+	}
+	return keyslotIdx, tokenID, nil
+}
+
+func (d *deviceV2) ImportToken(token Token) (int, error) {
+	if !isWritable(d.f) {
+		return 0, fmt.Errorf("device %v is opened read-only", d.path)
+	}
+
+	orig := d.meta
+	d.meta = orig.clone()
+
+	tokenID, err := d.addToken(token, token.Slots)
+	if err != nil {
+		d.meta = orig
+		return 0, err
+	}
+	if err := d.writeHeader(); err != nil {
+		d.meta = orig
+		return 0, err
+	}
+	return tokenID, nil
+}
+
+func (d *deviceV2) RemoveToken(tokenID int) error {
+	if !isWritable(d.f) {
+		return fmt.Errorf("device %v is opened read-only", d.path)
+	}
+	if _, ok := d.meta.Tokens[tokenID]; !ok {
+		return fmt.Errorf("token %d does not exist", tokenID)
+	}
+
+	orig := d.meta
+	d.meta = orig.clone()
+	delete(d.meta.Tokens, tokenID)
+	if err := d.writeHeader(); err != nil {
+		d.meta = orig
+		return err
+	}
+	return nil
+}
+
+func (d *deviceV2) ReplaceToken(tokenID int, token Token) error {
+	if !isWritable(d.f) {
+		return fmt.Errorf("device %v is opened read-only", d.path)
+	}
+	if _, ok := d.meta.Tokens[tokenID]; !ok {
+		return fmt.Errorf("token %d does not exist", tokenID)
+	}
+
+	payload, err := d.tokenJSON(token, token.Slots)
+	if err != nil {
+		return err
+	}
+
+	orig := d.meta
+	d.meta = orig.clone()
+	d.meta.Tokens[tokenID] = payload
+	if err := d.writeHeader(); err != nil {
+		d.meta = orig
+		return err
+	}
+	return nil
+}
+
+// addKeyslot stores the volume key into a new keyslot protected with the passphrase. The keyslot material is written
+// to an unused part of the keyslots area, the metadata is updated in memory only and the caller is responsible for
+// writing the header.
+func (d *deviceV2) addKeyslot(volumeKey, passphrase []byte, params KdfParams) (int, error) {
+	keyslotIdx := d.freeKeyslot()
+	if keyslotIdx == -1 {
+		return 0, fmt.Errorf("no free keyslots, maximum number of keyslots is %d", luks2KeyslotsMax)
+	}
+
+	// the new keyslot is bound to the volume key digest
+	digestID := -1
+	for i, dig := range d.meta.Digests {
+		if len(dig.Segments) != 0 {
+			digestID = i
+			break
+		}
+	}
+	if digestID == -1 {
+		return 0, fmt.Errorf("no digest is bound to a data segment")
+	}
+
+	ks, err := d.writeKeyslotMaterial(keyslotIdx, volumeKey, passphrase, params)
+	if err != nil {
+		return 0, err
+	}
+	d.meta.Keyslots[keyslotIdx] = ks
+
+	dig := d.meta.Digests[digestID]
+	dig.Keyslots = append(dig.Keyslots, json.Number(strconv.Itoa(keyslotIdx)))
+	d.meta.Digests[digestID] = dig
+
+	return keyslotIdx, nil
+}
+
+// addUnboundKeyslot stores the key into a new keyslot that is bound to a new digest without segments.
+// Similar to addKeyslot the metadata is updated in memory only.
+func (d *deviceV2) addUnboundKeyslot(key, passphrase []byte, params KdfParams) (int, error) {
+	keyslotIdx := d.freeKeyslot()
+	if keyslotIdx == -1 {
+		return 0, fmt.Errorf("no free keyslots, maximum number of keyslots is %d", luks2KeyslotsMax)
+	}
+	digestID := 0
+	for {
+		if _, ok := d.meta.Digests[digestID]; !ok {
+			break
+		}
+		digestID++
+	}
+
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return 0, err
+	}
+	value, err := deriveKdfKey(key, salt, KdfParams{Type: "pbkdf2", Hash: formatDigestHash, Iterations: formatDigestIters}, sha256.Size)
+	if err != nil {
+		return 0, err
+	}
+
+	ks, err := d.writeKeyslotMaterial(keyslotIdx, key, passphrase, params)
+	if err != nil {
+		return 0, err
+	}
+	d.meta.Keyslots[keyslotIdx] = ks
+	d.meta.Digests[digestID] = digest{
+		Type:       "pbkdf2",
+		Keyslots:   numberList{json.Number(strconv.Itoa(keyslotIdx))},
+		Segments:   numberList{},
+		Hash:       formatDigestHash,
+		Iterations: formatDigestIters,
+		Salt:       base64.StdEncoding.EncodeToString(salt),
+		Digest:     base64.StdEncoding.EncodeToString(value),
+	}
+	return keyslotIdx, nil
+}
+
+// freeKeyslot returns the first unused keyslot id or -1 if all keyslots are in use
+func (d *deviceV2) freeKeyslot() int {
+	for i := 0; i < luks2KeyslotsMax; i++ {
+		if _, ok := d.meta.Keyslots[i]; !ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// writeKeyslotMaterial encrypts the volume key with the passphrase and writes the key material to an unused part
+// of the keyslots area. It returns the keyslot metadata describing the material, the device metadata is not modified.
+func (d *deviceV2) writeKeyslotMaterial(keyslotIdx int, volumeKey, passphrase []byte, params KdfParams) (keyslot, error) {
+	kdf, err := newKdf(params)
+	if err != nil {
+		return keyslot{}, err
+	}
+
+	const (
+		areaEncryption = "aes-xts-plain64"
+		areaKeySize    = 64
+	)
+	keySize := len(volumeKey)
+	areaSize := uint64(roundUp(keyslotMaterialSize(keySize, stripesNum), 4096))
+	offset, err := d.allocateKeyslotArea(areaSize)
+	if err != nil {
+		return keyslot{}, err
+	}
+
+	afKey, err := deriveLuks2AfKey(kdf, keyslotIdx, passphrase, areaKeySize)
+	if err != nil {
+		return keyslot{}, err
+	}
+	defer clearSlice(afKey)
+	ciph, err := buildLuks2AfCipher(areaEncryption, afKey)
+	if err != nil {
+		return keyslot{}, err
+	}
+
+	// like cryptsetup the anti-forensic split uses the pbkdf2 hash, argon2 keyslots use sha256
+	afHash := "sha256"
+	if params.Type == "pbkdf2" {
+		afHash = params.Hash
+	}
+	h, _ := getHashAlgo(afHash)
+	material, err := splitKeyslotMaterial(volumeKey, h())
+	if err != nil {
+		return keyslot{}, err
+	}
+	defer clearSlice(material)
+	encryptKeyslotArea(ciph, material)
+
+	if _, err := d.f.WriteAt(material, d.offset+int64(offset)); err != nil {
+		return keyslot{}, err
+	}
+	if err := syncStorage(d.f); err != nil {
+		return keyslot{}, err
+	}
+
+	return keyslot{
+		Type:    "luks2",
+		KeySize: uint(keySize),
+		Af:      antiForensic{Type: "luks1", Stripes: stripesNum, Hash: afHash},
+		Area: area{
+			Type:       "raw",
+			Encryption: areaEncryption,
+			KeySize:    areaKeySize,
+			Offset:     json.Number(strconv.FormatUint(offset, 10)),
+			Size:       json.Number(strconv.FormatUint(areaSize, 10)),
+		},
+		Kdf: kdf,
+	}, nil
+}
+
+// allocateKeyslotArea finds the first unused 4096-aligned region of the given size in the keyslots area
+func (d *deviceV2) allocateKeyslotArea(size uint64) (uint64, error) {
+	keyslotsSize, err := parseUint64(d.meta.Config.KeyslotsSize)
+	if err != nil {
+		return 0, fmt.Errorf("invalid config.keyslots_size value: %v", err)
+	}
+	start := 2 * d.hdr.HeaderSize
+	end := start + keyslotsSize
+
+	type span struct{ start, end uint64 }
+	used := make([]span, 0, len(d.meta.Keyslots))
+	for i, ks := range d.meta.Keyslots {
+		offset, err := parseUint64(ks.Area.Offset)
+		if err != nil {
+			return 0, fmt.Errorf("invalid keyslot[%v] offset: %v", i, err)
+		}
+		areaSize, err := parseUint64(ks.Area.Size)
+		if err != nil {
+			return 0, fmt.Errorf("invalid keyslot[%v] size: %v", i, err)
+		}
+		used = append(used, span{offset, offset + areaSize})
+	}
+	sort.Slice(used, func(i, j int) bool { return used[i].start < used[j].start })
+
+	offset := start
+	for _, u := range used {
+		if offset+size <= u.start {
+			break
+		}
+		if u.end > offset {
+			offset = uint64(roundUp(int(u.end), 4096))
+		}
+	}
+	if offset+size > end {
+		return 0, fmt.Errorf("not enough free space in the keyslots area for %d bytes", size)
+	}
+	return offset, nil
+}
+
+// addToken adds the token bound to the given keyslots to the metadata. The caller is responsible for writing the header.
+func (d *deviceV2) addToken(token Token, keyslots []int) (int, error) {
+	tokenID := -1
+	for i := 0; i < luks2TokensMax; i++ {
+		if _, ok := d.meta.Tokens[i]; !ok {
+			tokenID = i
+			break
+		}
+	}
+	if tokenID == -1 {
+		return 0, fmt.Errorf("no free tokens, maximum number of tokens is %d", luks2TokensMax)
+	}
+
+	payload, err := d.tokenJSON(token, keyslots)
+	if err != nil {
+		return 0, err
+	}
+	d.meta.Tokens[tokenID] = payload
+	return tokenID, nil
+}
+
+// tokenJSON encodes the token metadata node bound to the given keyslots
+func (d *deviceV2) tokenJSON(token Token, keyslots []int) (json.RawMessage, error) {
+	node := make(map[string]json.RawMessage)
+	if len(token.Payload) != 0 {
+		if err := json.Unmarshal(token.Payload, &node); err != nil {
+			return nil, fmt.Errorf("invalid token payload: %v", err)
+		}
+	}
+	if token.Type != "" {
+		typ, err := json.Marshal(token.Type)
+		if err != nil {
+			return nil, err
+		}
+		node["type"] = typ
+	}
+	if _, ok := node["type"]; !ok {
+		return nil, fmt.Errorf("token type is not specified")
+	}
+	ids := make(numberList, 0, len(keyslots))
+	for _, k := range keyslots {
+		if _, ok := d.meta.Keyslots[k]; !ok {
+			return nil, fmt.Errorf("%w: keyslot %d", ErrKeyslotInactive, k)
+		}
+		ids = append(ids, json.Number(strconv.Itoa(k)))
+	}
+	keyslotsJSON, err := json.Marshal(ids)
+	if err != nil {
+		return nil, err
+	}
+	node["keyslots"] = keyslotsJSON
+
+	return json.Marshal(node)
+}
+
+// newKdf validates the KDF parameters and creates keyslot kdf metadata with a random salt
+func newKdf(params KdfParams) (kdf, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return kdf{}, err
+	}
+	k := kdf{Type: params.Type, Salt: base64.StdEncoding.EncodeToString(salt)}
+
+	switch params.Type {
+	case "pbkdf2":
+		if h, _ := getHashAlgo(params.Hash); h == nil {
+			return kdf{}, fmt.Errorf("Unknown pbkdf2 hash algorithm: %v", params.Hash)
+		}
+		if params.Iterations <= 0 {
+			return kdf{}, fmt.Errorf("invalid pbkdf2 iterations number: %v", params.Iterations)
+		}
+		k.Hash = params.Hash
+		k.Iterations = uint(params.Iterations)
+	case "argon2i", "argon2id":
+		if params.Time <= 0 || params.Memory <= 0 || params.Threads <= 0 || params.Threads > 255 {
+			return kdf{}, fmt.Errorf("invalid %v parameters: time %v, memory %v, threads %v", params.Type, params.Time, params.Memory, params.Threads)
+		}
+		k.Time = uint(params.Time)
+		k.Memory = uint(params.Memory)
+		k.Cpus = uint(params.Threads)
+	default:
+		return kdf{}, fmt.Errorf("Unknown kdf type: %v", params.Type)
+	}
+	return k, nil
+}
+
+func computeDigestForKey(dig *digest, keyslotIdx int, finalKey []byte) ([]byte, error) {
+	digSalt, err := base64.StdEncoding.DecodeString(dig.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("keyslotIdx[%v].digest.salt base64 parsing failed: %v", keyslotIdx, err)
+	}
+
+	switch dig.Type {
+	case "pbkdf2":
+		h, size := getHashAlgo(dig.Hash)
+		if h == nil {
+			return nil, fmt.Errorf("Unknown digest hash algorithm: %v", dig.Hash)
+		}
+		return deriveKdfKey(finalKey, digSalt, KdfParams{Type: "pbkdf2", Hash: dig.Hash, Iterations: int(dig.Iterations)}, size)
+	default:
+		return nil, fmt.Errorf("Unknown digest kdf type: %v", dig.Type)
 	}
+}
+
+func (d *deviceV2) decryptLuks2VolumeKey(keyslotIdx int, keyslot keyslot, afKey []byte) ([]byte, error) {
+	// this method follows logic at luks2_keyslot_get_key()
+	area := keyslot.Area
+
+	// decrypt keyslotIdx area using the derived key
+	keyslotSize := keyslotMaterialSize(int(keyslot.KeySize), stripesNum)
 
-	keyData := make([]byte, keyslotSize)
-	defer clearSlice(keyData)
+	areaSize, err := area.Size.Int64()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid keyslotIdx[%v] size value: %v. %v", keyslotIdx, area.Size, err)
+	}
+	if int64(keyslotSize) > areaSize {
+		return nil, fmt.Errorf("keyslot[%v] area size too small, given %v expected at least %v", keyslotIdx, areaSize, keyslotSize)
+	}
 
 	keyslotOffset, err := area.Offset.Int64()
 	if err != nil {
@@ -352,20 +1797,11 @@ func (d *deviceV2) decryptLuks2VolumeKey(keyslotIdx int, keyslot keyslot, afKey
 		return nil, fmt.Errorf("keyslot[%v] offset %v is not aligned to sector size %v", keyslotIdx, keyslotOffset, storageSectorSize)
 	}
 
-	if _, err := d.f.ReadAt(keyData, keyslotOffset); err != nil {
-		return nil, err
-	}
-
 	ciph, err := buildLuks2AfCipher(area.Encryption, afKey)
 	if err != nil {
 		return nil, err
 	}
 
-	for i := 0; i < int(keyslotSize/storageSectorSize); i++ {
-		block := keyData[i*storageSectorSize : (i+1)*storageSectorSize]
-		ciph.Decrypt(block, block, uint64(i))
-	}
-
 	// anti-forensic merge
 	af := keyslot.Af
 	if af.Stripes != stripesNum {
@@ -376,31 +1812,72 @@ func (d *deviceV2) decryptLuks2VolumeKey(keyslotIdx int, keyslot keyslot, afKey
 		return nil, fmt.Errorf("Unknown af hash algorithm: %v", af.Hash)
 	}
 
-	return afMerge(keyData, int(keyslot.KeySize), int(af.Stripes), h())
+	return mergeKeyslotArea(d.f, d.offset+keyslotOffset, ciph, int(keyslot.KeySize), int(af.Stripes), h())
 }
 
-func buildLuks2AfCipher(encryption string, afKey []byte) (*xts.Cipher, error) {
-	// parse encryption mode for the keyslot area, see crypt_parse_name_and_mode()
-	// example of `encryption` value is 'aes-xts-plain64'
+// isNullCipher reports whether the segment encryption is the null cipher i.e. the segment is stored as plaintext.
+// Besides cryptsetup's "cipher_null" it accepts the "null" sentinel. An empty value is not a null cipher,
+// it is invalid metadata.
+func isNullCipher(encryption string) bool {
+	return encryption == "null" || encryption == "cipher_null" || strings.HasPrefix(encryption, "cipher_null-")
+}
+
+// parseCipherSpec parses encryption mode for the keyslot area, see crypt_parse_name_and_mode()
+// example of `encryption` value is 'aes-xts-plain64' or its kernel crypto API form 'capi:xts(aes)-plain64'
+func parseCipherSpec(encryption string) (cipherName, cipherMode, ivMode string, err error) {
+	if strings.HasPrefix(encryption, capiPrefix) {
+		return parseCapiCipherSpec(encryption)
+	}
 	encParts := strings.Split(encryption, "-")
 	if len(encParts) != 3 {
-		return nil, fmt.Errorf("Unexpected encryption format: %v", encryption)
+		return "", "", "", fmt.Errorf("Unexpected encryption format: %v", encryption)
+	}
+	return encParts[0], encParts[1], encParts[2], nil
+}
+
+const capiPrefix = "capi:"
+
+// parseCapiCipherSpec parses the kernel crypto API cipher spec 'capi:<mode>(<cipher>)-<iv>' into the same parts as
+// the cryptsetup spec. dm-crypt accepts capi specs as is, so the data segment encryption is passed to the table
+// unchanged. Only plain block cipher templates are supported, e.g. authenc() used with integrity protection is not.
+func parseCapiCipherSpec(encryption string) (cipherName, cipherMode, ivMode string, err error) {
+	spec := strings.TrimPrefix(encryption, capiPrefix)
+	// the IV generator follows the closing parenthesis of the template
+	end := strings.LastIndexByte(spec, ')')
+	if end == -1 || !strings.HasPrefix(spec[end+1:], "-") || len(spec) == end+2 {
+		return "", "", "", fmt.Errorf("Unexpected encryption format: %v", encryption)
 	}
-	cipherName := encParts[0]
-	cipherMode := encParts[1]
-	// ivModeName := encParts[2]
+	template, ivMode := spec[:end+1], spec[end+2:]
 
-	cipherFunc, err := getCipher(cipherName)
-	if err != nil {
-		return nil, err
+	cipherMode, cipherName, ok := splitCapiTemplate(template)
+	if !ok {
+		return "", "", "", fmt.Errorf("Unexpected encryption format: %v", encryption)
+	}
+	// newer kernels spell the block cipher as an explicit ecb() template e.g. 'xts(ecb(aes))'
+	if mode, inner, ok := splitCapiTemplate(cipherName); ok && mode == "ecb" {
+		cipherName = inner
+	}
+	if strings.ContainsAny(cipherName, "(),") {
+		return "", "", "", fmt.Errorf("unsupported crypto API cipher spec: %v", encryption)
+	}
+	return cipherName, cipherMode, ivMode, nil
+}
+
+// splitCapiTemplate splits 'name(argument)' into its parts
+func splitCapiTemplate(template string) (name, argument string, ok bool) {
+	open := strings.IndexByte(template, '(')
+	if open <= 0 || !strings.HasSuffix(template, ")") || open+2 > len(template)-1 {
+		return "", "", false
 	}
+	return template[:open], template[open+1 : len(template)-1], true
+}
 
-	switch cipherMode {
-	case "xts":
-		return xts.NewCipher(cipherFunc, afKey)
-	default:
-		return nil, fmt.Errorf("Unknown encryption mode: %v", cipherMode)
+func buildLuks2AfCipher(encryption string, afKey []byte) (sectorCipher, error) {
+	cipherName, cipherMode, ivMode, err := parseCipherSpec(encryption)
+	if err != nil {
+		return nil, err
 	}
+	return newSectorCipher(cipherName, cipherMode, ivMode, afKey)
 }
 
 func deriveLuks2AfKey(kdf kdf, keyslotIdx int, passphrase []byte, keyLength uint) ([]byte, error) {
@@ -409,25 +1886,15 @@ func deriveLuks2AfKey(kdf kdf, keyslotIdx int, passphrase []byte, keyLength uint
 		return nil, fmt.Errorf("keyslotIdx[%v].kdf.salt base64 parsing failed: %v", keyslotIdx, err)
 	}
 
-	switch kdf.Type {
-	case "pbkdf2":
-		var h func() hash.Hash
-		switch kdf.Hash {
-		case "sha256":
-			h = sha256.New
-		case "sha512":
-			h = sha512.New
-		default:
-			return nil, fmt.Errorf("Unknown keyslotIdx[%v].kdf.hash algorithm: %v", keyslotIdx, kdf.Hash)
-		}
-		return pbkdf2.Key(passphrase, salt, int(kdf.Iterations), int(keyLength), h), nil
-	case "argon2i":
-		return argon2.Key(passphrase, salt, uint32(kdf.Time), uint32(kdf.Memory), uint8(kdf.Cpus), uint32(keyLength)), nil
-	case "argon2id":
-		return argon2.IDKey(passphrase, salt, uint32(kdf.Time), uint32(kdf.Memory), uint8(kdf.Cpus), uint32(keyLength)), nil
-	default:
-		return nil, fmt.Errorf("Unknown kdf type: %v", kdf.Type)
+	params := KdfParams{
+		Type:       kdf.Type,
+		Hash:       kdf.Hash,
+		Iterations: int(kdf.Iterations),
+		Time:       int(kdf.Time),
+		Memory:     int(kdf.Memory),
+		Threads:    int(kdf.Cpus),
 	}
+	return deriveKdfKey(passphrase, salt, params, int(keyLength))
 }
 
 func (d *deviceV2) findDigestForKeyslot(keyslotIdx int) *digest {
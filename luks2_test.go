@@ -1,17 +1,131 @@
 package luks
 
 import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"os/exec"
 	"os/user"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"unsafe"
 
+	"github.com/anatol/devmapper.go"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
 )
 
-func prepareLuks2Disk(password string, cryptsetupArgs ...string) (*os.File, error) {
+// number of pbkdf2 iterations used by fixtures, keep it small to make tests fast
+const fixtureIterations = 1000
+
+// createLuks2Fixture generates a LUKS2 disk image without using cryptsetup.
+// The image contains a single pbkdf2 keyslot #0 protected with the given password and a 1MiB 'dynamic' data segment.
+// It returns the disk file and the volume key.
+func createLuks2Fixture(t *testing.T, password string) (*os.File, []byte) {
+	disk, err := os.CreateTemp("", "luksv2.go.fixture")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		disk.Close()
+		os.Remove(disk.Name())
+	})
+
+	const segmentOffset = 16777216
+	require.NoError(t, disk.Truncate(segmentOffset+1024*1024))
+
+	volumeKey := make([]byte, 64)
+	_, err = rand.Read(volumeKey)
+	require.NoError(t, err)
+	digestSalt := make([]byte, 32)
+	_, err = rand.Read(digestSalt)
+	require.NoError(t, err)
+
+	digestValue := pbkdf2.Key(volumeKey, digestSalt, fixtureIterations, sha256.Size, sha256.New)
+
+	meta := metadata{
+		Keyslots: map[int]keyslot{},
+		Tokens:   map[int]json.RawMessage{},
+		Segments: map[int]segment{
+			0: {Type: "crypt", Offset: "16777216", IvTweak: "0", Size: "dynamic", Encryption: "aes-xts-plain64", SectorSize: 512},
+		},
+		Digests: map[int]digest{
+			0: {
+				Type:       "pbkdf2",
+				Keyslots:   numberList{},
+				Segments:   numberList{"0"},
+				Hash:       "sha256",
+				Iterations: fixtureIterations,
+				Salt:       base64.StdEncoding.EncodeToString(digestSalt),
+				Digest:     base64.StdEncoding.EncodeToString(digestValue),
+			},
+		},
+		Config: config{JSONSize: "12288", KeyslotsSize: "16744448"},
+	}
+
+	hdr := headerV2{Version: 2, HeaderSize: 16384}
+	copy(hdr.Magic[:], "LUKS\xba\xbe")
+	copy(hdr.ChecksumAlgorithm[:], "sha256")
+	copy(hdr.UUID[:], "7d2c1e9a-3b4f-4e5d-8a6b-9c0d1e2f3a4b")
+
+	d := &deviceV2{path: disk.Name(), f: FileStorage{disk}, hdr: &hdr, meta: &meta}
+	addLuks2FixtureKeyslot(t, d, 0, password, volumeKey)
+	require.NoError(t, d.writeHeader())
+
+	return disk, volumeKey
+}
+
+// addLuks2FixtureKeyslot adds a pbkdf2 keyslot with the given id to the fixture device metadata and writes
+// its key material. The caller is responsible for writing the header.
+func addLuks2FixtureKeyslot(t *testing.T, d *deviceV2, slot int, password string, volumeKey []byte) {
+	kdfSalt := make([]byte, 32)
+	_, err := rand.Read(kdfSalt)
+	require.NoError(t, err)
+	addLuks2FixtureKeyslotWithSalt(t, d, slot, password, volumeKey, kdfSalt)
+}
+
+// addLuks2FixtureKeyslotWithSalt is similar to addLuks2FixtureKeyslot but uses the given kdf salt
+func addLuks2FixtureKeyslotWithSalt(t *testing.T, d *deviceV2, slot int, password string, volumeKey []byte, kdfSalt []byte) {
+	const areaSize = 258048
+	keySize := len(volumeKey)
+	keyslotOffset := 32768 + slot*areaSize
+
+	keyMaterial, err := afSplit(volumeKey, stripesNum, sha256.New())
+	require.NoError(t, err)
+	afKey := pbkdf2.Key([]byte(password), kdfSalt, fixtureIterations, keySize, sha256.New)
+	ciph, err := xts.NewCipher(aes.NewCipher, afKey)
+	require.NoError(t, err)
+	for i := 0; i < len(keyMaterial)/storageSectorSize; i++ {
+		block := keyMaterial[i*storageSectorSize : (i+1)*storageSectorSize]
+		ciph.Encrypt(block, block, uint64(i))
+	}
+	_, err = d.f.WriteAt(keyMaterial, int64(keyslotOffset))
+	require.NoError(t, err)
+
+	d.meta.Keyslots[slot] = keyslot{
+		Type:    "luks2",
+		KeySize: uint(keySize),
+		Af:      antiForensic{Type: "luks1", Stripes: stripesNum, Hash: "sha256"},
+		Area:    area{Type: "raw", Encryption: "aes-xts-plain64", KeySize: uint(keySize), Offset: json.Number(strconv.Itoa(keyslotOffset)), Size: json.Number(strconv.Itoa(areaSize))},
+		Kdf:     kdf{Type: "pbkdf2", Salt: base64.StdEncoding.EncodeToString(kdfSalt), Hash: "sha256", Iterations: fixtureIterations},
+	}
+	dig := d.meta.Digests[0]
+	dig.Keyslots = append(dig.Keyslots, json.Number(strconv.Itoa(slot)))
+	d.meta.Digests[0] = dig
+}
+
+func prepareLuks2Disk(t *testing.T, password string, cryptsetupArgs ...string) (*os.File, error) {
+	skipIfMissing(t, "cryptsetup")
+
 	disk, err := os.CreateTemp("", "luksv2.go.disk")
 	if err != nil {
 		return nil, err
@@ -40,12 +154,12 @@ func runLuks2Test(t *testing.T, keySlot int, cryptsetupArgs ...string) {
 	t.Parallel()
 
 	password := "foobar"
-	disk, err := prepareLuks2Disk(password, cryptsetupArgs...)
+	disk, err := prepareLuks2Disk(t, password, cryptsetupArgs...)
 	require.NoError(t, err)
 	defer disk.Close()
 	defer os.Remove(disk.Name())
 
-	d, err := initV2Device(disk.Name(), disk)
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
 	require.NoError(t, err)
 
 	uuid, err := blkidUUID(disk.Name())
@@ -78,6 +192,22 @@ func TestLuks2UnlockKeysize256(t *testing.T) {
 	runLuks2Test(t, 0, "--cipher", "aes-xts-plain64", "--key-size", "256", "--pbkdf", "argon2id", "--iter-time", "7", "--pbkdf-memory", "1048576", "--hash", "sha256")
 }
 
+func TestLuks2UnlockCustomOffset(t *testing.T) {
+	t.Parallel()
+
+	disk, err := prepareLuks2Disk(t, "foobar", "--offset", "36864") // 18MiB
+	require.NoError(t, err)
+	defer disk.Close()
+	defer os.Remove(disk.Name())
+
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	v, err := d.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(18*1024*1024), v.StorageOffset)
+	require.Equal(t, uint64(6*1024*1024), v.StorageSize)
+}
+
 func TestLuks2Hashes(t *testing.T) {
 	// ripemd160 forces use of AF padding
 	// It looks like cryptsetup 2.4.0 at Arch Linux defaults to openssl backend that supports blake2b-512 and blake2s-256 only. "blake2b-160", "blake2b-256", "blake2b-384" tests are failing thus disabling it for now.
@@ -108,11 +238,32 @@ func TestLuks2WithIntegrity(t *testing.T) {
 	runLuks2Test(t, 0, "--cipher", "aes-xts-plain64", "--integrity", "hmac-sha256", "--integrity-no-wipe", "--sector-size", "4096")
 }
 
+func TestLuks2IntegritySegment(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	seg := d.meta.Segments[0]
+	seg.Encryption = "aes-xts-random"
+	seg.Integrity = &integrity{Type: "hmac(sha256)", JournalEncryption: "none", JournalIntegrity: "none"}
+	d.meta.Segments[0] = seg
+	require.NoError(t, d.writeHeader())
+
+	d, err = initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	v, err := d.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	require.Equal(t, "hmac(sha256)", v.StorageIntegrity)
+
+	// the fixture has no dm-integrity superblock at the data segment
+	require.Error(t, v.SetupMapper("luks-go-test-integrity"))
+}
+
 func TestLuks2UnlockMultipleKeySlots(t *testing.T) {
 	t.Parallel()
 
 	password := "barfoo"
-	disk, err := prepareLuks2Disk(password)
+	disk, err := prepareLuks2Disk(t, password)
 	require.NoError(t, err)
 	defer disk.Close()
 	defer os.Remove(disk.Name())
@@ -127,7 +278,7 @@ func TestLuks2UnlockMultipleKeySlots(t *testing.T) {
 	}
 	require.NoError(t, addKeyCmd.Run())
 
-	d, err := initV2Device(disk.Name(), disk)
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
 	require.NoError(t, err)
 
 	_, err = d.UnsealVolume(0, []byte(password))
@@ -141,7 +292,7 @@ func TestLuks2UnlockWithToken(t *testing.T) {
 	t.Parallel()
 
 	password := "foobar"
-	disk, err := prepareLuks2Disk(password)
+	disk, err := prepareLuks2Disk(t, password)
 	require.NoError(t, err)
 	defer disk.Close()
 	defer os.Remove(disk.Name())
@@ -156,7 +307,7 @@ func TestLuks2UnlockWithToken(t *testing.T) {
 	}
 	require.NoError(t, addTokenCmd.Run())
 
-	d, err := initV2Device(disk.Name(), disk)
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
 	require.NoError(t, err)
 
 	slots := d.Slots()
@@ -186,7 +337,7 @@ func TestLuks2PreferedPriority(t *testing.T) {
 	t.Parallel()
 
 	password := "foobar"
-	disk, err := prepareLuks2Disk(password)
+	disk, err := prepareLuks2Disk(t, password)
 	require.NoError(t, err)
 	defer disk.Close()
 	defer os.Remove(disk.Name())
@@ -199,7 +350,7 @@ func TestLuks2PreferedPriority(t *testing.T) {
 	}
 	require.NoError(t, configCmd.Run())
 
-	d, err := initV2Device(disk.Name(), disk)
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
 	require.NoError(t, err)
 
 	uuid, err := blkidUUID(disk.Name())
@@ -211,3 +362,1267 @@ func TestLuks2PreferedPriority(t *testing.T) {
 
 	require.ElementsMatch(t, []int{0}, d.Slots())
 }
+
+func TestLuks2RewriteHeader(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk, err := prepareLuks2Disk(t, password)
+	require.NoError(t, err)
+	defer disk.Close()
+	defer os.Remove(disk.Name())
+
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+
+	// put some garbage to the JSON area tail, the rewrite should clear it
+	jsonSize, err := d.meta.Config.JSONSize.Int64()
+	require.NoError(t, err)
+	garbageOffset := 4096 + jsonSize - 16
+	_, err = disk.WriteAt([]byte("garbagegarbage"), garbageOffset)
+	require.NoError(t, err)
+
+	seqID := d.hdr.SequenceID
+	require.NoError(t, d.writeHeader())
+
+	dumpCmd := exec.Command("cryptsetup", "luksDump", disk.Name())
+	if testing.Verbose() {
+		dumpCmd.Stdout = os.Stdout
+		dumpCmd.Stderr = os.Stderr
+	}
+	require.NoError(t, dumpCmd.Run())
+
+	tail := make([]byte, 16)
+	_, err = disk.ReadAt(tail, garbageOffset)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, 16), tail)
+
+	d2, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	require.Equal(t, seqID+1, d2.hdr.SequenceID)
+	require.Equal(t, d.meta.Keyslots, d2.meta.Keyslots)
+	require.Equal(t, d.meta.Segments, d2.meta.Segments)
+
+	_, err = d2.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+}
+
+func TestLuks2EncodeHeader(t *testing.T) {
+	data, err := os.ReadFile("testdata/metadata/1.json")
+	require.NoError(t, err)
+	var meta metadata
+	require.NoError(t, json.Unmarshal(data, &meta))
+
+	hdr := headerV2{Version: 2, HeaderSize: 16384, SequenceID: 5}
+	copy(hdr.Magic[:], "LUKS\xba\xbe")
+	copy(hdr.ChecksumAlgorithm[:], "sha256")
+	copy(hdr.UUID[:], "fa7e5b9b-5d4b-4f3b-9f2b-2b3c4d5e6f70")
+
+	encoded, err := encodeHeader(&hdr, &meta)
+	require.NoError(t, err)
+	require.Len(t, encoded, 16384)
+
+	disk, err := os.CreateTemp("", "luksv2.go.header")
+	require.NoError(t, err)
+	defer disk.Close()
+	defer os.Remove(disk.Name())
+	_, err = disk.Write(encoded)
+	require.NoError(t, err)
+
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	require.Equal(t, "fa7e5b9b-5d4b-4f3b-9f2b-2b3c4d5e6f70", d.UUID())
+	require.Equal(t, uint64(5), d.hdr.SequenceID)
+	require.Equal(t, meta.Keyslots, d.meta.Keyslots)
+	require.Equal(t, meta.Digests, d.meta.Digests)
+
+	// JSON that does not fit json_size must be rejected
+	meta.Config.JSONSize = "4096"
+	_, err = encodeHeader(&hdr, &meta)
+	require.Error(t, err)
+}
+
+func TestLuks2UnlockFixture(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk, volumeKey := createLuks2Fixture(t, password)
+
+	dev, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer dev.Close()
+	require.Equal(t, 2, dev.Version())
+	require.Equal(t, "7d2c1e9a-3b4f-4e5d-8a6b-9c0d1e2f3a4b", dev.UUID())
+	require.Equal(t, []int{0}, dev.Slots())
+
+	_, err = dev.UnsealVolume(0, []byte("wrongpassword"))
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+
+	v, err := dev.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, v.key)
+	require.Equal(t, uint64(16777216), v.StorageOffset)
+	require.Equal(t, uint64(1024*1024), v.StorageSize)
+	require.Equal(t, "aes-xts-plain64", v.StorageEncryption)
+}
+
+func TestLuks2UnlockWithVolumeKey(t *testing.T) {
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+
+	wrongKey := append([]byte(nil), volumeKey...)
+	wrongKey[0] ^= 0xff
+	require.Equal(t, ErrVolumeKeyIncorrect, d.UnlockWithVolumeKey(wrongKey, "luks-go-test-volume-key"))
+	require.Equal(t, ErrVolumeKeyIncorrect, d.UnlockWithVolumeKey(volumeKey[:len(volumeKey)-1], "luks-go-test-volume-key"))
+	// HMAC pads short keys with zeros, a key truncated before its trailing zero byte gives the same digest
+	paddedKey := append([]byte(nil), volumeKey...)
+	paddedKey[len(paddedKey)-1] = 0
+	orig := d.meta.Digests[0]
+	padded := orig
+	paddedDigest, err := computeDigestForKey(&padded, -1, paddedKey)
+	require.NoError(t, err)
+	padded.Digest = base64.StdEncoding.EncodeToString(paddedDigest)
+	d.meta.Digests[0] = padded
+	require.Equal(t, ErrVolumeKeyIncorrect, d.UnlockWithVolumeKey(paddedKey[:len(paddedKey)-1], "luks-go-test-volume-key"))
+	d.meta.Digests[0] = orig
+
+	dig := d.meta.Digests[0]
+	ok, err := verifyDigest(context.Background(), &dig, -1, volumeKey)
+	require.NoError(t, err)
+	require.True(t, ok)
+	expected, err := d.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	v, err := d.volumeForDigest(&dig, append([]byte(nil), volumeKey...))
+	require.NoError(t, err)
+	require.Equal(t, expected, v)
+
+	// digests that are not bound to a segment do not verify the volume key
+	dig.Segments = numberList{}
+	d.meta.Digests[0] = dig
+	require.Equal(t, ErrVolumeKeyIncorrect, d.UnlockWithVolumeKey(volumeKey, "luks-go-test-volume-key"))
+
+	d.metadataOnly = true
+	require.Equal(t, ErrMetadataOnly, d.UnlockWithVolumeKey(volumeKey, "luks-go-test-volume-key"))
+}
+
+func TestBuildLuks2AfCipher(t *testing.T) {
+	key := make([]byte, 64)
+
+	_, err := buildLuks2AfCipher("aes-xts-plain64", key)
+	require.NoError(t, err)
+	_, err = buildLuks2AfCipher("camellia-xts-plain64", key)
+	require.NoError(t, err)
+
+	_, err = buildLuks2AfCipher("aes-xts", key)
+	require.Error(t, err)
+	_, err = buildLuks2AfCipher("aes-cbc-essiv:sha256", key[:32])
+	require.NoError(t, err)
+	_, err = buildLuks2AfCipher("aes-cbc-essiv:md5", key[:32])
+	require.Error(t, err)
+	_, err = buildLuks2AfCipher("aes-ecb-plain64", key)
+	require.Error(t, err)
+	_, err = buildLuks2AfCipher("des-xts-plain64", key)
+	require.Error(t, err)
+}
+
+func TestLuks2RequiredAlgorithms(t *testing.T) {
+	t.Parallel()
+
+	disk, err := prepareLuks2Disk(t, "foobar", "--cipher", "camellia-xts-plain64", "--hash", "sha512", "--pbkdf", "argon2id")
+	require.NoError(t, err)
+	defer disk.Close()
+	defer os.Remove(disk.Name())
+
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+
+	ciphers, modes, hashes, kdfs := d.RequiredAlgorithms()
+	require.Equal(t, []string{"camellia"}, ciphers)
+	require.Equal(t, []string{"xts"}, modes)
+	require.Equal(t, []string{"sha512"}, hashes)
+	require.Equal(t, []string{"argon2id", "pbkdf2"}, kdfs)
+
+	for _, c := range ciphers {
+		require.Contains(t, SupportedCiphers(), c)
+	}
+	for _, m := range modes {
+		require.Contains(t, SupportedModes(), m)
+	}
+	for _, h := range hashes {
+		require.Contains(t, SupportedHashes(), h)
+	}
+	for _, k := range kdfs {
+		require.Contains(t, SupportedKdfs(), k)
+	}
+}
+
+func TestLuks2RequiredAlgorithmsFixture(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+
+	ciphers, modes, hashes, kdfs := d.RequiredAlgorithms()
+	require.Equal(t, []string{"aes"}, ciphers)
+	require.Equal(t, []string{"xts"}, modes)
+	require.Equal(t, []string{"sha256"}, hashes)
+	require.Equal(t, []string{"pbkdf2"}, kdfs)
+
+	// the data segment cipher is reported as well
+	seg := d.meta.Segments[0]
+	seg.Encryption = "serpent-cbc-essiv:sha256"
+	d.meta.Segments[0] = seg
+	ciphers, modes, _, _ = d.RequiredAlgorithms()
+	require.Equal(t, []string{"aes", "serpent"}, ciphers)
+	require.Equal(t, []string{"cbc", "xts"}, modes)
+}
+
+func TestLuks2OversizedHeaderDevice(t *testing.T) {
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	areaSize, err := d.headerAreaSize()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2*16384+16744448), areaSize)
+
+	// copy the metadata region to a larger "header partition" filled with garbage after the declared region
+	header := make([]byte, areaSize)
+	_, err = disk.ReadAt(header, 0)
+	require.NoError(t, err)
+	garbage := make([]byte, 4*1024*1024)
+	_, err = rand.Read(garbage)
+	require.NoError(t, err)
+
+	hdrDisk, err := os.CreateTemp("", "luksv2.go.header")
+	require.NoError(t, err)
+	defer hdrDisk.Close()
+	defer os.Remove(hdrDisk.Name())
+	_, err = hdrDisk.Write(header)
+	require.NoError(t, err)
+	_, err = hdrDisk.Write(garbage)
+	require.NoError(t, err)
+
+	d, err = initV2Device(hdrDisk.Name(), FileStorage{hdrDisk})
+	require.NoError(t, err)
+	areaSize2, err := d.headerAreaSize()
+	require.NoError(t, err)
+	require.Equal(t, areaSize, areaSize2)
+
+	v, err := d.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, v.key)
+
+	// the oversized partition is used as a detached header, the data segment is located at the data device
+	dev, err := OpenWithHeader(hdrDisk.Name(), disk.Name())
+	require.NoError(t, err)
+	v, err = dev.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, v.key)
+	require.Equal(t, disk.Name(), v.BackingDevice)
+	require.NoError(t, dev.Close())
+
+	// a header partition that does not hold the declared keyslots area is truncated
+	require.NoError(t, hdrDisk.Truncate(int64(areaSize)-4096))
+	_, err = OpenWithHeader(hdrDisk.Name(), disk.Name())
+	require.Error(t, err)
+}
+
+func TestLuks2TokenTypeNormalization(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	payload := `{"type":"  Clevis\t","keyslots":["0"],"jwe":{}}`
+	d.meta.Tokens[0] = json.RawMessage(payload)
+	require.NoError(t, d.writeHeader())
+
+	d, err = initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	tokens, err := d.Tokens()
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	require.Equal(t, ClevisTokenType, tokens[0].Type)
+	require.Equal(t, []int{0}, tokens[0].Slots)
+	// the original payload is preserved as is
+	require.Equal(t, payload, string(tokens[0].Payload))
+}
+
+func TestLuks2LargeSegmentOffset(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	// offset beyond 4GiB and iv_tweak beyond int64
+	d.meta.Segments[0] = segment{Type: "crypt", Offset: "5368709120", IvTweak: "9223372036854775808", Size: "8589934592", Encryption: "aes-xts-plain64", SectorSize: 512}
+	require.NoError(t, d.writeHeader())
+
+	d, err = initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	v, err := d.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(5*1024*1024*1024), v.StorageOffset)
+	require.Equal(t, uint64(8*1024*1024*1024), v.StorageSize)
+	require.Equal(t, uint64(1)<<63, v.StorageIvTweak)
+}
+
+func TestLuks2UseSecondaryHeader(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+
+	// rewrite only the secondary header with a different sequence id, the primary stays valid
+	hdr := *d.hdr
+	hdr.SequenceID = 100
+	hdr.HeaderOffset = hdr.HeaderSize
+	copy(hdr.Magic[:], luks2SecondaryMagic)
+	data, err := encodeHeader(&hdr, d.meta)
+	require.NoError(t, err)
+	_, err = disk.WriteAt(data, int64(hdr.HeaderSize))
+	require.NoError(t, err)
+
+	primary, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer primary.Close()
+	require.Equal(t, uint64(1), primary.(*deviceV2).hdr.SequenceID)
+
+	secondary, err := OpenWithOptions(disk.Name(), OpenOptions{UseSecondaryHeader: true})
+	require.NoError(t, err)
+	defer secondary.Close()
+	require.Equal(t, uint64(100), secondary.(*deviceV2).hdr.SequenceID)
+	require.Equal(t, primary.UUID(), secondary.UUID())
+
+	_, err = secondary.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+
+	// LUKS1 has no secondary header
+	disk1, _ := createLuks1Fixture(t, "foobar")
+	_, err = OpenWithOptions(disk1.Name(), OpenOptions{UseSecondaryHeader: true})
+	require.Error(t, err)
+}
+
+func TestLuks2JSONTrailingGarbage(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+
+	data, err := encodeHeader(d.hdr, d.meta)
+	require.NoError(t, err)
+	jsonEnd := 4096 + bytes.IndexByte(data[4096:], 0)
+	copy(data[jsonEnd:], "}garbage{\"keyslots\"")
+
+	// header with a broken checksum is still rejected
+	_, err = disk.WriteAt(data, 0)
+	require.NoError(t, err)
+	_, err = initV2Device(disk.Name(), FileStorage{disk})
+	require.Error(t, err)
+
+	checksum, err := computeHeaderChecksum(d.hdr, data)
+	require.NoError(t, err)
+	copy(data[unsafe.Offsetof(d.hdr.Checksum):], checksum)
+	_, err = disk.WriteAt(data, 0)
+	require.NoError(t, err)
+
+	d2, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	require.Equal(t, d.meta.Keyslots, d2.meta.Keyslots)
+	_, err = d2.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+}
+
+func TestLuks2Label(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	require.Equal(t, "", d.Label())
+	require.Equal(t, "", d.Subsystem())
+
+	label := strings.Repeat("l", 47)
+	require.NoError(t, putFixedString(d.hdr.Label[:], label))
+	require.NoError(t, putFixedString(d.hdr.SubsystemLabel[:], "system"))
+	require.NoError(t, d.writeHeader())
+
+	d, err = initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	require.Equal(t, label, d.Label())
+	require.Equal(t, "system", d.Subsystem())
+}
+
+func TestLuks2KeyslotFeasible(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+
+	feasible, reason := d.KeyslotFeasible(0)
+	require.True(t, feasible)
+	require.Empty(t, reason)
+
+	feasible, _ = d.KeyslotFeasible(5)
+	require.False(t, feasible)
+
+	d.meta.Keyslots[1] = keyslot{Kdf: kdf{Type: "argon2id", Time: 4, Memory: math.MaxUint32, Cpus: 4}} // ~4 TiB, the largest cost that fits into a 32-bit uint
+	feasible, reason = d.KeyslotFeasible(1)
+	require.False(t, feasible)
+	require.Contains(t, reason, "requires")
+
+	d.meta.Keyslots[1] = keyslot{Kdf: kdf{Type: "argon2i", Time: 4, Memory: 32, Cpus: 4}}
+	feasible, _ = d.KeyslotFeasible(1)
+	require.True(t, feasible)
+}
+
+func TestLuks2OversizedDigest(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+
+	// a digest longer than the hash output must not be compared out of bounds
+	dig := d.meta.Digests[0]
+	dig.Digest = base64.StdEncoding.EncodeToString(make([]byte, 100))
+	d.meta.Digests[0] = dig
+	_, err = d.UnsealVolume(0, []byte("foobar"))
+	require.ErrorIs(t, err, ErrPassphraseIncorrect)
+}
+
+func TestLuks2MaxKdfMemory(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	ks := d.meta.Keyslots[0]
+	ks.Kdf = kdf{Type: "argon2id", Salt: ks.Kdf.Salt, Time: 4, Memory: 64 * 1024 * 1024, Cpus: 4} // 64GiB
+	d.meta.Keyslots[0] = ks
+	require.NoError(t, d.writeHeader())
+
+	dev, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer dev.Close()
+	// the limit is verified before argon2 allocates the memory
+	_, err = dev.UnsealVolume(0, []byte("foobar"))
+	require.ErrorIs(t, err, ErrKdfMemoryLimit)
+	require.Equal(t, "Keyslot KDF memory cost exceeds the limit: keyslot 0 argon2id requires 65536 MiB of memory, the limit is 4096 MiB", err.Error())
+	err = dev.UnlockAny([]byte("foobar"), "test")
+	require.ErrorIs(t, err, ErrKdfMemoryLimit)
+	feasible, reason := dev.(Inspector).KeyslotFeasible(0)
+	require.False(t, feasible)
+	require.Contains(t, reason, "the limit is 4096 MiB")
+
+	limited, err := OpenWithOptions(disk.Name(), OpenOptions{MaxKdfMemory: 1024})
+	require.NoError(t, err)
+	defer limited.Close()
+	_, err = limited.UnsealVolume(0, []byte("foobar"))
+	require.ErrorIs(t, err, ErrKdfMemoryLimit)
+	require.Contains(t, err.Error(), "the limit is 1 MiB")
+
+	unlimited, err := OpenWithOptions(disk.Name(), OpenOptions{MaxKdfMemory: -1})
+	require.NoError(t, err)
+	defer unlimited.Close()
+	require.NoError(t, unlimited.(*deviceV2).checkKdfMemory(0, ks.Kdf))
+}
+
+func TestLuks2EnrollToken(t *testing.T) {
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+
+	dev, err := OpenWithOptions(disk.Name(), OpenOptions{ReadWrite: true})
+	require.NoError(t, err)
+	defer dev.Close()
+
+	kdf := KdfParams{Type: "pbkdf2", Hash: "sha256", Iterations: fixtureIterations}
+	token := Token{Type: "systemd-tpm2", Payload: []byte(`{"tpm2-pcrs":[7],"keyslots":["5"]}`)}
+
+	_, _, err = dev.(TokenManager).EnrollToken([]byte("wrongpassword"), []byte("tpmsecret"), token, kdf)
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+
+	slot, tokenID, err := dev.(TokenManager).EnrollToken([]byte("foobar"), []byte("tpmsecret"), token, kdf)
+	require.NoError(t, err)
+	require.Equal(t, 1, slot)
+	require.Equal(t, 0, tokenID)
+
+	// a token that does not fit into the JSON area fails the header write, neither keyslot nor token is added
+	huge := Token{Type: "clevis", Payload: []byte(`{"jwe":"` + strings.Repeat("A", 16384) + `"}`)}
+	_, _, err = dev.(TokenManager).EnrollToken([]byte("foobar"), []byte("clevissecret"), huge, kdf)
+	require.Error(t, err)
+	require.ElementsMatch(t, []int{0, 1}, dev.Slots())
+
+	reopened, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer reopened.Close()
+	require.ElementsMatch(t, []int{0, 1}, reopened.Slots())
+
+	tokens, err := reopened.Tokens()
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	require.Equal(t, 0, tokens[0].ID)
+	require.Equal(t, SystemdTPM2TokenType, tokens[0].Type)
+	require.Equal(t, []int{1}, tokens[0].Slots)
+	require.Contains(t, string(tokens[0].Payload), `"tpm2-pcrs":[7]`)
+
+	v, err := reopened.UnsealVolume(1, []byte("tpmsecret"))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, v.key)
+	v, err = reopened.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, v.key)
+}
+
+func TestLuks2EnrollTokenWriteFailure(t *testing.T) {
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+	kdf := KdfParams{Type: "pbkdf2", Hash: "sha256", Iterations: fixtureIterations}
+	token := Token{Type: "systemd-tpm2", Payload: []byte(`{"tpm2-pcrs":[7],"keyslots":["5"]}`)}
+
+	// the keyslot area is written but writing the headers fails
+	storage := &failingStorage{Storage: FileStorage{disk}, fail: func(off int64) bool { return off < 32768 }}
+	d, err := initV2Device(disk.Name(), storage)
+	require.NoError(t, err)
+	_, _, err = d.EnrollToken([]byte("foobar"), []byte("tpmsecret"), token, kdf)
+	require.Error(t, err)
+	require.Equal(t, []int{0}, d.Slots())
+	tokens, err := d.Tokens()
+	require.NoError(t, err)
+	require.Empty(t, tokens)
+
+	// the in-memory metadata is rolled back to the headers on disk
+	onDisk, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	require.Equal(t, onDisk.meta, d.meta)
+
+	// the device is still usable once the storage recovers
+	storage.fail = func(int64) bool { return false }
+	slot, tokenID, err := d.EnrollToken([]byte("foobar"), []byte("tpmsecret"), token, kdf)
+	require.NoError(t, err)
+	require.Equal(t, 1, slot)
+	require.Equal(t, 0, tokenID)
+	v, err := d.UnsealVolume(slot, []byte("tpmsecret"))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, v.key)
+}
+
+func TestLuks2AddKeyslot(t *testing.T) {
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+	kdf := KdfParams{Type: "pbkdf2", Hash: "sha256", Iterations: fixtureIterations}
+
+	ro, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer ro.Close()
+	_, err = ro.(Writer).AddKeyslot([]byte("foobar"), []byte("second"), kdf)
+	require.Error(t, err)
+
+	dev, err := OpenWithOptions(disk.Name(), OpenOptions{ReadWrite: true})
+	require.NoError(t, err)
+	defer dev.Close()
+	w := dev.(Writer)
+
+	_, err = w.AddKeyslot([]byte("wrongpassword"), []byte("second"), kdf)
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+	_, err = w.AddKeyslot([]byte("foobar"), []byte("second"), KdfParams{Type: "pbkdf2", Hash: "nosuchhash", Iterations: 1})
+	require.Error(t, err)
+	require.Equal(t, []int{0}, dev.Slots())
+
+	slot, err := w.AddKeyslot([]byte("foobar"), []byte("second"), kdf)
+	require.NoError(t, err)
+	require.Equal(t, 1, slot)
+	// the new keyslot can be used to enroll further keyslots
+	slot, err = w.AddKeyslot([]byte("second"), []byte("third"), KdfParams{Type: "pbkdf2", Hash: "sha512", Iterations: fixtureIterations})
+	require.NoError(t, err)
+	require.Equal(t, 2, slot)
+
+	// both header copies are updated
+	for _, opts := range []OpenOptions{{}, {UseSecondaryHeader: true}} {
+		reopened, err := OpenWithOptions(disk.Name(), opts)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []int{0, 1, 2}, reopened.Slots())
+		for slot, pass := range map[int]string{0: "foobar", 1: "second", 2: "third"} {
+			v, err := reopened.UnsealVolume(slot, []byte(pass))
+			require.NoError(t, err)
+			require.Equal(t, volumeKey, v.key)
+		}
+		require.NoError(t, reopened.Close())
+	}
+}
+
+func TestLuks2AddKeyslotWithVolumeKey(t *testing.T) {
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+
+	dev, err := OpenWithOptions(disk.Name(), OpenOptions{ReadWrite: true})
+	require.NoError(t, err)
+	defer dev.Close()
+
+	kdf := KdfParams{Type: "pbkdf2", Hash: "sha256", Iterations: fixtureIterations}
+	wrongKey := append([]byte(nil), volumeKey...)
+	wrongKey[0] ^= 0xff
+	_, err = dev.(Writer).AddKeyslotWithVolumeKey(NewVolumeKey(wrongKey), []byte("recovery"), kdf)
+	require.Equal(t, ErrVolumeKeyIncorrect, err)
+	wiped := NewVolumeKey(volumeKey)
+	wiped.Wipe()
+	_, err = dev.(Writer).AddKeyslotWithVolumeKey(wiped, []byte("recovery"), kdf)
+	require.Error(t, err)
+	require.Equal(t, []int{0}, dev.Slots())
+
+	keyslot, err := dev.(Writer).AddKeyslotWithVolumeKey(NewVolumeKey(volumeKey), []byte("recovery"), kdf)
+	require.NoError(t, err)
+	require.Equal(t, 1, keyslot)
+
+	reopened, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer reopened.Close()
+	require.Equal(t, []int{0, 1}, reopened.Slots())
+	v, err := reopened.UnsealVolume(1, []byte("recovery"))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, v.key)
+}
+
+func TestLuks2UnboundKeyslot(t *testing.T) {
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+
+	dev, err := OpenWithOptions(disk.Name(), OpenOptions{ReadWrite: true})
+	require.NoError(t, err)
+	defer dev.Close()
+	w := dev.(Writer)
+
+	wrappedKey := make([]byte, 32)
+	_, err = rand.Read(wrappedKey)
+	require.NoError(t, err)
+	kdf := KdfParams{Type: "pbkdf2", Hash: "sha256", Iterations: fixtureIterations}
+	keyslot, err := w.AddUnboundKeyslot(wrappedKey, []byte("unbound"), kdf)
+	require.NoError(t, err)
+	require.Equal(t, 1, keyslot)
+
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	require.Equal(t, []int{0}, d.Slots())
+	require.Equal(t, []int{1}, d.UnboundSlots())
+	info, err := d.Keyslot(1)
+	require.NoError(t, err)
+	require.Equal(t, KeyslotStateUnbound, info.State)
+	require.Equal(t, 32, info.KeySize)
+	digests, err := d.Digests()
+	require.NoError(t, err)
+	require.Len(t, digests, 2)
+	require.Equal(t, []int{1}, digests[1].Keyslots)
+	require.Empty(t, digests[1].Segments)
+
+	_, err = d.UnsealVolume(1, []byte("unbound"))
+	require.ErrorIs(t, err, ErrKeyslotUnbound)
+	_, err = d.UnsealUnboundKey(1, []byte("wrong"))
+	require.Equal(t, ErrPassphraseIncorrect, err)
+	key, err := d.UnsealUnboundKey(1, []byte("unbound"))
+	require.NoError(t, err)
+	require.Equal(t, wrappedKey, key)
+	_, err = d.UnsealUnboundKey(0, []byte("foobar"))
+	require.Error(t, err)
+	v, err := d.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, v.key)
+
+	// a keyslot that is not referenced by any digest is unbound too
+	delete(d.meta.Digests, 1)
+	require.Equal(t, []int{0}, d.Slots())
+	require.Equal(t, []int{1}, d.UnboundSlots())
+	_, err = d.UnsealVolume(1, []byte("unbound"))
+	require.ErrorIs(t, err, ErrKeyslotUnbound)
+
+	// the unbound keyslot can't open the data segment, so keyslot #0 is still the last one
+	require.Error(t, w.RemoveKeyslot(0))
+	_, err = w.UnlockAndKillSlot(0, []byte("foobar"))
+	require.Error(t, err)
+	require.Equal(t, []int{0}, dev.Slots())
+
+	// the digest of the unbound key is removed together with its keyslot
+	require.NoError(t, w.RemoveKeyslot(1))
+	require.Empty(t, dev.(Inspector).UnboundSlots())
+	digests, err = dev.(Inspector).Digests()
+	require.NoError(t, err)
+	require.Len(t, digests, 1)
+}
+
+func TestLuks2UnlockAndKillSlotHeaderWriteFailure(t *testing.T) {
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	addLuks2FixtureKeyslot(t, d, 1, "recovery", volumeKey)
+	require.NoError(t, d.writeHeader())
+
+	// the keyslot area is wiped but writing the headers fails
+	storage := &failingStorage{Storage: FileStorage{disk}, fail: func(off int64) bool { return off < 32768 }}
+	d, err = initV2Device(disk.Name(), storage)
+	require.NoError(t, err)
+	_, err = d.UnlockAndKillSlot(1, []byte("recovery"))
+	require.Error(t, err)
+
+	// the key material is gone thus the keyslot must not be advertised anymore
+	require.Equal(t, []int{0}, d.Slots())
+	require.NotContains(t, d.meta.Keyslots, 1)
+	require.Equal(t, numberList{"0"}, d.meta.Digests[0].Keyslots)
+
+	onDisk, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1}, onDisk.Slots())
+	_, err = onDisk.UnsealVolume(1, []byte("recovery"))
+	require.Error(t, err)
+}
+
+func TestLuks2AddKeyslotBlake2(t *testing.T) {
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+	dev, err := OpenWithOptions(disk.Name(), OpenOptions{ReadWrite: true})
+	require.NoError(t, err)
+	defer dev.Close()
+
+	for i, hash := range []string{"blake2b-512", "blake2s-256"} {
+		slot, err := dev.(Writer).AddKeyslot([]byte("foobar"), []byte(hash), KdfParams{Type: "pbkdf2", Hash: hash, Iterations: fixtureIterations})
+		require.NoError(t, err)
+		require.Equal(t, i+1, slot)
+
+		info, err := dev.(Inspector).Keyslot(slot)
+		require.NoError(t, err)
+		require.Equal(t, hash, info.Kdf.Hash)
+		require.Equal(t, hash, info.AfHash)
+	}
+
+	reopened, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer reopened.Close()
+	for i, hash := range []string{"blake2b-512", "blake2s-256"} {
+		v, err := reopened.UnsealVolume(i+1, []byte(hash))
+		require.NoError(t, err)
+		require.Equal(t, volumeKey, v.key)
+	}
+}
+
+func TestLuks2ChangePassphrase(t *testing.T) {
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	priority := 2
+	ks := d.meta.Keyslots[0]
+	ks.Priority = &priority
+	d.meta.Keyslots[0] = ks
+	require.NoError(t, d.writeHeader())
+	before := cloneDisk(t, disk)
+
+	dev, err := OpenWithOptions(disk.Name(), OpenOptions{ReadWrite: true})
+	require.NoError(t, err)
+	defer dev.Close()
+
+	require.Equal(t, ErrPassphraseDoesNotMatch, dev.(Writer).ChangePassphrase(0, []byte("wrong"), []byte("newpass")))
+	require.NoError(t, dev.(Writer).ChangePassphrase(0, []byte("foobar"), []byte("newpass")))
+	require.Equal(t, []int{0}, dev.Slots())
+
+	reopened, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	_, err = reopened.UnsealVolume(0, []byte("foobar"))
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+	v, err := reopened.UnsealVolume(0, []byte("newpass"))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, v.key)
+
+	ks = reopened.meta.Keyslots[0]
+	require.Equal(t, 2, *ks.Priority)
+	require.Equal(t, uint(fixtureIterations), ks.Kdf.Iterations)
+	require.NotEqual(t, json.Number("32768"), ks.Area.Offset, "new material must not overwrite the old one")
+
+	// the old material is wiped
+	old := make([]byte, 258048)
+	_, err = before.ReadAt(old, 32768)
+	require.NoError(t, err)
+	wiped := make([]byte, len(old))
+	_, err = disk.ReadAt(wiped, 32768)
+	require.NoError(t, err)
+	require.NotEqual(t, old, wiped)
+
+	// a power loss after the primary header is written leaves the old secondary header and the old key material,
+	// the device stays openable with both passphrases
+	crashed := cloneDisk(t, disk)
+	_, err = crashed.WriteAt(old, 32768)
+	require.NoError(t, err)
+	secondary := make([]byte, 16384)
+	_, err = before.ReadAt(secondary, 16384)
+	require.NoError(t, err)
+	_, err = crashed.WriteAt(secondary, 16384)
+	require.NoError(t, err)
+
+	primary, err := initV2Device(crashed.Name(), FileStorage{crashed})
+	require.NoError(t, err)
+	v, err = primary.UnsealVolume(0, []byte("newpass"))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, v.key)
+	fallback, err := initV2DeviceSecondary(crashed.Name(), FileStorage{crashed}, 0)
+	require.NoError(t, err)
+	v, err = fallback.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, v.key)
+}
+
+func TestLuks2DeviceAtOffset(t *testing.T) {
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+	luksSize, err := FileStorage{disk}.Size()
+	require.NoError(t, err)
+
+	// embed the LUKS image into a larger disk image after a 1MiB "partition table" gap,
+	// another 1MiB partition follows the LUKS one
+	const baseOffset = 1024 * 1024
+	image, err := os.CreateTemp("", "luksv2.go.image")
+	require.NoError(t, err)
+	defer os.Remove(image.Name())
+	defer image.Close()
+	require.NoError(t, image.Truncate(baseOffset+int64(luksSize)+1024*1024))
+	_, err = image.Seek(baseOffset, io.SeekStart)
+	require.NoError(t, err)
+	_, err = io.Copy(image, io.NewSectionReader(disk, 0, 1<<62))
+	require.NoError(t, err)
+
+	d, err := initV2DeviceAt(image.Name(), FileStorage{image}, baseOffset)
+	require.NoError(t, err)
+	require.Equal(t, "7d2c1e9a-3b4f-4e5d-8a6b-9c0d1e2f3a4b", d.UUID())
+	// the dynamic data segment size is unknown, it must not extend over the next partition
+	_, err = d.UnsealVolume(0, []byte("foobar"))
+	require.Error(t, err)
+
+	d.size = int64(luksSize)
+	v, err := d.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, v.key)
+	require.Equal(t, uint64(baseOffset+16777216), v.StorageOffset)
+	require.Equal(t, uint64(1024*1024), v.StorageSize)
+
+	for _, opts := range []OpenOptions{
+		{Offset: baseOffset, Size: int64(luksSize)},
+		{Offset: baseOffset, Size: int64(luksSize), UseSecondaryHeader: true},
+	} {
+		dev, err := OpenWithOptions(image.Name(), opts)
+		require.NoError(t, err)
+		v, err = dev.UnsealVolume(0, []byte("foobar"))
+		require.NoError(t, err)
+		require.Equal(t, volumeKey, v.key)
+		require.Equal(t, uint64(1024*1024), v.StorageSize)
+		require.NoError(t, dev.Close())
+	}
+
+	// the device does not fit into the image
+	dev, err := OpenWithOptions(image.Name(), OpenOptions{Offset: baseOffset, Size: int64(luksSize) + 2*1024*1024})
+	require.NoError(t, err)
+	_, err = dev.UnsealVolume(0, []byte("foobar"))
+	require.Error(t, err)
+	require.NoError(t, dev.Close())
+
+	_, err = OpenWithOptions(image.Name(), OpenOptions{Offset: baseOffset, Size: -1})
+	require.Error(t, err)
+	_, err = Open(image.Name())
+	require.Error(t, err)
+}
+
+func TestLuks2KeyslotLayout(t *testing.T) {
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	addLuks2FixtureKeyslot(t, d, 1, "barfoo", volumeKey)
+
+	layout, err := d.KeyslotLayout()
+	require.NoError(t, err)
+	require.Equal(t, uint64(32768), layout.RegionOffset)
+	require.Equal(t, uint64(16744448), layout.RegionSize)
+	require.Equal(t, uint64(4096), layout.Alignment)
+	require.Equal(t, []KeyslotArea{
+		{Keyslot: 0, Active: true, Offset: 32768, Size: 258048},
+		{Keyslot: 1, Active: true, Offset: 290816, Size: 258048},
+	}, layout.Areas)
+}
+
+func TestLuks2AtypicalSaltLength(t *testing.T) {
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	short := []byte("0123456789")
+	long := bytes.Repeat([]byte("salt"), 50)
+	addLuks2FixtureKeyslotWithSalt(t, d, 1, "short", volumeKey, short)
+	addLuks2FixtureKeyslotWithSalt(t, d, 2, "long", volumeKey, long)
+
+	// volume key digest with a 7-byte salt
+	digestSalt := []byte("pepper!")
+	dig := d.meta.Digests[0]
+	dig.Salt = base64.StdEncoding.EncodeToString(digestSalt)
+	dig.Digest = base64.StdEncoding.EncodeToString(pbkdf2.Key(volumeKey, digestSalt, fixtureIterations, sha256.Size, sha256.New))
+	d.meta.Digests[0] = dig
+	require.NoError(t, d.writeHeader())
+
+	d, err = initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+
+	// the salt is used verbatim
+	afKey, err := deriveLuks2AfKey(d.meta.Keyslots[2].Kdf, 2, []byte("long"), 64)
+	require.NoError(t, err)
+	require.Equal(t, pbkdf2.Key([]byte("long"), long, fixtureIterations, 64, sha256.New), afKey)
+
+	for slot, password := range map[int]string{0: "foobar", 1: "short", 2: "long"} {
+		v, err := d.UnsealVolume(slot, []byte(password))
+		require.NoError(t, err)
+		require.Equal(t, volumeKey, v.key)
+	}
+}
+
+func TestLuks2NullEncryptionSegment(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+
+	for _, enc := range []string{"null", "cipher_null-ecb"} {
+		d, err := initV2Device(disk.Name(), FileStorage{disk})
+		require.NoError(t, err)
+		seg := d.meta.Segments[0]
+		seg.Encryption = enc
+		d.meta.Segments[0] = seg
+		require.NoError(t, d.writeHeader())
+
+		d, err = initV2Device(disk.Name(), FileStorage{disk})
+		require.NoError(t, err)
+		v, err := d.UnsealVolume(0, []byte("foobar"))
+		require.NoError(t, err)
+		require.True(t, v.StorageUnencrypted, enc)
+
+		table, err := v.linearTable()
+		require.NoError(t, err)
+		require.Equal(t, uint64(16777216), table.BackendOffset)
+		require.Equal(t, uint64(1024*1024), table.Length)
+	}
+
+	require.False(t, isNullCipher("aes-xts-plain64"))
+	require.False(t, isNullCipher("cipher_nullish"))
+	require.False(t, isNullCipher(""))
+
+	// a segment without encryption is invalid rather than plaintext
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	seg := d.meta.Segments[0]
+	seg.Encryption = ""
+	d.meta.Segments[0] = seg
+	_, err = d.UnsealVolume(0, []byte("foobar"))
+	require.Error(t, err)
+}
+
+func TestLuks2KeyslotPriority(t *testing.T) {
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	for i := 1; i <= 4; i++ {
+		addLuks2FixtureKeyslot(t, d, i, "foobar", volumeKey)
+	}
+	setPriority := func(slot, priority int) {
+		ks := d.meta.Keyslots[slot]
+		ks.Priority = &priority
+		d.meta.Keyslots[slot] = ks
+	}
+	setPriority(0, luks2PriorityIgnore)
+	setPriority(2, luks2PriorityNormal)
+	setPriority(3, luks2PriorityPrefer)
+	setPriority(4, luks2PriorityPrefer)
+	require.NoError(t, d.writeHeader())
+
+	dev, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer dev.Close()
+	require.Equal(t, []int{3, 4, 1, 2}, dev.Slots())
+
+	// the first tried keyslot matches
+	keyslot, _, err := UnsealAny(context.Background(), dev, []byte("foobar"), UnsealAnyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 3, keyslot)
+
+	// "ignore" keyslot is used only when addressed explicitly
+	v, err := dev.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, v.key)
+}
+
+func TestLuks2Keyslot(t *testing.T) {
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	addLuks2FixtureKeyslot(t, d, 1, "barfoo", volumeKey)
+	ignore := luks2PriorityIgnore
+	ks := d.meta.Keyslots[1]
+	ks.Priority = &ignore
+	d.meta.Keyslots[1] = ks
+	// unbind the keyslot from the data segment
+	dig := d.meta.Digests[0]
+	dig.Keyslots = numberList{"0"}
+	d.meta.Digests[0] = dig
+	d.meta.Digests[1] = digest{Type: "pbkdf2", Keyslots: numberList{"1"}, Segments: numberList{}}
+
+	salt, err := base64.StdEncoding.DecodeString(d.meta.Keyslots[0].Kdf.Salt)
+	require.NoError(t, err)
+	info, err := d.Keyslot(0)
+	require.NoError(t, err)
+	require.Equal(t, KeyslotInfo{
+		ID:             0,
+		State:          KeyslotStateActive,
+		Priority:       "normal",
+		KeySize:        len(volumeKey),
+		Kdf:            KdfParams{Type: "pbkdf2", Hash: "sha256", Iterations: fixtureIterations},
+		KdfSalt:        salt,
+		AreaEncryption: "aes-xts-plain64",
+		AreaKeySize:    len(volumeKey),
+		AfStripes:      stripesNum,
+		AfHash:         "sha256",
+		Area:           KeyslotArea{Keyslot: 0, Active: true, Offset: 32768, Size: 258048},
+	}, info)
+
+	info, err = d.Keyslot(1)
+	require.NoError(t, err)
+	require.Equal(t, KeyslotStateUnbound, info.State)
+	require.Equal(t, "ignore", info.Priority)
+	require.Equal(t, uint64(290816), info.Area.Offset)
+
+	info, err = d.Keyslot(5)
+	require.NoError(t, err)
+	require.Equal(t, KeyslotInfo{ID: 5, State: KeyslotStateInactive}, info)
+	_, err = d.Keyslot(luks2KeyslotsMax)
+	require.Error(t, err)
+}
+
+func TestLuks2Segments(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	d.meta.Segments[1] = segment{
+		Type:       "crypt",
+		Offset:     "17825792",
+		IvTweak:    "2048",
+		Size:       "1048576",
+		Encryption: "aes-xts-plain64",
+		SectorSize: 4096,
+		Integrity:  &integrity{Type: "hmac(sha256)"},
+	}
+
+	segments, err := d.Segments()
+	require.NoError(t, err)
+	require.Equal(t, []SegmentInfo{
+		{ID: 0, Type: "crypt", Offset: 16777216, Dynamic: true, Encryption: "aes-xts-plain64", SectorSize: 512},
+		{ID: 1, Type: "crypt", Offset: 17825792, Size: 1048576, Encryption: "aes-xts-plain64", IvTweak: 2048, SectorSize: 4096, Integrity: "hmac(sha256)"},
+	}, segments)
+
+	d.meta.Segments[1] = segment{Type: "crypt", Offset: "17825792", Size: "invalid"}
+	_, err = d.Segments()
+	require.Error(t, err)
+}
+
+func TestLuks2MetadataJSON(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+
+	expected, err := json.Marshal(d.meta)
+	require.NoError(t, err)
+	data, err := d.MetadataJSON()
+	require.NoError(t, err)
+	require.Equal(t, expected, data)
+
+	// the secondary header holds the same metadata
+	secondary, err := initV2DeviceSecondary(disk.Name(), FileStorage{disk}, 0)
+	require.NoError(t, err)
+	data, err = secondary.MetadataJSON()
+	require.NoError(t, err)
+	require.Equal(t, expected, data)
+}
+
+func TestLuks2PersistentFlags(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	d.meta.Config.Flags = []string{FlagAllowDiscards, "no-journal", FlagNoReadWorkqueue, "unknown-future-flag"}
+	require.NoError(t, d.writeHeader())
+
+	dev, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer dev.Close()
+	require.Equal(t, []string{FlagAllowDiscards, "no-journal", FlagNoReadWorkqueue, "unknown-future-flag"}, dev.(Inspector).Flags())
+	// only dm-crypt flags are used for activation
+	require.Equal(t, []string{FlagAllowDiscards, FlagNoReadWorkqueue}, dev.FlagsGet())
+
+	v, err := dev.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	table, err := v.cryptTable()
+	require.NoError(t, err)
+	require.Equal(t, []string{devmapper.CryptFlagAllowDiscards, devmapper.CryptFlagNoReadWorkqueue}, table.Flags)
+
+	// activation flags are independent of the persistent ones
+	dev.FlagsClear()
+	require.Len(t, dev.(Inspector).Flags(), 4)
+}
+
+func TestLuks2SetFlags(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+
+	dev, err := OpenWithOptions(disk.Name(), OpenOptions{ReadWrite: true})
+	require.NoError(t, err)
+	defer dev.Close()
+	w := dev.(Writer)
+
+	require.NoError(t, w.SetFlags([]string{FlagAllowDiscards, FlagNoWriteWorkqueue, FlagAllowDiscards}))
+	require.Equal(t, []string{FlagAllowDiscards, FlagNoWriteWorkqueue}, dev.(Inspector).Flags())
+	require.Error(t, w.SetFlags([]string{FlagReadOnly}))
+	require.Error(t, w.SetFlags([]string{"unknown"}))
+	require.Equal(t, []string{FlagAllowDiscards, FlagNoWriteWorkqueue}, dev.(Inspector).Flags())
+
+	// both header copies are updated
+	primary, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	require.Equal(t, []string{FlagAllowDiscards, FlagNoWriteWorkqueue}, primary.Flags())
+	secondary, err := initV2DeviceSecondary(disk.Name(), FileStorage{disk}, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{FlagAllowDiscards, FlagNoWriteWorkqueue}, secondary.Flags())
+
+	require.NoError(t, w.SetFlags(nil))
+	reopened, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer reopened.Close()
+	require.Empty(t, reopened.(Inspector).Flags())
+
+	readOnly, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer readOnly.Close()
+	require.Error(t, readOnly.(Writer).SetFlags([]string{FlagAllowDiscards}))
+}
+
+func TestLuks2SetLabel(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+
+	dev, err := OpenWithOptions(disk.Name(), OpenOptions{ReadWrite: true})
+	require.NoError(t, err)
+	defer dev.Close()
+	require.Equal(t, "", dev.(Inspector).Label())
+
+	require.NoError(t, dev.(Writer).SetLabel("backup"))
+	require.NoError(t, dev.(Writer).SetSubsystem("system"))
+	require.Error(t, dev.(Writer).SetLabel(strings.Repeat("x", 48)))
+	require.Equal(t, "backup", dev.(Inspector).Label())
+	require.Equal(t, "system", dev.(Inspector).Subsystem())
+
+	for _, init := range []func() (*deviceV2, error){
+		func() (*deviceV2, error) { return initV2Device(disk.Name(), FileStorage{disk}) },
+		func() (*deviceV2, error) { return initV2DeviceSecondary(disk.Name(), FileStorage{disk}, 0) },
+	} {
+		d, err := init()
+		require.NoError(t, err)
+		require.Equal(t, "backup", d.Label())
+		require.Equal(t, "system", d.Subsystem())
+	}
+}
+
+func TestLuks2ImportToken(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+
+	dev, err := OpenWithOptions(disk.Name(), OpenOptions{ReadWrite: true})
+	require.NoError(t, err)
+	defer dev.Close()
+	tm := dev.(TokenManager)
+
+	tokenID, err := tm.ImportToken(Token{Type: "clevis", Slots: []int{0}, Payload: []byte(`{"jwe":{"protected":"abc"}}`)})
+	require.NoError(t, err)
+	require.Equal(t, 0, tokenID)
+	// the type can be specified in the payload, a token without keyslots is allowed
+	tokenID, err = tm.ImportToken(Token{Payload: []byte(`{"type":"systemd-fido2","keyslots":["0"],"fido2-credential":"Y3JlZA==","fido2-salt":"c2FsdA=="}`)})
+	require.NoError(t, err)
+	require.Equal(t, 1, tokenID)
+
+	_, err = tm.ImportToken(Token{Type: "clevis", Slots: []int{3}, Payload: []byte(`{}`)})
+	require.ErrorIs(t, err, ErrKeyslotInactive)
+	_, err = tm.ImportToken(Token{Type: "clevis", Payload: []byte(`["not", "object"]`)})
+	require.Error(t, err)
+	_, err = tm.ImportToken(Token{Payload: []byte(`{}`)})
+	require.Error(t, err)
+
+	reopened, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer reopened.Close()
+	tokens, err := reopened.Tokens()
+	require.NoError(t, err)
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+	require.Len(t, tokens, 2)
+	require.Equal(t, ClevisTokenType, tokens[0].Type)
+	require.Equal(t, []int{0}, tokens[0].Slots)
+	require.Contains(t, string(tokens[0].Payload), `"jwe":{"protected":"abc"}`)
+	require.Equal(t, SystemdFido2TokenType, tokens[1].Type)
+	require.Equal(t, []int{}, tokens[1].Slots)
+
+	v1, _ := createLuks1Fixture(t, "foobar")
+	dev1, err := OpenWithOptions(v1.Name(), OpenOptions{ReadWrite: true})
+	require.NoError(t, err)
+	defer dev1.Close()
+	_, err = dev1.(TokenManager).ImportToken(Token{Type: "clevis", Payload: []byte(`{}`)})
+	require.Error(t, err)
+}
+
+func TestLuks2RemoveReplaceToken(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+
+	dev, err := OpenWithOptions(disk.Name(), OpenOptions{ReadWrite: true})
+	require.NoError(t, err)
+	defer dev.Close()
+	tm := dev.(TokenManager)
+
+	first, err := tm.ImportToken(Token{Type: "systemd-tpm2", Slots: []int{0}, Payload: []byte(`{"tpm2-policy-hash":"aa"}`)})
+	require.NoError(t, err)
+	second, err := tm.ImportToken(Token{Type: "clevis", Slots: []int{0}, Payload: []byte(`{}`)})
+	require.NoError(t, err)
+
+	require.NoError(t, tm.ReplaceToken(first, Token{Type: "systemd-tpm2", Slots: []int{0}, Payload: []byte(`{"tpm2-policy-hash":"bb"}`)}))
+	require.Error(t, tm.ReplaceToken(5, Token{Type: "clevis", Payload: []byte(`{}`)}))
+	require.ErrorIs(t, tm.ReplaceToken(first, Token{Type: "clevis", Slots: []int{4}, Payload: []byte(`{}`)}), ErrKeyslotInactive)
+	require.NoError(t, tm.RemoveToken(second))
+	require.Error(t, tm.RemoveToken(second))
+
+	reopened, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer reopened.Close()
+	tokens, err := reopened.Tokens()
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	require.Equal(t, first, tokens[0].ID)
+	require.Equal(t, []int{0}, tokens[0].Slots)
+	require.Contains(t, string(tokens[0].Payload), `"tpm2-policy-hash":"bb"`)
+	// the keyslot bound to the removed token is kept
+	require.Equal(t, []int{0}, reopened.Slots())
+}
+
+func TestParseCipherSpec(t *testing.T) {
+	for spec, expected := range map[string][3]string{
+		"aes-xts-plain64":                {"aes", "xts", "plain64"},
+		"aes-cbc-essiv:sha256":           {"aes", "cbc", "essiv:sha256"},
+		"capi:xts(aes)-plain64":          {"aes", "xts", "plain64"},
+		"capi:cbc(serpent)-essiv:sha256": {"serpent", "cbc", "essiv:sha256"},
+		"capi:xts(ecb(aes))-plain64":     {"aes", "xts", "plain64"},
+	} {
+		cipherName, mode, iv, err := parseCipherSpec(spec)
+		require.NoError(t, err, spec)
+		require.Equal(t, expected, [3]string{cipherName, mode, iv}, spec)
+	}
+
+	for _, spec := range []string{
+		"aes-xts",
+		"capi:xts(aes)",
+		"capi:xts(aes)-",
+		"capi:xts-plain64",
+		"capi:(aes)-plain64",
+		"capi:xts()-plain64",
+		"capi:authenc(hmac(sha256),xts(aes))-random",
+	} {
+		_, _, _, err := parseCipherSpec(spec)
+		require.Error(t, err, spec)
+	}
+
+	// a keyslot area encrypted with a capi spec is decrypted the same way as the cryptsetup spec
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	ks := d.meta.Keyslots[0]
+	ks.Area.Encryption = "capi:xts(aes)-plain64"
+	d.meta.Keyslots[0] = ks
+	v, err := d.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, v.key)
+	ciphers, modes, _, _ := d.RequiredAlgorithms()
+	require.Equal(t, []string{"aes"}, ciphers)
+	require.Equal(t, []string{"xts"}, modes)
+}
@@ -0,0 +1,618 @@
+package luks
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// cloneDisk copies the disk image to a new temporary file
+func cloneDisk(t *testing.T, disk *os.File) *os.File {
+	clone, err := os.CreateTemp("", "luks.go.clone")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		clone.Close()
+		os.Remove(clone.Name())
+	})
+
+	_, err = io.Copy(clone, io.NewSectionReader(disk, 0, 1<<62))
+	require.NoError(t, err)
+	return clone
+}
+
+func TestSameMasterKey(t *testing.T) {
+	t.Parallel()
+
+	disk1, _ := createLuks2Fixture(t, "foobar")
+	disk2, _ := createLuks2Fixture(t, "foobar")
+	clone := cloneDisk(t, disk1)
+
+	d1, err := initV2Device(disk1.Name(), FileStorage{disk1})
+	require.NoError(t, err)
+	d2, err := initV2Device(disk2.Name(), FileStorage{disk2})
+	require.NoError(t, err)
+	dClone, err := initV2Device(clone.Name(), FileStorage{clone})
+	require.NoError(t, err)
+
+	same, err := SameMasterKey(d1, dClone, []byte("foobar"), []byte("foobar"))
+	require.NoError(t, err)
+	require.True(t, same)
+
+	same, err = SameMasterKey(d1, d2, []byte("foobar"), []byte("foobar"))
+	require.NoError(t, err)
+	require.False(t, same)
+
+	_, err = SameMasterKey(d1, d2, []byte("foobar"), []byte("wrongpassword"))
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+}
+
+func TestNormalizeTokenType(t *testing.T) {
+	require.Equal(t, ClevisTokenType, normalizeTokenType("clevis"))
+	require.Equal(t, ClevisTokenType, normalizeTokenType(" Clevis\n"))
+	require.Equal(t, SystemdTPM2TokenType, normalizeTokenType("SYSTEMD-TPM2 "))
+	require.Equal(t, "MyToken", normalizeTokenType("  MyToken  "))
+}
+
+func TestMasterKeyDigestParams(t *testing.T) {
+	check := func(d Device, volumeKey []byte) {
+		params, err := d.(Inspector).MasterKeyDigestParams()
+		require.NoError(t, err)
+		require.Equal(t, "pbkdf2", params.Type)
+		require.Equal(t, "sha256", params.Hash)
+		require.Equal(t, fixtureIterations, params.Iterations)
+		require.Len(t, params.Salt, 32)
+
+		// the digest can be verified offline with the returned parameters
+		digest := pbkdf2.Key(volumeKey, params.Salt, params.Iterations, sha256.Size, sha256.New)
+		require.Equal(t, digest[:len(params.Digest)], params.Digest)
+	}
+
+	disk1, key1 := createLuks1Fixture(t, "foobar")
+	d1, err := initV1Device(disk1.Name(), FileStorage{disk1})
+	require.NoError(t, err)
+	check(d1, key1)
+
+	disk2, key2 := createLuks2Fixture(t, "foobar")
+	d2, err := initV2Device(disk2.Name(), FileStorage{disk2})
+	require.NoError(t, err)
+	check(d2, key2)
+}
+
+func TestUnlockAndKillSlot(t *testing.T) {
+	t.Parallel()
+
+	check := func(path string, volumeKey []byte) {
+		dev, err := OpenWithOptions(path, OpenOptions{ReadWrite: true})
+		require.NoError(t, err)
+		defer dev.Close()
+		require.ElementsMatch(t, []int{0, 1}, dev.Slots())
+
+		_, err = dev.(Writer).UnlockAndKillSlot(1, []byte("wrongpassword"))
+		require.Equal(t, ErrPassphraseDoesNotMatch, err)
+		require.ElementsMatch(t, []int{0, 1}, dev.Slots())
+
+		key, err := dev.(Writer).UnlockAndKillSlot(1, []byte("recovery"))
+		require.NoError(t, err)
+		require.Equal(t, volumeKey, key)
+		require.Equal(t, []int{0}, dev.Slots())
+
+		// the last keyslot must survive
+		_, err = dev.(Writer).UnlockAndKillSlot(0, []byte("foobar"))
+		require.Error(t, err)
+
+		// the change is persistent and the recovery passphrase can't be used anymore
+		reopened, err := Open(path)
+		require.NoError(t, err)
+		defer reopened.Close()
+		require.Equal(t, []int{0}, reopened.Slots())
+		_, err = reopened.UnsealVolume(1, []byte("recovery"))
+		require.Error(t, err)
+		v, err := reopened.UnsealVolume(0, []byte("foobar"))
+		require.NoError(t, err)
+		require.Equal(t, volumeKey, v.key)
+	}
+
+	disk1, key1 := createLuks1Fixture(t, "foobar")
+	d1, err := initV1Device(disk1.Name(), FileStorage{disk1})
+	require.NoError(t, err)
+	addLuks1FixtureKeyslot(t, disk1, d1.hdr, 1, "recovery", key1)
+	require.NoError(t, d1.writeHeader())
+	check(disk1.Name(), key1)
+
+	disk2, key2 := createLuks2Fixture(t, "foobar")
+	d2, err := initV2Device(disk2.Name(), FileStorage{disk2})
+	require.NoError(t, err)
+	addLuks2FixtureKeyslot(t, d2, 1, "recovery", key2)
+	d2.meta.Tokens[0] = json.RawMessage(`{"type":"systemd-recovery","keyslots":["0","1"]}`)
+	require.NoError(t, d2.writeHeader())
+	check(disk2.Name(), key2)
+
+	dev, err := Open(disk2.Name())
+	require.NoError(t, err)
+	defer dev.Close()
+	tokens, err := dev.Tokens()
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	require.Equal(t, []int{0}, tokens[0].Slots)
+	require.Equal(t, SystemdRecoveryTokenType, tokens[0].Type)
+}
+
+func TestRemoveKeyslot(t *testing.T) {
+	t.Parallel()
+
+	check := func(disk *os.File, volumeKey []byte) {
+		ro, err := Open(disk.Name())
+		require.NoError(t, err)
+		defer ro.Close()
+		require.Error(t, ro.(Writer).RemoveKeyslot(1))
+
+		dev, err := OpenWithOptions(disk.Name(), OpenOptions{ReadWrite: true})
+		require.NoError(t, err)
+		defer dev.Close()
+		w := dev.(Writer)
+
+		layout, err := dev.(Inspector).KeyslotLayout()
+		require.NoError(t, err)
+		var area KeyslotArea
+		for _, a := range layout.Areas {
+			if a.Keyslot == 1 {
+				area = a
+			}
+		}
+		require.True(t, area.Active)
+		material := make([]byte, area.Size)
+		_, err = disk.ReadAt(material, int64(area.Offset))
+		require.NoError(t, err)
+
+		require.Error(t, w.RemoveKeyslot(5))
+		require.NoError(t, w.RemoveKeyslot(1))
+		require.Equal(t, []int{0}, dev.Slots())
+		require.Error(t, w.RemoveKeyslot(1))
+		require.Error(t, w.RemoveKeyslot(0), "the last keyslot must survive")
+
+		wiped := make([]byte, area.Size)
+		_, err = disk.ReadAt(wiped, int64(area.Offset))
+		require.NoError(t, err)
+		require.NotEqual(t, material, wiped)
+
+		reopened, err := Open(disk.Name())
+		require.NoError(t, err)
+		defer reopened.Close()
+		require.Equal(t, []int{0}, reopened.Slots())
+		v, err := reopened.UnsealVolume(0, []byte("foobar"))
+		require.NoError(t, err)
+		require.Equal(t, volumeKey, v.key)
+	}
+
+	disk1, key1 := createLuks1Fixture(t, "foobar")
+	d1, err := initV1Device(disk1.Name(), FileStorage{disk1})
+	require.NoError(t, err)
+	addLuks1FixtureKeyslot(t, disk1, d1.hdr, 1, "second", key1)
+	require.NoError(t, d1.writeHeader())
+	check(disk1, key1)
+
+	disk2, key2 := createLuks2Fixture(t, "foobar")
+	d2, err := initV2Device(disk2.Name(), FileStorage{disk2})
+	require.NoError(t, err)
+	addLuks2FixtureKeyslot(t, d2, 1, "second", key2)
+	d2.meta.Tokens[0] = json.RawMessage(`{"type":"systemd-tpm2","keyslots":["1"]}`)
+	require.NoError(t, d2.writeHeader())
+	check(disk2, key2)
+
+	// both header copies drop the keyslot from digests and tokens
+	for _, opts := range []OpenOptions{{}, {UseSecondaryHeader: true}} {
+		dev, err := OpenWithOptions(disk2.Name(), opts)
+		require.NoError(t, err)
+		d := dev.(*deviceV2)
+		require.Equal(t, numberList{"0"}, d.meta.Digests[0].Keyslots)
+		tokens, err := d.Tokens()
+		require.NoError(t, err)
+		require.Len(t, tokens, 1)
+		require.Empty(t, tokens[0].Slots)
+		require.NoError(t, dev.Close())
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	disk1, _ := createLuks1Fixture(t, "foobar")
+	disk2, _ := createLuks2Fixture(t, "foobar")
+
+	d1, err := Open(disk1.Name())
+	require.NoError(t, err)
+	defer d1.Close()
+	require.Equal(t, Capabilities{}, d1.Capabilities())
+
+	d2, err := Open(disk2.Name())
+	require.NoError(t, err)
+	defer d2.Close()
+	require.Equal(t, Capabilities{Tokens: true}, d2.Capabilities())
+
+	v2, err := initV2Device(disk2.Name(), FileStorage{disk2})
+	require.NoError(t, err)
+	seg := v2.meta.Segments[0]
+	seg.Integrity = &integrity{Type: "hmac(sha256)", JournalEncryption: "none", JournalIntegrity: "none"}
+	v2.meta.Segments[0] = seg
+	require.Equal(t, Capabilities{Tokens: true, Integrity: true, Writable: true}, v2.Capabilities())
+	v2.meta.Config.Requirements = []string{"online-reencrypt-v2"}
+	require.Equal(t, Capabilities{Tokens: true, Integrity: true, Reencryption: true, Writable: true}, v2.Capabilities())
+
+	d2rw, err := OpenWithOptions(disk2.Name(), OpenOptions{ReadWrite: true})
+	require.NoError(t, err)
+	defer d2rw.Close()
+	require.True(t, d2rw.Capabilities().Writable)
+}
+
+// TestReadOnlyDevice checks that inspecting and unsealing a device (e.g. a snapshot) never writes to it
+func TestReadOnlyDevice(t *testing.T) {
+	t.Parallel()
+
+	check := func(disk *os.File, volumeKey []byte) {
+		before, err := os.ReadFile(disk.Name())
+		require.NoError(t, err)
+
+		for _, opts := range []OpenOptions{{}, {UseSecondaryHeader: true}} {
+			if opts.UseSecondaryHeader && bytes.HasPrefix(before, []byte("LUKS\xba\xbe\x00\x01")) {
+				continue
+			}
+			// any write attempt fails and is counted
+			storage := &failingStorage{Storage: FileStorage{disk}, readOnly: true}
+			dev, err := OpenStorage(storage, disk.Name(), opts)
+			require.NoError(t, err)
+
+			require.False(t, dev.Capabilities().Writable)
+			require.NotEmpty(t, dev.Slots())
+			_, err = dev.Tokens()
+			require.NoError(t, err)
+			_, err = dev.(Inspector).MasterKeyDigestParams()
+			require.NoError(t, err)
+			dev.(Inspector).RequiredAlgorithms()
+			dev.(Inspector).AutoUnlockable()
+
+			v, err := dev.UnsealVolume(0, []byte("foobar"))
+			require.NoError(t, err)
+			require.Equal(t, volumeKey, v.key)
+
+			// metadata modifications are refused upfront
+			_, err = dev.(Writer).UnlockAndKillSlot(0, []byte("foobar"))
+			require.Error(t, err)
+
+			require.NoError(t, dev.Close())
+			require.Zero(t, storage.writes)
+		}
+
+		after, err := os.ReadFile(disk.Name())
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(before, after))
+	}
+
+	disk1, key1 := createLuks1Fixture(t, "foobar")
+	check(disk1, key1)
+	disk2, key2 := createLuks2Fixture(t, "foobar")
+	check(disk2, key2)
+}
+
+func TestCheckKdfStrength(t *testing.T) {
+	require.Empty(t, CheckKdfStrength(KdfParams{Type: "argon2id", Time: 4, Memory: 1048576, Threads: 4}))
+
+	warnings := CheckKdfStrength(KdfParams{Type: "argon2i", Time: 1, Memory: 65536, Threads: 1})
+	require.Len(t, warnings, 2)
+	require.Contains(t, warnings[0], "memory")
+	require.Contains(t, warnings[1], "time")
+
+	require.Len(t, CheckKdfStrength(KdfParams{Type: "pbkdf2", Hash: "sha256", Iterations: 1000000}), 1)
+	require.Len(t, CheckKdfStrength(KdfParams{Type: "pbkdf2", Hash: "sha1", Iterations: 1000}), 3)
+	require.Len(t, CheckKdfStrength(KdfParams{Type: "scrypt"}), 1)
+}
+
+func TestMetadataOnly(t *testing.T) {
+	disk1, _ := createLuks1Fixture(t, "foobar")
+	disk2, _ := createLuks2Fixture(t, "foobar")
+
+	for _, disk := range []*os.File{disk1, disk2} {
+		dev, err := OpenWithOptions(disk.Name(), OpenOptions{MetadataOnly: true})
+		require.NoError(t, err)
+
+		require.NotEmpty(t, dev.UUID())
+		require.Equal(t, []int{0}, dev.Slots())
+		_, err = dev.Tokens()
+		require.NoError(t, err)
+		_, err = dev.(Inspector).KeyslotLayout()
+		require.NoError(t, err)
+		_, err = dev.(Inspector).Snapshot()
+		require.NoError(t, err)
+
+		_, err = dev.UnsealVolume(0, []byte("foobar"))
+		require.Equal(t, ErrMetadataOnly, err)
+		require.Equal(t, ErrMetadataOnly, dev.UnlockAny([]byte("foobar"), "luks-go-test-metadata-only"))
+		require.NoError(t, dev.Close())
+	}
+}
+
+func TestVolumeKeyExport(t *testing.T) {
+	disk1, volumeKey1 := createLuks1Fixture(t, "foobar")
+	disk2, volumeKey2 := createLuks2Fixture(t, "foobar")
+
+	for disk, volumeKey := range map[*os.File][]byte{disk1: volumeKey1, disk2: volumeKey2} {
+		dev, err := Open(disk.Name())
+		require.NoError(t, err)
+		_, err = dev.(Unlocker).VolumeKey(0, []byte("foobar"))
+		require.Equal(t, ErrVolumeKeyExportDisabled, err)
+		require.NoError(t, dev.Close())
+
+		dev, err = OpenWithOptions(disk.Name(), OpenOptions{AllowVolumeKeyExport: true})
+		require.NoError(t, err)
+		_, err = dev.(Unlocker).VolumeKey(0, []byte("wrongpassword"))
+		require.Equal(t, ErrPassphraseIncorrect, err)
+		key, err := dev.(Unlocker).VolumeKey(0, []byte("foobar"))
+		require.NoError(t, err)
+		require.Equal(t, volumeKey, key.Bytes())
+		key.Wipe()
+		require.Nil(t, key.Bytes())
+		require.NoError(t, dev.Close())
+	}
+}
+
+func TestOpenDetectsVersion(t *testing.T) {
+	disk1, _ := createLuks1Fixture(t, "foobar")
+	disk2, _ := createLuks2Fixture(t, "foobar")
+
+	for version, disk := range map[int]*os.File{1: disk1, 2: disk2} {
+		f, err := os.Open(disk.Name())
+		require.NoError(t, err)
+		d, err := OpenFile(f)
+		require.NoError(t, err)
+		require.Equal(t, version, d.Version())
+		require.NoError(t, d.Close())
+	}
+
+	notLuks, err := os.CreateTemp("", "luks.go.notluks")
+	require.NoError(t, err)
+	defer os.Remove(notLuks.Name())
+	defer notLuks.Close()
+
+	// an empty file and a zero-filled file
+	_, err = Open(notLuks.Name())
+	require.ErrorIs(t, err, ErrNotLuksDevice)
+	require.NoError(t, notLuks.Truncate(1024*1024))
+	_, err = OpenFile(notLuks)
+	require.ErrorIs(t, err, ErrNotLuksDevice)
+}
+
+func TestOpenWithHeader(t *testing.T) {
+	t.Parallel()
+
+	data, err := os.CreateTemp("", "luks.go.data")
+	require.NoError(t, err)
+	defer os.Remove(data.Name())
+	defer data.Close()
+	require.NoError(t, data.Truncate(3*1024*1024))
+
+	check := func(header *os.File, volumeKey []byte) {
+		dev, err := OpenWithHeader(header.Name(), data.Name())
+		require.NoError(t, err)
+		defer dev.Close()
+
+		v, err := dev.UnsealVolume(0, []byte("foobar"))
+		require.NoError(t, err)
+		require.Equal(t, volumeKey, v.key)
+		require.Equal(t, data.Name(), v.BackingDevice)
+		require.Equal(t, uint64(0), v.StorageOffset)
+		require.Equal(t, uint64(3*1024*1024), v.StorageSize)
+	}
+
+	// `cryptsetup luksFormat --header` places the payload at the beginning of the data device
+	disk1, key1 := createLuks1Fixture(t, "foobar")
+	d1, err := initV1Device(disk1.Name(), FileStorage{disk1})
+	require.NoError(t, err)
+	d1.hdr.PayloadOffset = 0
+	require.NoError(t, d1.writeHeader())
+	check(disk1, key1)
+
+	disk2, key2 := createLuks2Fixture(t, "foobar")
+	d2, err := initV2Device(disk2.Name(), FileStorage{disk2})
+	require.NoError(t, err)
+	seg := d2.meta.Segments[0]
+	seg.Offset = "0"
+	d2.meta.Segments[0] = seg
+	require.NoError(t, d2.writeHeader())
+	check(disk2, key2)
+
+	_, err = OpenWithHeader(disk2.Name(), "/nonexistent")
+	require.Error(t, err)
+	_, err = OpenWithHeader(data.Name(), disk2.Name())
+	require.ErrorIs(t, err, ErrNotLuksDevice)
+}
+
+func TestParseHeader(t *testing.T) {
+	t.Parallel()
+
+	check := func(disk *os.File) {
+		// a dump of the first (up to) 4MiB of the disk, it includes the keyslot area of the fixtures
+		dump, err := io.ReadAll(io.NewSectionReader(disk, 0, 4*1024*1024))
+		require.NoError(t, err)
+
+		dev, err := Open(disk.Name())
+		require.NoError(t, err)
+		defer dev.Close()
+
+		parsed, err := ReadHeaderFrom(bytes.NewReader(dump))
+		require.NoError(t, err)
+		require.Equal(t, dev.Version(), parsed.Version())
+		require.Equal(t, dev.UUID(), parsed.UUID())
+		require.Equal(t, dev.Slots(), parsed.Slots())
+		require.False(t, parsed.Capabilities().Writable)
+
+		digest, err := dev.(Inspector).MasterKeyDigestParams()
+		require.NoError(t, err)
+		parsedDigest, err := parsed.(Inspector).MasterKeyDigestParams()
+		require.NoError(t, err)
+		require.Equal(t, digest, parsedDigest)
+		tokens, err := dev.Tokens()
+		require.NoError(t, err)
+		parsedTokens, err := parsed.Tokens()
+		require.NoError(t, err)
+		require.Equal(t, tokens, parsedTokens)
+
+		_, err = parsed.(Writer).AddKeyslot([]byte("foobar"), []byte("second"), KdfParams{Type: "pbkdf2", Hash: "sha256", Iterations: fixtureIterations})
+		require.Error(t, err)
+	}
+
+	disk1, _ := createLuks1Fixture(t, "foobar")
+	check(disk1)
+	disk2, _ := createLuks2Fixture(t, "foobar")
+	check(disk2)
+
+	_, err := ParseHeader(nil)
+	require.ErrorIs(t, err, ErrNotLuksDevice)
+	_, err = ParseHeader(make([]byte, 4096))
+	require.ErrorIs(t, err, ErrNotLuksDevice)
+}
+
+func TestErrors(t *testing.T) {
+	disk1, _ := createLuks1Fixture(t, "foobar")
+	disk2, _ := createLuks2Fixture(t, "foobar")
+
+	for _, disk := range []*os.File{disk1, disk2} {
+		dev, err := Open(disk.Name())
+		require.NoError(t, err)
+		_, err = dev.UnsealVolume(0, []byte("wrong"))
+		require.ErrorIs(t, err, ErrPassphraseIncorrect)
+		require.ErrorIs(t, err, ErrPassphraseDoesNotMatch)
+		_, err = dev.UnsealVolume(3, []byte("foobar"))
+		require.ErrorIs(t, err, ErrKeyslotInactive)
+		require.NoError(t, dev.Close())
+	}
+
+	// version 3 does not exist
+	_, err := disk2.WriteAt([]byte{0, 3}, 6)
+	require.NoError(t, err)
+	_, err = Open(disk2.Name())
+	require.ErrorIs(t, err, ErrUnsupportedVersion)
+	_, err = disk2.WriteAt([]byte{0, 2}, 6)
+	require.NoError(t, err)
+
+	// damaged JSON area does not match the header checksum
+	_, err = disk2.WriteAt([]byte("garbage"), 4096)
+	require.NoError(t, err)
+	_, err = Open(disk2.Name())
+	require.ErrorIs(t, err, ErrHeaderCorrupted)
+	require.NotErrorIs(t, err, ErrNotLuksDevice)
+}
+
+func TestUnsealVolumeContext(t *testing.T) {
+	disk1, key1 := createLuks1Fixture(t, "foobar")
+	disk2, key2 := createLuks2Fixture(t, "foobar")
+
+	for disk, volumeKey := range map[*os.File][]byte{disk1: key1, disk2: key2} {
+		dev, err := Open(disk.Name())
+		require.NoError(t, err)
+
+		v, err := dev.(Unlocker).UnsealVolumeContext(context.Background(), 0, []byte("foobar"))
+		require.NoError(t, err)
+		require.Equal(t, volumeKey, v.key)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = dev.(Unlocker).UnsealVolumeContext(ctx, 0, []byte("foobar"))
+		require.ErrorIs(t, err, context.Canceled)
+		require.ErrorIs(t, dev.(Unlocker).UnlockAnyContext(ctx, []byte("foobar"), "luks-go-test"), context.Canceled)
+		require.NoError(t, dev.Close())
+	}
+}
+
+func TestUnsealAny(t *testing.T) {
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	for i, password := range []string{"first", "second", "third"} {
+		addLuks2FixtureKeyslot(t, d, i+1, password, volumeKey)
+	}
+	require.NoError(t, d.writeHeader())
+
+	dev, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer dev.Close()
+
+	for _, opts := range []UnsealAnyOptions{{}, {Workers: 4}, {Workers: 4, MemoryBudget: 1}} {
+		keyslot, v, err := UnsealAny(context.Background(), dev, []byte("third"), opts)
+		require.NoError(t, err)
+		require.Equal(t, 3, keyslot)
+		require.Equal(t, volumeKey, v.key)
+
+		_, _, err = UnsealAny(context.Background(), dev, []byte("wrong"), opts)
+		require.ErrorIs(t, err, ErrPassphraseIncorrect)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, _, err = UnsealAny(ctx, dev, []byte("third"), opts)
+		require.ErrorIs(t, err, context.Canceled)
+	}
+}
+
+func TestDigests(t *testing.T) {
+	disk1, _ := createLuks1Fixture(t, "foobar")
+	d1, err := initV1Device(disk1.Name(), FileStorage{disk1})
+	require.NoError(t, err)
+	digests, err := d1.Digests()
+	require.NoError(t, err)
+	params, err := d1.MasterKeyDigestParams()
+	require.NoError(t, err)
+	require.Equal(t, []DigestInfo{{ID: 0, DigestParams: params, Keyslots: []int{0}, Segments: []int{0}}}, digests)
+
+	disk2, volumeKey := createLuks2Fixture(t, "foobar")
+	d2, err := initV2Device(disk2.Name(), FileStorage{disk2})
+	require.NoError(t, err)
+	addLuks2FixtureKeyslot(t, d2, 1, "barfoo", volumeKey)
+	d2.meta.Digests[1] = digest{Type: "pbkdf2", Keyslots: numberList{}, Segments: numberList{}, Hash: "sha256", Iterations: 1000, Salt: "AAAA", Digest: "AAAA"}
+	digests, err = d2.Digests()
+	require.NoError(t, err)
+	params, err = d2.MasterKeyDigestParams()
+	require.NoError(t, err)
+	require.Equal(t, []DigestInfo{
+		{ID: 0, DigestParams: params, Keyslots: []int{0, 1}, Segments: []int{0}},
+		{ID: 1, DigestParams: DigestParams{Type: "pbkdf2", Hash: "sha256", Iterations: 1000, Salt: []byte{0, 0, 0}, Digest: []byte{0, 0, 0}}, Keyslots: []int{}, Segments: []int{}},
+	}, digests)
+
+	d2.meta.Digests[1] = digest{Type: "pbkdf2", Keyslots: numberList{"x"}}
+	_, err = d2.Digests()
+	require.Error(t, err)
+}
+
+func TestSetUUID(t *testing.T) {
+	disk1, key1 := createLuks1Fixture(t, "foobar")
+	disk2, key2 := createLuks2Fixture(t, "foobar")
+
+	for disk, volumeKey := range map[*os.File][]byte{disk1: key1, disk2: key2} {
+		dev, err := OpenWithOptions(disk.Name(), OpenOptions{ReadWrite: true})
+		require.NoError(t, err)
+		oldUUID := dev.UUID()
+
+		require.Error(t, dev.(Writer).SetUUID("not-a-uuid"))
+		require.Error(t, dev.(Writer).SetUUID("3f0c7a4e-2b1d-4c6e-9a8f-1e2d3c4b5a6z"))
+		require.Equal(t, oldUUID, dev.UUID())
+
+		require.NoError(t, dev.(Writer).SetUUID("3f0c7a4e-2b1d-4c6e-9a8f-1e2d3c4b5a69"))
+		require.Equal(t, "3f0c7a4e-2b1d-4c6e-9a8f-1e2d3c4b5a69", dev.UUID())
+		require.NoError(t, dev.Close())
+
+		dev, err = OpenWithOptions(disk.Name(), OpenOptions{ReadWrite: true})
+		require.NoError(t, err)
+		require.Equal(t, "3f0c7a4e-2b1d-4c6e-9a8f-1e2d3c4b5a69", dev.UUID())
+		v, err := dev.UnsealVolume(0, []byte("foobar"))
+		require.NoError(t, err)
+		require.Equal(t, volumeKey, v.key)
+		require.Equal(t, "3f0c7a4e-2b1d-4c6e-9a8f-1e2d3c4b5a69", v.UUID)
+
+		require.NoError(t, dev.(Writer).SetUUID(""))
+		require.True(t, isValidUUID(dev.UUID()))
+		require.NotEqual(t, "3f0c7a4e-2b1d-4c6e-9a8f-1e2d3c4b5a69", dev.UUID())
+		require.NoError(t, dev.Close())
+	}
+}
@@ -0,0 +1,218 @@
+package luks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrNoPassphrase is returned by a PassphraseProvider that has no (more) passphrases to offer, e.g. a static
+// passphrase that has already been tried
+var ErrNoPassphrase = fmt.Errorf("No passphrase available")
+
+// PassphraseRequest describes the passphrase a PassphraseProvider is asked for
+type PassphraseRequest struct {
+	// Prompt is the human-readable message e.g. "Please enter passphrase for disk root:"
+	Prompt string
+	// Attempt is the 1-based number of the attempt. Providers that can't offer a different passphrase return
+	// ErrNoPassphrase for attempts after the first one.
+	Attempt int
+	// UUID of the device being unlocked
+	UUID string
+}
+
+// PassphraseProvider obtains passphrases for unlocking e.g. from the user or from the environment
+type PassphraseProvider interface {
+	Passphrase(ctx context.Context, req PassphraseRequest) ([]byte, error)
+}
+
+// PassphraseProviderFunc is an adapter to use ordinary functions as PassphraseProvider
+type PassphraseProviderFunc func(ctx context.Context, req PassphraseRequest) ([]byte, error)
+
+// Passphrase calls f(ctx, req)
+func (f PassphraseProviderFunc) Passphrase(ctx context.Context, req PassphraseRequest) ([]byte, error) {
+	return f(ctx, req)
+}
+
+// StaticPassphrase provides the passphrase once
+type StaticPassphrase []byte
+
+// Passphrase returns a copy of the static passphrase on the first attempt
+func (p StaticPassphrase) Passphrase(_ context.Context, req PassphraseRequest) ([]byte, error) {
+	if req.Attempt > 1 {
+		return nil, ErrNoPassphrase
+	}
+	return secureCopy(p), nil
+}
+
+// EnvPassphrase provides the passphrase from the environment variable with the given name once
+type EnvPassphrase string
+
+// Passphrase returns the value of the environment variable on the first attempt
+func (p EnvPassphrase) Passphrase(_ context.Context, req PassphraseRequest) ([]byte, error) {
+	value, ok := os.LookupEnv(string(p))
+	if !ok || req.Attempt > 1 {
+		return nil, ErrNoPassphrase
+	}
+	return secureCopy([]byte(value)), nil
+}
+
+// FDPassphrase reads the passphrase from the file descriptor (e.g. a pipe from a parent process) till EOF once.
+// A single trailing newline is stripped as the passphrase is usually written with `echo`. The descriptor is closed
+// after reading.
+type FDPassphrase uintptr
+
+// Passphrase reads the passphrase from the file descriptor on the first attempt
+func (p FDPassphrase) Passphrase(_ context.Context, req PassphraseRequest) ([]byte, error) {
+	if req.Attempt > 1 {
+		return nil, ErrNoPassphrase
+	}
+	f := os.NewFile(uintptr(p), "passphrase")
+	if f == nil {
+		return nil, fmt.Errorf("invalid passphrase file descriptor %d", p)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, DefaultKeyfileSizeMax))
+	if err != nil {
+		clearSlice(data)
+		return nil, err
+	}
+	return secureMove(bytes.TrimSuffix(data, []byte("\n"))), nil
+}
+
+// TerminalPassphrase prompts for the passphrase at the controlling terminal (/dev/tty) with echo disabled.
+// Every attempt asks again.
+type TerminalPassphrase struct{}
+
+// Passphrase reads a line from the terminal. Cancelling ctx does not interrupt the pending read.
+func (TerminalPassphrase) Passphrase(ctx context.Context, req PassphraseRequest) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer tty.Close()
+
+	fd := int(tty.Fd())
+	orig, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get terminal attributes: %v", err)
+	}
+	noEcho := *orig
+	noEcho.Lflag &^= unix.ECHO
+	noEcho.Lflag |= unix.ICANON | unix.ISIG
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &noEcho); err != nil {
+		return nil, fmt.Errorf("unable to disable terminal echo: %v", err)
+	}
+	defer unix.IoctlSetTermios(fd, unix.TCSETS, orig)
+
+	prompt := req.Prompt
+	if prompt == "" {
+		prompt = "Enter passphrase:"
+	}
+	if _, err := fmt.Fprintf(tty, "%s ", prompt); err != nil {
+		return nil, err
+	}
+	defer fmt.Fprintln(tty) // the newline typed by the user is not echoed
+
+	line, err := readLine(tty)
+	if err != nil {
+		return nil, err
+	}
+	return secureMove(line), nil
+}
+
+// readLine reads bytes till a newline without buffering beyond it
+func readLine(r io.Reader) ([]byte, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				return line, nil
+			}
+			line = append(line, b[0])
+		}
+		if errors.Is(err, io.EOF) && len(line) > 0 {
+			return line, nil
+		}
+		if err != nil {
+			clearSlice(line)
+			return nil, err
+		}
+	}
+}
+
+// ProviderUnlockOptions controls UnlockWithProvider
+type ProviderUnlockOptions struct {
+	// Keyslot to unlock, nil tries all keyslots
+	Keyslot *int
+	// Tries is the maximum number of passphrases asked, 0 means 3 like cryptsetup uses
+	Tries int
+	// Prompt passed to the provider
+	Prompt string
+	// OnFailure is called after every failed attempt e.g. to show "wrong passphrase" to the user. Returning an error
+	// stops the retries, the error is returned by UnlockWithProvider.
+	OnFailure func(attempt int, err error) error
+}
+
+// UnlockWithProvider asks provider for passphrases and unlocks the device with them until it succeeds, the tries are
+// exhausted or the provider returns ErrNoPassphrase. Only incorrect passphrases are retried, other errors are
+// returned immediately. It replaces the prompt-and-retry loop consumers of the library would write otherwise.
+func UnlockWithProvider(ctx context.Context, d Device, provider PassphraseProvider, dmName string, opts ProviderUnlockOptions) error {
+	tries := opts.Tries
+	if tries == 0 {
+		tries = 3
+	}
+
+	lastErr := ErrNoPassphrase
+	for attempt := 1; attempt <= tries; attempt++ {
+		passphrase, err := provider.Passphrase(ctx, PassphraseRequest{Prompt: opts.Prompt, Attempt: attempt, UUID: d.UUID()})
+		if errors.Is(err, ErrNoPassphrase) {
+			return lastErr
+		}
+		if err != nil {
+			return err
+		}
+
+		err = unlockWithPassphrase(ctx, d, opts.Keyslot, passphrase, dmName)
+		clearSlice(passphrase)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, ErrPassphraseIncorrect) {
+			return err
+		}
+		lastErr = err
+		if opts.OnFailure != nil {
+			if err := opts.OnFailure(attempt, err); err != nil {
+				return err
+			}
+		}
+	}
+	return lastErr
+}
+
+// unlockWithPassphrase unlocks the given keyslot or any keyslot if it is nil. The attempt is cancellable if
+// the device implements Unlocker.
+func unlockWithPassphrase(ctx context.Context, d Device, keyslot *int, passphrase []byte, dmName string) error {
+	u, cancellable := d.(Unlocker)
+	switch {
+	case keyslot == nil && cancellable:
+		return u.UnlockAnyContext(ctx, passphrase, dmName)
+	case keyslot == nil:
+		return d.UnlockAny(passphrase, dmName)
+	case cancellable:
+		return u.UnlockContext(ctx, *keyslot, passphrase, dmName)
+	default:
+		return d.Unlock(*keyslot, passphrase, dmName)
+	}
+}
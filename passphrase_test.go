@@ -0,0 +1,113 @@
+package luks
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestPassphraseProviders(t *testing.T) {
+	ctx := context.Background()
+	first := PassphraseRequest{Attempt: 1}
+	second := PassphraseRequest{Attempt: 2}
+
+	p, err := StaticPassphrase("foo").Passphrase(ctx, first)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), p)
+	_, err = StaticPassphrase("foo").Passphrase(ctx, second)
+	require.ErrorIs(t, err, ErrNoPassphrase)
+
+	t.Setenv("LUKS_TEST_PASSPHRASE", "bar\n")
+	p, err = EnvPassphrase("LUKS_TEST_PASSPHRASE").Passphrase(ctx, first)
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar\n"), p)
+	_, err = EnvPassphrase("LUKS_TEST_UNSET").Passphrase(ctx, first)
+	require.ErrorIs(t, err, ErrNoPassphrase)
+
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	_, err = w.WriteString("baz\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	// FDPassphrase closes the descriptor, pass a duplicate so r does not close a reused descriptor number later
+	fd, err := unix.Dup(int(r.Fd()))
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	p, err = FDPassphrase(fd).Passphrase(ctx, first)
+	require.NoError(t, err)
+	require.Equal(t, []byte("baz"), p)
+}
+
+func TestReadLine(t *testing.T) {
+	r := strings.NewReader("first\nsecond")
+	line, err := readLine(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), line)
+	line, err = readLine(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte("second"), line)
+	_, err = readLine(r)
+	require.Error(t, err)
+}
+
+func TestUnlockWithProvider(t *testing.T) {
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+	dev, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer dev.Close()
+
+	var asked, failures []int
+	provider := PassphraseProviderFunc(func(_ context.Context, req PassphraseRequest) ([]byte, error) {
+		require.Equal(t, dev.UUID(), req.UUID)
+		require.Equal(t, "Passphrase:", req.Prompt)
+		asked = append(asked, req.Attempt)
+		return []byte("wrong"), nil
+	})
+	err = UnlockWithProvider(context.Background(), dev, provider, "test", ProviderUnlockOptions{
+		Prompt: "Passphrase:",
+		OnFailure: func(attempt int, err error) error {
+			require.ErrorIs(t, err, ErrPassphraseIncorrect)
+			failures = append(failures, attempt)
+			return nil
+		},
+	})
+	require.ErrorIs(t, err, ErrPassphraseIncorrect)
+	require.Equal(t, []int{1, 2, 3}, asked)
+	require.Equal(t, []int{1, 2, 3}, failures)
+
+	// a static passphrase is tried once
+	err = UnlockWithProvider(context.Background(), dev, StaticPassphrase("wrong"), "test", ProviderUnlockOptions{Tries: 5})
+	require.ErrorIs(t, err, ErrPassphraseIncorrect)
+
+	// the hook stops the retries
+	stop := errors.New("cancelled by user")
+	asked = nil
+	err = UnlockWithProvider(context.Background(), dev, provider, "test", ProviderUnlockOptions{
+		Prompt:    "Passphrase:",
+		OnFailure: func(int, error) error { return stop },
+	})
+	require.ErrorIs(t, err, stop)
+	require.Equal(t, []int{1}, asked)
+
+	// the zero options try all keyslots, the passphrase of keyslot #1 is not tried against keyslot #0 only
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	addLuks2FixtureKeyslot(t, d, 1, "second", volumeKey)
+	require.NoError(t, d.writeHeader())
+	dev2, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer dev2.Close()
+	keyslot := 0
+	err = UnlockWithProvider(context.Background(), dev2, StaticPassphrase("second"), "test", ProviderUnlockOptions{Keyslot: &keyslot})
+	require.ErrorIs(t, err, ErrPassphraseIncorrect)
+	err = UnlockWithProvider(context.Background(), dev2, StaticPassphrase("second"), "luks-go-test-provider", ProviderUnlockOptions{})
+	if err == nil {
+		require.NoError(t, Lock("luks-go-test-provider"))
+	}
+	require.NotErrorIs(t, err, ErrPassphraseIncorrect) // the keyslot is unsealed, only the mapping might fail
+}
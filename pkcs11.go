@@ -0,0 +1,55 @@
+package luks
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// SystemdPKCS11Token is a parsed `systemd-pkcs11` token as created by systemd-cryptenroll
+type SystemdPKCS11Token struct {
+	Keyslots []int
+	// URI is the RFC 7512 URI of the private key (or its certificate) at the PKCS#11 token
+	URI string
+	// Key is the keyslot secret encrypted with the RSA public key (PKCS#1 v1.5), or for EC keys the ephemeral public
+	// key (uncompressed point) the secret is derived from with ECDH
+	Key []byte
+}
+
+// ParseSystemdPKCS11Token parses LUKS2 `systemd-pkcs11` token payload
+func ParseSystemdPKCS11Token(payload []byte) (*SystemdPKCS11Token, error) {
+	var node struct {
+		Keyslots numberList `json:"keyslots"`
+		URI      string     `json:"pkcs11-uri"`
+		Key      string     `json:"pkcs11-key"`
+	}
+	if err := json.Unmarshal(payload, &node); err != nil {
+		return nil, fmt.Errorf("invalid systemd-pkcs11 token: %v", err)
+	}
+
+	var (
+		t   SystemdPKCS11Token
+		err error
+	)
+	if t.Keyslots, err = node.Keyslots.ints(); err != nil {
+		return nil, fmt.Errorf("invalid systemd-pkcs11 token keyslots: %v", err)
+	}
+	if !strings.HasPrefix(node.URI, "pkcs11:") {
+		return nil, fmt.Errorf("invalid systemd-pkcs11 token pkcs11-uri %q", node.URI)
+	}
+	t.URI = node.URI
+	if t.Key, err = base64.StdEncoding.DecodeString(node.Key); err != nil {
+		return nil, fmt.Errorf("invalid systemd-pkcs11 token pkcs11-key: %v", err)
+	}
+	if len(t.Key) == 0 {
+		return nil, fmt.Errorf("systemd-pkcs11 token has no pkcs11-key")
+	}
+	return &t, nil
+}
+
+func init() {
+	RegisterTokenType(SystemdPKCS11TokenType, func(payload []byte) (interface{}, error) {
+		return ParseSystemdPKCS11Token(payload)
+	})
+}
@@ -0,0 +1,21 @@
+package luks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSystemdPKCS11Token(t *testing.T) {
+	tok, err := ParseSystemdPKCS11Token([]byte(`{"type":"systemd-pkcs11","keyslots":["2"],
+		"pkcs11-uri":"pkcs11:token=YubiKey;id=%01","pkcs11-key":"a2V5"}`))
+	require.NoError(t, err)
+	require.Equal(t, &SystemdPKCS11Token{Keyslots: []int{2}, URI: "pkcs11:token=YubiKey;id=%01", Key: []byte("key")}, tok)
+
+	_, err = ParseSystemdPKCS11Token([]byte(`{"type":"systemd-pkcs11","pkcs11-uri":"file:///key","pkcs11-key":"a2V5"}`))
+	require.Error(t, err)
+	_, err = ParseSystemdPKCS11Token([]byte(`{"type":"systemd-pkcs11","pkcs11-uri":"pkcs11:id=%01"}`))
+	require.Error(t, err)
+	_, err = ParseSystemdPKCS11Token([]byte(`{"type":"systemd-pkcs11","pkcs11-uri":"pkcs11:id=%01","pkcs11-key":"!"}`))
+	require.Error(t, err)
+}
@@ -0,0 +1,88 @@
+package luks
+
+import (
+	"encoding/json"
+	"fmt"
+	"unicode"
+)
+
+// modhex alphabet used by systemd recovery keys, it has no ambiguous characters across keyboard layouts
+const modhexAlphabet = "cbdefghijklnrtuv"
+
+// systemd recovery keys are 32 bytes encoded as 64 modhex characters, formatted as 8 dash separated groups
+const (
+	recoveryKeyChars     = 64
+	recoveryKeyGroupSize = 8
+)
+
+// SystemdRecoveryToken is a parsed `systemd-recovery` token. The token carries no secrets, it only marks
+// the keyslots that are protected with a recovery key generated by systemd-cryptenroll.
+type SystemdRecoveryToken struct {
+	Keyslots []int
+}
+
+// ParseSystemdRecoveryToken parses LUKS2 `systemd-recovery` token payload
+func ParseSystemdRecoveryToken(payload []byte) (*SystemdRecoveryToken, error) {
+	var node struct {
+		Keyslots numberList `json:"keyslots"`
+	}
+	if err := json.Unmarshal(payload, &node); err != nil {
+		return nil, fmt.Errorf("invalid systemd-recovery token: %v", err)
+	}
+	keyslots, err := node.Keyslots.ints()
+	if err != nil {
+		return nil, fmt.Errorf("invalid systemd-recovery token keyslots: %v", err)
+	}
+	return &SystemdRecoveryToken{Keyslots: keyslots}, nil
+}
+
+// NormalizeRecoveryKey converts a human-typed systemd recovery key into the canonical form used as the keyslot
+// passphrase. Whitespaces and dashes are ignored and the characters are matched case-insensitively, e.g.
+// "CBDE FGHI ..." becomes "cbdefghi-...". An error is returned if the input is not a well-formed recovery key.
+func NormalizeRecoveryKey(key []byte) ([]byte, error) {
+	chars := make([]byte, 0, recoveryKeyChars)
+	for _, c := range key {
+		if c == '-' || unicode.IsSpace(rune(c)) {
+			continue
+		}
+		c = byte(unicode.ToLower(rune(c)))
+		if !isModhex(c) {
+			clearSlice(chars)
+			return nil, fmt.Errorf("recovery key contains invalid character %q", c)
+		}
+		if len(chars) == recoveryKeyChars {
+			clearSlice(chars)
+			return nil, fmt.Errorf("recovery key is too long")
+		}
+		chars = append(chars, c)
+	}
+	if len(chars) != recoveryKeyChars {
+		clearSlice(chars)
+		return nil, fmt.Errorf("recovery key is too short")
+	}
+
+	normalized := make([]byte, 0, recoveryKeyChars+recoveryKeyChars/recoveryKeyGroupSize-1)
+	for i := 0; i < recoveryKeyChars; i += recoveryKeyGroupSize {
+		if i != 0 {
+			normalized = append(normalized, '-')
+		}
+		normalized = append(normalized, chars[i:i+recoveryKeyGroupSize]...)
+	}
+	clearSlice(chars)
+	return normalized, nil
+}
+
+func isModhex(c byte) bool {
+	for i := 0; i < len(modhexAlphabet); i++ {
+		if modhexAlphabet[i] == c {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	RegisterTokenType(SystemdRecoveryTokenType, func(payload []byte) (interface{}, error) {
+		return ParseSystemdRecoveryToken(payload)
+	})
+}
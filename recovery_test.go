@@ -0,0 +1,70 @@
+package luks
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testRecoveryKey = "cbdefghi-jklnrtuv-cbdefghi-jklnrtuv-vutrnlkj-ihgfedcb-vutrnlkj-ihgfedcb"
+
+func TestNormalizeRecoveryKey(t *testing.T) {
+	for _, input := range []string{
+		testRecoveryKey,
+		strings.ToUpper(testRecoveryKey),
+		strings.ReplaceAll(testRecoveryKey, "-", ""),
+		" " + strings.ReplaceAll(testRecoveryKey, "-", " ") + "\n",
+		"cbdefghijklnrtuv-cbdefghijklnrtuv-vutrnlkjihgfedcb-vutrnlkjihgfedcb",
+	} {
+		key, err := NormalizeRecoveryKey([]byte(input))
+		require.NoError(t, err, input)
+		require.Equal(t, testRecoveryKey, string(key))
+	}
+
+	for _, input := range []string{
+		"",
+		testRecoveryKey[:70],
+		testRecoveryKey + "c",
+		strings.Replace(testRecoveryKey, "c", "a", 1), // 'a' is not a modhex character
+	} {
+		_, err := NormalizeRecoveryKey([]byte(input))
+		require.Error(t, err, input)
+	}
+}
+
+func TestParseSystemdRecoveryToken(t *testing.T) {
+	tok, err := ParseSystemdRecoveryToken([]byte(`{"type":"systemd-recovery","keyslots":["1","3"]}`))
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 3}, tok.Keyslots)
+
+	_, err = ParseSystemdRecoveryToken([]byte(`{"type":"systemd-recovery","keyslots":["x"]}`))
+	require.Error(t, err)
+}
+
+func TestUnsealAnyRecoveryKey(t *testing.T) {
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	addLuks2FixtureKeyslot(t, d, 1, testRecoveryKey, volumeKey)
+	require.NoError(t, d.writeHeader())
+
+	dev, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer dev.Close()
+
+	typed := []byte(strings.ToUpper(strings.ReplaceAll(testRecoveryKey, "-", " ")))
+	_, _, err = UnsealAny(context.Background(), dev, typed, UnsealAnyOptions{})
+	require.ErrorIs(t, err, ErrPassphraseIncorrect)
+
+	keyslot, v, err := UnsealAny(context.Background(), dev, typed, UnsealAnyOptions{RecoveryKey: true})
+	require.NoError(t, err)
+	require.Equal(t, 1, keyslot)
+	require.Equal(t, volumeKey, v.key)
+
+	// regular passphrases are not affected
+	keyslot, _, err = UnsealAny(context.Background(), dev, []byte("foobar"), UnsealAnyOptions{RecoveryKey: true})
+	require.NoError(t, err)
+	require.Equal(t, 0, keyslot)
+}
@@ -0,0 +1,150 @@
+package luks
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ScanResult describes a LUKS device found by Scan
+type ScanResult struct {
+	Path    string
+	Version int
+	UUID    string
+	// Label is the LUKS2 label, LUKS v1 has no label
+	Label string
+	// Err is set if the device can't be probed e.g. permission is denied or the LUKS header is corrupted
+	Err error
+}
+
+// sysfs, devtmpfs and udev locations used by Scan and Find*
+var (
+	sysBlockDir = "/sys/block"
+	devDir      = "/dev"
+	diskDir     = "/dev/disk"
+)
+
+// Scan probes block devices for a LUKS superblock. If no paths are given then all block devices and partitions
+// listed at /sys/block are probed, devices without media (zero size) are skipped. Only the metadata is read,
+// devices that do not contain LUKS are not reported. It is the equivalent of `blkid -t TYPE=crypto_LUKS`.
+func Scan(paths ...string) ([]ScanResult, error) {
+	if len(paths) == 0 {
+		var err error
+		if paths, err = blockDevices(); err != nil {
+			return nil, err
+		}
+	}
+
+	var results []ScanResult
+	for _, p := range paths {
+		dev, err := openPath(p, OpenOptions{MetadataOnly: true})
+		if errors.Is(err, ErrNotLuksDevice) {
+			continue
+		}
+		if err != nil {
+			results = append(results, ScanResult{Path: p, Err: err})
+			continue
+		}
+		results = append(results, ScanResult{Path: p, Version: dev.Version(), UUID: dev.UUID(), Label: dev.Label()})
+		dev.Close()
+	}
+	return results, nil
+}
+
+// blockDevices returns device paths of the block devices and their partitions with non-zero size
+func blockDevices() ([]string, error) {
+	disks, err := os.ReadDir(sysBlockDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, d := range disks {
+		names = append(names, d.Name())
+		// partitions are subdirectories that have a "partition" attribute
+		parts, err := os.ReadDir(filepath.Join(sysBlockDir, d.Name()))
+		if err != nil {
+			continue
+		}
+		for _, p := range parts {
+			if _, err := os.Stat(filepath.Join(sysBlockDir, d.Name(), p.Name(), "partition")); err == nil {
+				names = append(names, d.Name()+"/"+p.Name())
+			}
+		}
+	}
+	sort.Strings(names)
+
+	var paths []string
+	for _, n := range names {
+		size, err := os.ReadFile(filepath.Join(sysBlockDir, n, "size"))
+		if err != nil || strings.TrimSpace(string(size)) == "0" {
+			continue
+		}
+		paths = append(paths, filepath.Join(devDir, filepath.Base(n)))
+	}
+	return paths, nil
+}
+
+// ErrDeviceNotFound is returned by FindByUUID and FindByLabel if no device matches
+var ErrDeviceNotFound = fmt.Errorf("LUKS device not found")
+
+// FindByUUID returns the path of the block device with the given LUKS UUID. The udev /dev/disk/by-uuid symlink is
+// used as a fast path, otherwise all block devices are scanned (see Scan). The header is always read to confirm
+// the match, blkid is not needed.
+func FindByUUID(uuid string) (string, error) {
+	uuid = strings.ToLower(uuid)
+	return findDevice(filepath.Join(diskDir, "by-uuid", uuid), func(r ScanResult) bool {
+		return strings.ToLower(r.UUID) == uuid
+	}, "UUID="+uuid)
+}
+
+// FindByLabel returns the path of the block device with the given LUKS2 label, see FindByUUID.
+// LUKS v1 devices have no label.
+func FindByLabel(label string) (string, error) {
+	if label == "" {
+		return "", fmt.Errorf("empty label")
+	}
+	return findDevice(filepath.Join(diskDir, "by-label", udevEncode(label)), func(r ScanResult) bool {
+		return r.Label == label
+	}, "LABEL="+label)
+}
+
+func findDevice(link string, match func(ScanResult) bool, what string) (string, error) {
+	if path, err := filepath.EvalSymlinks(link); err == nil {
+		if results, _ := Scan(path); len(results) == 1 && results[0].Err == nil && match(results[0]) {
+			return path, nil
+		}
+	}
+
+	results, err := Scan()
+	if err != nil {
+		return "", err
+	}
+	for _, r := range results {
+		if r.Err == nil && match(r) {
+			return r.Path, nil
+		}
+	}
+	return "", fmt.Errorf("%s: %w", what, ErrDeviceNotFound)
+}
+
+// udevEncode escapes the string the way udev names /dev/disk/by-label symlinks: characters other than
+// alphanumerics, "#+-.:=@_" and non-ASCII UTF-8 are written as \xNN
+func udevEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 0x80,
+			c >= '0' && c <= '9', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z',
+			strings.IndexByte("#+-.:=@_", c) != -1:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,114 @@
+package luks
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScan(t *testing.T) {
+	luks1, _ := createLuks1Fixture(t, "foo")
+	luks2, _ := createLuks2Fixture(t, "bar")
+
+	sys := t.TempDir()
+	dev := t.TempDir()
+	defer func(sysOrig, devOrig string) { sysBlockDir, devDir = sysOrig, devOrig }(sysBlockDir, devDir)
+	sysBlockDir, devDir = sys, dev
+
+	writeAttr := func(path, value string) {
+		require.NoError(t, os.MkdirAll(filepath.Join(sys, filepath.Dir(path)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(sys, path), []byte(value), 0o644))
+	}
+	writeAttr("loop0/size", "0\n")
+	writeAttr("sda/size", "2048\n")
+	writeAttr("sda/sda1/size", "1024\n")
+	writeAttr("sda/sda1/partition", "1\n")
+	writeAttr("sda/sda2/size", "1024\n")
+	writeAttr("sda/sda2/partition", "2\n")
+	writeAttr("sda/queue/rotational", "0\n")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dev, "sda"), make([]byte, 8192), 0o644))
+	require.NoError(t, os.Symlink(luks1.Name(), filepath.Join(dev, "sda1")))
+	require.NoError(t, os.Symlink(luks2.Name(), filepath.Join(dev, "sda2")))
+
+	d1, err := Open(luks1.Name())
+	require.NoError(t, err)
+	defer d1.Close()
+	d2, err := Open(luks2.Name())
+	require.NoError(t, err)
+	defer d2.Close()
+
+	results, err := Scan()
+	require.NoError(t, err)
+	require.Equal(t, []ScanResult{
+		{Path: filepath.Join(dev, "sda1"), Version: 1, UUID: d1.UUID()},
+		{Path: filepath.Join(dev, "sda2"), Version: 2, UUID: d2.UUID(), Label: d2.(Inspector).Label()},
+	}, results)
+
+	// an explicit list, missing devices are reported
+	results, err = Scan(luks2.Name(), filepath.Join(dev, "missing"))
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.Equal(t, 2, results[0].Version)
+	require.Error(t, results[1].Err)
+}
+
+func TestFindDevice(t *testing.T) {
+	luks1, _ := createLuks1Fixture(t, "foo")
+	luks2, _ := createLuks2Fixture(t, "bar")
+
+	d2, err := OpenWithOptions(luks2.Name(), OpenOptions{ReadWrite: true})
+	require.NoError(t, err)
+	require.NoError(t, d2.(Writer).SetLabel("my root"))
+	uuid2 := d2.UUID()
+	d2.Close()
+	d1, err := Open(luks1.Name())
+	require.NoError(t, err)
+	uuid1 := d1.UUID()
+	d1.Close()
+
+	sys, dev, disk := t.TempDir(), t.TempDir(), t.TempDir()
+	defer func(sysOrig, devOrig, diskOrig string) {
+		sysBlockDir, devDir, diskDir = sysOrig, devOrig, diskOrig
+	}(sysBlockDir, devDir, diskDir)
+	sysBlockDir, devDir, diskDir = sys, dev, disk
+
+	// sda1 is found by scanning only, sda2 has udev symlinks
+	for _, name := range []string{"sda1", "sda2"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(sys, name), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(sys, name, "size"), []byte("1024\n"), 0o644))
+	}
+	require.NoError(t, os.Symlink(luks1.Name(), filepath.Join(dev, "sda1")))
+	require.NoError(t, os.Symlink(luks2.Name(), filepath.Join(dev, "sda2")))
+	require.NoError(t, os.MkdirAll(filepath.Join(disk, "by-uuid"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(disk, "by-label"), 0o755))
+	require.NoError(t, os.Symlink(luks2.Name(), filepath.Join(disk, "by-uuid", uuid2)))
+	require.NoError(t, os.Symlink(luks2.Name(), filepath.Join(disk, "by-label", `my\x20root`)))
+	// a stale symlink pointing to another device is ignored
+	require.NoError(t, os.Symlink(luks2.Name(), filepath.Join(disk, "by-uuid", uuid1)))
+
+	path, err := FindByUUID(uuid2)
+	require.NoError(t, err)
+	require.Equal(t, luks2.Name(), path)
+
+	path, err = FindByLabel("my root")
+	require.NoError(t, err)
+	require.Equal(t, luks2.Name(), path)
+
+	path, err = FindByUUID(uuid1)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dev, "sda1"), path)
+
+	_, err = FindByUUID("00000000-0000-0000-0000-000000000000")
+	require.ErrorIs(t, err, ErrDeviceNotFound)
+	_, err = FindByLabel("missing")
+	require.ErrorIs(t, err, ErrDeviceNotFound)
+}
+
+func TestUdevEncode(t *testing.T) {
+	require.Equal(t, `my\x20root`, udevEncode("my root"))
+	require.Equal(t, `a\x2fb#c_d`, udevEncode("a/b#c_d"))
+	require.Equal(t, "données", udevEncode("données"))
+}
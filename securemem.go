@@ -0,0 +1,153 @@
+package luks
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Secure memory keeps secrets handled by the library (passphrase copies, derived keys and volume keys) in mlock()ed
+// pages that are excluded from core dumps (MADV_DONTDUMP). Small secrets share pages, they are carved into slots
+// of power-of-two size classes. A slot is zeroed and returned to its free list by clearSlice, the library calls it
+// at the end of life of every secret. Pages are never returned to the OS as stale slices of released slots must
+// not point to unmapped memory.
+var secureMem struct {
+	sync.Mutex
+	enabled bool
+	free    map[int][][]byte   // size class -> free slots
+	inUse   map[uintptr][]byte // start address -> the slot with its full capacity
+}
+
+const (
+	secureMinClass = 32
+	secureMaxClass = 4096 // bigger secrets (e.g. long keyfile passphrases) stay in regular memory
+)
+
+// SetSecureMemory enables or disables the secure memory mode. It is off by default. In this mode passphrase copies,
+// derived keys and volume keys allocated by the library are stored in locked pages that are never swapped out and
+// are excluded from core dumps, they are zeroed on release. It is useful for long-running daemons.
+//
+// Locked memory is limited by RLIMIT_MEMLOCK, an error is returned if it can't be locked at all. Buffers owned by
+// the caller (e.g. the passphrase passed to Unlock) are not affected.
+func SetSecureMemory(enabled bool) error {
+	secureMem.Lock()
+	defer secureMem.Unlock()
+	if enabled && !secureMem.enabled {
+		// check that locking works before any secret depends on it
+		if err := secureGrow(secureMinClass); err != nil {
+			return err
+		}
+	}
+	secureMem.enabled = enabled
+	return nil
+}
+
+// secureCopy returns a copy of secret, in secure memory if the mode is enabled. The source is not modified.
+func secureCopy(secret []byte) []byte {
+	b := secureAlloc(len(secret))
+	if b == nil {
+		return append([]byte(nil), secret...)
+	}
+	copy(b, secret)
+	return b
+}
+
+// secureMove is similar to secureCopy but also wipes the source
+func secureMove(secret []byte) []byte {
+	b := secureAlloc(len(secret))
+	if b == nil {
+		return secret
+	}
+	copy(b, secret)
+	clearSlice(secret)
+	return b
+}
+
+// secureAlloc returns a zeroed slot of at least size bytes or nil if the secure memory mode is disabled
+// or the size is not supported
+func secureAlloc(size int) []byte {
+	if size == 0 || size > secureMaxClass {
+		return nil
+	}
+	class := secureMinClass
+	for class < size {
+		class *= 2
+	}
+
+	secureMem.Lock()
+	defer secureMem.Unlock()
+	if !secureMem.enabled {
+		return nil
+	}
+	if len(secureMem.free[class]) == 0 {
+		if err := secureGrow(class); err != nil {
+			return nil // locked memory is exhausted, fall back to regular memory
+		}
+	}
+	slots := secureMem.free[class]
+	slot := slots[len(slots)-1]
+	secureMem.free[class] = slots[:len(slots)-1]
+	secureMem.inUse[uintptr(unsafe.Pointer(&slot[0]))] = slot
+	return slot[:size:size]
+}
+
+// secureGrow maps a new locked page and splits it into free slots of the size class.
+// secureMem must be locked by the caller.
+func secureGrow(class int) error {
+	page, err := unix.Mmap(-1, 0, os.Getpagesize(), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return fmt.Errorf("unable to map secure memory: %v", err)
+	}
+	if err := unix.Mlock(page); err != nil {
+		unix.Munmap(page)
+		return fmt.Errorf("unable to lock secure memory: %v", err)
+	}
+	if err := unix.Madvise(page, unix.MADV_DONTDUMP); err != nil {
+		unix.Munmap(page)
+		return fmt.Errorf("unable to exclude secure memory from core dumps: %v", err)
+	}
+
+	if secureMem.free == nil {
+		secureMem.free = make(map[int][][]byte)
+		secureMem.inUse = make(map[uintptr][]byte)
+	}
+	for off := 0; off+class <= len(page); off += class {
+		secureMem.free[class] = append(secureMem.free[class], page[off:off+class:off+class])
+	}
+	return nil
+}
+
+// secureRelease zeroes the secure slot that starts at the slice and makes it available again.
+// Slices in regular memory are ignored.
+func secureRelease(slice []byte) {
+	if cap(slice) == 0 {
+		return
+	}
+	addr := uintptr(unsafe.Pointer(&slice[:1][0]))
+
+	secureMem.Lock()
+	defer secureMem.Unlock()
+	slot, ok := secureMem.inUse[addr]
+	if !ok {
+		return
+	}
+	delete(secureMem.inUse, addr)
+	for i := range slot {
+		slot[i] = 0
+	}
+	secureMem.free[cap(slot)] = append(secureMem.free[cap(slot)], slot)
+}
+
+// isSecure reports whether the slice is an allocated secure memory slot
+func isSecure(slice []byte) bool {
+	if cap(slice) == 0 {
+		return false
+	}
+	secureMem.Lock()
+	defer secureMem.Unlock()
+	_, ok := secureMem.inUse[uintptr(unsafe.Pointer(&slice[:1][0]))]
+	return ok
+}
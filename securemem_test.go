@@ -0,0 +1,42 @@
+package luks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecureMemory(t *testing.T) {
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+
+	if err := SetSecureMemory(true); err != nil {
+		t.Skipf("secure memory is not available: %v", err)
+	}
+	defer SetSecureMemory(false)
+
+	v, err := d.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	require.Equal(t, volumeKey, v.key)
+	require.True(t, isSecure(v.key))
+
+	// the released slot is zeroed and reused
+	key := v.key
+	v.Wipe()
+	require.False(t, isSecure(key))
+	require.Equal(t, make([]byte, len(key)), key)
+	again := secureCopy([]byte("secret"))
+	require.True(t, isSecure(again))
+	require.Equal(t, []byte("secret"), again)
+	clearSlice(again)
+
+	// big secrets stay in regular memory
+	big := secureCopy(make([]byte, secureMaxClass+1))
+	require.False(t, isSecure(big))
+
+	require.NoError(t, SetSecureMemory(false))
+	v, err = d.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	require.False(t, isSecure(v.key))
+}
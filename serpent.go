@@ -0,0 +1,161 @@
+package luks
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// Serpent block cipher (https://www.cl.cam.ac.uk/~rja14/serpent.html) in the byte order used by the Linux kernel and
+// cryptsetup. Neither golang standard library nor x/crypto implement it. It is used for keyslot areas only, so this
+// straightforward (not bitsliced) implementation is fast enough.
+
+const serpentBlockSize = 16
+
+var serpentSbox = [8][16]uint8{
+	{3, 8, 15, 1, 10, 6, 5, 11, 14, 13, 4, 2, 7, 0, 9, 12},
+	{15, 12, 2, 7, 9, 0, 5, 10, 1, 11, 14, 8, 6, 13, 3, 4},
+	{8, 6, 7, 9, 3, 12, 10, 15, 13, 1, 14, 4, 0, 11, 5, 2},
+	{0, 15, 11, 8, 12, 9, 6, 3, 13, 1, 2, 4, 10, 7, 5, 14},
+	{1, 15, 8, 3, 12, 0, 11, 6, 2, 5, 4, 10, 9, 14, 7, 13},
+	{15, 5, 2, 11, 4, 10, 9, 12, 0, 3, 14, 8, 13, 6, 7, 1},
+	{7, 2, 12, 5, 8, 4, 6, 11, 14, 9, 1, 15, 13, 3, 10, 0},
+	{1, 13, 15, 0, 14, 8, 2, 11, 7, 4, 12, 10, 9, 3, 5, 6},
+}
+
+var serpentSboxInv [8][16]uint8
+
+func init() {
+	for i, s := range serpentSbox {
+		for x, y := range s {
+			serpentSboxInv[i][y] = uint8(x)
+		}
+	}
+}
+
+type serpentCipher struct {
+	subkeys [33][4]uint32
+}
+
+func newSerpentCipher(key []byte) (cipher.Block, error) {
+	if len(key) > 32 {
+		return nil, fmt.Errorf("invalid serpent key size %d", len(key))
+	}
+	// short keys are padded with a single one bit followed by zeros
+	padded := make([]byte, 32)
+	copy(padded, key)
+	if len(key) < 32 {
+		padded[len(key)] = 1
+	}
+
+	var w [140]uint32
+	for i := 0; i < 8; i++ {
+		w[i] = binary.LittleEndian.Uint32(padded[4*i:])
+	}
+	clearSlice(padded)
+	for i := 8; i < len(w); i++ {
+		w[i] = bits.RotateLeft32(w[i-8]^w[i-5]^w[i-3]^w[i-1]^0x9e3779b9^uint32(i-8), 11)
+	}
+
+	c := &serpentCipher{}
+	for i := range c.subkeys {
+		k := [4]uint32{w[8+4*i], w[9+4*i], w[10+4*i], w[11+4*i]}
+		c.subkeys[i] = serpentApplySbox(&serpentSbox[(35-i)%8], k)
+	}
+	for i := range w {
+		w[i] = 0
+	}
+	return c, nil
+}
+
+func (c *serpentCipher) BlockSize() int { return serpentBlockSize }
+
+func (c *serpentCipher) Encrypt(dst, src []byte) {
+	x := serpentLoad(src)
+	for r := 0; r < 32; r++ {
+		serpentXor(&x, &c.subkeys[r])
+		x = serpentApplySbox(&serpentSbox[r%8], x)
+		if r < 31 {
+			serpentLinear(&x)
+		}
+	}
+	serpentXor(&x, &c.subkeys[32])
+	serpentStore(dst, x)
+}
+
+func (c *serpentCipher) Decrypt(dst, src []byte) {
+	x := serpentLoad(src)
+	serpentXor(&x, &c.subkeys[32])
+	for r := 31; r >= 0; r-- {
+		if r < 31 {
+			serpentLinearInv(&x)
+		}
+		x = serpentApplySbox(&serpentSboxInv[r%8], x)
+		serpentXor(&x, &c.subkeys[r])
+	}
+	serpentStore(dst, x)
+}
+
+func serpentLoad(b []byte) [4]uint32 {
+	_ = b[15]
+	return [4]uint32{
+		binary.LittleEndian.Uint32(b[0:]),
+		binary.LittleEndian.Uint32(b[4:]),
+		binary.LittleEndian.Uint32(b[8:]),
+		binary.LittleEndian.Uint32(b[12:]),
+	}
+}
+
+func serpentStore(b []byte, x [4]uint32) {
+	_ = b[15]
+	for i, v := range x {
+		binary.LittleEndian.PutUint32(b[4*i:], v)
+	}
+}
+
+func serpentXor(x, k *[4]uint32) {
+	for i := range x {
+		x[i] ^= k[i]
+	}
+}
+
+// serpentApplySbox applies the S-box to 32 nibbles formed by the same bit of the four words
+func serpentApplySbox(s *[16]uint8, x [4]uint32) [4]uint32 {
+	var y [4]uint32
+	for j := 0; j < 32; j++ {
+		in := (x[0]>>j)&1 | ((x[1]>>j)&1)<<1 | ((x[2]>>j)&1)<<2 | ((x[3]>>j)&1)<<3
+		out := uint32(s[in])
+		y[0] |= (out & 1) << j
+		y[1] |= ((out >> 1) & 1) << j
+		y[2] |= ((out >> 2) & 1) << j
+		y[3] |= ((out >> 3) & 1) << j
+	}
+	return y
+}
+
+func serpentLinear(x *[4]uint32) {
+	x[0] = bits.RotateLeft32(x[0], 13)
+	x[2] = bits.RotateLeft32(x[2], 3)
+	x[1] ^= x[0] ^ x[2]
+	x[3] ^= x[2] ^ x[0]<<3
+	x[1] = bits.RotateLeft32(x[1], 1)
+	x[3] = bits.RotateLeft32(x[3], 7)
+	x[0] ^= x[1] ^ x[3]
+	x[2] ^= x[3] ^ x[1]<<7
+	x[0] = bits.RotateLeft32(x[0], 5)
+	x[2] = bits.RotateLeft32(x[2], 22)
+}
+
+func serpentLinearInv(x *[4]uint32) {
+	x[2] = bits.RotateLeft32(x[2], -22)
+	x[0] = bits.RotateLeft32(x[0], -5)
+	x[2] ^= x[3] ^ x[1]<<7
+	x[0] ^= x[1] ^ x[3]
+	x[3] = bits.RotateLeft32(x[3], -7)
+	x[1] = bits.RotateLeft32(x[1], -1)
+	x[3] ^= x[2] ^ x[0]<<3
+	x[1] ^= x[0] ^ x[2]
+	x[2] = bits.RotateLeft32(x[2], -3)
+	x[0] = bits.RotateLeft32(x[0], -13)
+}
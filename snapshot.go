@@ -0,0 +1,43 @@
+package luks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+)
+
+// DeviceSnapshot is a deterministic summary of the device metadata. Snapshots can be stored and compared
+// (e.g. with reflect.DeepEqual) to detect unauthorized changes such as enrollment of a new keyslot or token.
+// The snapshot contains no secret material, keyslots and tokens are represented by hashes of their metadata.
+type DeviceSnapshot struct {
+	Version    int
+	UUID       string
+	SequenceID uint64 // LUKS2 header sequence id, always 0 for LUKS1
+	Keyslots   []SnapshotEntry
+	Tokens     []SnapshotEntry
+	Segments   []SnapshotSegment
+}
+
+// SnapshotEntry is a fingerprint (hex-encoded sha256) of a keyslot or token metadata
+type SnapshotEntry struct {
+	ID          int
+	Fingerprint string
+}
+
+// SnapshotSegment describes a data segment layout
+type SnapshotSegment struct {
+	ID         int
+	Offset     string // in bytes
+	Size       string // in bytes or "dynamic"
+	Encryption string
+	SectorSize int
+}
+
+func fingerprint(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func sortSnapshotEntries(entries []SnapshotEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+}
@@ -0,0 +1,65 @@
+package luks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLuks2Snapshot(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+
+	dev, err := OpenWithOptions(disk.Name(), OpenOptions{ReadWrite: true})
+	require.NoError(t, err)
+	defer dev.Close()
+
+	before, err := dev.(Inspector).Snapshot()
+	require.NoError(t, err)
+	require.Equal(t, 2, before.Version)
+	require.Equal(t, "7d2c1e9a-3b4f-4e5d-8a6b-9c0d1e2f3a4b", before.UUID)
+	require.Equal(t, uint64(1), before.SequenceID)
+	require.Len(t, before.Keyslots, 1)
+	require.Empty(t, before.Tokens)
+	require.Equal(t, []SnapshotSegment{{ID: 0, Offset: "16777216", Size: "dynamic", Encryption: "aes-xts-plain64", SectorSize: 512}}, before.Segments)
+
+	// the snapshot is deterministic for the same header state
+	reopened, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer reopened.Close()
+	again, err := reopened.(Inspector).Snapshot()
+	require.NoError(t, err)
+	require.Equal(t, before, again)
+
+	kdf := KdfParams{Type: "pbkdf2", Hash: "sha256", Iterations: fixtureIterations}
+	_, _, err = dev.(TokenManager).EnrollToken([]byte("foobar"), []byte("secret"), Token{Type: "clevis"}, kdf)
+	require.NoError(t, err)
+
+	after, err := dev.(Inspector).Snapshot()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), after.SequenceID)
+	require.Len(t, after.Keyslots, 2)
+	require.Equal(t, before.Keyslots[0], after.Keyslots[0])
+	require.Len(t, after.Tokens, 1)
+	require.Equal(t, before.Segments, after.Segments)
+}
+
+func TestLuks1Snapshot(t *testing.T) {
+	disk, volumeKey := createLuks1Fixture(t, "foobar")
+
+	d, err := initV1Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	before, err := d.Snapshot()
+	require.NoError(t, err)
+	require.Equal(t, 1, before.Version)
+	require.Equal(t, uint64(0), before.SequenceID)
+	require.Len(t, before.Keyslots, 1)
+	require.Empty(t, before.Tokens)
+	require.Equal(t, []SnapshotSegment{{ID: 0, Offset: "2097152", Size: "dynamic", Encryption: "aes-xts-plain64", SectorSize: 512}}, before.Segments)
+
+	addLuks1FixtureKeyslot(t, disk, d.hdr, 3, "barfoo", volumeKey)
+	after, err := d.Snapshot()
+	require.NoError(t, err)
+	require.Len(t, after.Keyslots, 2)
+	require.Equal(t, before.Keyslots[0], after.Keyslots[0])
+	require.Equal(t, 3, after.Keyslots[1].ID)
+}
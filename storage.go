@@ -0,0 +1,93 @@
+package luks
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Storage is a backend that holds LUKS device data e.g. a block device, an image file, a memory buffer or
+// a network block device. Use FileStorage for an *os.File.
+//
+// Optional methods are used if implemented: `Sync() error` flushes written data, `Writable() bool` reports whether
+// the storage accepts writes and `Close() error` is called by Device.Close().
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	// Size returns size of the storage in bytes
+	Size() (uint64, error)
+}
+
+// FileStorage is a Storage backed by a file i.e. an image file or a block device
+type FileStorage struct {
+	*os.File
+}
+
+// Size returns size of the file, for a block device it is the device size
+func (f FileStorage) Size() (uint64, error) {
+	return fileSize(f.File)
+}
+
+// Writable reports whether the file has been opened for writing
+func (f FileStorage) Writable() bool {
+	fl, err := unix.FcntlInt(f.Fd(), unix.F_GETFL, 0)
+	if err != nil {
+		return false
+	}
+	mode := fl & unix.O_ACCMODE
+	return mode == unix.O_RDWR || mode == unix.O_WRONLY
+}
+
+// syncStorage flushes the written data to the storage
+func syncStorage(s Storage) error {
+	if syncer, ok := s.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+func closeStorage(s Storage) error {
+	if closer, ok := s.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// isWritable reports whether the storage has been opened for writing
+func isWritable(s Storage) bool {
+	if w, ok := s.(interface{ Writable() bool }); ok {
+		return w.Writable()
+	}
+	return true
+}
+
+// bytesStorage is a read-only Storage backed by a memory buffer, e.g. a header dump
+type bytesStorage []byte
+
+func (b bytesStorage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= int64(len(b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (b bytesStorage) WriteAt(p []byte, off int64) (int, error) {
+	return 0, fmt.Errorf("memory buffer is read-only")
+}
+
+func (b bytesStorage) Size() (uint64, error) {
+	return uint64(len(b)), nil
+}
+
+func (b bytesStorage) Writable() bool {
+	return false
+}
@@ -0,0 +1,93 @@
+package luks
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memStorage is an in-memory Storage
+type memStorage []byte
+
+func (m memStorage) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m memStorage) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(m)) {
+		return 0, fmt.Errorf("write beyond the end of storage")
+	}
+	return copy(m[off:], p), nil
+}
+
+func (m memStorage) Size() (uint64, error) {
+	return uint64(len(m)), nil
+}
+
+// failingStorage is a Storage whose writes fail. fail selects the failing writes by offset, nil fails all writes.
+type failingStorage struct {
+	Storage
+	fail     func(off int64) bool
+	readOnly bool // reported by Writable()
+	writes   int  // number of write attempts
+}
+
+func (s *failingStorage) Writable() bool {
+	return !s.readOnly
+}
+
+func (s *failingStorage) WriteAt(p []byte, off int64) (int, error) {
+	s.writes++
+	if s.fail == nil || s.fail(off) {
+		return 0, fmt.Errorf("simulated write failure at offset %d", off)
+	}
+	return s.Storage.WriteAt(p, off)
+}
+
+func TestOpenStorage(t *testing.T) {
+	t.Parallel()
+
+	check := func(disk *os.File, volumeKey []byte) {
+		data, err := os.ReadFile(disk.Name())
+		require.NoError(t, err)
+		storage := memStorage(data)
+
+		dev, err := OpenStorage(storage, "", OpenOptions{})
+		require.NoError(t, err)
+		defer dev.Close()
+		require.True(t, dev.Capabilities().Writable)
+
+		v, err := dev.UnsealVolume(0, []byte("foobar"))
+		require.NoError(t, err)
+		require.Equal(t, volumeKey, v.key)
+
+		// writes go to the memory buffer only
+		slot, err := dev.(Writer).AddKeyslot([]byte("foobar"), []byte("second"), KdfParams{Type: "pbkdf2", Hash: "sha256", Iterations: fixtureIterations})
+		require.NoError(t, err)
+		reopened, err := OpenStorage(storage, "", OpenOptions{})
+		require.NoError(t, err)
+		v, err = reopened.UnsealVolume(slot, []byte("second"))
+		require.NoError(t, err)
+		require.Equal(t, volumeKey, v.key)
+
+		onDisk, err := Open(disk.Name())
+		require.NoError(t, err)
+		defer onDisk.Close()
+		require.Equal(t, []int{0}, onDisk.Slots())
+	}
+
+	disk1, key1 := createLuks1Fixture(t, "foobar")
+	check(disk1, key1)
+	disk2, key2 := createLuks2Fixture(t, "foobar")
+	check(disk2, key2)
+}
@@ -0,0 +1,244 @@
+package systemdfido2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Minimal CBOR (RFC 8949) implementation covering the subset used by CTAP2 messages
+
+// cborMap is a CBOR map, it is encoded in the CTAP2 canonical form (keys sorted by length, then bytewise)
+type cborMap map[interface{}]interface{}
+
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMapT   = 5
+	cborSimple = 7
+)
+
+func cborEncode(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := cborWrite(&b, v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func cborWriteHead(b *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		b.WriteByte(major<<5 | byte(n))
+	case n <= 0xff:
+		b.WriteByte(major<<5 | 24)
+		b.WriteByte(byte(n))
+	case n <= 0xffff:
+		b.WriteByte(major<<5 | 25)
+		_ = binary.Write(b, binary.BigEndian, uint16(n))
+	case n <= 0xffffffff:
+		b.WriteByte(major<<5 | 26)
+		_ = binary.Write(b, binary.BigEndian, uint32(n))
+	default:
+		b.WriteByte(major<<5 | 27)
+		_ = binary.Write(b, binary.BigEndian, n)
+	}
+}
+
+func cborWrite(b *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case int:
+		return cborWrite(b, int64(v))
+	case int64:
+		if v < 0 {
+			cborWriteHead(b, cborNegInt, uint64(-1-v))
+		} else {
+			cborWriteHead(b, cborUint, uint64(v))
+		}
+	case uint64:
+		cborWriteHead(b, cborUint, v)
+	case []byte:
+		cborWriteHead(b, cborBytes, uint64(len(v)))
+		b.Write(v)
+	case string:
+		cborWriteHead(b, cborText, uint64(len(v)))
+		b.WriteString(v)
+	case bool:
+		if v {
+			b.WriteByte(cborSimple<<5 | 21)
+		} else {
+			b.WriteByte(cborSimple<<5 | 20)
+		}
+	case []interface{}:
+		cborWriteHead(b, cborArray, uint64(len(v)))
+		for _, e := range v {
+			if err := cborWrite(b, e); err != nil {
+				return err
+			}
+		}
+	case cborMap:
+		type entry struct{ key, value []byte }
+		entries := make([]entry, 0, len(v))
+		for k, val := range v {
+			key, err := cborEncode(k)
+			if err != nil {
+				return err
+			}
+			value, err := cborEncode(val)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry{key, value})
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			if len(entries[i].key) != len(entries[j].key) {
+				return len(entries[i].key) < len(entries[j].key)
+			}
+			return bytes.Compare(entries[i].key, entries[j].key) < 0
+		})
+		cborWriteHead(b, cborMapT, uint64(len(entries)))
+		for _, e := range entries {
+			b.Write(e.key)
+			b.Write(e.value)
+		}
+	default:
+		return fmt.Errorf("cbor: unsupported type %T", v)
+	}
+	return nil
+}
+
+// cborDecode decodes a single CBOR item. Integers are decoded as int64, maps as cborMap.
+func cborDecode(data []byte) (interface{}, error) {
+	d := cborDecoder{data: data}
+	v, err := d.item(0)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+// maximum nesting level of CBOR items, CTAP2 messages are shallow
+const cborMaxDepth = 16
+
+func (d *cborDecoder) head() (byte, uint64, error) {
+	if d.pos >= len(d.data) {
+		return 0, 0, fmt.Errorf("cbor: unexpected end of data")
+	}
+	initial := d.data[d.pos]
+	d.pos++
+	major, info := initial>>5, initial&0x1f
+
+	var size int
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, fmt.Errorf("cbor: unsupported additional information %d", info)
+	}
+	if d.pos+size > len(d.data) {
+		return 0, 0, fmt.Errorf("cbor: unexpected end of data")
+	}
+	var n uint64
+	for _, c := range d.data[d.pos : d.pos+size] {
+		n = n<<8 | uint64(c)
+	}
+	d.pos += size
+	return major, n, nil
+}
+
+func (d *cborDecoder) item(depth int) (interface{}, error) {
+	if depth > cborMaxDepth {
+		return nil, fmt.Errorf("cbor: nesting is too deep")
+	}
+	major, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case cborUint:
+		if n > 1<<63-1 {
+			return nil, fmt.Errorf("cbor: integer overflow")
+		}
+		return int64(n), nil
+	case cborNegInt:
+		if n > 1<<63-1 {
+			return nil, fmt.Errorf("cbor: integer overflow")
+		}
+		return -1 - int64(n), nil
+	case cborBytes, cborText:
+		if n > uint64(len(d.data)-d.pos) {
+			return nil, fmt.Errorf("cbor: unexpected end of data")
+		}
+		data := d.data[d.pos : d.pos+int(n)]
+		d.pos += int(n)
+		if major == cborText {
+			return string(data), nil
+		}
+		return append([]byte(nil), data...), nil
+	case cborArray:
+		if n > uint64(len(d.data)-d.pos) {
+			return nil, fmt.Errorf("cbor: unexpected end of data")
+		}
+		arr := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			v, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case cborMapT:
+		if n > uint64(len(d.data)-d.pos) {
+			return nil, fmt.Errorf("cbor: unexpected end of data")
+		}
+		m := make(cborMap, n)
+		for i := uint64(0); i < n; i++ {
+			k, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, fmt.Errorf("cbor: unsupported map key type %T", k)
+			}
+			v, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = v
+		}
+		return m, nil
+	case cborSimple:
+		switch n {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22:
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cbor: unsupported simple value %d", n)
+	default:
+		return nil, fmt.Errorf("cbor: unsupported major type %d", major)
+	}
+}
@@ -0,0 +1,60 @@
+package systemdfido2
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCborEncode(t *testing.T) {
+	for _, tc := range []struct {
+		value   interface{}
+		encoded string
+	}{
+		{0, "00"},
+		{23, "17"},
+		{24, "1818"},
+		{1000, "1903e8"},
+		{-1, "20"},
+		{-25, "3818"},
+		{[]byte{1, 2}, "420102"},
+		{"up", "627570"},
+		{true, "f5"},
+		{false, "f4"},
+		{[]interface{}{1, "a"}, "82016161"},
+		// canonical key order: shorter keys first, then bytewise
+		{cborMap{"uv": true, 3: 1, -1: 2, "a": 3}, "a403012002616103627576f5"},
+	} {
+		data, err := cborEncode(tc.value)
+		require.NoError(t, err)
+		require.Equal(t, tc.encoded, hex.EncodeToString(data), "%v", tc.value)
+
+		decoded, err := cborDecode(data)
+		require.NoError(t, err)
+		reencoded, err := cborEncode(decoded)
+		require.NoError(t, err)
+		require.Equal(t, data, reencoded)
+	}
+
+	_, err := cborEncode(1.5)
+	require.Error(t, err)
+}
+
+func TestCborDecodeInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"19",                                     // truncated integer
+		"4201",                                   // truncated bytes
+		"a1",                                     // truncated map
+		"a1f501",                                 // unsupported key type
+		"f9",                                     // floats are not supported
+		"9fff",                                   // indefinite length
+		"81818181818181818181818181818181818100", // too deep
+	} {
+		data, err := hex.DecodeString(s)
+		require.NoError(t, err)
+		_, err = cborDecode(data)
+		require.Error(t, err, s)
+	}
+}
@@ -0,0 +1,195 @@
+package systemdfido2
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// CTAPHID transport over Linux hidraw devices, see "USB HID" section of the CTAP2 specification
+
+const (
+	hidReportSize   = 64
+	hidBroadcastCID = 0xffffffff
+
+	ctaphidInit      = 0x06
+	ctaphidCbor      = 0x10
+	ctaphidKeepalive = 0x3b
+	ctaphidError     = 0x3f
+)
+
+// FIDO alliance HID usage page (0xF1D0) as it appears in a report descriptor
+var fidoUsagePage = []byte{0x06, 0xd0, 0xf1}
+
+// transport sends CTAP2 CBOR commands to an authenticator
+type transport interface {
+	cbor(ctx context.Context, cmd byte, req []byte) ([]byte, error)
+	Close() error
+}
+
+// hidDevices returns paths of hidraw devices that implement the FIDO HID usage page
+func hidDevices() ([]string, error) {
+	descriptors, err := filepath.Glob("/sys/class/hidraw/hidraw*/device/report_descriptor")
+	if err != nil {
+		return nil, err
+	}
+	var devices []string
+	for _, p := range descriptors {
+		desc, err := os.ReadFile(p)
+		if err != nil || !bytes.Contains(desc, fidoUsagePage) {
+			continue
+		}
+		name := filepath.Base(filepath.Dir(filepath.Dir(p)))
+		devices = append(devices, "/dev/"+name)
+	}
+	return devices, nil
+}
+
+type hidDevice struct {
+	f   *os.File
+	cid uint32
+	mu  sync.Mutex
+}
+
+func openHIDDevice(ctx context.Context, path string) (*hidDevice, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	d := &hidDevice{f: f, cid: hidBroadcastCID}
+
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		f.Close()
+		return nil, err
+	}
+	resp, err := d.transact(ctx, ctaphidInit, nonce)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if len(resp) < 17 || !bytes.Equal(resp[:8], nonce) {
+		f.Close()
+		return nil, fmt.Errorf("%v: invalid CTAPHID_INIT response", path)
+	}
+	d.cid = binary.BigEndian.Uint32(resp[8:12])
+	return d, nil
+}
+
+func (d *hidDevice) Close() error {
+	return d.f.Close()
+}
+
+func (d *hidDevice) cbor(ctx context.Context, cmd byte, req []byte) ([]byte, error) {
+	return d.transact(ctx, ctaphidCbor, append([]byte{cmd}, req...))
+}
+
+// transact sends the message and waits for the response. The read is interrupted if the context is cancelled,
+// e.g. the user does not touch the authenticator in time.
+func (d *hidDevice) transact(ctx context.Context, cmd byte, data []byte) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.send(cmd, data); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		data, err := d.receive(cmd)
+		done <- result{data, err}
+	}()
+	select {
+	case r := <-done:
+		return r.data, r.err
+	case <-ctx.Done():
+		d.f.Close() // unblocks the pending read, the device can't be used anymore
+		<-done
+		return nil, ctx.Err()
+	}
+}
+
+func (d *hidDevice) send(cmd byte, data []byte) error {
+	if len(data) > 0xffff {
+		return fmt.Errorf("CTAPHID message is too large")
+	}
+	// the leading zero byte is the report id
+	packet := make([]byte, hidReportSize+1)
+	binary.BigEndian.PutUint32(packet[1:], d.cid)
+	packet[5] = 0x80 | cmd
+	binary.BigEndian.PutUint16(packet[6:], uint16(len(data)))
+	n := copy(packet[8:], data)
+	if _, err := d.f.Write(packet); err != nil {
+		return err
+	}
+
+	for seq := byte(0); n < len(data); seq++ {
+		if seq > 0x7f {
+			return fmt.Errorf("CTAPHID message is too large")
+		}
+		packet = make([]byte, hidReportSize+1)
+		binary.BigEndian.PutUint32(packet[1:], d.cid)
+		packet[5] = seq
+		n += copy(packet[6:], data[n:])
+		if _, err := d.f.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *hidDevice) receive(cmd byte) ([]byte, error) {
+	packet := make([]byte, hidReportSize)
+	for {
+		if _, err := d.f.Read(packet); err != nil {
+			return nil, err
+		}
+		if binary.BigEndian.Uint32(packet) != d.cid {
+			continue // a response to another channel
+		}
+		switch packet[4] {
+		case 0x80 | ctaphidKeepalive:
+			continue // the authenticator waits for user presence
+		case 0x80 | ctaphidError:
+			return nil, fmt.Errorf("CTAPHID error 0x%02x", packet[7])
+		case 0x80 | cmd:
+		default:
+			return nil, fmt.Errorf("unexpected CTAPHID command 0x%02x", packet[4])
+		}
+		break
+	}
+
+	size := int(binary.BigEndian.Uint16(packet[5:]))
+	data := make([]byte, 0, size)
+	data = append(data, packet[7:min(7+size, hidReportSize)]...)
+	for seq := byte(0); len(data) < size; {
+		if _, err := d.f.Read(packet); err != nil {
+			return nil, err
+		}
+		if binary.BigEndian.Uint32(packet) != d.cid {
+			continue
+		}
+		if packet[4] != seq {
+			return nil, fmt.Errorf("unexpected CTAPHID continuation packet %d", packet[4])
+		}
+		data = append(data, packet[5:min(5+size-len(data), hidReportSize)]...)
+		seq++
+	}
+	return data, nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,397 @@
+// Package systemdfido2 unlocks LUKS2 keyslots enrolled with `systemd-cryptenroll --fido2-device`. The keyslot
+// passphrase is the output of the FIDO2 hmac-secret extension for the salt and credential stored at
+// the `systemd-fido2` token. The authenticators are accessed with CTAP2 over Linux hidraw devices, no libfido2 is
+// needed.
+package systemdfido2
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/anatol/luks.go"
+)
+
+// CTAP2 commands and subcommands
+const (
+	cmdGetAssertion = 0x02
+	cmdClientPIN    = 0x06
+
+	pinProtocol           = 1
+	subCmdGetKeyAgreement = 0x02
+	subCmdGetPINToken     = 0x05
+)
+
+// CTAP2 status codes
+const (
+	statusOK            = 0x00
+	statusNoCredentials = 0x2e
+	statusPINInvalid    = 0x31
+	statusPINRequired   = 0x36
+)
+
+// ErrPINRequired is returned if the authenticator requires a PIN and none is provided
+var ErrPINRequired = fmt.Errorf("FIDO2 authenticator requires a PIN")
+
+// ErrNoAuthenticator is returned if none of the connected authenticators holds the token credential
+var ErrNoAuthenticator = fmt.Errorf("No FIDO2 authenticator with the token credential is found")
+
+// ctapError is a non-zero CTAP2 status code
+type ctapError byte
+
+func (e ctapError) Error() string {
+	switch e {
+	case statusNoCredentials:
+		return "FIDO2 authenticator has no such credential"
+	case statusPINInvalid:
+		return "FIDO2 PIN is invalid"
+	case statusPINRequired:
+		return ErrPINRequired.Error()
+	}
+	return fmt.Sprintf("CTAP2 error 0x%02x", byte(e))
+}
+
+func (e ctapError) Is(target error) bool {
+	return target == ErrPINRequired && e == statusPINRequired
+}
+
+// Passphrase performs the hmac-secret assertion for the `systemd-fido2` token with the connected authenticators and
+// returns the keyslot passphrase. The pin is used if the token requires it. The user might need to touch
+// the authenticator, the wait is interrupted when the context is cancelled.
+func Passphrase(ctx context.Context, token luks.Token, pin []byte) ([]byte, error) {
+	t, err := parseToken(token)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := hidDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	var firstErr error
+	for _, path := range devices {
+		dev, err := openHIDDevice(ctx, path)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		passphrase, err := hmacSecretPassphrase(ctx, dev, t, pin)
+		dev.Close()
+		if err == nil {
+			return passphrase, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !errors.Is(err, ctapError(statusNoCredentials)) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = ErrNoAuthenticator
+	}
+	return nil, firstErr
+}
+
+// Unlock recovers the passphrase with Passphrase and unlocks the first token keyslot that accepts it, the volume
+// is mapped with dmName.
+func Unlock(ctx context.Context, d luks.Device, token luks.Token, pin []byte, dmName string) error {
+	passphrase, err := Passphrase(ctx, token, pin)
+	if err != nil {
+		return err
+	}
+	defer clearSlice(passphrase)
+
+	u, cancellable := d.(luks.Unlocker)
+	err = luks.ErrPassphraseIncorrect
+	for _, s := range token.Slots {
+		var volume *luks.Volume
+		if cancellable {
+			volume, err = u.UnsealVolumeContext(ctx, s, passphrase)
+		} else {
+			volume, err = d.UnsealVolume(s, passphrase)
+		}
+		if err == nil {
+			return volume.SetupMapper(dmName)
+		}
+	}
+	return err
+}
+
+func parseToken(token luks.Token) (*luks.SystemdFido2Token, error) {
+	if t, ok := token.Value.(*luks.SystemdFido2Token); ok {
+		return t, nil
+	}
+	return luks.ParseSystemdFido2Token(token.Payload)
+}
+
+// hmacSecretPassphrase performs the assertion with the hmac-secret extension, the passphrase is base64 encoded
+// extension output as systemd-cryptenroll uses it
+func hmacSecretPassphrase(ctx context.Context, dev transport, t *luks.SystemdFido2Token, pin []byte) ([]byte, error) {
+	if t.PINRequired && len(pin) == 0 {
+		return nil, ErrPINRequired
+	}
+
+	platformKey, authKey, err := keyAgreement(ctx, dev)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := sharedSecret(platformKey, authKey)
+	if err != nil {
+		return nil, err
+	}
+	defer clearSlice(shared)
+
+	clientDataHash := make([]byte, 32)
+	if _, err := rand.Read(clientDataHash); err != nil {
+		return nil, err
+	}
+
+	saltEnc, err := aesCBC(shared, t.Salt, true)
+	if err != nil {
+		return nil, err
+	}
+	options := cborMap{"up": t.UPRequired}
+	if t.UVRequired {
+		options["uv"] = true
+	}
+	req := cborMap{
+		1: t.RP,
+		2: clientDataHash,
+		3: []interface{}{cborMap{"type": "public-key", "id": t.Credential}},
+		4: cborMap{"hmac-secret": cborMap{
+			1: coseKey(&platformKey.PublicKey),
+			2: saltEnc,
+			3: hmacSHA256(shared, saltEnc)[:16],
+		}},
+		5: options,
+	}
+	if t.PINRequired {
+		pinToken, err := getPINToken(ctx, dev, platformKey, shared, pin)
+		if err != nil {
+			return nil, err
+		}
+		req[6] = hmacSHA256(pinToken, clientDataHash)[:16]
+		req[7] = pinProtocol
+		clearSlice(pinToken)
+	}
+
+	resp, err := command(ctx, dev, cmdGetAssertion, req)
+	if err != nil {
+		return nil, err
+	}
+	authData, ok := resp[int64(2)].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("FIDO2 assertion has no authenticator data")
+	}
+	outputEnc, err := hmacSecretOutput(authData)
+	if err != nil {
+		return nil, err
+	}
+	output, err := aesCBC(shared, outputEnc, false)
+	if err != nil {
+		return nil, err
+	}
+	defer clearSlice(output)
+	if len(output) != 32 {
+		return nil, fmt.Errorf("unexpected hmac-secret output size %d", len(output))
+	}
+	return []byte(base64.StdEncoding.EncodeToString(output)), nil
+}
+
+// hmacSecretOutput extracts the encrypted hmac-secret output from the authenticator data extensions
+func hmacSecretOutput(authData []byte) ([]byte, error) {
+	const (
+		headerSize       = 32 + 1 + 4 // rpIdHash, flags, signCount
+		flagExtensions   = 0x80
+		flagAttestedData = 0x40
+	)
+	if len(authData) < headerSize {
+		return nil, fmt.Errorf("FIDO2 authenticator data is truncated")
+	}
+	flags := authData[32]
+	if flags&flagExtensions == 0 {
+		return nil, fmt.Errorf("FIDO2 authenticator did not return the hmac-secret extension")
+	}
+	if flags&flagAttestedData != 0 {
+		return nil, fmt.Errorf("unexpected attested credential data in FIDO2 assertion")
+	}
+	ext, err := cborDecode(authData[headerSize:])
+	if err != nil {
+		return nil, err
+	}
+	extMap, ok := ext.(cborMap)
+	if !ok {
+		return nil, fmt.Errorf("invalid FIDO2 extensions")
+	}
+	output, ok := extMap["hmac-secret"].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("FIDO2 authenticator did not return the hmac-secret extension")
+	}
+	return output, nil
+}
+
+// keyAgreement generates a platform key and requests the authenticator key agreement key (PIN protocol 1)
+func keyAgreement(ctx context.Context, dev transport) (*ecdsa.PrivateKey, *ecdsa.PublicKey, error) {
+	resp, err := command(ctx, dev, cmdClientPIN, cborMap{1: pinProtocol, 2: subCmdGetKeyAgreement})
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := resp[int64(1)].(cborMap)
+	if !ok {
+		return nil, nil, fmt.Errorf("FIDO2 authenticator returned no key agreement key")
+	}
+	authKey, err := parseCOSEKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	platformKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return platformKey, authKey, nil
+}
+
+// getPINToken exchanges the PIN for a PIN token
+func getPINToken(ctx context.Context, dev transport, platformKey *ecdsa.PrivateKey, shared, pin []byte) ([]byte, error) {
+	pinHash := sha256.Sum256(pin)
+	pinHashEnc, err := aesCBC(shared, pinHash[:16], true)
+	clearSlice(pinHash[:])
+	if err != nil {
+		return nil, err
+	}
+	resp, err := command(ctx, dev, cmdClientPIN, cborMap{
+		1: pinProtocol,
+		2: subCmdGetPINToken,
+		3: coseKey(&platformKey.PublicKey),
+		6: pinHashEnc,
+	})
+	if err != nil {
+		return nil, err
+	}
+	tokenEnc, ok := resp[int64(2)].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("FIDO2 authenticator returned no PIN token")
+	}
+	return aesCBC(shared, tokenEnc, false)
+}
+
+// command sends the CTAP2 command and decodes the response map
+func command(ctx context.Context, dev transport, cmd byte, req cborMap) (cborMap, error) {
+	data, err := cborEncode(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := dev.cbor(ctx, cmd, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) == 0 {
+		return nil, fmt.Errorf("empty CTAP2 response")
+	}
+	if resp[0] != statusOK {
+		return nil, ctapError(resp[0])
+	}
+	if len(resp) == 1 {
+		return cborMap{}, nil
+	}
+	v, err := cborDecode(resp[1:])
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(cborMap)
+	if !ok {
+		return nil, fmt.Errorf("CTAP2 response is not a map")
+	}
+	return m, nil
+}
+
+// COSE key parameters of the P-256 ECDH key used by PIN protocol 1
+const (
+	coseKty        = 1
+	coseAlg        = 3
+	coseCrv        = -1
+	coseX          = -2
+	coseY          = -3
+	coseKtyEC2     = 2
+	coseAlgECDHES  = -25 // ECDH-ES+HKDF-256
+	coseCurveP256  = 1
+	coordinateSize = 32
+)
+
+func coseKey(pub *ecdsa.PublicKey) cborMap {
+	return cborMap{
+		coseKty: coseKtyEC2,
+		coseAlg: coseAlgECDHES,
+		coseCrv: coseCurveP256,
+		coseX:   pub.X.FillBytes(make([]byte, coordinateSize)),
+		coseY:   pub.Y.FillBytes(make([]byte, coordinateSize)),
+	}
+}
+
+func parseCOSEKey(m cborMap) (*ecdsa.PublicKey, error) {
+	if m[int64(coseKty)] != int64(coseKtyEC2) || m[int64(coseCrv)] != int64(coseCurveP256) {
+		return nil, fmt.Errorf("unsupported FIDO2 key agreement key")
+	}
+	x, okX := m[int64(coseX)].([]byte)
+	y, okY := m[int64(coseY)].([]byte)
+	if !okX || !okY {
+		return nil, fmt.Errorf("invalid FIDO2 key agreement key")
+	}
+	pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, fmt.Errorf("FIDO2 key agreement key is not on curve")
+	}
+	return pub, nil
+}
+
+// sharedSecret computes the PIN protocol 1 shared secret SHA-256(ECDH(platform, authenticator).x)
+func sharedSecret(platformKey *ecdsa.PrivateKey, authKey *ecdsa.PublicKey) ([]byte, error) {
+	x, _ := authKey.Curve.ScalarMult(authKey.X, authKey.Y, platformKey.D.Bytes())
+	z := x.FillBytes(make([]byte, coordinateSize))
+	defer clearSlice(z)
+	shared := sha256.Sum256(z)
+	return shared[:], nil
+}
+
+// aesCBC encrypts or decrypts data with AES-256-CBC and zero IV as PIN protocol 1 specifies
+func aesCBC(key, data []byte, encrypt bool) ([]byte, error) {
+	if len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("invalid FIDO2 encrypted data size %d", len(data))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	out := make([]byte, len(data))
+	if encrypt {
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, data)
+	} else {
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+	}
+	return out, nil
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func clearSlice(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
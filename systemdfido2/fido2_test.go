@@ -0,0 +1,134 @@
+package systemdfido2
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/anatol/luks.go"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAuthenticator implements the CTAP2 subset used for hmac-secret assertions
+type fakeAuthenticator struct {
+	t          *testing.T
+	key        *ecdsa.PrivateKey
+	credential []byte
+	credSecret []byte
+	pin        []byte
+	pinToken   []byte
+}
+
+func newFakeAuthenticator(t *testing.T, pin string) *fakeAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	a := &fakeAuthenticator{t: t, key: key, credential: []byte("credential id"), pin: []byte(pin)}
+	a.credSecret = make([]byte, 32)
+	a.pinToken = make([]byte, 32)
+	_, _ = rand.Read(a.credSecret)
+	_, _ = rand.Read(a.pinToken)
+	return a
+}
+
+func (a *fakeAuthenticator) Close() error { return nil }
+
+func (a *fakeAuthenticator) shared(platformKey interface{}) []byte {
+	pub, err := parseCOSEKey(platformKey.(cborMap))
+	require.NoError(a.t, err)
+	x, _ := elliptic.P256().ScalarMult(pub.X, pub.Y, a.key.D.Bytes())
+	shared := sha256.Sum256(x.FillBytes(make([]byte, 32)))
+	return shared[:]
+}
+
+func (a *fakeAuthenticator) cbor(ctx context.Context, cmd byte, data []byte) ([]byte, error) {
+	v, err := cborDecode(data)
+	require.NoError(a.t, err)
+	req := v.(cborMap)
+
+	var resp cborMap
+	switch cmd {
+	case cmdClientPIN:
+		switch req[int64(2)] {
+		case int64(subCmdGetKeyAgreement):
+			resp = cborMap{1: coseKey(&a.key.PublicKey)}
+		case int64(subCmdGetPINToken):
+			shared := a.shared(req[int64(3)])
+			pinHash, err := aesCBC(shared, req[int64(6)].([]byte), false)
+			require.NoError(a.t, err)
+			expected := sha256.Sum256(a.pin)
+			if !bytes.Equal(pinHash, expected[:16]) {
+				return []byte{statusPINInvalid}, nil
+			}
+			tokenEnc, err := aesCBC(shared, a.pinToken, true)
+			require.NoError(a.t, err)
+			resp = cborMap{2: tokenEnc}
+		}
+	case cmdGetAssertion:
+		allow := req[int64(3)].([]interface{})
+		if !bytes.Equal(allow[0].(cborMap)["id"].([]byte), a.credential) {
+			return []byte{statusNoCredentials}, nil
+		}
+		if len(a.pin) != 0 {
+			pinAuth, ok := req[int64(6)].([]byte)
+			if !ok {
+				return []byte{statusPINRequired}, nil
+			}
+			require.Equal(a.t, hmacSHA256(a.pinToken, req[int64(2)].([]byte))[:16], pinAuth)
+		}
+		ext := req[int64(4)].(cborMap)["hmac-secret"].(cborMap)
+		shared := a.shared(ext[int64(1)])
+		saltEnc := ext[int64(2)].([]byte)
+		require.True(a.t, hmac.Equal(hmacSHA256(shared, saltEnc)[:16], ext[int64(3)].([]byte)))
+		salt, err := aesCBC(shared, saltEnc, false)
+		require.NoError(a.t, err)
+		outputEnc, err := aesCBC(shared, hmacSHA256(a.credSecret, salt), true)
+		require.NoError(a.t, err)
+
+		extensions, err := cborEncode(cborMap{"hmac-secret": outputEnc})
+		require.NoError(a.t, err)
+		rpHash := sha256.Sum256([]byte(req[int64(1)].(string)))
+		authData := append(rpHash[:], 0x80|0x01, 0, 0, 0, 1)
+		resp = cborMap{1: cborMap{"type": "public-key", "id": a.credential}, 2: append(authData, extensions...), 3: []byte("sig")}
+	}
+	encoded, err := cborEncode(resp)
+	require.NoError(a.t, err)
+	return append([]byte{statusOK}, encoded...), nil
+}
+
+func TestHmacSecretPassphrase(t *testing.T) {
+	salt := bytes.Repeat([]byte{0x5a}, 32)
+	for _, pin := range []string{"", "1234"} {
+		auth := newFakeAuthenticator(t, pin)
+		token := &luks.SystemdFido2Token{
+			Credential:  auth.credential,
+			Salt:        salt,
+			RP:          "io.systemd.cryptsetup",
+			PINRequired: pin != "",
+			UPRequired:  true,
+		}
+
+		passphrase, err := hmacSecretPassphrase(context.Background(), auth, token, []byte(pin))
+		require.NoError(t, err)
+		expected := base64.StdEncoding.EncodeToString(hmacSHA256(auth.credSecret, salt))
+		require.Equal(t, expected, string(passphrase))
+
+		if pin != "" {
+			_, err = hmacSecretPassphrase(context.Background(), auth, token, nil)
+			require.ErrorIs(t, err, ErrPINRequired)
+			_, err = hmacSecretPassphrase(context.Background(), auth, token, []byte("wrong"))
+			require.Equal(t, ctapError(statusPINInvalid), err)
+		}
+	}
+
+	auth := newFakeAuthenticator(t, "")
+	token := &luks.SystemdFido2Token{Credential: []byte("other"), Salt: salt, RP: "io.systemd.cryptsetup"}
+	_, err := hmacSecretPassphrase(context.Background(), auth, token, nil)
+	require.True(t, errors.Is(err, ctapError(statusNoCredentials)))
+}
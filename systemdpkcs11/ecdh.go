@@ -0,0 +1,24 @@
+package systemdpkcs11
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"math/big"
+)
+
+// ecdh returns the x coordinate of priv * (x, y) padded to the curve size. It matches the CKD_NULL output of
+// CKM_ECDH1_DERIVE.
+func ecdh(priv *ecdsa.PrivateKey, x, y *big.Int) []byte {
+	sx, _ := priv.Curve.ScalarMult(x, y, priv.D.Bytes())
+	secret := make([]byte, curveSize(priv.Curve))
+	return sx.FillBytes(secret)
+}
+
+func curveSize(curve elliptic.Curve) int {
+	return (curve.Params().BitSize + 7) / 8
+}
+
+// marshalPoint encodes the public key as an uncompressed point (X9.62)
+func marshalPoint(pub *ecdsa.PublicKey) []byte {
+	return elliptic.Marshal(pub.Curve, pub.X, pub.Y)
+}
@@ -0,0 +1,164 @@
+package systemdpkcs11
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Module is the path of the PKCS#11 module. The p11-kit proxy loads all modules configured in the system, the same
+// way systemd-cryptsetup accesses the tokens.
+var Module = "/usr/lib/p11-kit-proxy.so"
+
+// ErrPINRequired is returned if the token requires a login and no PIN is provided
+var ErrPINRequired = fmt.Errorf("PKCS#11 token requires a PIN")
+
+// ErrNoToken is returned if none of the tokens matches the URI
+var ErrNoToken = fmt.Errorf("No PKCS#11 token matches the URI")
+
+// Session is a logged in session with the token that holds the private key referenced by a PKCS#11 URI
+type Session struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	uri     *uri
+}
+
+// Open loads the PKCS#11 module, finds the token matching the RFC 7512 uri and logs in with pin
+func Open(module string, pkcs11URI string, pin []byte) (*Session, error) {
+	u, err := parseURI(pkcs11URI)
+	if err != nil {
+		return nil, err
+	}
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, fmt.Errorf("unable to load PKCS#11 module %s", module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("unable to initialize PKCS#11 module %s: %v", module, err)
+	}
+	s := &Session{ctx: ctx, uri: u}
+	if err := s.open(pin); err != nil {
+		_ = ctx.Finalize()
+		ctx.Destroy()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Session) open(pin []byte) error {
+	slots, err := s.ctx.GetSlotList(true)
+	if err != nil {
+		return err
+	}
+	for _, slot := range slots {
+		info, err := s.ctx.GetTokenInfo(slot)
+		if err != nil || !s.uri.matchToken(info) {
+			continue
+		}
+		loginRequired := info.Flags&pkcs11.CKF_LOGIN_REQUIRED != 0
+		if loginRequired && len(pin) == 0 {
+			return ErrPINRequired
+		}
+		if s.session, err = s.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION); err != nil {
+			return fmt.Errorf("unable to open PKCS#11 session: %v", err)
+		}
+		if loginRequired {
+			err = s.ctx.Login(s.session, pkcs11.CKU_USER, string(pin))
+			var code pkcs11.Error
+			if errors.As(err, &code) && code == pkcs11.CKR_USER_ALREADY_LOGGED_IN {
+				err = nil
+			}
+			if err != nil {
+				_ = s.ctx.CloseSession(s.session)
+				return fmt.Errorf("PKCS#11 login failed: %v", err)
+			}
+		}
+		return nil
+	}
+	return ErrNoToken
+}
+
+// Close closes the session and unloads the module
+func (s *Session) Close() error {
+	_ = s.ctx.Logout(s.session)
+	err := s.ctx.CloseSession(s.session)
+	_ = s.ctx.Finalize()
+	s.ctx.Destroy()
+	return err
+}
+
+// Decrypt implements Key with the private key referenced by the URI
+func (s *Session) Decrypt(encrypted []byte) ([]byte, error) {
+	if key, err := s.findObject(pkcs11.CKO_PRIVATE_KEY, pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA)); err == nil {
+		if err := s.ctx.DecryptInit(s.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)}, key); err != nil {
+			return nil, err
+		}
+		return s.ctx.Decrypt(s.session, encrypted)
+	}
+
+	key, err := s.findObject(pkcs11.CKO_PRIVATE_KEY, pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC))
+	if err != nil {
+		return nil, err
+	}
+	params := pkcs11.NewECDH1DeriveParams(pkcs11.CKD_NULL, nil, encrypted)
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_GENERIC_SECRET),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+	}
+	derived, err := s.ctx.DeriveKey(s.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDH1_DERIVE, params)}, key, template)
+	if err != nil {
+		return nil, fmt.Errorf("ECDH derivation failed: %v", err)
+	}
+	defer s.ctx.DestroyObject(s.session, derived)
+
+	attrs, err := s.ctx.GetAttributeValue(s.session, derived, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil)})
+	if err != nil {
+		return nil, err
+	}
+	return attrs[0].Value, nil
+}
+
+// PublicKey returns the public key of the certificate referenced by the URI, it is used for Enroll
+func (s *Session) PublicKey() (interface{}, error) {
+	cert, err := s.findObject(pkcs11.CKO_CERTIFICATE)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := s.ctx.GetAttributeValue(s.session, cert, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil)})
+	if err != nil {
+		return nil, err
+	}
+	c, err := x509.ParseCertificate(attrs[0].Value)
+	if err != nil {
+		return nil, err
+	}
+	return c.PublicKey, nil
+}
+
+// findObject returns the only object of the class that matches the URI and extra attributes
+func (s *Session) findObject(class uint, extra ...*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	template := append([]*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)}, s.uri.objectTemplate()...)
+	template = append(template, extra...)
+	if err := s.ctx.FindObjectsInit(s.session, template); err != nil {
+		return 0, err
+	}
+	objects, _, err := s.ctx.FindObjects(s.session, 2)
+	_ = s.ctx.FindObjectsFinal(s.session)
+	if err != nil {
+		return 0, err
+	}
+	switch len(objects) {
+	case 0:
+		return 0, fmt.Errorf("no PKCS#11 object matches the URI")
+	case 1:
+		return objects[0], nil
+	default:
+		return 0, fmt.Errorf("PKCS#11 URI matches multiple objects")
+	}
+}
@@ -0,0 +1,153 @@
+// Package systemdpkcs11 enrolls and unlocks LUKS2 keyslots protected with a PKCS#11 token (smartcard, YubiKey PIV,
+// etc.) in the `systemd-cryptenroll --pkcs11-token-uri` format. A random secret is encrypted with the public key of
+// the token and stored at a `systemd-pkcs11` token, the token decrypts it with its private key at unlock time.
+// The keyslot passphrase is base64 encoding of the secret.
+//
+// For RSA keys the secret is encrypted with PKCS#1 v1.5 padding. For EC keys the secret is an ECDH shared secret
+// between the token key and an ephemeral key, the public part of the ephemeral key is stored at the token.
+package systemdpkcs11
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/anatol/luks.go"
+)
+
+// size of the random secret for RSA keys
+const secretSize = 32
+
+// Key is a private key that is able to decrypt `pkcs11-key` of the token. *Session implements it for keys stored at
+// a PKCS#11 token.
+type Key interface {
+	// Decrypt returns the plaintext secret. It is PKCS#1 v1.5 decryption for RSA keys and ECDH with the stored
+	// uncompressed ephemeral public point for EC keys.
+	Decrypt(encrypted []byte) ([]byte, error)
+}
+
+// Enroll encrypts a new random secret with pub and adds a keyslot protected with it together with a `systemd-pkcs11`
+// token that references the key by uri. pub is the public key of the token certificate (see Session.PublicKey),
+// *rsa.PublicKey and *ecdsa.PublicKey are supported. The volume key is recovered using existingPassphrase.
+// The device needs to be opened with luks.OpenOptions.ReadWrite, d is usually a luks.Device type-asserted to
+// luks.TokenManager.
+func Enroll(d luks.TokenManager, existingPassphrase []byte, uri string, pub interface{}, kdf luks.KdfParams) (keyslot int, tokenID int, err error) {
+	if kdf.Type == "" {
+		kdf = luks.KdfParams{Type: "pbkdf2", Hash: "sha512", Iterations: 1000}
+	}
+
+	secret, encrypted, err := encryptSecret(pub)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer clearSlice(secret)
+
+	payload, err := json.Marshal(systemdToken{
+		Type: luks.SystemdPKCS11TokenType,
+		URI:  uri,
+		Key:  base64.StdEncoding.EncodeToString(encrypted),
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	// validates the uri the same way unlocking does
+	if _, err := luks.ParseSystemdPKCS11Token(payload); err != nil {
+		return 0, 0, err
+	}
+
+	passphrase := []byte(base64.StdEncoding.EncodeToString(secret))
+	defer clearSlice(passphrase)
+	return d.EnrollToken(existingPassphrase, passphrase, luks.Token{Type: luks.SystemdPKCS11TokenType, Payload: payload}, kdf)
+}
+
+// encryptSecret generates the secret and its encrypted form stored as `pkcs11-key`
+func encryptSecret(pub interface{}) (secret, encrypted []byte, err error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		secret = make([]byte, secretSize)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, nil, err
+		}
+		encrypted, err = rsa.EncryptPKCS1v15(rand.Reader, pub, secret)
+		if err != nil {
+			clearSlice(secret)
+			return nil, nil, err
+		}
+		return secret, encrypted, nil
+	case *ecdsa.PublicKey:
+		ephemeral, err := ecdsa.GenerateKey(pub.Curve, rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		secret = ecdh(ephemeral, pub.X, pub.Y)
+		return secret, marshalPoint(&ephemeral.PublicKey), nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported PKCS#11 public key type %T", pub)
+	}
+}
+
+// Passphrase decrypts `pkcs11-key` of the `systemd-pkcs11` token with key and returns the keyslot passphrase
+func Passphrase(token luks.Token, key Key) ([]byte, error) {
+	t, err := parseToken(token)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := key.Decrypt(t.Key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt systemd-pkcs11 key: %v", err)
+	}
+	defer clearSlice(secret)
+	return []byte(base64.StdEncoding.EncodeToString(secret)), nil
+}
+
+// Unlock opens the key referenced by the token with the PKCS#11 module (see Module), recovers the passphrase and
+// unlocks the first token keyslot that accepts it. The volume is mapped with dmName.
+func Unlock(d luks.Device, token luks.Token, pin []byte, dmName string) error {
+	t, err := parseToken(token)
+	if err != nil {
+		return err
+	}
+	session, err := Open(Module, t.URI, pin)
+	if err != nil {
+		return err
+	}
+	passphrase, err := Passphrase(token, session)
+	session.Close()
+	if err != nil {
+		return err
+	}
+	defer clearSlice(passphrase)
+
+	err = luks.ErrPassphraseIncorrect
+	for _, s := range token.Slots {
+		var volume *luks.Volume
+		volume, err = d.UnsealVolume(s, passphrase)
+		if err == nil {
+			return volume.SetupMapper(dmName)
+		}
+	}
+	return err
+}
+
+func parseToken(token luks.Token) (*luks.SystemdPKCS11Token, error) {
+	if t, ok := token.Value.(*luks.SystemdPKCS11Token); ok {
+		return t, nil
+	}
+	return luks.ParseSystemdPKCS11Token(token.Payload)
+}
+
+// systemdToken is the token JSON written by systemd-cryptenroll, the keyslots list is set by TokenManager.EnrollToken
+type systemdToken struct {
+	Type string `json:"type"`
+	URI  string `json:"pkcs11-uri"`
+	Key  string `json:"pkcs11-key"`
+}
+
+func clearSlice(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
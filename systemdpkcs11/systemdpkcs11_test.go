@@ -0,0 +1,78 @@
+package systemdpkcs11
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/anatol/luks.go"
+	"github.com/stretchr/testify/require"
+)
+
+type rsaKey struct{ *rsa.PrivateKey }
+
+func (k rsaKey) Decrypt(encrypted []byte) ([]byte, error) {
+	return rsa.DecryptPKCS1v15(nil, k.PrivateKey, encrypted)
+}
+
+type ecKey struct{ *ecdsa.PrivateKey }
+
+func (k ecKey) Decrypt(encrypted []byte) ([]byte, error) {
+	x, y := elliptic.Unmarshal(k.Curve, encrypted)
+	if x == nil {
+		return nil, fmt.Errorf("invalid EC point")
+	}
+	return ecdh(k.PrivateKey, x, y), nil
+}
+
+func tokenFor(t *testing.T, encrypted []byte) luks.Token {
+	payload, err := json.Marshal(systemdToken{
+		Type: luks.SystemdPKCS11TokenType,
+		URI:  "pkcs11:token=test;id=%01",
+		Key:  base64.StdEncoding.EncodeToString(encrypted),
+	})
+	require.NoError(t, err)
+	return luks.Token{Type: luks.SystemdPKCS11TokenType, Payload: payload}
+}
+
+func TestPassphraseRSA(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	secret, encrypted, err := encryptSecret(&priv.PublicKey)
+	require.NoError(t, err)
+	require.Len(t, secret, secretSize)
+
+	passphrase, err := Passphrase(tokenFor(t, encrypted), rsaKey{priv})
+	require.NoError(t, err)
+	require.Equal(t, base64.StdEncoding.EncodeToString(secret), string(passphrase))
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, err = Passphrase(tokenFor(t, encrypted), rsaKey{other})
+	require.Error(t, err)
+}
+
+func TestPassphraseEC(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	secret, encrypted, err := encryptSecret(&priv.PublicKey)
+	require.NoError(t, err)
+	require.Len(t, secret, 32)
+	require.Len(t, encrypted, 65)
+
+	passphrase, err := Passphrase(tokenFor(t, encrypted), ecKey{priv})
+	require.NoError(t, err)
+	require.Equal(t, base64.StdEncoding.EncodeToString(secret), string(passphrase))
+}
+
+func TestEncryptSecretUnsupportedKey(t *testing.T) {
+	_, _, err := encryptSecret([]byte("key"))
+	require.Error(t, err)
+}
@@ -0,0 +1,82 @@
+package systemdpkcs11
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+)
+
+// uri is the subset of RFC 7512 PKCS#11 URI attributes used to find the key
+type uri struct {
+	token, manufacturer, serial, model string
+	object                             string
+	id                                 []byte
+	hasID                              bool
+}
+
+func parseURI(s string) (*uri, error) {
+	if !strings.HasPrefix(s, "pkcs11:") {
+		return nil, fmt.Errorf("invalid PKCS#11 URI %q", s)
+	}
+	path := strings.TrimPrefix(s, "pkcs11:")
+	if i := strings.IndexByte(path, '?'); i != -1 {
+		path = path[:i] // query attributes such as pin-source are not used
+	}
+
+	var u uri
+	if path == "" {
+		return &u, nil
+	}
+	for _, attr := range strings.Split(path, ";") {
+		kv := strings.SplitN(attr, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid PKCS#11 URI attribute %q", attr)
+		}
+		value, err := url.PathUnescape(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid PKCS#11 URI attribute %q: %v", attr, err)
+		}
+		switch kv[0] {
+		case "token":
+			u.token = value
+		case "manufacturer":
+			u.manufacturer = value
+		case "serial":
+			u.serial = value
+		case "model":
+			u.model = value
+		case "object":
+			u.object = value
+		case "id":
+			u.id, u.hasID = []byte(value), true
+		case "type":
+			// the key and its certificate are looked up by the class explicitly
+		default:
+			// unknown attributes do not narrow down the search
+		}
+	}
+	return &u, nil
+}
+
+// matchToken reports whether the token info matches the URI. PKCS#11 pads the info strings with spaces.
+func (u *uri) matchToken(info pkcs11.TokenInfo) bool {
+	match := func(want, got string) bool {
+		return want == "" || want == strings.TrimRight(got, " ")
+	}
+	return match(u.token, info.Label) && match(u.manufacturer, info.ManufacturerID) &&
+		match(u.serial, info.SerialNumber) && match(u.model, info.Model)
+}
+
+// objectTemplate returns the search attributes of the key object
+func (u *uri) objectTemplate() []*pkcs11.Attribute {
+	var template []*pkcs11.Attribute
+	if u.object != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, u.object))
+	}
+	if u.hasID {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, u.id))
+	}
+	return template
+}
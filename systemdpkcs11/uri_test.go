@@ -0,0 +1,36 @@
+package systemdpkcs11
+
+import (
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseURI(t *testing.T) {
+	u, err := parseURI("pkcs11:model=PKCS%2315%20emulated;manufacturer=piv_II;serial=0123;token=YubiKey%20PIV;id=%02;object=KEY%20MAN;type=private?pin-value=1234")
+	require.NoError(t, err)
+	require.Equal(t, &uri{
+		token:        "YubiKey PIV",
+		manufacturer: "piv_II",
+		serial:       "0123",
+		model:        "PKCS#15 emulated",
+		object:       "KEY MAN",
+		id:           []byte{0x02},
+		hasID:        true,
+	}, u)
+
+	require.True(t, u.matchToken(pkcs11.TokenInfo{Label: "YubiKey PIV  ", ManufacturerID: "piv_II", Model: "PKCS#15 emulated", SerialNumber: "0123"}))
+	require.False(t, u.matchToken(pkcs11.TokenInfo{Label: "Other", ManufacturerID: "piv_II", Model: "PKCS#15 emulated", SerialNumber: "0123"}))
+
+	u, err = parseURI("pkcs11:")
+	require.NoError(t, err)
+	require.True(t, u.matchToken(pkcs11.TokenInfo{Label: "any"}))
+
+	_, err = parseURI("file:///key")
+	require.Error(t, err)
+	_, err = parseURI("pkcs11:token")
+	require.Error(t, err)
+	_, err = parseURI("pkcs11:id=%zz")
+	require.Error(t, err)
+}
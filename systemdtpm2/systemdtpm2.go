@@ -0,0 +1,292 @@
+// Package systemdtpm2 enrolls and unlocks LUKS2 keyslots protected with TPM2 in the systemd-cryptenroll format.
+// A random secret is sealed to the TPM with a PCR policy and stored at a `systemd-tpm2` token, its base64 encoding
+// is the keyslot passphrase. Volumes enrolled by this package unlock with systemd-cryptsetup and vice versa.
+//
+// Importing the package registers a luks.TokenHandler for `systemd-tpm2` tokens.
+package systemdtpm2
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/anatol/luks.go"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Device is the path of the TPM device
+var Device = "/dev/tpmrm0"
+
+// size of the sealed secret, the same as systemd uses
+const secretSize = 32
+
+// persistent handle of the storage root key shared by systemd and other TPM users
+const srkHandle = tpmutil.Handle(0x81000001)
+
+// EnrollOptions specifies how the secret is sealed
+type EnrollOptions struct {
+	// PCRs the secret is bound to, PCR 7 (Secure Boot state) is used by default like systemd-cryptenroll does
+	PCRs []int
+	// Kdf of the new keyslot. The passphrase is a high entropy secret, so by default pbkdf2 with the minimal
+	// number of iterations is used like systemd-cryptenroll does.
+	Kdf luks.KdfParams
+}
+
+func init() {
+	luks.RegisterTokenHandler(luks.SystemdTPM2TokenType, tokenHandler{})
+}
+
+// Enroll seals a new random secret with the current values of the PCRs and adds a keyslot protected with it
+// together with a `systemd-tpm2` token. The volume key is recovered using existingPassphrase.
+// The device needs to be opened with luks.OpenOptions.ReadWrite, d is usually a luks.Device type-asserted to
+// luks.TokenManager.
+func Enroll(d luks.TokenManager, existingPassphrase []byte, opts EnrollOptions) (keyslot int, tokenID int, err error) {
+	pcrs := opts.PCRs
+	if len(pcrs) == 0 {
+		pcrs = []int{7}
+	}
+	pcrs = append([]int(nil), pcrs...)
+	sort.Ints(pcrs)
+	kdf := opts.Kdf
+	if kdf.Type == "" {
+		kdf = luks.KdfParams{Type: "pbkdf2", Hash: "sha512", Iterations: 1000}
+	}
+
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return 0, 0, err
+	}
+	defer clearSlice(secret)
+
+	rw, err := tpm2.OpenTPM(Device)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rw.Close()
+
+	sel := tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: pcrs}
+	policy, err := pcrPolicyDigest(rw, sel)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	parent, _, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", primaryTemplate)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to create primary key: %v", err)
+	}
+	defer tpm2.FlushContext(rw, parent)
+
+	priv, pub, err := tpm2.Seal(rw, parent, "", "", policy, secret)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to seal secret: %v", err)
+	}
+
+	token := systemdToken{
+		Type:       luks.SystemdTPM2TokenType,
+		Blob:       base64.StdEncoding.EncodeToString(marshalBlob(priv, pub)),
+		PCRs:       pcrs,
+		PCRBank:    "sha256",
+		PrimaryAlg: "ecc",
+		PolicyHash: hex.EncodeToString(policy),
+	}
+	payload, err := json.Marshal(token)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	passphrase := []byte(base64.StdEncoding.EncodeToString(secret))
+	defer clearSlice(passphrase)
+	return d.EnrollToken(existingPassphrase, passphrase, luks.Token{Type: luks.SystemdTPM2TokenType, Payload: payload}, kdf)
+}
+
+// Passphrase unseals the keyslot passphrase stored at the `systemd-tpm2` token. Tokens that require a PIN or
+// a signed PCR policy are not supported.
+func Passphrase(token luks.Token) ([]byte, error) {
+	t, ok := token.Value.(*luks.SystemdTPM2Token)
+	if !ok {
+		var err error
+		if t, err = luks.ParseSystemdTPM2Token(token.Payload); err != nil {
+			return nil, err
+		}
+	}
+	if t.PIN {
+		return nil, fmt.Errorf("systemd-tpm2 tokens protected with a PIN are not supported")
+	}
+	if len(t.PublicKey) != 0 || t.PCRLock {
+		return nil, fmt.Errorf("systemd-tpm2 tokens with signed or pcrlock policies are not supported")
+	}
+	if len(t.Blobs) == 0 {
+		return nil, fmt.Errorf("systemd-tpm2 token has no sealed blob")
+	}
+	bank, err := algorithm(t.PCRBank)
+	if err != nil {
+		return nil, err
+	}
+	if t.PrimaryAlg != "" && t.PrimaryAlg != "ecc" && len(t.SRK) == 0 {
+		return nil, fmt.Errorf("unsupported systemd-tpm2 primary key algorithm %q", t.PrimaryAlg)
+	}
+
+	rw, err := tpm2.OpenTPM(Device)
+	if err != nil {
+		return nil, err
+	}
+	defer rw.Close()
+
+	parent := srkHandle
+	if len(t.SRK) == 0 {
+		// tokens created before systemd v254 use a transient primary key
+		if parent, _, err = tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", primaryTemplate); err != nil {
+			return nil, fmt.Errorf("unable to create primary key: %v", err)
+		}
+		defer tpm2.FlushContext(rw, parent)
+	}
+
+	sel := tpm2.PCRSelection{Hash: bank, PCRs: t.PCRs}
+	var firstErr error
+	for _, blob := range t.Blobs {
+		secret, err := unseal(rw, parent, blob, sel)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		passphrase := []byte(base64.StdEncoding.EncodeToString(secret))
+		clearSlice(secret)
+		return passphrase, nil
+	}
+	return nil, firstErr
+}
+
+func unseal(rw io.ReadWriter, parent tpmutil.Handle, blob []byte, sel tpm2.PCRSelection) ([]byte, error) {
+	priv, pub, err := unmarshalBlob(blob)
+	if err != nil {
+		return nil, err
+	}
+	object, _, err := tpm2.Load(rw, parent, "", pub, priv)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load sealed object: %v", err)
+	}
+	defer tpm2.FlushContext(rw, object)
+
+	session, _, err := tpm2.StartAuthSession(rw, tpm2.HandleNull, tpm2.HandleNull, make([]byte, 16), nil, tpm2.SessionPolicy, tpm2.AlgNull, tpm2.AlgSHA256)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start policy session: %v", err)
+	}
+	defer tpm2.FlushContext(rw, session)
+
+	if err := tpm2.PolicyPCR(rw, session, nil, sel); err != nil {
+		return nil, fmt.Errorf("unable to apply PCR policy: %v", err)
+	}
+	secret, err := tpm2.UnsealWithSession(rw, session, object, "")
+	if err != nil {
+		return nil, fmt.Errorf("unable to unseal: %v", err)
+	}
+	return secret, nil
+}
+
+// pcrPolicyDigest computes the PolicyPCR digest for the current PCR values with a trial session
+func pcrPolicyDigest(rw io.ReadWriter, sel tpm2.PCRSelection) ([]byte, error) {
+	session, _, err := tpm2.StartAuthSession(rw, tpm2.HandleNull, tpm2.HandleNull, make([]byte, 16), nil, tpm2.SessionTrial, tpm2.AlgNull, tpm2.AlgSHA256)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start trial session: %v", err)
+	}
+	defer tpm2.FlushContext(rw, session)
+
+	if err := tpm2.PolicyPCR(rw, session, nil, sel); err != nil {
+		return nil, fmt.Errorf("unable to compute PCR policy: %v", err)
+	}
+	return tpm2.PolicyGetDigest(rw, session)
+}
+
+type tokenHandler struct{}
+
+func (tokenHandler) Available(token luks.Token) bool {
+	if _, err := os.Stat(Device); err != nil {
+		return false
+	}
+	t, ok := token.Value.(*luks.SystemdTPM2Token)
+	return ok && !t.PIN && len(t.PublicKey) == 0 && !t.PCRLock
+}
+
+func (tokenHandler) Passphrase(token luks.Token) ([]byte, error) {
+	return Passphrase(token)
+}
+
+// systemdToken is the token JSON written by systemd-cryptenroll, the keyslots list is set by TokenManager.EnrollToken
+type systemdToken struct {
+	Type       string `json:"type"`
+	Blob       string `json:"tpm2-blob"`
+	PCRs       []int  `json:"tpm2-pcrs"`
+	PCRBank    string `json:"tpm2-pcr-bank"`
+	PrimaryAlg string `json:"tpm2-primary-alg"`
+	PolicyHash string `json:"tpm2-policy-hash"`
+	PIN        bool   `json:"tpm2-pin"`
+}
+
+// primaryTemplate is the ECC primary key template that systemd uses when no persistent SRK is available
+var primaryTemplate = tpm2.Public{
+	Type:    tpm2.AlgECC,
+	NameAlg: tpm2.AlgSHA256,
+	Attributes: tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth |
+		tpm2.FlagRestricted | tpm2.FlagDecrypt,
+	ECCParameters: &tpm2.ECCParams{
+		Symmetric: &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB},
+		CurveID:   tpm2.CurveNISTP256,
+	},
+}
+
+// marshalBlob encodes the sealed object as systemd does: TPM2B_PRIVATE followed by TPM2B_PUBLIC
+func marshalBlob(priv, pub []byte) []byte {
+	var b bytes.Buffer
+	for _, part := range [][]byte{priv, pub} {
+		_ = binary.Write(&b, binary.BigEndian, uint16(len(part)))
+		b.Write(part)
+	}
+	return b.Bytes()
+}
+
+func unmarshalBlob(blob []byte) (priv, pub []byte, err error) {
+	parts := make([][]byte, 2)
+	for i := range parts {
+		if len(blob) < 2 {
+			return nil, nil, fmt.Errorf("systemd-tpm2 blob is truncated")
+		}
+		size := int(binary.BigEndian.Uint16(blob))
+		if len(blob) < 2+size {
+			return nil, nil, fmt.Errorf("systemd-tpm2 blob is truncated")
+		}
+		parts[i] = blob[2 : 2+size]
+		blob = blob[2+size:]
+	}
+	return parts[0], parts[1], nil
+}
+
+func algorithm(name string) (tpm2.Algorithm, error) {
+	switch name {
+	case "sha1":
+		return tpm2.AlgSHA1, nil
+	case "", "sha256":
+		return tpm2.AlgSHA256, nil
+	case "sha384":
+		return tpm2.AlgSHA384, nil
+	case "sha512":
+		return tpm2.AlgSHA512, nil
+	default:
+		return 0, fmt.Errorf("unsupported PCR bank %q", name)
+	}
+}
+
+func clearSlice(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,22 @@
+package systemdtpm2
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlob(t *testing.T) {
+	blob := marshalBlob([]byte{1, 2, 3}, []byte{4, 5})
+	require.Equal(t, []byte{0, 3, 1, 2, 3, 0, 2, 4, 5}, blob)
+
+	priv, pub, err := unmarshalBlob(blob)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, priv)
+	require.Equal(t, []byte{4, 5}, pub)
+
+	_, _, err = unmarshalBlob(blob[:7])
+	require.Error(t, err)
+	_, _, err = unmarshalBlob([]byte{0})
+	require.Error(t, err)
+}
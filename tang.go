@@ -0,0 +1,264 @@
+package luks
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrTangUnreachable is an error that indicates the tang server did not respond (e.g. network is down or the request
+// timed out). Boot logic might fall back to a passphrase prompt in this case.
+var ErrTangUnreachable = fmt.Errorf("Tang server is unreachable")
+
+// TangTimeout is the maximum time to wait for a tang server response
+var TangTimeout = 5 * time.Second
+
+// maximum size of a tang server response, advertisements are small JSON documents
+const tangMaxResponseSize = 1024 * 1024
+
+// jwk is a JSON Web Key (RFC 7517) as used by tang
+type jwk struct {
+	Kty    string   `json:"kty"`
+	Crv    string   `json:"crv,omitempty"`
+	X      string   `json:"x,omitempty"`
+	Y      string   `json:"y,omitempty"`
+	Alg    string   `json:"alg,omitempty"`
+	KeyOps []string `json:"key_ops,omitempty"`
+}
+
+// thumbprint computes JWK thumbprint (RFC 7638) using the given hash. Clevis uses sha256 and (older versions) sha1.
+func (k *jwk) thumbprint(h crypto.Hash) (string, error) {
+	if k.Kty != "EC" {
+		return "", fmt.Errorf("unsupported JWK key type: %v", k.Kty)
+	}
+	// the required members in lexicographic order
+	data, err := json.Marshal(struct {
+		Crv string `json:"crv"`
+		Kty string `json:"kty"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}{k.Crv, k.Kty, k.X, k.Y})
+	if err != nil {
+		return "", err
+	}
+	hash := h.New()
+	hash.Write(data)
+	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+// hasThumbprint reports whether the key's thumbprint (either sha256 or sha1 one) matches the given thumbprint
+func (k *jwk) hasThumbprint(thp string) bool {
+	for _, h := range []crypto.Hash{crypto.SHA256, crypto.SHA1} {
+		if t, err := k.thumbprint(h); err == nil && t == thp {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *jwk) hasKeyOp(op string) bool {
+	for _, o := range k.KeyOps {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *jwk) ecdsaPublicKey() (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported JWK curve: %v", k.Crv)
+	}
+
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWK x coordinate: %v", err)
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWK y coordinate: %v", err)
+	}
+	pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, fmt.Errorf("JWK point is not on curve %v", k.Crv)
+	}
+	return pub, nil
+}
+
+type jwsSignature struct {
+	Protected string `json:"protected"`
+	Signature string `json:"signature"`
+}
+
+// jws is a JSON Web Signature (RFC 7515) in either general or flattened JSON serialization
+type jws struct {
+	Payload    string         `json:"payload"`
+	Signatures []jwsSignature `json:"signatures"`
+	jwsSignature
+}
+
+// verify checks that the JWS is signed by the given key
+func (j *jws) verify(key *jwk) bool {
+	pub, err := key.ecdsaPublicKey()
+	if err != nil {
+		return false
+	}
+
+	signatures := j.Signatures
+	if j.Signature != "" {
+		signatures = append(signatures, j.jwsSignature)
+	}
+	for _, s := range signatures {
+		protected, err := base64.RawURLEncoding.DecodeString(s.Protected)
+		if err != nil {
+			continue
+		}
+		var hdr struct {
+			Alg string `json:"alg"`
+		}
+		if err := json.Unmarshal(protected, &hdr); err != nil {
+			continue
+		}
+		var h crypto.Hash
+		switch hdr.Alg {
+		case "ES256":
+			h = crypto.SHA256
+		case "ES384":
+			h = crypto.SHA384
+		case "ES512":
+			h = crypto.SHA512
+		default:
+			continue
+		}
+
+		sig, err := base64.RawURLEncoding.DecodeString(s.Signature)
+		if err != nil {
+			continue
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			continue
+		}
+		hash := h.New()
+		hash.Write([]byte(s.Protected + "." + j.Payload))
+		r := new(big.Int).SetBytes(sig[:size])
+		ss := new(big.Int).SetBytes(sig[size:])
+		if ecdsa.Verify(pub, hash.Sum(nil), r, ss) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchTangAdvertisement downloads the advertisement from the tang server and returns its keys.
+// The advertisement must be signed by one of its own verification keys. If thp is not empty then the advertisement
+// must contain a key with this thumbprint (the key pinned at the time of binding), it protects against a server
+// that has been replaced or rotated its keys.
+// The request is bounded by TangTimeout, if the server does not respond ErrTangUnreachable is returned.
+func fetchTangAdvertisement(ctx context.Context, url string, thp string) ([]jwk, error) {
+	ctx, cancel := context.WithTimeout(ctx, TangTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(url, "/")+"/adv", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTangUnreachable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tang server %v returned status %v", url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, tangMaxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTangUnreachable, err)
+	}
+
+	var adv jws
+	if err := json.Unmarshal(body, &adv); err != nil {
+		return nil, fmt.Errorf("invalid tang advertisement: %v", err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(adv.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tang advertisement payload: %v", err)
+	}
+	var keys struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(payload, &keys); err != nil {
+		return nil, fmt.Errorf("invalid tang advertisement payload: %v", err)
+	}
+
+	signed := false
+	for i := range keys.Keys {
+		if keys.Keys[i].hasKeyOp("verify") && adv.verify(&keys.Keys[i]) {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return nil, fmt.Errorf("tang advertisement from %v is not signed by its verification keys", url)
+	}
+
+	if thp != "" {
+		pinned := false
+		for i := range keys.Keys {
+			if keys.Keys[i].hasThumbprint(thp) {
+				pinned = true
+				break
+			}
+		}
+		if !pinned {
+			return nil, fmt.Errorf("tang advertisement from %v does not contain the pinned key %v", url, thp)
+		}
+	}
+
+	return keys.Keys, nil
+}
+
+// fetchTangAdvertisementAny tries the tang servers in order until one of them returns a valid advertisement.
+// Each server is contacted with its own TangTimeout. It returns the URL of the server that responded.
+// If none of the servers responds then ErrTangUnreachable is returned.
+func fetchTangAdvertisementAny(ctx context.Context, urls []string, thp string) (string, []jwk, error) {
+	if len(urls) == 0 {
+		return "", nil, fmt.Errorf("no tang servers are specified")
+	}
+
+	var firstErr error
+	for _, url := range urls {
+		if err := ctx.Err(); err != nil {
+			return "", nil, err
+		}
+
+		keys, err := fetchTangAdvertisement(ctx, url, thp)
+		if err == nil {
+			return url, keys, nil
+		}
+		// prefer reporting a "real" error (e.g. pinned key mismatch) over unreachable servers
+		if firstErr == nil || (errors.Is(firstErr, ErrTangUnreachable) && !errors.Is(err, ErrTangUnreachable)) {
+			firstErr = err
+		}
+	}
+	return "", nil, firstErr
+}
@@ -0,0 +1,167 @@
+package luks
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func ecJWK(key *ecdsa.PrivateKey, alg string, ops ...string) jwk {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return jwk{
+		Kty:    "EC",
+		Crv:    key.Curve.Params().Name,
+		X:      base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size))),
+		Y:      base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+		Alg:    alg,
+		KeyOps: ops,
+	}
+}
+
+// testTangServer is a minimal tang server that serves a signed advertisement
+type testTangServer struct {
+	*httptest.Server
+	signKey     *ecdsa.PrivateKey
+	exchangeKey *ecdsa.PrivateKey
+}
+
+func newTestTangServer(t *testing.T) *testTangServer {
+	signKey, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	require.NoError(t, err)
+	exchangeKey, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	require.NoError(t, err)
+
+	keys := struct {
+		Keys []jwk `json:"keys"`
+	}{[]jwk{ecJWK(signKey, "ES512", "verify"), ecJWK(exchangeKey, "ECMR", "deriveKey")}}
+	payload, err := json.Marshal(keys)
+	require.NoError(t, err)
+
+	protected := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"ES512","cty":"jwk-set+json"}`))
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha512.Sum512([]byte(protected + "." + encodedPayload))
+	r, s, err := ecdsa.Sign(rand.Reader, signKey, hash[:])
+	require.NoError(t, err)
+	size := 66
+	sig := append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+
+	adv, err := json.Marshal(jws{
+		Payload:    encodedPayload,
+		Signatures: []jwsSignature{{Protected: protected, Signature: base64.RawURLEncoding.EncodeToString(sig)}},
+	})
+	require.NoError(t, err)
+
+	srv := &testTangServer{signKey: signKey, exchangeKey: exchangeKey}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/adv", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/jose+json")
+		_, _ = w.Write(adv)
+	})
+	mux.HandleFunc("/rec/", func(w http.ResponseWriter, r *http.Request) {
+		var req jwk
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		x, err := req.ecdsaPublicKey()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		yx, yy := exchangeKey.Curve.ScalarMult(x.X, x.Y, exchangeKey.D.Bytes())
+		w.Header().Set("Content-Type", "application/jwk+json")
+		_ = json.NewEncoder(w).Encode(ecPointJWK(exchangeKey.Curve, yx, yy))
+	})
+	srv.Server = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestFetchTangAdvertisement(t *testing.T) {
+	srv := newTestTangServer(t)
+
+	exchange := ecJWK(srv.exchangeKey, "ECMR", "deriveKey")
+	thp, err := exchange.thumbprint(crypto.SHA256)
+	require.NoError(t, err)
+
+	keys, err := fetchTangAdvertisement(context.Background(), srv.URL, thp)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	require.Equal(t, exchange, keys[1])
+
+	// old clevis versions pin sha1 thumbprints
+	thp1, err := exchange.thumbprint(crypto.SHA1)
+	require.NoError(t, err)
+	_, err = fetchTangAdvertisement(context.Background(), srv.URL+"/", thp1)
+	require.NoError(t, err)
+
+	_, err = fetchTangAdvertisement(context.Background(), srv.URL, "5gJ9uJaBqtmDtyGsGyjDL1vq2Uc")
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrTangUnreachable)
+
+	other := newTestTangServer(t)
+	_, err = fetchTangAdvertisement(context.Background(), other.URL, thp)
+	require.Error(t, err)
+}
+
+func TestFetchTangAdvertisementTimeout(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	timeout := TangTimeout
+	TangTimeout = 100 * time.Millisecond
+	defer func() { TangTimeout = timeout }()
+
+	start := time.Now()
+	_, err := fetchTangAdvertisement(context.Background(), srv.URL, "")
+	require.ErrorIs(t, err, ErrTangUnreachable)
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = fetchTangAdvertisement(ctx, srv.URL, "")
+	require.ErrorIs(t, err, ErrTangUnreachable)
+}
+
+func TestFetchTangAdvertisementFailover(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	downURL := down.URL
+	down.Close() // nothing listens at this address anymore
+
+	srv := newTestTangServer(t)
+	exchange := ecJWK(srv.exchangeKey, "ECMR", "deriveKey")
+	thp, err := exchange.thumbprint(crypto.SHA256)
+	require.NoError(t, err)
+
+	url, keys, err := fetchTangAdvertisementAny(context.Background(), []string{downURL, srv.URL}, thp)
+	require.NoError(t, err)
+	require.Equal(t, srv.URL, url)
+	require.Contains(t, keys, exchange)
+
+	_, _, err = fetchTangAdvertisementAny(context.Background(), []string{downURL, downURL}, thp)
+	require.ErrorIs(t, err, ErrTangUnreachable)
+
+	// a server with different keys is not a valid replacement of an unreachable one
+	other := newTestTangServer(t)
+	_, _, err = fetchTangAdvertisementAny(context.Background(), []string{downURL, other.URL}, thp)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrTangUnreachable)
+}
@@ -0,0 +1,168 @@
+package luks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// TokenHandler recovers keyslot passphrases from tokens of a specific type without user interaction
+// e.g. by unsealing a secret with TPM or by contacting a tang server.
+type TokenHandler interface {
+	// Available reports whether the token can be handled in the current environment (TPM is present,
+	// tang server is reachable, etc.)
+	Available(token Token) bool
+	// Passphrase recovers passphrase for the token's keyslots
+	Passphrase(token Token) ([]byte, error)
+}
+
+var (
+	tokenHandlersMu sync.RWMutex
+	tokenHandlers   = make(map[string]TokenHandler)
+)
+
+// RegisterTokenHandler registers handler for the given token type. A nil handler unregisters the type.
+func RegisterTokenHandler(tokenType string, handler TokenHandler) {
+	tokenHandlersMu.Lock()
+	defer tokenHandlersMu.Unlock()
+
+	if handler == nil {
+		delete(tokenHandlers, tokenType)
+	} else {
+		tokenHandlers[tokenType] = handler
+	}
+}
+
+func getTokenHandler(tokenType string) TokenHandler {
+	tokenHandlersMu.RLock()
+	defer tokenHandlersMu.RUnlock()
+
+	return tokenHandlers[tokenType]
+}
+
+// TokenDecoder parses the raw token payload into a typed value. For LUKS2 the payload is the token JSON object,
+// for LUKS1 it is the luksmeta slot data.
+type TokenDecoder func(payload []byte) (interface{}, error)
+
+var (
+	tokenDecodersMu sync.RWMutex
+	tokenDecoders   = make(map[string]TokenDecoder)
+)
+
+// RegisterTokenType registers a payload decoder for the given token type. Tokens of this type returned by
+// Device.Tokens() have Token.Value set to the decoded payload, Token.Payload keeps the raw data.
+// A nil decoder unregisters the type.
+func RegisterTokenType(tokenType string, decoder TokenDecoder) {
+	tokenDecodersMu.Lock()
+	defer tokenDecodersMu.Unlock()
+
+	tokenType = normalizeTokenType(tokenType)
+	if decoder == nil {
+		delete(tokenDecoders, tokenType)
+	} else {
+		tokenDecoders[tokenType] = decoder
+	}
+}
+
+func getTokenDecoder(tokenType string) TokenDecoder {
+	tokenDecodersMu.RLock()
+	defer tokenDecodersMu.RUnlock()
+
+	return tokenDecoders[tokenType]
+}
+
+// decodeToken sets the token value using the decoder registered for its type. Tokens of unknown types are left as is.
+func decodeToken(t *Token) error {
+	decoder := getTokenDecoder(t.Type)
+	if decoder == nil {
+		return nil
+	}
+	value, err := decoder(t.Payload)
+	if err != nil {
+		return fmt.Errorf("unable to decode token %d of type %s: %v", t.ID, t.Type, err)
+	}
+	t.Value = value
+	return nil
+}
+
+// autoUnlockable checks if any token bound to an active keyslot can be handled by a registered handler
+func autoUnlockable(d device) bool {
+	tokens, err := d.Tokens()
+	if err != nil {
+		return false
+	}
+
+	active := make(map[int]bool)
+	for _, s := range d.Slots() {
+		active[s] = true
+	}
+
+	for _, t := range tokens {
+		h := getTokenHandler(t.Type)
+		if h == nil {
+			continue
+		}
+		for _, s := range t.Slots {
+			if active[s] && h.Available(t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RemapTokenSlots returns a copy of the token with keyslot references remapped according to the mapping
+// (source keyslot id -> target keyslot id). It is useful for migrating tokens between devices.
+// Both Slots and the "keyslots" field of a JSON (LUKS2) payload are updated. An error is returned if the mapping
+// is missing any referenced keyslot.
+func RemapTokenSlots(t Token, mapping map[int]int) (Token, error) {
+	remapped := t
+	remapped.Slots = make([]int, len(t.Slots))
+	for i, s := range t.Slots {
+		target, ok := mapping[s]
+		if !ok {
+			return Token{}, fmt.Errorf("token %d references keyslot %d that is missing in the mapping", t.ID, s)
+		}
+		remapped.Slots[i] = target
+	}
+	remapped.Payload = append([]byte(nil), t.Payload...)
+
+	var node map[string]json.RawMessage
+	if err := json.Unmarshal(t.Payload, &node); err != nil {
+		// not a JSON object (e.g. LUKS1 luksmeta payload), keyslots are not stored in the payload
+		return remapped, nil
+	}
+	raw, ok := node["keyslots"]
+	if !ok {
+		return remapped, nil
+	}
+	var keyslots []json.Number
+	if err := json.Unmarshal(raw, &keyslots); err != nil {
+		return Token{}, fmt.Errorf("invalid token %d keyslots: %v", t.ID, err)
+	}
+	updated := make(numberList, len(keyslots))
+	for i, k := range keyslots {
+		s, err := k.Int64()
+		if err != nil {
+			return Token{}, fmt.Errorf("invalid token %d keyslot %v: %v", t.ID, k, err)
+		}
+		target, ok := mapping[int(s)]
+		if !ok {
+			return Token{}, fmt.Errorf("token %d references keyslot %d that is missing in the mapping", t.ID, s)
+		}
+		updated[i] = json.Number(strconv.Itoa(target))
+	}
+
+	raw, err := json.Marshal(updated)
+	if err != nil {
+		return Token{}, err
+	}
+	node["keyslots"] = raw
+	payload, err := json.Marshal(node)
+	if err != nil {
+		return Token{}, err
+	}
+	remapped.Payload = payload
+	return remapped, nil
+}
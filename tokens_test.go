@@ -0,0 +1,116 @@
+package luks
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testTokenHandler struct {
+	available bool
+}
+
+func (h testTokenHandler) Available(Token) bool { return h.available }
+
+func (h testTokenHandler) Passphrase(Token) ([]byte, error) { return []byte("foobar"), nil }
+
+func TestAutoUnlockable(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+
+	// no tokens at all
+	require.False(t, d.AutoUnlockable())
+
+	d.meta.Tokens[0] = json.RawMessage(`{"type":"test-available","keyslots":["0"]}`)
+	require.False(t, d.AutoUnlockable())
+
+	RegisterTokenHandler("test-available", testTokenHandler{available: true})
+	defer RegisterTokenHandler("test-available", nil)
+	require.True(t, d.AutoUnlockable())
+
+	// token is bound to a non-existent keyslot
+	d.meta.Tokens[0] = json.RawMessage(`{"type":"test-available","keyslots":["5"]}`)
+	require.False(t, d.AutoUnlockable())
+
+	// handler cannot be used in the current environment
+	RegisterTokenHandler("test-unavailable", testTokenHandler{available: false})
+	defer RegisterTokenHandler("test-unavailable", nil)
+	d.meta.Tokens[0] = json.RawMessage(`{"type":"test-unavailable","keyslots":["0"]}`)
+	require.False(t, d.AutoUnlockable())
+}
+
+type testTokenPayload struct {
+	Secret string
+}
+
+func TestRegisterTokenType(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+
+	d.meta.Tokens[0] = json.RawMessage(`{"type":"test-decoded","keyslots":["0"],"secret":"abc"}`)
+	d.meta.Tokens[1] = json.RawMessage(`{"type":"test-unknown","keyslots":["0"],"foo":1}`)
+
+	RegisterTokenType("test-decoded", func(payload []byte) (interface{}, error) {
+		var p testTokenPayload
+		err := json.Unmarshal(payload, &p)
+		return p, err
+	})
+	defer RegisterTokenType("test-decoded", nil)
+
+	tokens, err := d.Tokens()
+	require.NoError(t, err)
+	require.Len(t, tokens, 2)
+	for _, tok := range tokens {
+		switch tok.Type {
+		case "test-decoded":
+			require.Equal(t, testTokenPayload{Secret: "abc"}, tok.Value)
+		case "test-unknown":
+			require.Nil(t, tok.Value)
+			require.Equal(t, `{"type":"test-unknown","keyslots":["0"],"foo":1}`, string(tok.Payload))
+		}
+	}
+
+	// decoding errors are reported
+	d.meta.Tokens[0] = json.RawMessage(`{"type":"test-decoded","keyslots":["0"],"secret":1}`)
+	_, err = d.Tokens()
+	require.Error(t, err)
+
+	RegisterTokenType("test-decoded", nil)
+	tokens, err = d.Tokens()
+	require.NoError(t, err)
+	for _, tok := range tokens {
+		require.Nil(t, tok.Value)
+	}
+}
+
+func TestRemapTokenSlots(t *testing.T) {
+	token := Token{
+		ID:      2,
+		Slots:   []int{1, 3},
+		Type:    SystemdTPM2TokenType,
+		Payload: []byte(`{"type":"systemd-tpm2","keyslots":["1","3"],"tpm2-pcrs":[7]}`),
+	}
+
+	remapped, err := RemapTokenSlots(token, map[int]int{1: 0, 3: 5, 4: 6})
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 5}, remapped.Slots)
+	require.Equal(t, 2, remapped.ID)
+	require.Equal(t, SystemdTPM2TokenType, remapped.Type)
+	require.JSONEq(t, `{"type":"systemd-tpm2","keyslots":["0","5"],"tpm2-pcrs":[7]}`, string(remapped.Payload))
+	// the original token is not modified
+	require.Equal(t, []int{1, 3}, token.Slots)
+	require.Contains(t, string(token.Payload), `["1","3"]`)
+
+	_, err = RemapTokenSlots(token, map[int]int{1: 0})
+	require.Error(t, err)
+
+	// LUKS1 luksmeta payload is opaque
+	luksmeta := Token{ID: 1, Slots: []int{1}, Type: ClevisTokenType, Payload: []byte("eyJhbGciOiJFQ0RILUVTIn0..")}
+	remapped, err = RemapTokenSlots(luksmeta, map[int]int{1: 4})
+	require.NoError(t, err)
+	require.Equal(t, []int{4}, remapped.Slots)
+	require.Equal(t, luksmeta.Payload, remapped.Payload)
+}
@@ -0,0 +1,161 @@
+package luks
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// SystemdTPM2Token is a parsed `systemd-tpm2` token as created by systemd-cryptenroll
+type SystemdTPM2Token struct {
+	Keyslots []int
+	// Blobs are the sealed key objects (TPM2B_PRIVATE followed by TPM2B_PUBLIC). Older systemd versions store
+	// a single blob.
+	Blobs [][]byte
+	// PCRs is the list of PCR indexes the key is bound to
+	PCRs []int
+	// PCRBank is the PCR hash algorithm e.g. "sha256"
+	PCRBank string
+	// PublicKey is the PEM encoded public key used for signed PCR policies
+	PublicKey []byte
+	// PublicKeyPCRs is the list of PCR indexes covered by the signed policy
+	PublicKeyPCRs []int
+	// PrimaryAlg is the algorithm of the primary key e.g. "ecc" or "rsa"
+	PrimaryAlg string
+	// PolicyHashes are the expected policy digests, one per blob
+	PolicyHashes [][]byte
+	// PIN reports whether a PIN is required in addition to the PCR policy
+	PIN bool
+	// PCRLock reports whether the policy is managed by systemd-pcrlock
+	PCRLock bool
+	// PCRLockNV is the NV index policy data used by systemd-pcrlock
+	PCRLockNV []byte
+	// Salt is used to derive the TPM PIN
+	Salt []byte
+	// SRK is the marshalled storage root key the blob is sealed against
+	SRK []byte
+}
+
+// PCRMask returns the PCRs as a bit mask
+func (t *SystemdTPM2Token) PCRMask() uint32 {
+	var mask uint32
+	for _, p := range t.PCRs {
+		mask |= 1 << uint(p)
+	}
+	return mask
+}
+
+// tpm2TokenJSON is the JSON schema of the token, see tpm2_make_luks2_json() at systemd
+type tpm2TokenJSON struct {
+	Keyslots      numberList      `json:"keyslots"`
+	Blob          json.RawMessage `json:"tpm2-blob"`
+	PCRs          []int           `json:"tpm2-pcrs"`
+	PCRBank       string          `json:"tpm2-pcr-bank"`
+	PublicKey     string          `json:"tpm2_pubkey"`
+	PublicKeyPCRs []int           `json:"tpm2_pubkey_pcrs"`
+	PrimaryAlg    string          `json:"tpm2-primary-alg"`
+	PolicyHash    json.RawMessage `json:"tpm2-policy-hash"`
+	PIN           bool            `json:"tpm2-pin"`
+	PCRLock       bool            `json:"tpm2_pcrlock"`
+	PCRLockNV     string          `json:"tpm2_pcrlock_nv"`
+	Salt          string          `json:"tpm2_salt"`
+	SRK           string          `json:"tpm2_srk"`
+}
+
+// ParseSystemdTPM2Token parses LUKS2 `systemd-tpm2` token payload
+func ParseSystemdTPM2Token(payload []byte) (*SystemdTPM2Token, error) {
+	var node tpm2TokenJSON
+	if err := json.Unmarshal(payload, &node); err != nil {
+		return nil, fmt.Errorf("invalid systemd-tpm2 token: %v", err)
+	}
+
+	var (
+		t   SystemdTPM2Token
+		err error
+	)
+	if t.Keyslots, err = node.Keyslots.ints(); err != nil {
+		return nil, fmt.Errorf("invalid systemd-tpm2 token keyslots: %v", err)
+	}
+	if len(node.Blob) != 0 {
+		if t.Blobs, err = decodeStringOrList(node.Blob, base64.StdEncoding.DecodeString); err != nil {
+			return nil, fmt.Errorf("invalid systemd-tpm2 token tpm2-blob: %v", err)
+		}
+	}
+	if len(node.PolicyHash) != 0 {
+		if t.PolicyHashes, err = decodeStringOrList(node.PolicyHash, hex.DecodeString); err != nil {
+			return nil, fmt.Errorf("invalid systemd-tpm2 token tpm2-policy-hash: %v", err)
+		}
+	}
+	if err := checkPCRs(node.PCRs); err != nil {
+		return nil, err
+	}
+	if err := checkPCRs(node.PublicKeyPCRs); err != nil {
+		return nil, err
+	}
+
+	for _, f := range []struct {
+		name string
+		in   string
+		out  *[]byte
+	}{
+		{"tpm2_pubkey", node.PublicKey, &t.PublicKey},
+		{"tpm2_pcrlock_nv", node.PCRLockNV, &t.PCRLockNV},
+		{"tpm2_salt", node.Salt, &t.Salt},
+		{"tpm2_srk", node.SRK, &t.SRK},
+	} {
+		if f.in == "" {
+			continue
+		}
+		if *f.out, err = base64.StdEncoding.DecodeString(f.in); err != nil {
+			return nil, fmt.Errorf("invalid systemd-tpm2 token %s: %v", f.name, err)
+		}
+	}
+
+	t.PCRs = node.PCRs
+	t.PCRBank = node.PCRBank
+	t.PublicKeyPCRs = node.PublicKeyPCRs
+	t.PrimaryAlg = node.PrimaryAlg
+	t.PIN = node.PIN
+	t.PCRLock = node.PCRLock
+	return &t, nil
+}
+
+// checkPCRs verifies the PCR indexes are in range of a PC client TPM
+func checkPCRs(pcrs []int) error {
+	for _, p := range pcrs {
+		if p < 0 || p >= 24 {
+			return fmt.Errorf("invalid systemd-tpm2 token PCR index %d", p)
+		}
+	}
+	return nil
+}
+
+// decodeStringOrList decodes a JSON value that is either a single encoded string or a list of them.
+// systemd switched to lists when it started to support multiple sealed blobs per token.
+func decodeStringOrList(raw json.RawMessage, decode func(string) ([]byte, error)) ([][]byte, error) {
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, fmt.Errorf("expected a string or a list of strings")
+		}
+		list = []string{s}
+	}
+
+	result := make([][]byte, len(list))
+	for i, s := range list {
+		data, err := decode(s)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = data
+	}
+	return result, nil
+}
+
+func init() {
+	RegisterTokenType(SystemdTPM2TokenType, func(payload []byte) (interface{}, error) {
+		return ParseSystemdTPM2Token(payload)
+	})
+}
@@ -0,0 +1,58 @@
+package luks
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSystemdTPM2Token(t *testing.T) {
+	// systemd v256 format with a list of blobs and policy hashes
+	payload := []byte(`{"type":"systemd-tpm2","keyslots":["1"],"tpm2-blob":["AAEC","AwQ="],"tpm2-pcrs":[0,7],
+		"tpm2-pcr-bank":"sha256","tpm2-primary-alg":"ecc","tpm2-policy-hash":["00ff","abcd"],"tpm2-pin":true,
+		"tpm2_pcrlock":false,"tpm2_salt":"c2FsdA==","tpm2_srk":"c3Jr","tpm2_pubkey":"cHVia2V5","tpm2_pubkey_pcrs":[11]}`)
+	tok, err := ParseSystemdTPM2Token(payload)
+	require.NoError(t, err)
+	require.Equal(t, []int{1}, tok.Keyslots)
+	require.Equal(t, [][]byte{{0, 1, 2}, {3, 4}}, tok.Blobs)
+	require.Equal(t, []int{0, 7}, tok.PCRs)
+	require.Equal(t, uint32(0x81), tok.PCRMask())
+	require.Equal(t, "sha256", tok.PCRBank)
+	require.Equal(t, "ecc", tok.PrimaryAlg)
+	require.Equal(t, [][]byte{{0x00, 0xff}, {0xab, 0xcd}}, tok.PolicyHashes)
+	require.True(t, tok.PIN)
+	require.False(t, tok.PCRLock)
+	require.Equal(t, []byte("salt"), tok.Salt)
+	require.Equal(t, []byte("srk"), tok.SRK)
+	require.Equal(t, []byte("pubkey"), tok.PublicKey)
+	require.Equal(t, []int{11}, tok.PublicKeyPCRs)
+
+	// older format with a single blob and policy hash
+	tok, err = ParseSystemdTPM2Token([]byte(`{"type":"systemd-tpm2","keyslots":["0"],"tpm2-blob":"AAEC","tpm2-pcrs":[7],"tpm2-policy-hash":"00ff"}`))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{{0, 1, 2}}, tok.Blobs)
+	require.Equal(t, [][]byte{{0x00, 0xff}}, tok.PolicyHashes)
+
+	_, err = ParseSystemdTPM2Token([]byte(`{"tpm2-blob":"not base64!"}`))
+	require.Error(t, err)
+	_, err = ParseSystemdTPM2Token([]byte(`{"tpm2-blob":"AAEC","tpm2-pcrs":[24]}`))
+	require.Error(t, err)
+	_, err = ParseSystemdTPM2Token([]byte(`{"tpm2-policy-hash":"xyz"}`))
+	require.Error(t, err)
+}
+
+func TestSystemdTPM2TokenDecoded(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+
+	d.meta.Tokens[0] = json.RawMessage(`{"type":"systemd-tpm2","keyslots":["0"],"tpm2-blob":"AAEC","tpm2-pcrs":[7],"tpm2-pcr-bank":"sha256"}`)
+	tokens, err := d.Tokens()
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	tok, ok := tokens[0].Value.(*SystemdTPM2Token)
+	require.True(t, ok)
+	require.Equal(t, uint32(1<<7), tok.PCRMask())
+	require.Equal(t, "sha256", tok.PCRBank)
+}
@@ -2,23 +2,29 @@ package luks
 
 import (
 	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
+	"context"
+	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/subtle"
 	"fmt"
 	"hash"
+	"io"
 	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"unsafe"
 
-	"github.com/dgryski/go-camellia"
 	"github.com/jzelinskie/whirlpool"
 	"golang.org/x/crypto/blake2b"
 	"golang.org/x/crypto/blake2s"
 	"golang.org/x/crypto/ripemd160"
 	"golang.org/x/crypto/sha3"
-	"golang.org/x/crypto/twofish"
 	"golang.org/x/sys/unix"
 )
 
@@ -47,10 +53,79 @@ func fileSize(f *os.File) (uint64, error) {
 	return uint64(sz), err
 }
 
+// deferredRemove asks device-mapper to remove the mapping once it is not used anymore (DM_DEFERRED_REMOVE).
+// devmapper.go does not expose ioctl flags for removal thus the ioctl is issued directly.
+func deferredRemove(name string) error {
+	var req unix.DmIoctl
+	if len(name) >= len(req.Name) {
+		return fmt.Errorf("device-mapper name %q is too long", name)
+	}
+
+	control, err := os.Open("/dev/mapper/control")
+	if err != nil {
+		return err
+	}
+	defer control.Close()
+
+	req.Version = [3]uint32{unix.DM_VERSION_MAJOR, 0, 0}
+	req.Data_size = unix.SizeofDmIoctl
+	req.Data_start = unix.SizeofDmIoctl
+	req.Flags = unix.DM_DEFERRED_REMOVE
+	copy(req.Name[:], name)
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, control.Fd(), unix.DM_DEV_REMOVE, uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		return os.NewSyscallError("dm deferred remove", errno)
+	}
+	return nil
+}
+
+// availableMemory returns amount of memory (in bytes) available for new allocations without swapping.
+// It uses MemAvailable from /proc/meminfo and falls back to sysinfo() free memory if the former is not available.
+func availableMemory() (uint64, error) {
+	if data, err := os.ReadFile("/proc/meminfo"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || fields[0] != "MemAvailable:" {
+				continue
+			}
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid MemAvailable value: %v", err)
+			}
+			return kb * 1024, nil
+		}
+	}
+
+	var info unix.Sysinfo_t
+	if err := unix.Sysinfo(&info); err != nil {
+		return 0, err
+	}
+	return uint64(info.Freeram) * uint64(info.Unit), nil
+}
+
 func isPowerOfTwo(x uint) bool {
 	return (x & (x - 1)) == 0
 }
 
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
 func roundUp(n int, divider int) int {
 	return (n + divider - 1) / divider * divider
 }
@@ -63,10 +138,220 @@ func fixedArrayToString(buff []byte) string {
 	return string(buff)
 }
 
+// putFixedString writes the string to a fixed-size NUL-terminated header field (e.g. label).
+// The string must leave space for at least one terminating NUL byte, the rest of the field is zeroed.
+func putFixedString(field []byte, s string) error {
+	if len(s) >= len(field) {
+		return fmt.Errorf("string %q is too long, maximum length is %d bytes", s, len(field)-1)
+	}
+	if strings.IndexByte(s, 0) != -1 {
+		return fmt.Errorf("string %q contains NUL byte", s)
+	}
+
+	clearSlice(field)
+	copy(field, s)
+	return nil
+}
+
+// wipeArea overwrites the given on-disk region with random data so the previous content (e.g. keyslot material)
+// can't be recovered
+func wipeArea(s Storage, offset int64, size int64) error {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	if _, err := s.WriteAt(buf, offset); err != nil {
+		return err
+	}
+	return syncStorage(s)
+}
+
+// deriveKey runs the derivation (KDF, digest) of the secret and returns early with ctx.Err() if ctx is cancelled.
+// x/crypto KDFs can't be interrupted, so a cancelled derivation keeps running in the background with its own copy
+// of the secret. Both the copy and the derived key are wiped once it completes.
+func deriveKey(ctx context.Context, secret []byte, derive func(secret []byte) ([]byte, error)) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ctx.Done() == nil {
+		// the context is never cancelled
+		return derive(secret)
+	}
+
+	type result struct {
+		key []byte
+		err error
+	}
+	secretCopy := secureCopy(secret)
+	done := make(chan result, 1)
+	go func() {
+		key, err := derive(secretCopy)
+		clearSlice(secretCopy)
+		done <- result{key, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.key, r.err
+	case <-ctx.Done():
+		go func() {
+			r := <-done
+			clearSlice(r.key)
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// digestsEqual reports whether the computed digest matches the stored one. The comparison takes constant time so
+// an attacker driving unlock attempts can't learn which byte mismatched, only the (public) stored length matters.
+// A computed digest longer than the stored one is compared by its prefix as LUKS stores truncated digests.
+func digestsEqual(computed, stored []byte) bool {
+	if len(stored) == 0 || len(computed) < len(stored) {
+		return false
+	}
+	return subtle.ConstantTimeCompare(computed[:len(stored)], stored) == 1
+}
+
+// clearSlice wipes the secret, a slice in secure memory is released (see SetSecureMemory)
 func clearSlice(slice []byte) {
 	for i := range slice {
 		slice[i] = 0
 	}
+	secureRelease(slice)
+}
+
+// decryptKeyslotArea decrypts the keyslot area in-place, firstSector is the number of the first data sector
+// within the area. XTS sectors are independent of each other thus the area is split into chunks that are
+// decrypted concurrently (bounded by GOMAXPROCS).
+func decryptKeyslotArea(ciph sectorCipher, data []byte, firstSector uint64) {
+	sectors := len(data) / storageSectorSize
+	workers := runtime.GOMAXPROCS(0)
+	if workers > sectors {
+		workers = sectors
+	}
+	if workers <= 1 {
+		decryptSectors(ciph, data, firstSector, 0, sectors)
+		return
+	}
+
+	chunk := (sectors + workers - 1) / workers
+	var wg sync.WaitGroup
+	for start := 0; start < sectors; start += chunk {
+		end := start + chunk
+		if end > sectors {
+			end = sectors
+		}
+
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			decryptSectors(ciph, data, firstSector, start, end)
+		}(start, end)
+	}
+	wg.Wait()
+}
+
+// keyslotMaterialSize returns size of the anti-forensic split key material rounded up to whole sectors,
+// see AF_split_sectors() at cryptsetup. The padding is encrypted together with the material and ignored on merge.
+func keyslotMaterialSize(keySize, stripes int) int {
+	return roundUp(keySize*stripes, storageSectorSize)
+}
+
+// splitKeyslotMaterial splits the key into stripesNum stripes and pads the material to whole sectors
+func splitKeyslotMaterial(key []byte, h hash.Hash) ([]byte, error) {
+	material, err := afSplit(key, stripesNum, h)
+	if err != nil {
+		return nil, err
+	}
+	size := keyslotMaterialSize(len(key), stripesNum)
+	if len(material) == size {
+		return material, nil
+	}
+	padded := make([]byte, size)
+	copy(padded, material)
+	clearSlice(material)
+	return padded, nil
+}
+
+// encryptKeyslotArea encrypts the keyslot area in-place
+func encryptKeyslotArea(ciph sectorCipher, data []byte) {
+	for i := 0; i < len(data)/storageSectorSize; i++ {
+		sector := data[i*storageSectorSize : (i+1)*storageSectorSize]
+		ciph.Encrypt(sector, sector, uint64(i))
+	}
+}
+
+// decryptSectors decrypts sectors [start, end) of data
+func decryptSectors(ciph sectorCipher, data []byte, firstSector uint64, start, end int) {
+	for i := start; i < end; i++ {
+		block := data[i*storageSectorSize : (i+1)*storageSectorSize]
+		ciph.Decrypt(block, block, firstSector+uint64(i))
+	}
+}
+
+// keyslotChunkSize is the amount of key material that is read and decrypted at once
+const keyslotChunkSize = 64 * 1024
+
+// keyslotChunkPool keeps the chunk buffers between unlock attempts e.g. when the user retypes a wrong passphrase.
+// A buffer holds decrypted key material, it is always wiped before it is returned to the pool.
+var keyslotChunkPool = sync.Pool{New: func() interface{} { return new([keyslotChunkSize]byte) }}
+
+// mergeKeyslotArea reads keySize*stripes bytes of encrypted key material at offset, decrypts it and merges
+// the anti-forensic stripes. The material is processed in chunks of keyslotChunkSize so the peak memory use
+// does not depend on the key material size.
+func mergeKeyslotArea(r io.ReaderAt, offset int64, ciph sectorCipher, keySize, stripes int, h hash.Hash) ([]byte, error) {
+	// the merger ignores the sector padding that follows the stripes
+	materialSize := keyslotMaterialSize(keySize, stripes)
+
+	buf := keyslotChunkPool.Get().(*[keyslotChunkSize]byte)
+	defer func() {
+		clearSlice(buf[:])
+		keyslotChunkPool.Put(buf)
+	}()
+	chunk := buf[:]
+	if len(chunk) > materialSize {
+		chunk = chunk[:materialSize]
+	}
+
+	merger := newAfMerger(keySize, stripes, h)
+	defer merger.clear()
+	for pos := 0; pos < materialSize; pos += len(chunk) {
+		if rest := materialSize - pos; rest < len(chunk) {
+			chunk = chunk[:rest]
+		}
+		if _, err := r.ReadAt(chunk, offset+int64(pos)); err != nil {
+			return nil, err
+		}
+		decryptKeyslotArea(ciph, chunk, uint64(pos/storageSectorSize))
+		merger.write(chunk)
+	}
+	return merger.result()
+}
+
+// SupportedModes returns list of block cipher modes supported for keyslot decryption
+func SupportedModes() []string {
+	return []string{"cbc", "xts"}
+}
+
+// SupportedHashes returns list of hash algorithms supported for key derivation, anti-forensic split and digests
+func SupportedHashes() []string {
+	return []string{
+		"sha1", "sha224", "sha256", "sha384", "sha512",
+		"sha3-224", "sha3-256", "sha3-384", "sha3-512",
+		"ripemd160", "blake2b-160", "blake2b-256", "blake2b-384", "blake2b-512", "blake2s-256", "whirlpool",
+	}
+}
+
+// sortedSet returns sorted list of the non-empty set elements
+func sortedSet(set map[string]bool) []string {
+	result := make([]string, 0, len(set))
+	for k := range set {
+		if k != "" {
+			result = append(result, k)
+		}
+	}
+	sort.Strings(result)
+	return result
 }
 
 // getHashAlgo gets hash implementation and the hash size by its name
@@ -108,29 +393,14 @@ func getHashAlgo(name string) (func() hash.Hash, int) {
 		// blake2s-{128,160,224} are not supported by golang crypto library
 		return blake2s256Constructor()
 	case "whirlpool":
+		// this is the standard Whirlpool. Headers created with libgcrypt older than 1.6.0 used a flawed
+		// implementation (cryptsetup calls it "whirlpool_gcryptbug") and can't be unlocked.
 		return whirlpool.New, 512 / 8
 	default:
 		return nil, 0
 	}
 }
 
-func getCipher(name string) (func(key []byte) (cipher.Block, error), error) {
-	switch name {
-	case "aes":
-		return aes.NewCipher, nil
-	case "camellia":
-		return camellia.New, nil
-	case "twofish":
-		f := func(key []byte) (cipher.Block, error) {
-			// twofish.NewCipher returns Cipher type, convert it to cipher.Block
-			return twofish.NewCipher(key)
-		}
-		return f, nil
-	default:
-		return nil, fmt.Errorf("Unknown cipher: %v", name)
-	}
-}
-
 func blake2bConstructor(size int) (func() hash.Hash, int) {
 	size = size / 8
 	return func() hash.Hash {
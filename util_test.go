@@ -1,16 +1,23 @@
 package luks
 
 import (
+	"context"
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"os/exec"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/xts"
 )
 
 func TestIsPowerOf2(t *testing.T) {
 	valid := []uint{1, 2, 4, 1 << 3, 1 << 8, 1 << 24}
-	invalid := []uint{3, 5, 9, 323, 34322, 6521212322}
+	invalid := []uint{3, 5, 9, 323, 34322, 3221225472}
 
 	for _, v := range valid {
 		require.True(t, isPowerOfTwo(v))
@@ -39,6 +46,143 @@ func TestFromNulEndedSlice(t *testing.T) {
 	check([]byte{'\x00'}, "")
 }
 
+func TestPutFixedString(t *testing.T) {
+	field := make([]byte, 48)
+
+	// exactly fitting string, the last byte is reserved for NUL terminator
+	label := strings.Repeat("a", 47)
+	require.NoError(t, putFixedString(field, label))
+	require.Equal(t, label, fixedArrayToString(field))
+	require.Equal(t, byte(0), field[47])
+
+	// shorter string clears leftovers of the previous value
+	require.NoError(t, putFixedString(field, "short"))
+	require.Equal(t, "short", fixedArrayToString(field))
+	require.Equal(t, make([]byte, 48-5), field[5:])
+
+	// oversized string does not modify the field
+	require.Error(t, putFixedString(field, strings.Repeat("b", 48)))
+	require.Equal(t, "short", fixedArrayToString(field))
+
+	require.Error(t, putFixedString(field, "with\x00nul"))
+}
+
+func TestGetHashAlgo(t *testing.T) {
+	h, size := getHashAlgo("sha256")
+	require.NotNil(t, h)
+	require.Equal(t, 32, size)
+	require.Equal(t, size, h().Size())
+
+	h, size = getHashAlgo("sha3-512")
+	require.NotNil(t, h)
+	require.Equal(t, 64, size)
+
+	h, size = getHashAlgo("whirlpool")
+	require.NotNil(t, h)
+	require.Equal(t, 64, size)
+	// ISO/IEC 10118-3 test vector, the flawed libgcrypt implementation produces a different digest
+	w := h()
+	w.Write([]byte("abc"))
+	require.Equal(t, "4e2448a4c6f486bb16b6562c73b4020bf3043e3a731bce721ae1b303d97e6d4c7181eebdb6c57e277d0e34957114cbd6c797fc9d95d8b582d225292076d4eef5", hex.EncodeToString(w.Sum(nil)))
+
+	h, _ = getHashAlgo("md5")
+	require.Nil(t, h)
+}
+
+func TestDigestsEqual(t *testing.T) {
+	stored := []byte{1, 2, 3, 4}
+	require.True(t, digestsEqual([]byte{1, 2, 3, 4}, stored))
+	// LUKS stores truncated digests
+	require.True(t, digestsEqual([]byte{1, 2, 3, 4, 5, 6}, stored))
+	require.False(t, digestsEqual([]byte{1, 2, 3, 5}, stored))
+	require.False(t, digestsEqual([]byte{0, 2, 3, 4}, stored))
+	// a digest shorter than the stored one never matches and must not panic
+	require.False(t, digestsEqual([]byte{1, 2}, stored))
+	require.False(t, digestsEqual([]byte{1, 2}, nil))
+}
+
+func TestGetCipher(t *testing.T) {
+	for _, name := range []string{"aes", "camellia", "serpent", "twofish"} {
+		c, err := getCipher(name)
+		require.NoError(t, err)
+		require.NotNil(t, c)
+	}
+
+	_, err := getCipher("des")
+	require.Error(t, err)
+}
+
+func TestDecryptKeyslotArea(t *testing.T) {
+	key := make([]byte, 64)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	ciph, err := xts.NewCipher(aes.NewCipher, key)
+	require.NoError(t, err)
+
+	// the parallel implementation must be bit-identical to the sequential one for any number of stripes
+	for _, stripes := range []int{1, 7, 512, 4000, 10000} {
+		data := make([]byte, roundUp(32*stripes, storageSectorSize))
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+
+		expected := append([]byte(nil), data...)
+		decryptSectors(ciph, expected, 0, 0, len(expected)/storageSectorSize)
+
+		decryptKeyslotArea(ciph, data, 0)
+		require.Equal(t, expected, data, "stripes: %d", stripes)
+	}
+}
+
+func BenchmarkDecryptKeyslotArea(b *testing.B) {
+	for _, spec := range []struct {
+		name         string
+		mode, ivMode string
+		keySize      int
+	}{
+		{"XTS", "xts", "plain64", 64},
+		{"CBC", "cbc", "essiv:sha256", 32},
+	} {
+		ciph, err := newSectorCipher("aes", spec.mode, spec.ivMode, make([]byte, spec.keySize))
+		require.NoError(b, err)
+
+		for _, stripes := range []int{4000, 40000} {
+			data := make([]byte, 64*stripes)
+
+			b.Run(fmt.Sprintf("%sSerial%d", spec.name, stripes), func(b *testing.B) {
+				b.SetBytes(int64(len(data)))
+				for i := 0; i < b.N; i++ {
+					decryptSectors(ciph, data, 0, 0, len(data)/storageSectorSize)
+				}
+			})
+			b.Run(fmt.Sprintf("%sParallel%d", spec.name, stripes), func(b *testing.B) {
+				b.SetBytes(int64(len(data)))
+				for i := 0; i < b.N; i++ {
+					decryptKeyslotArea(ciph, data, 0)
+				}
+			})
+		}
+	}
+
+	// the x/crypto implementation for comparison
+	reference, err := xts.NewCipher(aes.NewCipher, make([]byte, 64))
+	require.NoError(b, err)
+	data := make([]byte, 64*4000)
+	b.Run("XTSReference4000", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			decryptSectors(reference, data, 0, 0, len(data)/storageSectorSize)
+		}
+	})
+}
+
+// skipIfMissing skips the test if the given binary (e.g. cryptsetup) is not available at the host
+func skipIfMissing(t *testing.T, binary string) {
+	t.Helper()
+	if _, err := exec.LookPath(binary); err != nil {
+		t.Skipf("%s binary is not found, skipping the test", binary)
+	}
+}
+
 func blkidUUID(filename string) (string, error) {
 	cmdOut, err := exec.Command("blkid", "-s", "UUID", "-o", "value", filename).CombinedOutput()
 	if err != nil {
@@ -46,3 +190,46 @@ func blkidUUID(filename string) (string, error) {
 	}
 	return strings.Trim(string(cmdOut), "\n"), nil
 }
+
+func TestAvailableMemory(t *testing.T) {
+	mem, err := availableMemory()
+	require.NoError(t, err)
+	require.NotZero(t, mem)
+}
+
+func TestDeferredRemoveLongName(t *testing.T) {
+	require.Error(t, deferredRemove(strings.Repeat("x", 128)))
+}
+
+func TestDeriveKeyCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	secret := []byte("secret")
+	started, release, finished := make(chan bool), make(chan bool), make(chan bool)
+	go func() {
+		_, err := deriveKey(ctx, secret, func(s []byte) ([]byte, error) {
+			close(started)
+			<-release
+			return []byte("derived key"), nil
+		})
+		require.ErrorIs(t, err, context.Canceled)
+		close(finished)
+	}()
+
+	<-started
+	cancel()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("deriveKey does not return after the context is cancelled")
+	}
+	close(release)
+
+	// the caller might wipe its secret right away, the derivation works with a copy
+	clearSlice(secret)
+
+	_, err := deriveKey(ctx, secret, func(s []byte) ([]byte, error) {
+		panic("derivation with cancelled context")
+	})
+	require.ErrorIs(t, err, context.Canceled)
+}
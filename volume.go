@@ -1,10 +1,14 @@
 package luks
 
 import (
+	"context"
+	"encoding/hex"
 	"fmt"
+	"runtime"
 	"strings"
 
 	"github.com/anatol/devmapper.go"
+	"golang.org/x/sys/unix"
 )
 
 // Volume represents information provided by an unsealed (i.e. with recovered password) LUKS slot
@@ -19,6 +23,17 @@ type Volume struct {
 	StorageSectorSize uint64
 	StorageOffset     uint64 // offset of underlying storage in bytes
 	StorageSize       uint64 // length of underlying device in bytes, zero means that size should be calculated using `diskSize` function
+	StorageIntegrity  string // integrity algorithm (e.g. "hmac(sha256)") if the segment is protected with dm-integrity
+	// IntegrityRecovery maps the dm-integrity device in recovery mode: integrity tags are not verified. It is needed to
+	// populate a volume formatted without wiping (cryptsetup --integrity-no-wipe) as its tags are not valid yet.
+	// Such mapping provides no integrity protection, it is equivalent of `cryptsetup open --integrity-recovery-mode`.
+	IntegrityRecovery bool
+	// StorageUnencrypted is set if the segment is a plaintext passthrough (null cipher) e.g. during reencryption.
+	// Such volume is mapped with a linear mapping instead of dm-crypt.
+	StorageUnencrypted bool
+	// DisableKeyring passes the volume key to dm-crypt directly in the table. By default the key is passed through
+	// a kernel keyring logon key so it does not appear in the table (e.g. `dmsetup table --showkeys`).
+	DisableKeyring bool
 }
 
 // map of LUKS flag names to its dm-crypt counterparts
@@ -30,37 +45,250 @@ var flagsKernelNames = map[string]string{
 	FlagNoWriteWorkqueue:    devmapper.CryptFlagNoWriteWorkqueue,
 }
 
+// dm-crypt option that is missing at the devmapper package
+const cryptFlagIVLargeSectors = "iv_large_sectors"
+
+// VolumeKey is a copy of the decrypted volume (master) key, see Volume.Key. It is zeroed by Wipe or, as a best
+// effort, by a finalizer once the VolumeKey is garbage collected. Note that the Go runtime might have left other
+// copies of the key in memory (e.g. after a stack growth), Wipe only guarantees this buffer is scrubbed.
+type VolumeKey struct {
+	key []byte
+}
+
+// NewVolumeKey returns a VolumeKey that holds a copy of the key e.g. a volume key restored from an escrow, see
+// Writer.AddKeyslotWithVolumeKey. The caller keeps the ownership of the key slice.
+func NewVolumeKey(key []byte) *VolumeKey {
+	k := &VolumeKey{key: secureCopy(key)}
+	runtime.SetFinalizer(k, (*VolumeKey).Wipe)
+	return k
+}
+
+// Bytes returns the key. The slice is owned by VolumeKey and is zeroed by Wipe, callers must not keep it around.
+// It returns nil after Wipe.
+func (k *VolumeKey) Bytes() []byte {
+	return k.key
+}
+
+// Wipe zeroes the key, it is safe to call it more than once
+func (k *VolumeKey) Wipe() {
+	clearSlice(k.key)
+	k.key = nil
+	runtime.SetFinalizer(k, nil)
+}
+
+// Key returns a copy of the volume key e.g. to back it up or to pass it to another tool.
+// The caller should Wipe the copy once it is not needed anymore.
+func (v *Volume) Key() *VolumeKey {
+	return NewVolumeKey(v.key)
+}
+
+// Wipe zeroes the volume key held by the volume once activation is done. The volume can't be mapped afterwards.
+func (v *Volume) Wipe() {
+	clearSlice(v.key)
+	v.key = nil
+}
+
 // SetupMapper creates a device mapper for the given LUKS volume
 func (v *Volume) SetupMapper(name string) error {
+	if v.StorageIntegrity != "" {
+		// dm-crypt stores authentication tags at a dm-integrity device placed underneath
+		return v.setupIntegrityMapper(name)
+	}
+
+	if v.StorageUnencrypted {
+		table, err := v.linearTable()
+		if err != nil {
+			return err
+		}
+		return devmapper.CreateAndLoad(name, v.mapperUUID(name), v.mapperFlags(), table)
+	}
+
+	table, err := v.cryptTable()
+	if err != nil {
+		return err
+	}
+	return v.withKeyringKey(func(keyID string) error {
+		table.KeyID = keyID
+		return devmapper.CreateAndLoad(name, v.mapperUUID(name), v.mapperFlags(), table)
+	})
+}
+
+// ResumeMapper sets the volume key of the suspended mapping (see Unlocker.Suspend) and resumes it
+func (v *Volume) ResumeMapper(name string) error {
+	if err := checkMapperUUID(name, v.mapperUUID(name)); err != nil {
+		return err
+	}
+	return v.withKeyringKey(func(keyID string) error {
+		key := keyID
+		if key == "" {
+			key = hex.EncodeToString(v.key)
+		}
+		if err := devmapper.Message(name, 0, "key set "+key); err != nil {
+			return err
+		}
+		return devmapper.Resume(name)
+	})
+}
+
+// withKeyringKey adds the volume key to the kernel keyring for the duration of fn. keyID is the dm-crypt key
+// specification that references the key or empty if the key needs to be passed directly (the keyring is disabled
+// or not supported by the kernel).
+func (v *Volume) withKeyringKey(fn func(keyID string) error) error {
+	if len(v.key) == 0 {
+		return fmt.Errorf("volume key is wiped")
+	}
+	if v.DisableKeyring {
+		return fn("")
+	}
+
+	// dm-crypt looks up the key in keyrings of the calling thread, the key must be added and used
+	// from the same OS thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	keyID, err := unix.AddKey("logon", v.keyringDescription(), v.key, unix.KEY_SPEC_THREAD_KEYRING)
+	if err == unix.ENOSYS {
+		// the kernel is built without keyring support
+		return fn("")
+	} else if err != nil {
+		return fmt.Errorf("unable to add volume key to the kernel keyring: %v", err)
+	}
+	// dm-crypt keeps its own copy of the key, the keyring one is not needed once dm-crypt has read it
+	defer unix.KeyctlInt(unix.KEYCTL_REVOKE, keyID, 0, 0, 0)
+
+	return fn(v.keyringKeyID())
+}
+
+// keyringDescription returns description of the logon key with the volume key, it follows cryptsetup naming
+// (see crypt_volume_key_set_description())
+func (v *Volume) keyringDescription() string {
+	return fmt.Sprintf("cryptsetup:%v-d0", v.UUID)
+}
+
+// keyringKeyID returns dm-crypt key specification that references the volume key in the kernel keyring
+func (v *Volume) keyringKeyID() string {
+	return fmt.Sprintf(":%d:logon:%v", len(v.key), v.keyringDescription())
+}
+
+// linearTable builds a linear (no encryption) table for the plaintext volume
+func (v *Volume) linearTable() (devmapper.LinearTable, error) {
+	if v.StorageSize%storageSectorSize != 0 {
+		return devmapper.LinearTable{}, fmt.Errorf("storage size must be multiple of sector size")
+	}
+	if v.StorageOffset%storageSectorSize != 0 {
+		return devmapper.LinearTable{}, fmt.Errorf("offset must be multiple of sector size")
+	}
+
+	return devmapper.LinearTable{
+		Start:         0,
+		Length:        v.StorageSize,
+		BackendDevice: v.BackingDevice,
+		BackendOffset: v.StorageOffset,
+	}, nil
+}
+
+// cryptTable builds dm-crypt table for the volume
+func (v *Volume) cryptTable() (devmapper.CryptTable, error) {
 	kernelFlags := make([]string, 0, len(v.Flags))
 	for _, f := range v.Flags {
+		if f == FlagReadOnly {
+			continue // it is a device-mapper flag, see mapperFlags()
+		}
 		flag, ok := flagsKernelNames[f]
 		if !ok {
-			return fmt.Errorf("unknown LUKS flag: %v", f)
+			return devmapper.CryptTable{}, fmt.Errorf("unknown LUKS flag: %v", f)
 		}
 		kernelFlags = append(kernelFlags, flag)
 	}
 
+	if v.StorageSectorSize > storageSectorSize && v.LuksType == "LUKS2" {
+		// LUKS2 IVs are computed in units of the encryption sector, dm-crypt uses 512-byte units by default
+		kernelFlags = append(kernelFlags, cryptFlagIVLargeSectors)
+	}
+
 	if v.StorageSize%v.StorageSectorSize != 0 {
-		return fmt.Errorf("storage size must be multiple of sector size")
+		return devmapper.CryptTable{}, fmt.Errorf("storage size must be multiple of sector size")
 	}
 	if v.StorageOffset%v.StorageSectorSize != 0 {
-		return fmt.Errorf("offset must be multiple of sector size")
+		return devmapper.CryptTable{}, fmt.Errorf("offset must be multiple of sector size")
 	}
 
-	table := devmapper.CryptTable{
+	return devmapper.CryptTable{
 		Start:         0,
 		Length:        v.StorageSize,
 		BackendDevice: v.BackingDevice,
+		// the exact data segment offset (e.g. set with cryptsetup --offset), devmapper converts it to 512-byte sectors
 		BackendOffset: v.StorageOffset,
 		Encryption:    v.StorageEncryption,
 		Key:           v.key,
 		IVTweak:       v.StorageIvTweak,
 		Flags:         kernelFlags,
 		SectorSize:    v.StorageSectorSize,
+	}, nil
+}
+
+// mapperFlags returns device-mapper flags of the mapping
+func (v *Volume) mapperFlags() uint32 {
+	for _, f := range v.Flags {
+		if f == FlagReadOnly {
+			return devmapper.ReadOnlyFlag
+		}
+	}
+	return 0
+}
+
+// mapperUUID returns device-mapper UUID for the mapping with the given name
+func (v *Volume) mapperUUID(name string) string {
+	return mapperUUID(v.LuksType, v.UUID, name)
+}
+
+// mapperUUID returns device-mapper UUID of a LUKS mapping, see dm_prepare_uuid()
+func mapperUUID(luksType, uuid, name string) string {
+	return fmt.Sprintf("CRYPT-%v-%v-%v", luksType, strings.ReplaceAll(uuid, "-", ""), name)
+}
+
+// checkMapperUUID verifies that the mapping exists and has the expected UUID i.e. belongs to the LUKS device
+func checkMapperUUID(name, uuid string) error {
+	info, err := devmapper.InfoByName(name)
+	if err != nil {
+		return err
+	}
+	if info.UUID != uuid {
+		return fmt.Errorf("mapping %v does not belong to the device: expected UUID %v, got %v", name, uuid, info.UUID)
+	}
+	return nil
+}
+
+// SetupMapperContext is similar to SetupMapper but stops waiting for device-mapper once ctx is done.
+// Device-mapper ioctls cannot be interrupted, so on ctx expiry the setup is abandoned and keeps running in background;
+// once it finishes the (possibly partially created) mapping is removed.
+func (v *Volume) SetupMapperContext(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	uuid := fmt.Sprintf("CRYPT-%v-%v-%v", v.LuksType, strings.ReplaceAll(v.UUID, "-", ""), name) // See dm_prepare_uuid()
+	// the caller might wipe the key right after this function returns, give the background setup its own copy
+	volume := *v
+	volume.key = secureCopy(v.key)
 
-	return devmapper.CreateAndLoad(name, uuid, 0, table)
+	done := make(chan error, 1)
+	go func() {
+		defer clearSlice(volume.key)
+		done <- volume.SetupMapper(name)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		go func() {
+			<-done
+			// the setup might fail halfway and leave the mapping behind, but also it might fail because a mapping
+			// with the same name already exists. Remove the mapping only if it is the one we created.
+			if info, err := devmapper.InfoByName(name); err == nil && info.UUID == volume.mapperUUID(name) {
+				_ = devmapper.Remove(name)
+			}
+		}()
+		return ctx.Err()
+	}
 }
@@ -0,0 +1,144 @@
+package luks
+
+import (
+	"context"
+	"testing"
+
+	"github.com/anatol/devmapper.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupMapperContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	v := &Volume{key: make([]byte, 64), StorageSectorSize: storageSectorSize}
+	require.Equal(t, context.Canceled, v.SetupMapperContext(ctx, "luks-go-test-canceled"))
+}
+
+func TestVolumeKeyWipe(t *testing.T) {
+	disk, volumeKey := createLuks2Fixture(t, "foobar")
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	v, err := d.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+
+	k := v.Key()
+	require.Equal(t, volumeKey, k.Bytes())
+	buf := k.Bytes()
+	k.Wipe()
+	require.Nil(t, k.Bytes())
+	require.Equal(t, make([]byte, len(volumeKey)), buf)
+	k.Wipe()
+
+	// the volume keeps its own copy
+	require.Equal(t, volumeKey, v.key)
+	buf = v.key
+	v.Wipe()
+	require.Equal(t, make([]byte, len(volumeKey)), buf)
+	err = v.SetupMapper("luks-go-test-wiped")
+	require.Error(t, err)
+	require.Equal(t, "volume key is wiped", err.Error())
+}
+
+func TestCryptTableOffset(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	// a custom data offset as with `cryptsetup luksFormat --offset 34816` (17MiB)
+	seg := d.meta.Segments[0]
+	seg.Offset = "17825792"
+	d.meta.Segments[0] = seg
+	require.NoError(t, disk.Truncate(17825792+1024*1024))
+	require.NoError(t, d.writeHeader())
+
+	d, err = initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	v, err := d.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+
+	table, err := v.cryptTable()
+	require.NoError(t, err)
+	require.Equal(t, uint64(17825792), table.BackendOffset)
+	require.Equal(t, uint64(1024*1024), table.Length)
+	require.Equal(t, disk.Name(), table.BackendDevice)
+
+	v.StorageOffset++
+	_, err = v.cryptTable()
+	require.Error(t, err)
+}
+
+func TestKeyringKeyID(t *testing.T) {
+	v := &Volume{key: make([]byte, 64), UUID: "462c8bc5-f997-4aa5-b97e-6346f5275521"}
+	require.Equal(t, ":64:logon:cryptsetup:462c8bc5-f997-4aa5-b97e-6346f5275521-d0", v.keyringKeyID())
+}
+
+func TestActivationFlags(t *testing.T) {
+	v := &Volume{
+		key:               make([]byte, 64),
+		StorageSize:       1024 * 1024,
+		StorageSectorSize: storageSectorSize,
+		Flags:             []string{FlagAllowDiscards, FlagNoReadWorkqueue, FlagNoWriteWorkqueue, FlagSameCPUCrypt, FlagSubmitFromCryptCPUs},
+	}
+	table, err := v.cryptTable()
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		devmapper.CryptFlagAllowDiscards,
+		devmapper.CryptFlagNoReadWorkqueue,
+		devmapper.CryptFlagNoWriteWorkqueue,
+		devmapper.CryptFlagSameCPUCrypt,
+		devmapper.CryptFlagSubmitFromCryptCPUs,
+	}, table.Flags)
+	require.Equal(t, uint32(0), v.mapperFlags())
+
+	v.Flags = []string{FlagReadOnly, FlagAllowDiscards}
+	table, err = v.cryptTable()
+	require.NoError(t, err)
+	require.Equal(t, []string{devmapper.CryptFlagAllowDiscards}, table.Flags)
+	require.Equal(t, uint32(devmapper.ReadOnlyFlag), v.mapperFlags())
+
+	v.Flags = []string{"no-such-flag"}
+	_, err = v.cryptTable()
+	require.Error(t, err)
+}
+
+func TestCryptTableSectorSize(t *testing.T) {
+	disk, _ := createLuks2Fixture(t, "foobar")
+
+	d, err := initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	// as formatted with `cryptsetup luksFormat --sector-size 4096`
+	seg := d.meta.Segments[0]
+	seg.SectorSize = 4096
+	d.meta.Segments[0] = seg
+	require.NoError(t, disk.Truncate(16*1024*1024+1024*1024))
+	require.NoError(t, d.writeHeader())
+
+	d, err = initV2Device(disk.Name(), FileStorage{disk})
+	require.NoError(t, err)
+	v, err := d.UnsealVolume(0, []byte("foobar"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(4096), v.StorageSectorSize)
+
+	table, err := v.cryptTable()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4096), table.SectorSize)
+	require.Equal(t, []string{cryptFlagIVLargeSectors}, table.Flags)
+
+	// the payload must consist of whole encryption sectors
+	v.StorageSize -= 512
+	_, err = v.cryptTable()
+	require.Error(t, err)
+
+	// LUKS1 has no large sectors, the IVs are always in 512-byte units
+	v = &Volume{key: make([]byte, 64), LuksType: "LUKS1", StorageSize: 1024 * 1024, StorageSectorSize: storageSectorSize}
+	table, err = v.cryptTable()
+	require.NoError(t, err)
+	require.Empty(t, table.Flags)
+
+	seg.SectorSize = 3000
+	d.meta.Segments[0] = seg
+	_, err = d.UnsealVolume(0, []byte("foobar"))
+	require.Error(t, err)
+}